@@ -0,0 +1,377 @@
+package app
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	bgpPort          = 179
+	bgpHoldTime      = 90
+	bgpDialTimeout   = 5 * time.Second
+	bgpOpenTimeout   = 30 * time.Second
+	bgpWriteTimeout  = time.Second
+	bgpRetryInterval = 10 * time.Second
+	stageBGP         = "bgp"
+)
+
+// BGPPeer is an upstream router to announce the pod CIDRs of the node to.
+type BGPPeer struct {
+	Address net.IP
+	Port    int
+	ASN     uint32
+}
+
+// ParseBGPPeer parses a peer in the form of address=asn, with an optional port like [address]:port=asn.
+func ParseBGPPeer(spec string) (BGPPeer, error) {
+	address, asn, ok := strings.Cut(spec, "=")
+	if !ok {
+		return BGPPeer{}, fmt.Errorf("bad bgp peer [%s], should be address=asn", spec)
+	}
+	peer := BGPPeer{Address: net.ParseIP(address), Port: bgpPort}
+	if peer.Address == nil {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return BGPPeer{}, fmt.Errorf("bad address of bgp peer [%s]", spec)
+		}
+		peer.Address = net.ParseIP(host)
+		if peer.Port, err = strconv.Atoi(port); err != nil || peer.Address == nil || peer.Port <= 0 ||
+			peer.Port > 65535 {
+			return BGPPeer{}, fmt.Errorf("bad address of bgp peer [%s]", spec)
+		}
+	}
+	parsedASN, err := strconv.ParseUint(asn, 10, 32)
+	if err != nil || parsedASN == 0 {
+		return BGPPeer{}, fmt.Errorf("bad asn of bgp peer [%s]", spec)
+	}
+	peer.ASN = uint32(parsedASN)
+	return peer, nil
+}
+
+func (peer BGPPeer) String() string {
+	return net.JoinHostPort(peer.Address.String(), strconv.Itoa(peer.Port))
+}
+
+// bgpSpeaker announces the pod CIDRs of the node to the upstream peers, so they're reachable from outside without
+// NAT. Only the upstream learns the routes; the overlay is still used between nodes.
+type bgpSpeaker struct {
+	shiba       *Shiba
+	localASN    uint32
+	routerID    net.IP // Nil to use the local IPv4 address of each session, or one derived from the node name.
+	peers       []BGPPeer
+	established map[string]bool // Peer -> whether the session is established.
+	lock        sync.Mutex
+	wg          sync.WaitGroup
+}
+
+// initBGP checks the BGP options.
+func (shiba *Shiba) initBGP(localASN uint32, routerID net.IP, peers []BGPPeer) error {
+	if len(peers) == 0 {
+		return nil
+	}
+	if localASN == 0 {
+		return errors.New("local asn is not set")
+	}
+	if routerID != nil && routerID.To4() == nil {
+		return fmt.Errorf("router id [%s] is not an ipv4 address", routerID)
+	}
+	shiba.bgpSpeaker = &bgpSpeaker{
+		shiba:       shiba,
+		localASN:    localASN,
+		routerID:    routerID,
+		peers:       peers,
+		established: make(map[string]bool),
+	}
+	log.Infof("pod cidrs %v are announced by bgp as AS%d", util.FormatIPNets(shiba.nodePodCIDRs), localASN)
+	return nil
+}
+
+// run keeps a session with each peer until stopCh is closed, when the routes are withdrawn. Call wait to wait for
+// the withdrawal.
+func (speaker *bgpSpeaker) run(stopCh <-chan struct{}) {
+	for _, peer := range speaker.peers {
+		peer := peer
+		if speaker.shiba.dryRun {
+			_ = speaker.shiba.apply(stageBGP, model.Change{
+				Kind: "bgp", Action: "announce", Target: peer.String(),
+				Detail: util.FormatIPNets(speaker.shiba.nodePodCIDRs),
+			}, nil)
+			continue
+		}
+		speaker.wg.Add(1)
+		go func() {
+			defer speaker.wg.Done()
+			speaker.keepSession(stopCh, peer)
+		}()
+	}
+}
+
+func (speaker *bgpSpeaker) wait() {
+	speaker.wg.Wait()
+}
+
+// keepSession reconnects to the peer until stopCh is closed.
+func (speaker *bgpSpeaker) keepSession(stopCh <-chan struct{}, peer BGPPeer) {
+	logger := log.WithFields(log.Fields{fieldPeer: peer.String(), fieldOperation: "bgp"})
+	for {
+		err := speaker.session(stopCh, peer, logger)
+		speaker.setEstablished(peer, false)
+		if err == nil {
+			return // Stopped.
+		}
+		logger.WithError(err).Warningf("bgp session failed, retrying in %v", bgpRetryInterval)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(bgpRetryInterval):
+		}
+	}
+}
+
+// session runs a session with the peer, returning nil if it's closed by stopCh.
+func (speaker *bgpSpeaker) session(stopCh <-chan struct{}, peer BGPPeer, logger *log.Entry) error {
+	conn, err := net.DialTimeout("tcp", peer.String(), bgpDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	send := func(msgType uint8, body []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(bgpWriteTimeout))
+		return util.WriteBGPMessage(conn, msgType, body)
+	}
+	notify := func(code, subcode uint8) {
+		_ = send(util.BGPNotification, util.BuildBGPNotification(code, subcode))
+	}
+	// Nothing is announced before the handshake completes, so it's simply aborted on stop.
+	handshakeCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-stopCh:
+			_ = conn.Close()
+		case <-handshakeCh:
+		case <-doneCh:
+		}
+	}()
+
+	if err := send(util.BGPOpen, util.BuildBGPOpen(speaker.localASN, bgpHoldTime,
+		speaker.sessionRouterID(localIP))); err != nil {
+		return fmt.Errorf("failed to send open: %w", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(bgpOpenTimeout))
+	msgType, body, err := util.ReadBGPMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to receive open: %w", err)
+	}
+	if msgType != util.BGPOpen {
+		return fmt.Errorf("expected open, received message of type %d", msgType)
+	}
+	open, err := util.ParseBGPOpen(body)
+	if err != nil {
+		return err
+	}
+	if open.ASN != peer.ASN {
+		notify(util.BGPErrOpen, util.BGPErrOpenBadPeerAS)
+		return fmt.Errorf("peer is AS%d, expected AS%d", open.ASN, peer.ASN)
+	}
+	holdTime := time.Duration(bgpHoldTime) * time.Second
+	if open.HoldTime < bgpHoldTime {
+		if open.HoldTime > 0 && open.HoldTime < 3 {
+			notify(util.BGPErrOpen, util.BGPErrOpenBadHoldTime)
+			return fmt.Errorf("unacceptable hold time %ds", open.HoldTime)
+		}
+		holdTime = time.Duration(open.HoldTime) * time.Second // Zero to disable keepalives.
+	}
+	if err := send(util.BGPKeepalive, nil); err != nil {
+		return fmt.Errorf("failed to send keepalive: %w", err)
+	}
+	close(handshakeCh)
+
+	// Messages are read in the background, so keepalives and the withdrawal on stop aren't blocked.
+	type message struct {
+		msgType uint8
+		body    []byte
+	}
+	messageCh := make(chan message)
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(holdTime))
+			} else {
+				_ = conn.SetReadDeadline(time.Time{})
+			}
+			msgType, body, err := util.ReadBGPMessage(conn)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case messageCh <- message{msgType, body}:
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+	var keepaliveCh <-chan time.Time
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepaliveCh = ticker.C
+	}
+	announcements := speaker.announcements(localIP, open, peer, logger)
+	var established bool
+	for {
+		select {
+		case <-stopCh:
+			if established {
+				speaker.withdraw(send, announcements, logger)
+			}
+			notify(util.BGPErrCease, util.BGPErrCeaseShutdown)
+			return nil
+		case <-keepaliveCh:
+			if err := send(util.BGPKeepalive, nil); err != nil {
+				return fmt.Errorf("failed to send keepalive: %w", err)
+			}
+		case err := <-errCh:
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				notify(util.BGPErrHoldTimer, 0)
+				return errors.New("hold timer expired")
+			}
+			return err
+		case m := <-messageCh:
+			switch m.msgType {
+			case util.BGPNotification:
+				if len(m.body) >= 2 {
+					return fmt.Errorf("peer sent notification %d/%d", m.body[0], m.body[1])
+				}
+				return errors.New("peer sent notification")
+			case util.BGPKeepalive:
+				if established {
+					continue
+				}
+				established = true
+				speaker.setEstablished(peer, true)
+				logger.Infof("bgp session established with AS%d (%s)", open.ASN, open.RouterID)
+				for _, announcement := range announcements {
+					if err := send(util.BGPUpdate, announcement.update); err != nil {
+						return fmt.Errorf("failed to announce %v: %w", util.FormatIPNets(announcement.prefixes), err)
+					}
+					logger.Infof("announced %v via %s", util.FormatIPNets(announcement.prefixes), announcement.nextHop)
+				}
+			case util.BGPUpdate:
+				// Routes from the peer are ignored.
+			default:
+				return fmt.Errorf("unexpected message of type %d", m.msgType)
+			}
+		}
+	}
+}
+
+type bgpAnnouncement struct {
+	prefixes []*net.IPNet
+	nextHop  net.IP
+	update   []byte
+}
+
+// announcements returns the updates announcing the pod CIDRs of each family supported by the peer. The next hop is
+// the local address of the session, or the underlay address of the node for IPv6 over an IPv4 session. IPv4 CIDRs
+// can't be announced over an IPv6 session.
+func (speaker *bgpSpeaker) announcements(localIP net.IP, open *util.BGPOpenMessage, peer BGPPeer,
+	logger *log.Entry) []bgpAnnouncement {
+	var asPath []uint32
+	if peer.ASN != speaker.localASN {
+		asPath = []uint32{speaker.localASN}
+	}
+	var announcements []bgpAnnouncement
+	for _, family := range []*ipFamily{familyV4, familyV6} {
+		var prefixes []*net.IPNet
+		for _, cidr := range speaker.shiba.nodePodCIDRs {
+			if family.match(cidr.IP) {
+				prefixes = append(prefixes, cidr)
+			}
+		}
+		if len(prefixes) == 0 {
+			continue
+		}
+		if (family == familyV4 && !open.IPv4Unicast) || (family == familyV6 && !open.IPv6Unicast) {
+			logger.Warningf("not announcing %v as the peer doesn't support %s unicast", util.FormatIPNets(prefixes),
+				family.name)
+			continue
+		}
+		nextHop := localIP
+		if !family.match(nextHop) {
+			if family != familyV6 {
+				logger.Warningf("not announcing %v over a session of another family", util.FormatIPNets(prefixes))
+				continue
+			}
+			nextHop = speaker.shiba.nodeIP
+		}
+		announcements = append(announcements, bgpAnnouncement{
+			prefixes: prefixes,
+			nextHop:  nextHop,
+			update:   util.BuildBGPAnnouncement(prefixes, nextHop, asPath, open.FourOctetAS),
+		})
+	}
+	return announcements
+}
+
+func (speaker *bgpSpeaker) withdraw(send func(uint8, []byte) error, announcements []bgpAnnouncement,
+	logger *log.Entry) {
+	for _, announcement := range announcements {
+		if err := send(util.BGPUpdate, util.BuildBGPWithdrawal(announcement.prefixes)); err != nil {
+			logger.WithError(err).Errorf("failed to withdraw %v", util.FormatIPNets(announcement.prefixes))
+			return
+		}
+		logger.Infof("withdrew %v", util.FormatIPNets(announcement.prefixes))
+	}
+}
+
+// sessionRouterID returns the configured router ID, the local IPv4 address, or one derived from the node name.
+func (speaker *bgpSpeaker) sessionRouterID(localIP net.IP) net.IP {
+	if speaker.routerID != nil {
+		return speaker.routerID
+	}
+	if ip4 := localIP.To4(); ip4 != nil {
+		return ip4
+	}
+	hash := sha256.Sum256([]byte(speaker.shiba.nodeName))
+	return net.IP(hash[:4])
+}
+
+func (speaker *bgpSpeaker) setEstablished(peer BGPPeer, established bool) {
+	speaker.lock.Lock()
+	defer speaker.lock.Unlock()
+	speaker.established[peer.String()] = established
+}
+
+func (shiba *Shiba) writeBGPMetrics(m *util.MetricWriter) {
+	if shiba.bgpSpeaker == nil {
+		return
+	}
+	speaker := shiba.bgpSpeaker
+	speaker.lock.Lock()
+	defer speaker.lock.Unlock()
+	m.Header("shiba_bgp_session_established", "gauge", "Whether the bgp session with the peer is established.")
+	for _, peer := range speaker.peers {
+		var established float64
+		if speaker.established[peer.String()] {
+			established = 1
+		}
+		m.Sample("shiba_bgp_session_established", established, "peer", peer.String())
+	}
+}
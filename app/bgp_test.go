@@ -0,0 +1,100 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+
+	"github.com/moycat/shiba/util"
+)
+
+func TestParseBGPPeer(t *testing.T) {
+	peer, err := ParseBGPPeer("192.0.2.1=65000")
+	assert.NilError(t, err)
+	assert.Equal(t, peer.String(), "192.0.2.1:179")
+	assert.Equal(t, peer.ASN, uint32(65000))
+	peer, err = ParseBGPPeer("[2001:db8::1]:1179=4200000000")
+	assert.NilError(t, err)
+	assert.Equal(t, peer.String(), "[2001:db8::1]:1179")
+	assert.Equal(t, peer.ASN, uint32(4200000000))
+
+	for spec, problem := range map[string]string{
+		"192.0.2.1":         "should be address=asn",
+		"router=65000":      "bad address",
+		"192.0.2.1:0=65000": "bad address",
+		"192.0.2.1=0":       "bad asn",
+		"192.0.2.1=as65000": "bad asn",
+	} {
+		_, err := ParseBGPPeer(spec)
+		assert.ErrorContains(t, err, problem, spec)
+	}
+}
+
+// TestBGPSpeaker runs the speaker against a stand-in peer.
+func TestBGPSpeaker(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+	podCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24", "fd00:1::/64"})
+	assert.NilError(t, err)
+	shiba := &Shiba{nodeName: "self", nodeIP: net.ParseIP("2001:db8::1"), nodePodCIDRs: podCIDRs}
+	peer := BGPPeer{Address: net.ParseIP("127.0.0.1"), Port: listener.Addr().(*net.TCPAddr).Port, ASN: 65001}
+	assert.NilError(t, shiba.initBGP(65000, nil, []BGPPeer{peer}))
+	stopCh := make(chan struct{})
+	shiba.bgpSpeaker.run(stopCh)
+
+	conn, err := listener.Accept()
+	assert.NilError(t, err)
+	defer conn.Close()
+	read := func(expectedType uint8) []byte {
+		msgType, body, err := util.ReadBGPMessage(conn)
+		assert.NilError(t, err)
+		assert.Equal(t, msgType, expectedType)
+		return body
+	}
+	open, err := util.ParseBGPOpen(read(util.BGPOpen))
+	assert.NilError(t, err)
+	assert.Equal(t, open.ASN, uint32(65000))
+	assert.Assert(t, open.RouterID.Equal(net.ParseIP("127.0.0.1")))
+	assert.NilError(t, util.WriteBGPMessage(conn, util.BGPOpen, util.BuildBGPOpen(65001, 30, net.ParseIP("192.0.2.254"))))
+	read(util.BGPKeepalive)
+	assert.NilError(t, util.WriteBGPMessage(conn, util.BGPKeepalive, nil))
+
+	// IPv4 via the local address of the session, and IPv6 via the underlay address.
+	assert.DeepEqual(t, read(util.BGPUpdate),
+		util.BuildBGPAnnouncement(podCIDRs[:1], net.ParseIP("127.0.0.1"), []uint32{65000}, true))
+	assert.DeepEqual(t, read(util.BGPUpdate),
+		util.BuildBGPAnnouncement(podCIDRs[1:], shiba.nodeIP, []uint32{65000}, true))
+	var metrics strings.Builder
+	shiba.writeBGPMetrics(util.NewMetricWriter(&metrics))
+	assert.Assert(t, strings.Contains(metrics.String(),
+		`shiba_bgp_session_established{peer="`+peer.String()+`"} 1`), metrics.String())
+
+	// Withdrawn on stop.
+	close(stopCh)
+	assert.DeepEqual(t, read(util.BGPUpdate), util.BuildBGPWithdrawal(podCIDRs[:1]))
+	assert.DeepEqual(t, read(util.BGPUpdate), util.BuildBGPWithdrawal(podCIDRs[1:]))
+	assert.DeepEqual(t, read(util.BGPNotification), util.BuildBGPNotification(util.BGPErrCease, util.BGPErrCeaseShutdown))
+	shiba.bgpSpeaker.wait()
+}
+
+func TestBGPSpeaker_announcements(t *testing.T) {
+	podCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24", "fd00:1::/64"})
+	assert.NilError(t, err)
+	shiba := &Shiba{nodeName: "self", nodeIP: net.ParseIP("2001:db8::1"), nodePodCIDRs: podCIDRs}
+	peer := BGPPeer{Address: net.ParseIP("192.0.2.254"), Port: 179, ASN: 65001}
+	assert.NilError(t, shiba.initBGP(65000, nil, []BGPPeer{peer}))
+	logger := log.WithField("peer", peer.String())
+
+	announcements := shiba.bgpSpeaker.announcements(net.ParseIP("192.0.2.1"),
+		&util.BGPOpenMessage{IPv4Unicast: true, IPv6Unicast: true}, peer, logger)
+	assert.Equal(t, len(announcements), 2)
+	// IPv6 isn't sent to a peer without the multiprotocol capability of it.
+	announcements = shiba.bgpSpeaker.announcements(net.ParseIP("192.0.2.1"),
+		&util.BGPOpenMessage{IPv4Unicast: true}, peer, logger)
+	assert.Equal(t, len(announcements), 1)
+	assert.Equal(t, util.FormatIPNets(announcements[0].prefixes), "[10.244.1.0/24]")
+}
@@ -1,32 +1,54 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/moycat/shiba/model"
 	"github.com/moycat/shiba/util"
 	log "github.com/sirupsen/logrus"
 )
 
+// Optional plugins of the CNI chain.
+const (
+	CNIPluginBandwidth = "bandwidth" // Traffic shaping by the ingress and egress bandwidth annotations of pods.
+	CNIPluginTuning    = "tuning"    // Sysctls of pods.
+	CNIPluginFirewall  = "firewall"  // Allows the traffic of pods when the forward policy is drop.
+)
+
+const defaultCNIVersion = "0.3.1"
+
+// CNIVersions are the supported versions of the CNI spec.
+var CNIVersions = []string{"0.3.1", "0.4.0", "1.0.0"}
+
 // initCNI writes the CNI configuration file for the container runtime.
 func (shiba *Shiba) initCNI() error {
+	shiba.resetPlan(stageCNI)
 	config := shiba.generateCNIConfig()
+	if err := shiba.checkCNIPlugins(config); err != nil {
+		return err
+	}
 	b, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal cni config: %w", err)
 	}
-	path := filepath.Join(shiba.cniConfigPath, cniConfigName)
-	if err := os.WriteFile(path, b, 0o644); err != nil {
-		return fmt.Errorf("failed to write cni config [%s]: %w", path, err)
+	shiba.cniConfig = b
+	if shiba.cniConfigOnSync {
+		// Not ready for pods until the first successful sync.
+		if err := shiba.removeCNIConfig(); err != nil {
+			return err
+		}
+	} else if err := shiba.writeCNIConfig(); err != nil {
+		return err
 	}
 	entries, err := os.ReadDir(shiba.cniConfigPath)
 	if err != nil {
 		return fmt.Errorf("failed to open cni config path [%s] for checking: %w", shiba.cniConfigPath, err)
 	}
-	log.Infof("cni config is written to [%s]", path)
 	// Check whether there are additional configs and give warnings.
 	for _, entry := range entries {
 		if entryName := entry.Name(); entryName != cniConfigName &&
@@ -38,6 +60,73 @@ func (shiba *Shiba) initCNI() error {
 	return nil
 }
 
+// writeCNIConfig writes the CNI config atomically if it's changed.
+func (shiba *Shiba) writeCNIConfig() error {
+	path := filepath.Join(shiba.cniConfigPath, cniConfigName)
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, shiba.cniConfig) {
+		log.Infof("cni config [%s] is up to date", path)
+		return nil
+	}
+	if err := shiba.apply(stageCNI, model.Change{
+		Kind: "file", Action: "write", Target: path, Detail: string(shiba.cniConfig),
+	}, func() error {
+		return util.WriteFileAtomic(path, shiba.cniConfig, 0o644)
+	}); err != nil {
+		return fmt.Errorf("failed to write cni config [%s]: %w", path, err)
+	}
+	log.Infof("cni config is written to [%s]", path)
+	return nil
+}
+
+// removeCNIConfig removes the CNI config if it exists, so the container runtime reports the network not ready.
+func (shiba *Shiba) removeCNIConfig() error {
+	path := filepath.Join(shiba.cniConfigPath, cniConfigName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := shiba.apply(stageCNI, model.Change{Kind: "file", Action: "delete", Target: path}, func() error {
+		return os.Remove(path)
+	}); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cni config [%s]: %w", path, err)
+	}
+	log.Infof("cni config [%s] is removed", path)
+	return nil
+}
+
+// syncCNIReadiness writes the CNI config after the first successful sync, when all tunnels are up.
+func (shiba *Shiba) syncCNIReadiness(nodeMap model.NodeMap) {
+	if !shiba.cniConfigOnSync {
+		return
+	}
+	shiba.cniLock.Lock()
+	defer shiba.cniLock.Unlock()
+	if shiba.cniReady || shiba.cniStopped {
+		return
+	}
+	if notUp := countTunnelsNotUp(shiba.nodePaths, nodeMap, tunnelState); notUp > 0 {
+		log.Infof("waiting for %d tunnels to be up before writing the cni config", notUp)
+		return
+	}
+	if err := shiba.writeCNIConfig(); err != nil {
+		log.WithError(err).Error("failed to write cni config")
+		return
+	}
+	shiba.cniReady = true
+}
+
+// cleanupCNI removes the CNI config on exit, so pods are no longer scheduled to the node.
+func (shiba *Shiba) cleanupCNI() {
+	if !shiba.cniConfigOnSync {
+		return
+	}
+	shiba.cniLock.Lock()
+	defer shiba.cniLock.Unlock()
+	shiba.cniStopped = true
+	if err := shiba.removeCNIConfig(); err != nil {
+		log.WithError(err).Error("failed to remove cni config on exit")
+	}
+}
+
 func (shiba *Shiba) generateCNIConfig() map[string]interface{} {
 	var (
 		hasV4, hasV6 bool
@@ -53,7 +142,11 @@ func (shiba *Shiba) generateCNIConfig() map[string]interface{} {
 		default:
 			continue
 		}
-		podCIDRs = append(podCIDRs, []map[string]interface{}{{"subnet": cidr.String()}})
+		podRange := map[string]interface{}{"subnet": cidr.String()}
+		if rangeEnd := shiba.poolRangeEnds[cidr.String()]; rangeEnd != nil {
+			podRange["rangeEnd"] = rangeEnd.String() // Node-local pools are carved from the end.
+		}
+		podCIDRs = append(podCIDRs, []map[string]interface{}{podRange})
 	}
 	if hasV4 {
 		routes = append(routes, map[string]interface{}{"dst": "0.0.0.0/0"})
@@ -61,23 +154,95 @@ func (shiba *Shiba) generateCNIConfig() map[string]interface{} {
 	if hasV6 {
 		routes = append(routes, map[string]interface{}{"dst": "::/0"})
 	}
+	ipam := map[string]interface{}{
+		"type":   "host-local", // Allocate IPs locally within following ranges.
+		"ranges": podCIDRs,
+		"routes": routes,
+	}
+	if len(shiba.ipPools) > 0 {
+		// Ask shiba for the addresses of pods requesting static IPs or pools, and delegate the others.
+		ipam = map[string]interface{}{
+			"type":     IPAMPluginType,
+			"socket":   shiba.ipamSocketPath,
+			"delegate": ipam,
+		}
+	}
+	plugins := []map[string]interface{}{
+		{
+			"type": "ptp", // Create a veth pair for each pod.
+			"ipam": ipam,
+		},
+	}
+	// The optional plugins are chained in a fixed order, whatever the order in the options.
+	if shiba.hasCNIPlugin(CNIPluginTuning) {
+		tuning := map[string]interface{}{"type": CNIPluginTuning}
+		if len(shiba.cniSysctls) > 0 {
+			tuning["sysctl"] = shiba.cniSysctls
+		}
+		plugins = append(plugins, tuning)
+	}
+	plugins = append(plugins, map[string]interface{}{
+		"type":         "portmap", // Essential for HostPort.
+		"snat":         true,
+		"capabilities": map[string]bool{"portMappings": true},
+	})
+	if shiba.hasCNIPlugin(CNIPluginFirewall) {
+		plugins = append(plugins, map[string]interface{}{"type": CNIPluginFirewall})
+	}
+	if shiba.hasCNIPlugin(CNIPluginBandwidth) {
+		plugins = append(plugins, map[string]interface{}{
+			"type":         CNIPluginBandwidth,
+			"capabilities": map[string]bool{"bandwidth": true},
+		})
+	}
+	plugins = append(plugins, shiba.cniExtraPlugins...)
+	cniVersion := shiba.cniVersion
+	if len(cniVersion) == 0 {
+		cniVersion = defaultCNIVersion
+	}
 	return map[string]interface{}{
 		"name":       cniNetName,
-		"cniVersion": "0.3.1",
-		"plugins": []map[string]interface{}{
-			{
-				"type": "ptp", // Create a veth pair for each pod.
-				"ipam": map[string]interface{}{
-					"type":   "host-local", // Allocate IPs locally within following ranges.
-					"ranges": podCIDRs,
-					"routes": routes,
-				},
-			},
-			{
-				"type":         "portmap", // Essential for HostPort.
-				"snat":         true,
-				"capabilities": map[string]bool{"portMappings": true},
-			},
-		},
+		"cniVersion": cniVersion,
+		"plugins":    plugins,
 	}
 }
+
+func (shiba *Shiba) hasCNIPlugin(name string) bool {
+	for _, plugin := range shiba.cniPlugins {
+		if plugin == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCNIPlugins checks the binaries of all plugins in the config exist in the CNI bin path, if set.
+func (shiba *Shiba) checkCNIPlugins(config map[string]interface{}) error {
+	if len(shiba.cniBinPath) == 0 {
+		return nil
+	}
+	var missing []string
+	check := func(pluginType interface{}) {
+		name, _ := pluginType.(string)
+		if len(name) == 0 {
+			missing = append(missing, "(no type)")
+			return
+		}
+		if info, err := os.Stat(filepath.Join(shiba.cniBinPath, name)); err != nil || info.IsDir() {
+			missing = append(missing, name)
+		}
+	}
+	for _, plugin := range config["plugins"].([]map[string]interface{}) {
+		check(plugin["type"])
+		if ipam, ok := plugin["ipam"].(map[string]interface{}); ok {
+			check(ipam["type"])
+			if delegate, ok := ipam["delegate"].(map[string]interface{}); ok {
+				check(delegate["type"])
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cni plugins %v are not found in [%s]", missing, shiba.cniBinPath)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func TestShiba_generateCNIConfig(t *testing.T) {
+	podCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24"})
+	assert.NilError(t, err)
+	shiba := &Shiba{
+		nodePodCIDRs:    podCIDRs,
+		cniVersion:      "1.0.0",
+		cniPlugins:      []string{CNIPluginBandwidth, CNIPluginFirewall, CNIPluginTuning},
+		cniSysctls:      map[string]string{"net.core.somaxconn": "1024"},
+		cniExtraPlugins: []map[string]interface{}{{"type": "sbr"}},
+	}
+	config := shiba.generateCNIConfig()
+	assert.Equal(t, config["cniVersion"], "1.0.0")
+	var types []string
+	for _, plugin := range config["plugins"].([]map[string]interface{}) {
+		types = append(types, plugin["type"].(string))
+	}
+	// In the fixed order, with the extra ones last.
+	assert.DeepEqual(t, types, []string{"ptp", "tuning", "portmap", "firewall", "bandwidth", "sbr"})
+	assert.DeepEqual(t, config["plugins"].([]map[string]interface{})[1]["sysctl"],
+		map[string]string{"net.core.somaxconn": "1024"})
+
+	shiba.cniBinPath = t.TempDir()
+	err = shiba.checkCNIPlugins(config)
+	assert.ErrorContains(t, err, "[ptp host-local tuning portmap firewall bandwidth sbr] are not found")
+	for _, name := range types {
+		assert.NilError(t, os.WriteFile(filepath.Join(shiba.cniBinPath, name), nil, 0o755))
+	}
+	err = shiba.checkCNIPlugins(config)
+	assert.ErrorContains(t, err, "[host-local] are not found")
+
+	shiba.cniPlugins, shiba.cniExtraPlugins, shiba.cniVersion = nil, nil, ""
+	config = shiba.generateCNIConfig()
+	assert.Equal(t, config["cniVersion"], defaultCNIVersion)
+	assert.Equal(t, len(config["plugins"].([]map[string]interface{})), 2)
+}
+
+func TestShiba_syncCNIReadiness(t *testing.T) {
+	shiba := &Shiba{
+		cniConfigPath:   t.TempDir(),
+		cniConfig:       []byte("{}"),
+		cniConfigOnSync: true,
+		plan:            make(model.Plan),
+	}
+	path := filepath.Join(shiba.cniConfigPath, cniConfigName)
+	assert.NilError(t, os.WriteFile(path, []byte("stale"), 0o644))
+	assert.NilError(t, shiba.removeCNIConfig())
+	_, err := os.Stat(path)
+	assert.Assert(t, os.IsNotExist(err))
+
+	// Written after a sync without any tunnel down.
+	shiba.syncCNIReadiness(model.NodeMap{})
+	b, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "{}")
+	assert.Assert(t, shiba.cniReady)
+
+	// Removed on exit, and never written again.
+	shiba.cleanupCNI()
+	_, err = os.Stat(path)
+	assert.Assert(t, os.IsNotExist(err))
+	shiba.cniReady = false
+	shiba.syncCNIReadiness(model.NodeMap{})
+	_, err = os.Stat(path)
+	assert.Assert(t, os.IsNotExist(err))
+}
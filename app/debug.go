@@ -0,0 +1,25 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/moycat/shiba/util"
+)
+
+// RegisterDebugHandlers registers the debug API of shiba to mux.
+func (shiba *Shiba) RegisterDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/shiba/plan", shiba.servePlan)
+	mux.HandleFunc("/debug/shiba/peers", shiba.servePeerHealth)
+}
+
+// MetricsHandler returns the handler serving metrics in the Prometheus text format.
+func (shiba *Shiba) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m := util.NewMetricWriter(w)
+		shiba.writeProbeMetrics(m)
+		shiba.writeIPAMMetrics(m)
+		shiba.writeBGPMetrics(m)
+		shiba.writeFlowMetrics(m)
+	})
+}
@@ -0,0 +1,647 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	egressChain         = "SHIBA-EGRESS"
+	egressCommentPrefix = "shiba-egress-" // Followed by the policy name.
+	egressExclusionNote = "shiba egress exclusion"
+	egressRulePriority  = 1001       // After the rules to the route table of shiba.
+	egressTableBase     = 0x53480000 // Route tables of the gateways start from here.
+	maxEgressGateways   = 256
+	maxEgressPolicyName = 32
+	stageEgress         = "egress"
+)
+
+var egressPolicyNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// egressPolicySpec is an egress policy in the runtime config map.
+type egressPolicySpec struct {
+	Name         string   `yaml:"name"`
+	Namespaces   []string `yaml:"namespaces"`
+	PodSelector  string   `yaml:"podSelector"`
+	Gateway      string   `yaml:"gateway"`
+	EgressIP     string   `yaml:"egressIP"`
+	Destinations []string `yaml:"destinations"`
+}
+
+// egressPolicy routes the traffic of the selected pods to the destinations through the gateway node, which SNATs
+// it to the egress IP.
+type egressPolicy struct {
+	name         string
+	namespaces   map[string]bool
+	podSelector  labels.Selector
+	gateway      string
+	egressIP     net.IP
+	destinations []*net.IPNet // Of the family of the egress IP.
+}
+
+// egressPod is what egress policies need to know about a pod.
+type egressPod struct {
+	namespace string
+	labels    labels.Set
+	nodeName  string
+	ips       []net.IP
+}
+
+// egressFlow is the traffic from a pod address to a destination selected by a policy.
+type egressFlow struct {
+	policy   string
+	gateway  string
+	src      *net.IPNet // Host prefix of the pod address.
+	dst      *net.IPNet
+	egressIP net.IP
+}
+
+// parseEgressPolicies parses the egress policies in YAML, a list of egressPolicySpec.
+func parseEgressPolicies(s string) ([]*egressPolicy, error) {
+	var specs []egressPolicySpec
+	if err := yaml.Unmarshal([]byte(s), &specs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	var policies []*egressPolicy
+	for _, spec := range specs {
+		if len(spec.Name) > maxEgressPolicyName || !egressPolicyNameRegexp.MatchString(spec.Name) {
+			return nil, fmt.Errorf("bad name [%s] of egress policy, should be a dns label of at most %d characters",
+				spec.Name, maxEgressPolicyName)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("duplicated egress policy [%s]", spec.Name)
+		}
+		names[spec.Name] = true
+		policy, err := newEgressPolicy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("bad egress policy [%s]: %w", spec.Name, err)
+		}
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].name < policies[j].name
+	})
+	return policies, nil
+}
+
+func newEgressPolicy(spec egressPolicySpec) (*egressPolicy, error) {
+	if len(spec.Namespaces) == 0 {
+		return nil, errors.New("no namespace is selected")
+	}
+	if len(spec.Gateway) == 0 {
+		return nil, errors.New("gateway is not set")
+	}
+	policy := &egressPolicy{
+		name:        spec.Name,
+		namespaces:  make(map[string]bool),
+		podSelector: labels.Everything(),
+		gateway:     spec.Gateway,
+		egressIP:    net.ParseIP(spec.EgressIP),
+	}
+	for _, namespace := range spec.Namespaces {
+		policy.namespaces[namespace] = true
+	}
+	if len(spec.PodSelector) > 0 {
+		selector, err := labels.Parse(spec.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("bad pod selector: %w", err)
+		}
+		policy.podSelector = selector
+	}
+	if policy.egressIP == nil {
+		return nil, fmt.Errorf("bad egress ip [%s]", spec.EgressIP)
+	}
+	if ip4 := policy.egressIP.To4(); ip4 != nil {
+		policy.egressIP = ip4
+	}
+	family := familyOf(policy.egressIP)
+	if len(spec.Destinations) == 0 {
+		policy.destinations = []*net.IPNet{defaultNet(family)}
+	}
+	for _, s := range spec.Destinations {
+		_, dst, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("bad destination [%s]: %w", s, err)
+		}
+		if familyOf(dst.IP) != family {
+			return nil, fmt.Errorf("destination [%s] is not of the family of egress ip", s)
+		}
+		policy.destinations = append(policy.destinations, dst)
+	}
+	return policy, nil
+}
+
+// selects checks if the policy selects the pod.
+func (policy *egressPolicy) selects(pod *egressPod) bool {
+	return policy.namespaces[pod.namespace] && policy.podSelector.Matches(pod.labels)
+}
+
+// String describes the policy for comparison and logs.
+func (policy *egressPolicy) String() string {
+	namespaces := make([]string, 0, len(policy.namespaces))
+	for namespace := range policy.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return fmt.Sprintf("%s: namespaces %v, pods [%s] -> %v via [%s] as %s", policy.name, namespaces,
+		policy.podSelector, util.FormatIPNets(policy.destinations), policy.gateway, policy.egressIP)
+}
+
+func formatEgressPolicies(policies []*egressPolicy) string {
+	return fmt.Sprint(policies)
+}
+
+// defaultNet returns the subnet of all addresses of the family.
+func defaultNet(family *ipFamily) *net.IPNet {
+	if family == familyV4 {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	}
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+func isOwnedEgressTable(table int) bool {
+	return table >= egressTableBase && table < egressTableBase+maxEgressGateways
+}
+
+// egressFlows returns the flows of local pods routed through remote gateways, and the flows SNATed on this node
+// as the gateway. Pod addresses of other families than the egress IP are skipped.
+func (shiba *Shiba) egressFlows(policies []*egressPolicy, pods map[string]*egressPod) (sources, snats []egressFlow) {
+	keys := make([]string, 0, len(pods))
+	for key := range pods {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, policy := range policies {
+		family := familyOf(policy.egressIP)
+		for _, key := range keys {
+			pod := pods[key]
+			local := pod.nodeName == shiba.nodeName
+			if !policy.selects(pod) || (!local && policy.gateway != shiba.nodeName) {
+				continue
+			}
+			for _, ip := range pod.ips {
+				if familyOf(ip) != family {
+					continue
+				}
+				for _, dst := range policy.destinations {
+					flow := egressFlow{
+						policy: policy.name, gateway: policy.gateway, src: hostPrefix(ip), dst: dst,
+						egressIP: policy.egressIP,
+					}
+					if policy.gateway == shiba.nodeName {
+						snats = append(snats, flow)
+					} else {
+						sources = append(sources, flow)
+					}
+				}
+			}
+		}
+	}
+	return sources, snats
+}
+
+// ruleSpec returns the rule in the egress chain, which SNATs the flow on the gateway, or keeps it from being
+// masqueraded on the source node.
+func (flow egressFlow) ruleSpec(snat bool) []string {
+	spec := []string{"-s", flow.src.String()}
+	if ones, _ := flow.dst.Mask.Size(); ones > 0 {
+		spec = append(spec, "-d", flow.dst.String()) // iptables omits the match of any destination.
+	}
+	spec = append(spec, "-m", "comment", "--comment", egressCommentPrefix+flow.policy)
+	if snat {
+		return append(spec, "-j", "SNAT", "--to-source", flow.egressIP.String())
+	}
+	return append(spec, "-j", "ACCEPT")
+}
+
+// syncEgress applies the egress policies, routing the traffic of selected local pods through the tunnels to the
+// gateway nodes, and SNATing the traffic of selected pods if this node is a gateway. Traffic to a gateway that isn't
+// a peer is dropped rather than leaving with the address of the node.
+func (shiba *Shiba) syncEgress(nodeMap model.NodeMap) {
+	if len(shiba.configNamespace) == 0 {
+		return
+	}
+	shiba.resetPlan(stageEgress)
+	shiba.configLock.Lock()
+	policies := shiba.egressPolicies
+	shiba.configLock.Unlock()
+	if len(policies) > 0 && !shiba.egressPodsSynced() {
+		log.Info("waiting for pods of egress policies, egress is not updated")
+		return
+	}
+	shiba.egressLock.Lock()
+	sources, snats := shiba.egressFlows(policies, shiba.egressPods)
+	shiba.egressLock.Unlock()
+	if len(policies) > 0 {
+		log.Debugf("syncing egress with %d source flows and %d snat flows", len(sources), len(snats))
+	}
+	tables, err := assignEgressTables(sources)
+	if err != nil {
+		log.WithError(err).Error("failed to assign egress route tables")
+		shiba.recordSyncError(stageEgress, fmt.Errorf("failed to assign egress route tables: %w", err))
+	}
+	// Routes go first, so no traffic falls through to the main table.
+	shiba.syncEgressRoutes(nodeMap, tables)
+	shiba.syncEgressRules(sources, tables)
+	if err := shiba.syncEgressChain(len(policies) > 0, sources, snats); err != nil {
+		log.WithError(err).Error("failed to sync egress nat rules")
+		shiba.recordSyncError(stageEgress, err)
+	}
+}
+
+// assignEgressTables returns the gateway node of each route table, one table for each gateway of the source flows.
+func assignEgressTables(sources []egressFlow) (map[int]string, error) {
+	seen := make(map[string]bool)
+	var gateways []string
+	for _, flow := range sources {
+		if !seen[flow.gateway] {
+			seen[flow.gateway] = true
+			gateways = append(gateways, flow.gateway)
+		}
+	}
+	if len(gateways) > maxEgressGateways {
+		return nil, fmt.Errorf("too many egress gateways %d, at most %d", len(gateways), maxEgressGateways)
+	}
+	sort.Strings(gateways)
+	tables := make(map[int]string, len(gateways))
+	for i, gateway := range gateways {
+		tables[egressTableBase+i] = gateway
+	}
+	return tables, nil
+}
+
+// syncEgressRules makes the rules to the route tables of the gateways match the source flows.
+func (shiba *Shiba) syncEgressRules(sources []egressFlow, tables map[int]string) {
+	tableOfGateway := make(map[string]int, len(tables))
+	for table, gateway := range tables {
+		tableOfGateway[gateway] = table
+	}
+	expected := make(map[string]*netlink.Rule)
+	for _, flow := range sources {
+		if tableOfGateway[flow.gateway] == 0 {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Src = flow.src
+		if ones, _ := flow.dst.Mask.Size(); ones > 0 {
+			rule.Dst = flow.dst
+		}
+		rule.Table = tableOfGateway[flow.gateway]
+		rule.Priority = egressRulePriority
+		expected[egressRuleKey(rule)] = rule
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			log.WithError(err).Error("failed to list rules")
+			shiba.recordSyncError(stageEgress, fmt.Errorf("failed to list rules: %w", err))
+			return
+		}
+		for _, rule := range rules {
+			if rule.Priority != egressRulePriority || !isOwnedEgressTable(rule.Table) {
+				continue
+			}
+			key := egressRuleKey(&rule)
+			if expected[key] != nil {
+				delete(expected, key)
+				continue
+			}
+			rule := rule
+			logger := log.WithFields(log.Fields{fieldCIDR: fmt.Sprint(rule.Src), fieldOperation: "delete-egress-rule"})
+			logger.Info("deleting stale egress rule")
+			if err := shiba.apply(stageEgress, model.Change{
+				Kind: "rule", Action: "delete", Target: fmt.Sprintf("table %d", rule.Table), Detail: key,
+			}, func() error {
+				return netlink.RuleDel(&rule)
+			}); err != nil {
+				logger.WithError(err).Error("failed to delete egress rule")
+			}
+		}
+	}
+	for key, rule := range expected {
+		rule := rule
+		logger := log.WithFields(log.Fields{fieldCIDR: rule.Src.String(), fieldOperation: "add-egress-rule"})
+		logger.Infof("adding egress rule through [%s]", tables[rule.Table])
+		if err := shiba.apply(stageEgress, model.Change{
+			Kind: "rule", Action: "add", Target: fmt.Sprintf("table %d", rule.Table), Detail: key,
+		}, func() error {
+			return netlink.RuleAdd(rule)
+		}); err != nil {
+			logger.WithError(err).Error("failed to add egress rule")
+		}
+	}
+}
+
+func egressRuleKey(rule *netlink.Rule) string {
+	dst := "all"
+	if rule.Dst != nil {
+		dst = rule.Dst.String()
+	}
+	return fmt.Sprintf("from %v to %s lookup %d pref %d", rule.Src, dst, rule.Table, rule.Priority)
+}
+
+// syncEgressRoutes makes the route tables of the gateways route the traffic through the tunnels to them, except
+// the traffic to pods, which falls through to the next rules. Stale tables are emptied.
+func (shiba *Shiba) syncEgressRoutes(nodeMap model.NodeMap, tables map[int]string) {
+	split, err := splitByFamily(shiba.clusterPodCIDRs)
+	if err != nil {
+		log.WithError(err).Error("failed to split cluster pod cidrs")
+		shiba.recordSyncError(stageEgress, fmt.Errorf("failed to split cluster pod cidrs: %w", err))
+		return
+	}
+	expected := make(map[string]netlink.Route)
+	for table, gateway := range tables {
+		var link netlink.Link
+		if node := nodeMap[model.NodeKey(model.SourceCluster, gateway)]; node != nil {
+			paths := shiba.usablePaths(shiba.nodePaths(node))
+			var err error
+			if link, err = netlink.LinkByName(paths[0].Tunnel); err != nil && !shiba.dryRun {
+				log.WithError(err).Errorf("failed to get tunnel to egress gateway [%s]", gateway)
+				shiba.recordSyncError(stageEgress, fmt.Errorf("failed to get tunnel to egress gateway [%s]: %w", gateway, err))
+			}
+		} else {
+			log.Warningf("egress gateway [%s] is not a peer, dropping its traffic", gateway)
+		}
+		for _, family := range ipFamilies {
+			if len(split[family]) == 0 {
+				continue
+			}
+			route := netlink.Route{
+				Dst:      defaultNet(family),
+				Table:    table,
+				Protocol: routeProtocol,
+				Type:     syscall.RTN_UNREACHABLE,
+			}
+			if link != nil {
+				route.LinkIndex = link.Attrs().Index
+				route.Type = syscall.RTN_UNICAST
+			}
+			expected[egressRouteKey(family, route)] = route
+			for _, cidr := range shiba.routeRuleCIDRs() {
+				if familyOf(cidr.IP) == family {
+					throw := netlink.Route{Dst: cidr, Table: table, Protocol: routeProtocol, Type: syscall.RTN_THROW}
+					expected[egressRouteKey(family, throw)] = throw
+				}
+			}
+		}
+	}
+	for family, netlinkFamily := range map[*ipFamily]int{familyV4: netlink.FAMILY_V4, familyV6: netlink.FAMILY_V6} {
+		routes, err := netlink.RouteListFiltered(netlinkFamily, &netlink.Route{Protocol: routeProtocol},
+			netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			log.WithError(err).Error("failed to list egress routes")
+			shiba.recordSyncError(stageEgress, fmt.Errorf("failed to list egress routes: %w", err))
+			return
+		}
+		for _, route := range routes {
+			if !isOwnedEgressTable(route.Table) {
+				continue
+			}
+			key := egressRouteKey(family, route)
+			if _, ok := expected[key]; ok {
+				delete(expected, key)
+				continue
+			}
+			route := route
+			logger := log.WithFields(log.Fields{fieldCIDR: fmt.Sprint(route.Dst), fieldOperation: "delete-egress-route"})
+			logger.Debug("deleting stale egress route")
+			if err := shiba.apply(stageEgress, model.Change{
+				Kind: "route", Action: "delete", Target: fmt.Sprintf("table %d", route.Table), Detail: key,
+			}, func() error {
+				return netlink.RouteDel(&route)
+			}); err != nil {
+				logger.WithError(err).Error("failed to delete egress route")
+			}
+		}
+	}
+	for key, route := range expected {
+		route := route
+		logger := log.WithFields(log.Fields{fieldCIDR: route.Dst.String(), fieldOperation: "add-egress-route"})
+		logger.Infof("adding egress route through [%s]", tables[route.Table])
+		if err := shiba.apply(stageEgress, model.Change{
+			Kind: "route", Action: "add", Target: fmt.Sprintf("table %d", route.Table), Detail: key,
+		}, func() error {
+			return netlink.RouteAdd(&route)
+		}); err != nil {
+			logger.WithError(err).Error("failed to add egress route")
+		}
+	}
+}
+
+// egressRouteKey identifies the route. The destination of default routes is nil when listed.
+func egressRouteKey(family *ipFamily, route netlink.Route) string {
+	dst := family.name + " default"
+	if route.Dst != nil {
+		if ones, _ := route.Dst.Mask.Size(); ones > 0 {
+			dst = route.Dst.String()
+		}
+	}
+	switch route.Type {
+	case syscall.RTN_UNREACHABLE:
+		return fmt.Sprintf("unreachable %s table %d", dst, route.Table)
+	case syscall.RTN_THROW:
+		return fmt.Sprintf("throw %s table %d", dst, route.Table)
+	}
+	return fmt.Sprintf("%s dev %d table %d", dst, route.LinkIndex, route.Table)
+}
+
+// syncEgressChain makes the egress chain, which goes before the masquerade chain, match the flows. Traffic to pods
+// is never SNATed.
+func (shiba *Shiba) syncEgressChain(enabled bool, sources, snats []egressFlow) error {
+	expected := make(map[*ipFamily]map[string][]string)
+	for _, family := range ipFamilies {
+		expected[family] = make(map[string][]string)
+	}
+	for _, flow := range sources {
+		spec := flow.ruleSpec(false)
+		expected[familyOf(flow.src.IP)][strings.Join(spec, " ")] = spec
+	}
+	for _, flow := range snats {
+		spec := flow.ruleSpec(true)
+		expected[familyOf(flow.src.IP)][strings.Join(spec, " ")] = spec
+	}
+	split, err := splitByFamily(shiba.routeRuleCIDRs())
+	if err != nil {
+		return err
+	}
+	for _, family := range ipFamilies {
+		if len(split[family]) == 0 {
+			continue // No NAT of the family.
+		}
+		exists, err := family.tables.ChainExists("nat", egressChain)
+		if err != nil && !shiba.dryRun {
+			return fmt.Errorf("failed to check %s egress chain: %w", family.name, err)
+		}
+		if !exists && !enabled {
+			continue
+		}
+		if enabled && !exists {
+			if err := shiba.newChainUnique(family.tables, "nat", egressChain); err != nil {
+				return fmt.Errorf("failed to create %s egress chain: %w", family.name, err)
+			}
+		}
+		if enabled {
+			if err := shiba.insertUnique(family.tables, "nat", "POSTROUTING", 1, "-j", egressChain); err != nil {
+				return fmt.Errorf("failed to jump to %s egress chain: %w", family.name, err)
+			}
+			for _, cidr := range split[family] {
+				if err := shiba.insertUnique(family.tables, "nat", egressChain, 1, "--dst", cidr.String(),
+					"-m", "comment", "--comment", egressExclusionNote, "-j", "RETURN"); err != nil {
+					return fmt.Errorf("failed to add egress exclusion for [%s]: %w", cidr, err)
+				}
+			}
+		}
+		var rules []string
+		if exists {
+			if rules, err = family.tables.List("nat", egressChain); err != nil {
+				return fmt.Errorf("failed to list %s egress rules: %w", family.name, err)
+			}
+		}
+		for _, rule := range rules {
+			fields := strings.Fields(rule)
+			if len(fields) < 2 || fields[0] != "-A" || !strings.Contains(rule, egressCommentPrefix) {
+				continue
+			}
+			spec := fields[2:]
+			for i := range spec {
+				spec[i] = strings.Trim(spec[i], `"`)
+			}
+			key := strings.Join(spec, " ")
+			if _, ok := expected[family][key]; ok {
+				delete(expected[family], key)
+				continue
+			}
+			log.WithField(fieldOperation, "delete-egress-nat").Infof("removing egress nat rule [%s]", key)
+			if err := shiba.apply(stageEgress, model.Change{
+				Kind: "rule", Action: "delete", Target: fmt.Sprintf("%s/nat/%s", family.tables.Name(), egressChain),
+				Detail: key,
+			}, func() error {
+				return family.tables.Delete("nat", egressChain, spec...)
+			}); err != nil {
+				return fmt.Errorf("failed to remove egress nat rule [%s]: %w", key, err)
+			}
+		}
+		keys := make([]string, 0, len(expected[family]))
+		for key := range expected[family] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			log.WithField(fieldOperation, "add-egress-nat").Infof("adding egress nat rule [%s]", key)
+			if err := shiba.appendUnique(family.tables, "nat", egressChain, expected[family][key]...); err != nil {
+				return fmt.Errorf("failed to add egress nat rule [%s]: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// watchEgressPods starts the shared pod informer once there are egress policies, keeping the pods in sync and
+// triggering a sync when the selected ones change.
+func (shiba *Shiba) watchEgressPods(stopCh <-chan struct{}) {
+	for {
+		shiba.configLock.Lock()
+		enabled := len(shiba.egressPolicies) > 0
+		shiba.configLock.Unlock()
+		if enabled {
+			break
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-shiba.egressCh:
+		}
+	}
+	informer := shiba.informers.Core().V1().Pods().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { shiba.handleEgressPod(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { shiba.handleEgressPod(obj, false) },
+		DeleteFunc: func(obj interface{}) { shiba.handleEgressPod(obj, true) },
+	})
+	shiba.egressLock.Lock()
+	shiba.egressPodInformer = informer
+	shiba.egressLock.Unlock()
+	shiba.informers.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return
+	}
+	log.Info("pods of egress policies are synced")
+	shiba.fire()
+}
+
+// egressPodsSynced returns whether all pods are known, before which the egress flows are incomplete.
+func (shiba *Shiba) egressPodsSynced() bool {
+	shiba.egressLock.Lock()
+	informer := shiba.egressPodInformer
+	shiba.egressLock.Unlock()
+	return informer != nil && informer.HasSynced()
+}
+
+func (shiba *Shiba) handleEgressPod(obj interface{}, deleted bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	if shiba.updateEgressPod(pod, deleted) {
+		shiba.fire()
+	}
+}
+
+// updateEgressPod records the pod, returning whether the egress flows may change.
+func (shiba *Shiba) updateEgressPod(pod *corev1.Pod, deleted bool) bool {
+	key := pod.Namespace + "/" + pod.Name
+	var current *egressPod
+	if !deleted && !pod.Spec.HostNetwork && pod.Status.Phase != corev1.PodSucceeded &&
+		pod.Status.Phase != corev1.PodFailed {
+		current = &egressPod{namespace: pod.Namespace, labels: labels.Set(pod.Labels), nodeName: pod.Spec.NodeName}
+		for _, podIP := range pod.Status.PodIPs {
+			if ip := net.ParseIP(podIP.IP); ip != nil {
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				current.ips = append(current.ips, ip)
+			}
+		}
+	}
+	shiba.configLock.Lock()
+	policies := shiba.egressPolicies
+	shiba.configLock.Unlock()
+	shiba.egressLock.Lock()
+	defer shiba.egressLock.Unlock()
+	last := shiba.egressPods[key]
+	if reflect.DeepEqual(last, current) {
+		return false
+	}
+	if current == nil {
+		delete(shiba.egressPods, key)
+	} else {
+		shiba.egressPods[key] = current
+	}
+	for _, policy := range policies {
+		if (last != nil && policy.selects(last)) || (current != nil && policy.selects(current)) {
+			log.WithField(fieldPod, key).Debug("pod of egress policy changed")
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testEgressPolicies = `
+- name: partner
+  namespaces: [payments]
+  podSelector: app=checkout
+  gateway: gw
+  egressIP: 198.51.100.10
+  destinations: [203.0.113.0/24]
+- name: all
+  namespaces: [billing]
+  gateway: self
+  egressIP: 2001:db8::10
+`
+
+func TestParseEgressPolicies(t *testing.T) {
+	policies, err := parseEgressPolicies(testEgressPolicies)
+	assert.NilError(t, err)
+	assert.Equal(t, len(policies), 2)
+	assert.Equal(t, policies[0].String(), "all: namespaces [billing], pods [] -> [::/0] via [self] as 2001:db8::10")
+	assert.Equal(t, policies[1].String(),
+		"partner: namespaces [payments], pods [app=checkout] -> [203.0.113.0/24] via [gw] as 198.51.100.10")
+
+	for spec, problem := range map[string]string{
+		"- {name: Bad, namespaces: [a], gateway: gw, egressIP: 198.51.100.10}":                           "bad name",
+		"- {name: a, gateway: gw, egressIP: 198.51.100.10}":                                              "no namespace",
+		"- {name: a, namespaces: [a], egressIP: 198.51.100.10}":                                          "gateway is not set",
+		"- {name: a, namespaces: [a], gateway: gw, egressIP: bad}":                                       "bad egress ip",
+		"- {name: a, namespaces: [a], gateway: gw, egressIP: 198.51.100.10, destinations: ['fd00::/8']}": "not of the family",
+		"- {name: a, namespaces: [a], gateway: gw, egressIP: 198.51.100.10}\n" +
+			"- {name: a, namespaces: [b], gateway: gw, egressIP: 198.51.100.10}": "duplicated",
+	} {
+		_, err := parseEgressPolicies(spec)
+		assert.ErrorContains(t, err, problem, spec)
+	}
+}
+
+func TestShiba_egressFlows(t *testing.T) {
+	policies, err := parseEgressPolicies(testEgressPolicies)
+	assert.NilError(t, err)
+	shiba := &Shiba{nodeName: "self", egressPods: make(map[string]*egressPod)}
+	pod := func(namespace, name, nodeName string, labels map[string]string, ips ...string) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+			Spec:       corev1.PodSpec{NodeName: nodeName},
+		}
+		for _, ip := range ips {
+			pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+		}
+		return pod
+	}
+	shiba.egressPolicies = policies
+	checkout := map[string]string{"app": "checkout"}
+	assert.Assert(t, shiba.updateEgressPod(pod("payments", "local", "self", checkout, "10.244.1.5", "fd00:1::5"), false))
+	assert.Assert(t, shiba.updateEgressPod(pod("payments", "remote", "other", checkout, "10.244.2.5"), false))
+	assert.Assert(t, !shiba.updateEgressPod(pod("payments", "web", "self", nil, "10.244.1.6"), false))
+	assert.Assert(t, shiba.updateEgressPod(pod("billing", "remote", "other", nil, "10.244.2.7", "fd00:2::7"), false))
+	// Unchanged.
+	assert.Assert(t, !shiba.updateEgressPod(pod("billing", "remote", "other", nil, "10.244.2.7", "fd00:2::7"), false))
+
+	sources, snats := shiba.egressFlows(policies, shiba.egressPods)
+	// The local pod is routed through the remote gateway, in the family of the egress IP only.
+	assert.Equal(t, len(sources), 1)
+	assert.Equal(t, strings.Join(sources[0].ruleSpec(false), " "),
+		"-s 10.244.1.5/32 -d 203.0.113.0/24 -m comment --comment shiba-egress-partner -j ACCEPT")
+	// Pods anywhere are SNATed by this gateway.
+	assert.Equal(t, len(snats), 1)
+	assert.Equal(t, strings.Join(snats[0].ruleSpec(true), " "),
+		"-s fd00:2::7/128 -m comment --comment shiba-egress-all -j SNAT --to-source 2001:db8::10")
+
+	tables, err := assignEgressTables(sources)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, tables, map[int]string{egressTableBase: "gw"})
+
+	assert.Assert(t, shiba.updateEgressPod(pod("billing", "remote", "other", nil), true))
+	_, snats = shiba.egressFlows(policies, shiba.egressPods)
+	assert.Equal(t, len(snats), 0)
+}
+
+func TestShiba_handleEgressPod(t *testing.T) {
+	policies, err := parseEgressPolicies(testEgressPolicies)
+	assert.NilError(t, err)
+	shiba := &Shiba{nodeName: "self", egressPods: make(map[string]*egressPod), fireCh: make(chan struct{}, 1)}
+	shiba.egressPolicies = policies
+	assert.Assert(t, !shiba.egressPodsSynced(), "pods aren't watched without policies")
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "billing", Name: "api"}}
+	pod.Status.PodIPs = []corev1.PodIP{{IP: "fd00:2::7"}}
+	shiba.handleEgressPod(pod, false)
+	assert.Equal(t, len(shiba.egressPods), 1)
+	assert.Equal(t, len(shiba.fireCh), 1)
+	<-shiba.fireCh
+	// Deletions missed by the watch are recovered from the relist.
+	shiba.handleEgressPod(cache.DeletedFinalStateUnknown{Key: "billing/api", Obj: pod}, true)
+	assert.Equal(t, len(shiba.egressPods), 0)
+	assert.Equal(t, len(shiba.fireCh), 1)
+}
+
+func TestDefaultNet(t *testing.T) {
+	assert.Equal(t, defaultNet(familyOf(net.ParseIP("10.0.0.1"))).String(), "0.0.0.0/0")
+	assert.Equal(t, defaultNet(familyOf(net.ParseIP("fd00::1"))).String(), "::/0")
+}
@@ -8,114 +8,164 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 )
 
-// processEvent parses the node event and updates the node map if necessary.
-func (shiba *Shiba) processEvent(event watch.Event) {
-	log.Debugf("received an event of type [%s]", event.Type)
+// processEvent parses the node event of the source and updates the node map if necessary.
+func (shiba *Shiba) processEvent(source string, event watch.Event) {
+	log.WithField(fieldEvent, event.Type).Debug("received a node event")
 	node, ok := event.Object.(*corev1.Node)
 	if !ok {
-		log.Warningf("received an event of type [%s] with unexpected object type [%T]",
-			event.Type, event.Object.GetObjectKind().GroupVersionKind())
+		log.WithField(fieldEvent, event.Type).Warningf("received a node event with unexpected object type [%T]",
+			event.Object)
 		return
 	}
-	if node.Name == shiba.nodeName {
-		log.Debugf("ignoring an [%s] event of myself", event.Type)
+	if source == model.SourceCluster && node.Name == shiba.nodeName {
+		if event.Type != watch.Deleted && shiba.updateSelfZone(node) {
+			shiba.fire() // Rescope the peers.
+		}
+		log.WithField(fieldEvent, event.Type).Debug("processed an event of myself")
 		return
 	}
+	if shiba.updateRemotePodCIDRs(source, node, event.Type == watch.Deleted) {
+		if err := shiba.syncRemoteExclusions(); err != nil {
+			log.WithError(err).Error("failed to exclude remote pod cidrs from nat")
+		}
+		shiba.fire() // For the route rules and the egress exclusions.
+	}
+	key := model.NodeKey(source, node.Name)
+	logger := peerLog(key, "process-event").WithField(fieldEvent, event.Type)
+	if event.Type != watch.Deleted && !shiba.isNodeSelected(node) {
+		if _, ok := shiba.cloneNodeMap()[key]; !ok {
+			logger.Debug("ignoring an event of unselected node")
+			return
+		}
+		logger.Info("node is no longer selected")
+		event.Type = watch.Deleted
+	}
 	var needFiring bool
 	switch event.Type {
 	case watch.Added:
-		needFiring = shiba.addNode(node)
+		needFiring = shiba.addNode(source, node)
 	case watch.Modified:
-		needFiring = shiba.updateNode(node)
+		needFiring = shiba.updateNode(source, node)
 	case watch.Deleted:
-		needFiring = shiba.deleteNode(node)
+		needFiring = shiba.deleteNode(source, node)
 	default:
-		log.Warningf("received an unwanted event of type [%s] of node [%s]", event.Type, node.Name)
+		logger.Warning("received an unwanted event")
 		return
 	}
 	if needFiring {
-		log.Infof("processed %s event of node [%s]", event.Type, node.Name)
-		select {
-		case shiba.fireCh <- struct{}{}:
-		default:
-		}
+		logger.Info("processed node event")
+		shiba.fire()
 	} else {
-		log.Debugf("processed %s event of node [%s] witch didn't trigger firing", event.Type, node.Name)
+		logger.Debug("processed node event which didn't trigger firing")
 	}
 }
 
-func (shiba *Shiba) addNode(node *corev1.Node) bool {
+func (shiba *Shiba) addNode(source string, node *corev1.Node) bool {
 	nodeMap := shiba.cloneNodeMap()
-	if _, ok := nodeMap[node.Name]; ok {
-		log.Debugf("adding a existing node [%s]", node.Name)
-		return shiba.updateNode(node)
-	}
-	nodeIP := util.FindNodeIPv6(node)
-	if nodeIP == nil {
-		log.Errorf("failed to find ipv6 address of node [%s]", node.Name)
-		return false
+	key := model.NodeKey(source, node.Name)
+	if _, ok := nodeMap[key]; ok {
+		peerLog(key, "add").Debug("adding an existing node")
+		return shiba.updateNode(source, node)
 	}
-	nodePodCIDRs, err := util.ParseNodePodCIDRs(node)
-	if err != nil {
-		log.Errorf("failed to parse pod cidrs of node [%s]: %v", node.Name, err)
+	parsedNode := shiba.parseNode(source, node)
+	if parsedNode == nil {
 		return false
 	}
-	parsedNode := &model.Node{
-		Name:     node.Name,
-		IP:       nodeIP,
-		PodCIDRs: nodePodCIDRs,
-		Tunnel:   tunnelPrefix + util.NewUID(),
-	}
-	nodeMap[node.Name] = parsedNode
+	nodeMap[key] = parsedNode
 	shiba.saveNodeMap(nodeMap)
 	shiba.dumpNodeMap()
-	log.Debugf("added node [%s] and dumped map", node.Name)
+	peerLog(key, "add").Debug("added node and dumped map")
 	return true
 }
 
-func (shiba *Shiba) deleteNode(node *corev1.Node) bool {
+func (shiba *Shiba) deleteNode(source string, node *corev1.Node) bool {
 	nodeMap := shiba.cloneNodeMap()
-	if _, ok := nodeMap[node.Name]; !ok {
-		log.Warningf("deleting node [%s] which is not present", node.Name)
+	key := model.NodeKey(source, node.Name)
+	if _, ok := nodeMap[key]; !ok {
+		peerLog(key, "delete").Warning("deleting node which is not present")
 		return false
 	}
-	delete(nodeMap, node.Name)
+	delete(nodeMap, key)
 	shiba.saveNodeMap(nodeMap)
 	shiba.dumpNodeMap()
-	log.Debugf("deleted node [%s] and dumped map", node.Name)
+	peerLog(key, "delete").Debug("deleted node and dumped map")
 	return true
 }
 
-func (shiba *Shiba) updateNode(node *corev1.Node) bool {
+func (shiba *Shiba) updateNode(source string, node *corev1.Node) bool {
 	nodeMap := shiba.cloneNodeMap()
-	oldNode, ok := nodeMap[node.Name]
+	key := model.NodeKey(source, node.Name)
+	oldNode, ok := nodeMap[key]
 	if !ok {
-		log.Warningf("updating node [%s] which is not present", node.Name)
-		return shiba.addNode(node)
+		peerLog(key, "update").Warning("updating node which is not present")
+		return shiba.addNode(source, node)
 	}
-	nodeIP := util.FindNodeIPv6(node)
-	if nodeIP == nil {
-		log.Errorf("failed to find ipv6 address of node [%s]", node.Name)
+	parsedNode := shiba.parseNode(source, node)
+	if parsedNode == nil {
 		return false
 	}
-	nodePodCIDRs, err := util.ParseNodePodCIDRs(node)
-	if err != nil {
-		log.Errorf("failed to parse pod cidrs of node [%s]: %v", node.Name, err)
+	if !parsedNode.DiffersFrom(oldNode) {
+		peerLog(key, "update").Debug("node has no actual updates")
 		return false
 	}
+	if parsedNode.IP.Equal(oldNode.IP) && samePaths(parsedNode.Paths, oldNode.Paths) {
+		// Keep the tunnels if only the pod CIDRs or the zone change, like when pool addresses move.
+		parsedNode.Tunnel = oldNode.Tunnel
+		for i := range parsedNode.Paths {
+			parsedNode.Paths[i].Tunnel = oldNode.Paths[i].Tunnel
+		}
+	}
+	nodeMap[key] = parsedNode
+	shiba.saveNodeMap(nodeMap)
+	shiba.dumpNodeMap()
+	peerLog(key, "update").Debug("updated node and saved map")
+	return true
+}
+
+// parseNode returns the parsed node with a new tunnel name, nil if failed.
+func (shiba *Shiba) parseNode(source string, node *corev1.Node) *model.Node {
+	key := model.NodeKey(source, node.Name)
+	nodeIP, paths := shiba.findNodePaths(node)
+	zone, zoneGateway := shiba.nodeZone(source, node)
+	if nodeIP == nil {
+		peerLog(key, "parse").Error("failed to find ipv6 address of node")
+		return nil
+	}
+	nodePodCIDRs, err := shiba.parseNodePodCIDRs(node)
+	if err != nil {
+		peerLog(key, "parse").WithError(err).Error("failed to parse pod cidrs of node")
+		return nil
+	}
 	parsedNode := &model.Node{
-		Name:     node.Name,
-		IP:       nodeIP,
-		PodCIDRs: nodePodCIDRs,
-		Tunnel:   tunnelPrefix + util.NewUID(),
+		Name:        node.Name,
+		IP:          nodeIP,
+		PodCIDRs:    nodePodCIDRs,
+		Tunnel:      tunnelPrefix + util.NewUID(),
+		Source:      source,
+		Paths:       paths,
+		Zone:        zone,
+		ZoneGateway: zoneGateway,
+		IPsecNonce:  node.Annotations[ipsecNonceAnnotation],
 	}
-	if !parsedNode.DiffersFrom(oldNode) {
-		log.Debugf("node [%s] have no actual updates", node.Name)
+	for i := range parsedNode.Paths {
+		if i == 0 {
+			parsedNode.Paths[i].Tunnel = parsedNode.Tunnel
+		} else {
+			parsedNode.Paths[i].Tunnel = tunnelPrefix + util.NewUID()
+		}
+	}
+	return parsedNode
+}
+
+// samePaths returns whether the paths are through the same pairs of underlay addresses.
+func samePaths(a, b []model.Path) bool {
+	if len(a) != len(b) {
 		return false
 	}
-	nodeMap[node.Name] = parsedNode
-	shiba.saveNodeMap(nodeMap)
-	shiba.dumpNodeMap()
-	log.Debugf("updated node [%s] and saved map", node.Name)
+	for i := range a {
+		if !a[i].Local.Equal(b[i].Local) || !a[i].Remote.Equal(b[i].Remote) {
+			return false
+		}
+	}
 	return true
 }
@@ -2,7 +2,9 @@ package app
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,25 +26,39 @@ func (shiba *Shiba) execute(stopCh <-chan struct{}) {
 			case <-shiba.fireCh:
 			default:
 			}
-			nodeMap := shiba.cloneNodeMap()
+			nodeMap := shiba.scopeNodeMap(shiba.cloneNodeMap())
 			shiba.syncTunnels(nodeMap)
+			shiba.syncIPsec(nodeMap)
 			shiba.syncRoutes(nodeMap)
+			shiba.syncEgress(nodeMap)
+			shiba.syncFilter(nodeMap)
+			shiba.syncCNIReadiness(nodeMap)
+			shiba.publishStatus(nodeMap)
+			if shiba.loadBalancer != nil {
+				shiba.loadBalancer.fire() // Announcers may change with the nodes.
+			}
 		}
 	}
 }
 
 func (shiba *Shiba) syncTunnels(nodeMap model.NodeMap) {
 	log.Info("syncing tunnels")
+	shiba.resetPlan(stageTunnels)
 	linkMap := make(map[string]*netlink.Ip6tnl)
-	tunnelMap := make(model.NodeMap, len(nodeMap)) // Tunnel name -> node.
+	tunnelMap := make(map[string]*model.Node, len(nodeMap)) // Tunnel name -> node.
+	pathMap := make(map[string]model.Path, len(nodeMap))    // Tunnel name -> path.
 	for _, node := range nodeMap {
-		tunnelMap[node.Tunnel] = node
+		for _, path := range shiba.nodePaths(node) {
+			tunnelMap[path.Tunnel] = node
+			pathMap[path.Tunnel] = path
+		}
 	}
 
 	log.Debug("examining existing tunnels")
 	links, err := netlink.LinkList()
 	if err != nil {
-		log.Errorf("failed to list links: %v", err)
+		log.WithField(fieldOperation, "sync-tunnels").WithError(err).Error("failed to list links")
+		shiba.recordSyncError(stageTunnels, fmt.Errorf("failed to list links: %w", err))
 	}
 	for _, link := range links {
 		link, ok := link.(*netlink.Ip6tnl)
@@ -53,10 +69,17 @@ func (shiba *Shiba) syncTunnels(nodeMap model.NodeMap) {
 		if strings.HasPrefix(linkName, tunnelPrefix) {
 			if _, ok := tunnelMap[linkName]; ok {
 				linkMap[linkName] = link
+			} else if !isOwnedLink(link) {
+				log.WithField(fieldTunnel, linkName).Debug("skipping tunnel not owned by shiba")
 			} else {
-				log.Debugf("removing dangling tunnel %s", linkName)
-				if err := netlink.LinkDel(link); err != nil {
-					log.Errorf("failed to delete tunnel: %v", err)
+				logger := log.WithFields(log.Fields{fieldTunnel: linkName, fieldOperation: "delete"})
+				logger.Debug("removing dangling tunnel")
+				if err := shiba.apply(stageTunnels, model.Change{
+					Kind: "link", Action: "delete", Target: linkName, Detail: "dangling",
+				}, func() error {
+					return netlink.LinkDel(link)
+				}); err != nil {
+					logger.WithError(err).Error("failed to delete tunnel")
 				}
 			}
 		}
@@ -66,99 +89,203 @@ func (shiba *Shiba) syncTunnels(nodeMap model.NodeMap) {
 	for linkName, node := range tunnelMap {
 		link, ok := linkMap[linkName]
 		if ok {
-			if shiba.isTunnelInSync(link, node) {
-				log.Debugf("tunnel [%s] to node [%s] is up and in sync, skipping", linkName, node.Name)
+			if shiba.isTunnelInSync(link, pathMap[linkName]) {
+				tunnelLog(node.Key(), linkName, "check").Debug("tunnel is up and in sync, skipping")
+				shiba.syncTunnelMTU(link)
+				shiba.syncTunnelAlias(link, node)
 				continue
 			}
-			log.Debugf("tunnel [%s] to node [%s] out of sync, recreating", linkName, node.Name)
-			if err := netlink.LinkDel(link); err != nil {
-				log.Errorf("failed to delete stale tunnel [%s] to node [%s]: %v", linkName, node.Name, err)
+			tunnelLog(node.Key(), linkName, "delete").Debug("tunnel is out of sync, recreating")
+			if err := shiba.apply(stageTunnels, model.Change{
+				Kind: "link", Action: "delete", Target: linkName, Detail: "out of sync",
+			}, func() error {
+				return netlink.LinkDel(link)
+			}); err != nil {
+				tunnelLog(node.Key(), linkName, "delete").WithError(err).Error("failed to delete stale tunnel")
 				continue
 			}
 		}
-		log.Infof("creating tunnel [%s] to node [%s] (%v)", linkName, node.Name, node.IP)
-		link, err := shiba.createIp6tnl(linkName, node)
+		path := pathMap[linkName]
+		logger := tunnelLog(node.Key(), linkName, "create")
+		logger.Infof("creating tunnel %v -> %v", path.Local, path.Remote)
+		link, err := shiba.createIp6tnl(linkName, path)
 		if err != nil {
-			log.Errorf("failed to create tunnel [%s] to node [%s]: %v", linkName, node.Name, err)
+			logger.WithError(err).Error("failed to create tunnel")
 			continue
 		}
-		if err := netlink.LinkAdd(link); err != nil {
-			log.Errorf("failed to create tunnel [%s]: %v", linkName, err)
+		if err := shiba.apply(stageTunnels, model.Change{
+			Kind:   "link",
+			Action: "add",
+			Target: linkName,
+			Detail: fmt.Sprintf("ip6tnl %v -> %v (node %s, mtu %d)", link.Local, link.Remote, node.Name, link.MTU),
+		}, func() error {
+			return netlink.LinkAdd(link)
+		}); err != nil {
+			logger.WithError(err).Error("failed to create tunnel")
 			continue
 		}
+		shiba.syncTunnelAlias(link, node)
 		for _, gatewayIP := range shiba.nodeGateways {
-			if err := netlink.AddrAdd(link, &netlink.Addr{
+			addr := &netlink.Addr{
 				IPNet: &net.IPNet{
 					IP:   gatewayIP,
 					Mask: net.CIDRMask(len(gatewayIP)<<3, len(gatewayIP)<<3),
 				},
+			}
+			if err := shiba.apply(stageTunnels, model.Change{
+				Kind: "addr", Action: "add", Target: linkName, Detail: addr.IPNet.String(),
+			}, func() error {
+				return netlink.AddrAdd(link, addr)
 			}); err != nil {
-				log.Errorf("failed to add address [%s] to tunnel [%s]: %v", gatewayIP, linkName, err)
+				logger.WithField(fieldCIDR, addr.IPNet.String()).WithError(err).Error("failed to add address to tunnel")
 				continue
 			}
 		}
-		if err := netlink.LinkSetUp(link); err != nil {
-			log.Errorf("failed to bring tunnel [%s] up: %v", linkName, err)
+		if err := shiba.apply(stageTunnels, model.Change{
+			Kind: "link", Action: "set-up", Target: linkName,
+		}, func() error {
+			return netlink.LinkSetUp(link)
+		}); err != nil {
+			logger.WithError(err).Error("failed to bring tunnel up")
 			continue
 		}
 	}
 }
 
-func (shiba *Shiba) createIp6tnl(linkName string, node *model.Node) (*netlink.Ip6tnl, error) {
-	if node == nil {
-		return nil, errors.New("node is nil")
+// syncTunnelAlias marks the tunnel as owned by shiba. Tunnels created by older versions are adopted as well,
+// since their names are generated.
+func (shiba *Shiba) syncTunnelAlias(link *netlink.Ip6tnl, node *model.Node) {
+	alias := linkAliasPrefix + node.Key()
+	if link.Alias == alias {
+		return
+	}
+	logger := tunnelLog(node.Key(), link.Name, "set-alias")
+	logger.Debugf("setting alias of tunnel to [%s]", alias)
+	if err := shiba.apply(stageTunnels, model.Change{
+		Kind: "link", Action: "set-alias", Target: link.Name, Detail: alias,
+	}, func() error {
+		return netlink.LinkSetAlias(link, alias)
+	}); err != nil {
+		logger.WithError(err).Error("failed to set alias of tunnel")
+	}
+}
+
+// syncTunnelMTU updates the MTU of the tunnel if it's changed at runtime.
+func (shiba *Shiba) syncTunnelMTU(link *netlink.Ip6tnl) {
+	shiba.configLock.Lock()
+	mtu := shiba.ip6tnlMTU
+	shiba.configLock.Unlock()
+	if mtu <= 0 || link.MTU == mtu {
+		return
+	}
+	logger := log.WithFields(log.Fields{fieldTunnel: link.Name, fieldOperation: "set-mtu"})
+	logger.Infof("changing mtu of tunnel from %d to %d", link.MTU, mtu)
+	if err := shiba.apply(stageTunnels, model.Change{
+		Kind: "link", Action: "set-mtu", Target: link.Name, Detail: strconv.Itoa(mtu),
+	}, func() error {
+		return netlink.LinkSetMTU(link, mtu)
+	}); err != nil {
+		logger.WithError(err).Error("failed to change mtu of tunnel")
+	}
+}
+
+func (shiba *Shiba) createIp6tnl(linkName string, path model.Path) (*netlink.Ip6tnl, error) {
+	if path.Remote == nil {
+		return nil, errors.New("remote address is nil")
 	}
+	shiba.configLock.Lock()
+	mtu := shiba.ip6tnlMTU
+	shiba.configLock.Unlock()
 	return &netlink.Ip6tnl{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: linkName,
-			MTU:  shiba.ip6tnlMTU,
+			MTU:  mtu,
 		},
-		Local:  shiba.nodeIP,
-		Remote: node.IP,
+		Local:  path.Local,
+		Remote: path.Remote,
 	}, nil
 }
 
 func (shiba *Shiba) syncRoutes(nodeMap model.NodeMap) {
 	log.Info("syncing routes")
+	shiba.resetPlan(stageRoutes)
+	shiba.syncRouteRules()
+	shiba.removeStrayRoutes()
 	for _, node := range nodeMap {
+		if paths := shiba.nodePaths(node); len(paths) > 1 {
+			shiba.syncMultipathRoutes(node, paths)
+			continue
+		}
 		link, err := netlink.LinkByName(node.Tunnel)
 		if err != nil {
-			log.Errorf("failed to get tunnel [%s] to node [%s]: %v", node.Tunnel, node.Name, err)
+			if shiba.dryRun {
+				// The tunnel is only planned, so are all its routes.
+				for _, ipNet := range node.PodCIDRs {
+					_ = shiba.apply(stageRoutes, model.Change{
+						Kind: "route", Action: "add", Target: ipNet.String(),
+						Detail: fmt.Sprintf("dev %s (node %s)", node.Tunnel, node.Name),
+					}, nil)
+				}
+				continue
+			}
+			tunnelLog(node.Key(), node.Tunnel, "sync-routes").WithError(err).Error("failed to get tunnel")
+			shiba.recordSyncError(stageRoutes, fmt.Errorf("failed to get tunnel [%s]: %w", node.Tunnel, err))
 			continue
 		}
-		log.Debugf("checking routes of tunnel [%s] to node [%s]", node.Tunnel, node.Name)
+		logger := tunnelLog(node.Key(), node.Tunnel, "sync-routes")
+		logger.Debug("checking routes of tunnel")
 		routeMap := make(map[string]*net.IPNet)
 		for _, ipNet := range node.PodCIDRs {
 			routeMap[ipNet.String()] = ipNet
 		}
-		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		routes, err := shiba.listTunnelRoutes(link)
 		if err != nil {
-			log.Errorf("failed to list routes of tunnel [%s] to node [%s]: %v", node.Tunnel, node.Name, err)
+			logger.WithError(err).Error("failed to list routes of tunnel")
+			shiba.recordSyncError(stageRoutes, fmt.Errorf("failed to list routes of tunnel [%s]: %w", node.Tunnel, err))
 			continue
 		}
 		for _, route := range routes {
 			if route.Dst != nil && route.Src == nil && len(route.Gw) == 0 && routeMap[route.Dst.String()] != nil {
-				log.Debugf("route to [%s] on node [%s] via tunnel [%s] exists",
-					route.Dst.String(), node.Name, node.Tunnel)
+				if route.Protocol != routeProtocol {
+					// Routes of older versions aren't marked, and are replaced below to be adopted.
+					logger.WithField(fieldCIDR, route.Dst.String()).Debug("adopting route")
+					continue
+				}
+				logger.WithField(fieldCIDR, route.Dst.String()).Debug("route exists")
 				delete(routeMap, route.Dst.String())
 				continue
 			}
-			log.Debugf("deleting unexpected route on tunnel [%s]: %v", node.Tunnel, route)
-			if err := netlink.RouteDel(&route); err != nil {
-				log.Errorf("failed to delete route on tunnel [%s]: %v", node.Tunnel, err)
+			if route.Protocol != routeProtocol {
+				logger.Debugf("skipping route not owned by shiba %v", route)
+				continue
+			}
+			logger.Debugf("deleting unexpected route %v", route)
+			route := route
+			if err := shiba.apply(stageRoutes, model.Change{
+				Kind: "route", Action: "delete", Target: node.Tunnel, Detail: route.String(),
+			}, func() error {
+				return netlink.RouteDel(&route)
+			}); err != nil {
+				logger.WithError(err).Error("failed to delete route")
 				continue
 			}
 		}
 		for _, routeToAdd := range routeMap {
-			log.Infof("adding route to [%s] on node [%s] via tunnel [%s]",
-				routeToAdd.String(), node.Name, node.Tunnel)
+			logger.WithField(fieldCIDR, routeToAdd.String()).Info("adding route")
 			route := netlink.Route{
 				LinkIndex: link.Attrs().Index,
 				Dst:       routeToAdd,
+				Protocol:  routeProtocol,
+				Table:     shiba.routeTable,
 			}
-			if err := netlink.RouteAdd(&route); err != nil {
-				log.Errorf("failed to add route to [%s] on node [%s] via tunnel [%s]: %v",
-					routeToAdd.String(), node.Name, node.Tunnel, err)
+			if err := shiba.apply(stageRoutes, model.Change{
+				Kind: "route", Action: "add", Target: routeToAdd.String(),
+				Detail: fmt.Sprintf("dev %s (node %s)", node.Tunnel, node.Name),
+			}, func() error {
+				// Replaced, so a route to the same destination left by an older version is taken over.
+				return netlink.RouteReplace(&route)
+			}); err != nil {
+				logger.WithField(fieldCIDR, routeToAdd.String()).WithError(err).Error("failed to add route")
 				continue
 			}
 		}
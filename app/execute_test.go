@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/vishvananda/netlink"
 	"gotest.tools/v3/assert"
 
 	"github.com/moycat/shiba/model"
@@ -13,10 +14,17 @@ func TestShiba_createIp6tnl(t *testing.T) {
 	s := &Shiba{
 		ip6tnlMTU: 1500,
 	}
-	link, err := s.createIp6tnl("hello", &model.Node{
-		IP: net.ParseIP("2605:340:cd52:100:39a:464d:c85c:e08a"),
+	link, err := s.createIp6tnl("hello", model.Path{
+		Remote: net.ParseIP("2605:340:cd52:100:39a:464d:c85c:e08a"),
 	})
 	assert.NilError(t, err)
 	assert.Equal(t, "hello", link.Name)
 	assert.Equal(t, 1500, link.Attrs().MTU)
 }
+
+func TestIsOwnedLink(t *testing.T) {
+	link := &netlink.Ip6tnl{LinkAttrs: netlink.LinkAttrs{Name: tunnelPrefix + "abc"}}
+	assert.Assert(t, !isOwnedLink(link)) // The name alone doesn't mean it's owned.
+	link.Alias = linkAliasPrefix + "node-1"
+	assert.Assert(t, isOwnedLink(link))
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"fmt"
+	"net"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+
+	"github.com/moycat/shiba/util"
+)
+
+// ipFamily describes how an IP family is handled by the different subsystems.
+type ipFamily struct {
+	name      string
+	match     func(ip net.IP) bool
+	tables    *util.Tables
+	nftFamily string // The nftables family, also the keyword to match addresses.
+	nftAddr   string // The nftables type of addresses.
+	addrType  discoveryv1.AddressType
+}
+
+var (
+	familyV4 = &ipFamily{
+		name:      "ipv4",
+		match:     util.IsV4,
+		tables:    util.V4tables,
+		nftFamily: "ip",
+		nftAddr:   "ipv4_addr",
+		addrType:  discoveryv1.AddressTypeIPv4,
+	}
+	familyV6 = &ipFamily{
+		name:      "ipv6",
+		match:     util.IsV6,
+		tables:    util.V6tables,
+		nftFamily: "ip6",
+		nftAddr:   "ipv6_addr",
+		addrType:  discoveryv1.AddressTypeIPv6,
+	}
+	ipFamilies = []*ipFamily{familyV4, familyV6}
+)
+
+// familyOf returns the family of ip, nil if it's neither IPv4 or IPv6.
+func familyOf(ip net.IP) *ipFamily {
+	for _, family := range ipFamilies {
+		if family.match(ip) {
+			return family
+		}
+	}
+	return nil
+}
+
+// splitByFamily groups subnets by their IP families.
+func splitByFamily(ipNets []*net.IPNet) (map[*ipFamily][]*net.IPNet, error) {
+	split := make(map[*ipFamily][]*net.IPNet, len(ipFamilies))
+	for _, ipNet := range ipNets {
+		family := familyOf(ipNet.IP)
+		if family == nil {
+			return nil, fmt.Errorf("[%s] is neither ipv4 or ipv6 subnet", ipNet.String())
+		}
+		split[family] = append(split[family], ipNet)
+	}
+	return split, nil
+}
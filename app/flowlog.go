@@ -0,0 +1,374 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	// FlowLogStdout is the flow log path to write flows to stdout.
+	FlowLogStdout     = "-"
+	flowEventStart    = "start"
+	flowEventEnd      = "end"
+	flowEventCapacity = 1024
+)
+
+var flowProtocols = map[uint8]string{
+	syscall.IPPROTO_ICMP:   "icmp",
+	syscall.IPPROTO_TCP:    "tcp",
+	syscall.IPPROTO_UDP:    "udp",
+	syscall.IPPROTO_ICMPV6: "icmpv6",
+	syscall.IPPROTO_SCTP:   "sctp",
+}
+
+// flowLogger logs the conntrack flows of the node from or to the cluster pod CIDRs, with the pods of the addresses.
+type flowLogger struct {
+	shiba     *Shiba
+	path      string
+	file      *os.File  // Nil if not writing to a file, guarded by writeLock.
+	writer    io.Writer // Nil to not write flows, guarded by writeLock.
+	writeLock sync.Mutex
+	metrics   bool
+	pods      map[string]*flowPod // IP -> pod.
+	podIPs    map[string][]string // Namespace/name -> IPs.
+	counters  map[flowCounterKey]*flowCounter
+	dropped   uint64 // Times events are dropped by the kernel.
+	lock      sync.Mutex
+}
+
+type flowPod struct {
+	namespace string
+	name      string
+	nodeName  string
+}
+
+type flowCounterKey struct {
+	srcNamespace string
+	dstNamespace string
+	protocol     string
+}
+
+type flowCounter struct {
+	flows uint64
+	bytes uint64
+}
+
+// initFlowLog opens the flow log. Flows are written as JSON lines to path if set, and counted in metrics if
+// metrics is set. Pods are found by the shared pod informer.
+func (shiba *Shiba) initFlowLog(path string, metrics bool) error {
+	if len(path) == 0 && !metrics {
+		return nil
+	}
+	logger := &flowLogger{
+		shiba:    shiba,
+		metrics:  metrics,
+		pods:     make(map[string]*flowPod),
+		podIPs:   make(map[string][]string),
+		counters: make(map[flowCounterKey]*flowCounter),
+	}
+	switch path {
+	case "":
+	case FlowLogStdout:
+		logger.writer = os.Stdout
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open flow log: %w", err)
+		}
+		logger.path, logger.file, logger.writer = path, f, f
+	}
+	shiba.informers.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { logger.processPod(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { logger.processPod(obj, false) },
+		DeleteFunc: func(obj interface{}) { logger.processPod(obj, true) },
+	})
+	shiba.flowLogger = logger
+	log.Infof("logging flows of pod cidrs %v", util.FormatIPNets(shiba.clusterPodCIDRs))
+	return nil
+}
+
+// run logs the flows until stopCh is closed, when the file is closed. The file is reopened on SIGHUP, so it can be
+// rotated by renaming.
+func (logger *flowLogger) run(stopCh <-chan struct{}) {
+	defer logger.close()
+	if len(logger.path) > 0 {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		go func() {
+			for {
+				select {
+				case <-stopCh:
+					return
+				case <-hupCh:
+					if err := logger.reopen(); err != nil {
+						log.WithError(err).Error("failed to reopen flow log")
+					}
+				}
+			}
+		}()
+	}
+	for {
+		if !logger.consume(stopCh) {
+			return
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(remoteRetryInterval):
+		}
+	}
+}
+
+// consume handles the conntrack events until the subscription fails, returning false if stopCh is closed.
+func (logger *flowLogger) consume(stopCh <-chan struct{}) bool {
+	eventCh := make(chan util.ConntrackEvent, flowEventCapacity)
+	errCh := make(chan error)
+	done := make(chan struct{})
+	defer close(done)
+	if err := util.SubscribeConntrack(eventCh, errCh, done); err != nil {
+		log.WithError(err).Error("failed to subscribe conntrack events")
+		return true
+	}
+	log.Info("subscribed conntrack events")
+	for {
+		select {
+		case <-stopCh:
+			return false
+		case err := <-errCh:
+			if err == util.ErrConntrackOverrun {
+				logger.lock.Lock()
+				logger.dropped++
+				logger.lock.Unlock()
+				log.Warning("conntrack events are dropped, some flows are not logged")
+				continue
+			}
+			log.WithError(err).Error("failed to receive conntrack events")
+			return true
+		case event, ok := <-eventCh:
+			if !ok {
+				return true
+			}
+			logger.handle(event, time.Now())
+		}
+	}
+}
+
+// reopen opens the flow log file again, which may be renamed by rotation. Flows are written to the old file until
+// the new one is opened.
+func (logger *flowLogger) reopen() error {
+	f, err := os.OpenFile(logger.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	logger.writeLock.Lock()
+	defer logger.writeLock.Unlock()
+	if logger.file == nil {
+		return f.Close() // Closed on stop.
+	}
+	_ = logger.file.Close()
+	logger.file, logger.writer = f, f
+	log.Infof("reopened flow log [%s]", logger.path)
+	return nil
+}
+
+// close closes the flow log file, after which no flow is written.
+func (logger *flowLogger) close() {
+	logger.writeLock.Lock()
+	defer logger.writeLock.Unlock()
+	if logger.file == nil {
+		return
+	}
+	if err := logger.file.Close(); err != nil {
+		log.WithError(err).Error("failed to close flow log")
+	}
+	logger.file, logger.writer = nil, nil
+}
+
+// processPod records the addresses of the pod, or forgets them if it's deleted.
+func (logger *flowLogger) processPod(obj interface{}, deleted bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.HostNetwork {
+		return // The addresses are of the node.
+	}
+	key := pod.Namespace + "/" + pod.Name
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	for _, ip := range logger.podIPs[key] {
+		if p := logger.pods[ip]; p != nil && p.namespace == pod.Namespace && p.name == pod.Name {
+			delete(logger.pods, ip)
+		}
+	}
+	delete(logger.podIPs, key)
+	if deleted {
+		return
+	}
+	for _, podIP := range pod.Status.PodIPs {
+		ip := net.ParseIP(podIP.IP)
+		if ip == nil {
+			continue
+		}
+		logger.pods[ip.String()] = &flowPod{namespace: pod.Namespace, name: pod.Name, nodeName: pod.Spec.NodeName}
+		logger.podIPs[key] = append(logger.podIPs[key], ip.String())
+	}
+}
+
+// handle logs the flow if it's from or to a pod.
+func (logger *flowLogger) handle(event util.ConntrackEvent, now time.Time) {
+	flow := logger.newFlow(event, now)
+	if flow == nil {
+		return
+	}
+	logger.writeLock.Lock()
+	if logger.writer != nil {
+		b, err := json.Marshal(flow)
+		if err != nil {
+			logger.writeLock.Unlock()
+			log.WithError(err).Error("failed to encode flow")
+			return
+		}
+		if _, err := logger.writer.Write(append(b, '\n')); err != nil {
+			log.WithError(err).Error("failed to write flow")
+		}
+	}
+	logger.writeLock.Unlock()
+	if logger.metrics && flow.Event == flowEventEnd {
+		key := flowCounterKey{srcNamespace: flow.Src.Namespace, dstNamespace: flow.Dst.Namespace, protocol: flow.Protocol}
+		logger.lock.Lock()
+		counter := logger.counters[key]
+		if counter == nil {
+			counter = &flowCounter{}
+			logger.counters[key] = counter
+		}
+		counter.flows++
+		counter.bytes += flow.Bytes + flow.ReplyBytes
+		logger.lock.Unlock()
+	}
+}
+
+// newFlow returns the flow of the event with the pods of the addresses, nil if no address is in the cluster pod
+// CIDRs. The destination of a DNATed flow is the translated one, like the pod behind a service.
+func (logger *flowLogger) newFlow(event util.ConntrackEvent, now time.Time) *model.Flow {
+	original, reply := event.Original, event.Reply
+	dst, dstPort := original.Dst, original.DstPort
+	dnat := reply.Src != nil && (!reply.Src.Equal(original.Dst) || reply.SrcPort != original.DstPort)
+	if dnat {
+		dst, dstPort = reply.Src, reply.SrcPort
+	}
+	if !logger.inCluster(original.Src) && !logger.inCluster(dst) {
+		return nil
+	}
+	protocol, ok := flowProtocols[event.Protocol]
+	if !ok {
+		protocol = strconv.Itoa(int(event.Protocol))
+	}
+	flow := &model.Flow{
+		Time:     now.UTC(),
+		Event:    flowEventStart,
+		Protocol: protocol,
+		Src:      logger.endpoint(original.Src, original.SrcPort),
+		Dst:      logger.endpoint(dst, dstPort),
+	}
+	if dnat {
+		flow.Service = &model.Endpoint{IP: original.Dst.String(), Port: original.DstPort}
+	}
+	if !event.New {
+		flow.Event = flowEventEnd
+		flow.Packets, flow.Bytes = original.Packets, original.Bytes
+		flow.ReplyPackets, flow.ReplyBytes = reply.Packets, reply.Bytes
+	}
+	return flow
+}
+
+func (logger *flowLogger) inCluster(ip net.IP) bool {
+	for _, cidr := range logger.shiba.clusterPodCIDRs {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoint returns the endpoint with the pod of the address, or only the node by the pod CIDR if the pod is unknown.
+func (logger *flowLogger) endpoint(ip net.IP, port uint16) model.Endpoint {
+	endpoint := model.Endpoint{IP: ip.String(), Port: port}
+	logger.lock.Lock()
+	pod := logger.pods[ip.String()]
+	logger.lock.Unlock()
+	if pod != nil {
+		endpoint.Pod, endpoint.Namespace, endpoint.Node = pod.name, pod.namespace, pod.nodeName
+		return endpoint
+	}
+	if !logger.inCluster(ip) {
+		return endpoint
+	}
+	for _, cidr := range logger.shiba.nodePodCIDRs {
+		if cidr.Contains(ip) {
+			endpoint.Node = logger.shiba.nodeName
+			return endpoint
+		}
+	}
+	for _, node := range logger.shiba.cloneNodeMap() {
+		for _, cidr := range node.PodCIDRs {
+			if node.Source == model.SourceCluster && cidr.Contains(ip) {
+				endpoint.Node = node.Name
+				return endpoint
+			}
+		}
+	}
+	return endpoint
+}
+
+func (shiba *Shiba) writeFlowMetrics(m *util.MetricWriter) {
+	if shiba.flowLogger == nil || !shiba.flowLogger.metrics {
+		return
+	}
+	logger := shiba.flowLogger
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	keys := make([]flowCounterKey, 0, len(logger.counters))
+	for key := range logger.counters {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.srcNamespace != b.srcNamespace {
+			return a.srcNamespace < b.srcNamespace
+		}
+		if a.dstNamespace != b.dstNamespace {
+			return a.dstNamespace < b.dstNamespace
+		}
+		return a.protocol < b.protocol
+	})
+	m.Header("shiba_flows_total", "counter", "Number of ended flows of pods by the namespaces, empty if not a pod.")
+	for _, key := range keys {
+		m.Sample("shiba_flows_total", float64(logger.counters[key].flows),
+			"src_namespace", key.srcNamespace, "dst_namespace", key.dstNamespace, "protocol", key.protocol)
+	}
+	m.Header("shiba_flow_bytes_total", "counter", "Bytes of ended flows of pods in both directions by the namespaces.")
+	for _, key := range keys {
+		m.Sample("shiba_flow_bytes_total", float64(logger.counters[key].bytes),
+			"src_namespace", key.srcNamespace, "dst_namespace", key.dstNamespace, "protocol", key.protocol)
+	}
+	m.Header("shiba_flow_event_overruns_total", "counter", "Times conntrack events are dropped by the kernel.")
+	m.Sample("shiba_flow_event_overruns_total", float64(logger.dropped))
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func TestFlowLogger(t *testing.T) {
+	clusterPodCIDRs, err := util.ParseIPNets([]string{"10.244.0.0/16"})
+	assert.NilError(t, err)
+	nodePodCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24"})
+	assert.NilError(t, err)
+	shiba := &Shiba{
+		nodeName:        "self",
+		clusterPodCIDRs: clusterPodCIDRs,
+		nodePodCIDRs:    nodePodCIDRs,
+		nodeMap: model.NodeMap{"other": {
+			Name: "other", PodCIDRs: []*net.IPNet{{IP: net.IP{10, 244, 2, 0}, Mask: net.CIDRMask(24, 32)}},
+		}},
+		informers: informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0),
+	}
+	assert.NilError(t, shiba.initFlowLog("", true))
+	var b bytes.Buffer
+	logger := shiba.flowLogger
+	logger.writer = &b
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "web", Name: "frontend"},
+		Spec:       corev1.PodSpec{NodeName: "self"},
+		Status:     corev1.PodStatus{PodIPs: []corev1.PodIP{{IP: "10.244.1.5"}}},
+	}
+	logger.processPod(pod, false)
+
+	// From a local pod to a remote one behind a service.
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	event := util.ConntrackEvent{
+		Protocol: syscall.IPPROTO_TCP,
+		Original: util.ConntrackTuple{
+			Src: net.ParseIP("10.244.1.5"), Dst: net.ParseIP("10.96.0.10"), SrcPort: 40000, DstPort: 80,
+			Packets: 3, Bytes: 180,
+		},
+		Reply: util.ConntrackTuple{
+			Src: net.ParseIP("10.244.2.7"), Dst: net.ParseIP("10.244.1.5"), SrcPort: 8080, DstPort: 40000,
+			Packets: 2, Bytes: 120,
+		},
+	}
+	logger.handle(event, now)
+	var flow model.Flow
+	assert.NilError(t, json.Unmarshal(b.Bytes(), &flow))
+	assert.DeepEqual(t, flow, model.Flow{
+		Time:         now,
+		Event:        flowEventEnd,
+		Protocol:     "tcp",
+		Src:          model.Endpoint{IP: "10.244.1.5", Port: 40000, Pod: "frontend", Namespace: "web", Node: "self"},
+		Dst:          model.Endpoint{IP: "10.244.2.7", Port: 8080, Node: "other"},
+		Service:      &model.Endpoint{IP: "10.96.0.10", Port: 80},
+		Packets:      3,
+		Bytes:        180,
+		ReplyPackets: 2,
+		ReplyBytes:   120,
+	})
+
+	// Flows not of pods are ignored.
+	b.Reset()
+	logger.handle(util.ConntrackEvent{New: true, Protocol: syscall.IPPROTO_UDP, Original: util.ConntrackTuple{
+		Src: net.ParseIP("192.0.2.1"), Dst: net.ParseIP("192.0.2.2"),
+	}}, now)
+	assert.Equal(t, b.Len(), 0)
+
+	// The pod is gone.
+	logger.processPod(cache.DeletedFinalStateUnknown{Key: "web/frontend", Obj: pod}, true)
+	assert.Equal(t, len(logger.pods), 0)
+
+	var metrics strings.Builder
+	shiba.writeFlowMetrics(util.NewMetricWriter(&metrics))
+	assert.Assert(t, strings.Contains(metrics.String(),
+		`shiba_flows_total{src_namespace="web",dst_namespace="",protocol="tcp"} 1`), metrics.String())
+	assert.Assert(t, strings.Contains(metrics.String(),
+		`shiba_flow_bytes_total{src_namespace="web",dst_namespace="",protocol="tcp"} 300`), metrics.String())
+}
+
+func TestFlowLogger_reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "flows.log")
+	clusterPodCIDRs, err := util.ParseIPNets([]string{"10.244.0.0/16"})
+	assert.NilError(t, err)
+	shiba := &Shiba{
+		clusterPodCIDRs: clusterPodCIDRs,
+		informers:       informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0),
+	}
+	assert.NilError(t, shiba.initFlowLog(path, false))
+	logger := shiba.flowLogger
+	event := util.ConntrackEvent{New: true, Protocol: syscall.IPPROTO_UDP, Original: util.ConntrackTuple{
+		Src: net.ParseIP("10.244.1.5"), Dst: net.ParseIP("10.244.2.7"),
+	}}
+	logger.handle(event, time.Now())
+
+	// Rotated by renaming.
+	assert.NilError(t, os.Rename(path, path+".1"))
+	assert.NilError(t, logger.reopen())
+	logger.handle(event, time.Now())
+	logger.close()
+	logger.handle(event, time.Now())
+	assert.NilError(t, logger.reopen(), "not reopened once closed")
+
+	for _, name := range []string{path + ".1", path} {
+		b, err := os.ReadFile(name)
+		assert.NilError(t, err)
+		assert.Equal(t, strings.Count(string(b), "\n"), 1, name)
+	}
+}
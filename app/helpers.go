@@ -3,10 +3,11 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net"
 	"os"
-	"path/filepath"
 	"reflect"
+	"strings"
 	"syscall"
 
 	"github.com/moycat/shiba/model"
@@ -15,6 +16,11 @@ import (
 	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 func (shiba *Shiba) getAPIContext() (context.Context, func()) {
@@ -24,18 +30,56 @@ func (shiba *Shiba) getAPIContext() (context.Context, func()) {
 	return context.WithCancel(context.Background())
 }
 
-func (shiba *Shiba) isTunnelInSync(link *netlink.Ip6tnl, node *model.Node) bool {
+func newEventRecorder(client kubernetes.Interface, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "shiba", Host: nodeName})
+}
+
+// recordNodeEvent records an event about the current node.
+func (shiba *Shiba) recordNodeEvent(eventType, reason, message string) {
+	if shiba.recorder == nil {
+		return
+	}
+	shiba.recorder.Event(&corev1.ObjectReference{
+		Kind: "Node",
+		Name: shiba.nodeName,
+		UID:  types.UID(shiba.nodeName),
+	}, eventType, reason, message)
+}
+
+// annotateNode patches the annotations of the current node. A nil value removes the annotation.
+func (shiba *Shiba) annotateNode(annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal patch: %w", err)
+	}
+	ctx, cancel := shiba.getAPIContext()
+	defer cancel()
+	_, err = shiba.client.CoreV1().Nodes().Patch(ctx, shiba.nodeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// isOwnedLink returns whether the link is marked as owned by shiba.
+func isOwnedLink(link netlink.Link) bool {
+	return strings.HasPrefix(link.Attrs().Alias, linkAliasPrefix)
+}
+
+func (shiba *Shiba) isTunnelInSync(link *netlink.Ip6tnl, path model.Path) bool {
+	logger := log.WithFields(log.Fields{fieldTunnel: link.Name, fieldOperation: "check"})
 	if link.LinkAttrs.Flags|net.FlagUp == 0 {
-		log.Debugf("tunnel [%s] is not up", link.Name)
+		logger.Debug("tunnel is not up")
 		return false
 	}
-	if !link.Local.Equal(shiba.nodeIP) || !link.Remote.Equal(node.IP) {
-		log.Debugf("tunnel [%s] has bad peer config", link.Name)
+	if !link.Local.Equal(path.Local) || !link.Remote.Equal(path.Remote) {
+		logger.Debugf("tunnel has bad peer config %v -> %v", link.Local, link.Remote)
 		return false
 	}
 	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
 	if err != nil {
-		log.Errorf("failed to get addr list of tunnel [%s]: %v", link.Name, err)
+		logger.WithError(err).Error("failed to get addr list of tunnel")
 		return false
 	}
 	addrMap := make(map[string]bool)
@@ -44,23 +88,26 @@ func (shiba *Shiba) isTunnelInSync(link *netlink.Ip6tnl, node *model.Node) bool
 			continue
 		}
 		if ones, bits := addr.Mask.Size(); ones != bits {
-			log.Debugf("tunnel [%s] has non-single address [%v]", link.Name, addr.IPNet.String())
+			logger.WithField(fieldCIDR, addr.IPNet.String()).Debug("tunnel has non-single address")
 		}
 		addrMap[addr.IP.String()] = true
 	}
 	if !reflect.DeepEqual(addrMap, shiba.nodeGatewayMap) {
-		log.Debugf("tunnel [%s] has bad ips: %v", link.Name, addrMap)
+		logger.Debugf("tunnel has bad ips: %v", addrMap)
 		return false
 	}
 	return true
 }
 
 func (shiba *Shiba) loadNodeMap() {
-	path := filepath.Join(os.TempDir(), nodeMapFilename)
+	path := shiba.nodeMapPath
+	if len(path) == 0 {
+		return
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Errorf("failed to open node map file [%s] for reading: %v", path, err)
+			log.WithField(fieldPath, path).WithError(err).Error("failed to open node map file for reading")
 		}
 		return
 	}
@@ -68,7 +115,7 @@ func (shiba *Shiba) loadNodeMap() {
 	decoder := json.NewDecoder(f)
 	nodeMap := make(model.NodeMap)
 	if err := decoder.Decode(&nodeMap); err != nil {
-		log.Errorf("failed to unmarshal node map file [%s]: %v", path, err)
+		log.WithField(fieldPath, path).WithError(err).Error("failed to unmarshal node map file")
 		return
 	}
 	shiba.saveNodeMap(nodeMap)
@@ -76,42 +123,79 @@ func (shiba *Shiba) loadNodeMap() {
 }
 
 func (shiba *Shiba) validateNodeMap() {
-	ctx, cancel := context.WithTimeout(context.Background(), shiba.apiTimeout)
-	defer cancel()
-	nodes, err := shiba.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
-	if err != nil {
-		log.Errorf("failed to list nodes: %v", err)
-		shiba.nodeMap = nil // Drop the map since we can't validate it.
-		return
+	clients := map[string]kubernetes.Interface{model.SourceCluster: shiba.client}
+	for _, cluster := range shiba.remoteClusters {
+		clients[model.RemoteSource(cluster.name)] = cluster.client
 	}
-	nodeMap := make(map[string]corev1.Node, nodes.Size())
-	for _, node := range nodes.Items {
-		nodeMap[node.Name] = node
+	sourceNodeMap := make(map[string]map[string]corev1.Node, len(clients)) // Source -> name -> node.
+	for source, client := range clients {
+		ctx, cancel := context.WithTimeout(context.Background(), shiba.apiTimeout)
+		nodes, err := client.CoreV1().Nodes().List(ctx, shiba.nodeListOptions())
+		cancel()
+		if err != nil {
+			if source == model.SourceCluster {
+				log.WithField(fieldOperation, "validate").WithError(err).Error("failed to list nodes")
+				for key, node := range shiba.nodeMap {
+					if node.Source != model.SourceStatic {
+						delete(shiba.nodeMap, key) // Drop the nodes since we can't validate them.
+					}
+				}
+				return
+			}
+			log.WithFields(log.Fields{"source": source, fieldOperation: "validate"}).WithError(err).
+				Error("failed to list nodes of the source")
+			continue // Drop the nodes of the source since we can't validate them.
+		}
+		nodeMap := make(map[string]corev1.Node, nodes.Size())
+		for _, node := range nodes.Items {
+			nodeMap[node.Name] = node
+		}
+		sourceNodeMap[source] = nodeMap
 	}
 	var badNodes []string
-	for name, node := range shiba.nodeMap {
-		n, ok := nodeMap[name]
+	for key, node := range shiba.nodeMap {
+		if node.Source == model.SourceStatic {
+			continue // Static peers are validated when reloaded.
+		}
+		nodeMap, ok := sourceNodeMap[node.Source]
 		if !ok {
-			log.Warningf("node [%s] loaded from cache doesn't exist, removing", name)
-			badNodes = append(badNodes, name)
+			peerLog(key, "validate").Warning("node loaded from cache has an unknown source, removing")
+			badNodes = append(badNodes, key)
 			continue
 		}
-		nodeIP := util.FindNodeIPv6(&n)
+		n, ok := nodeMap[node.Name]
+		if !ok {
+			peerLog(key, "validate").Warning("node loaded from cache doesn't exist or isn't selected, removing")
+			badNodes = append(badNodes, key)
+			continue
+		}
+		if !shiba.isNodeSelected(&n) {
+			peerLog(key, "validate").Warning("node loaded from cache isn't selected, removing")
+			badNodes = append(badNodes, key)
+			continue
+		}
+		nodeIP, paths := shiba.findNodePaths(&n)
 		if nodeIP == nil {
-			log.Warningf("node [%s] loaded from cache no longer has an IPv6 address, removing", name)
-			badNodes = append(badNodes, name)
+			peerLog(key, "validate").Warning("node loaded from cache no longer has an IPv6 address, removing")
+			badNodes = append(badNodes, key)
 			continue
 		}
-		nodePodCIDRs, err := util.ParseNodePodCIDRs(&n)
+		nodePodCIDRs, err := shiba.parseNodePodCIDRs(&n)
 		if err != nil {
-			log.Warningf("failed to parse pod cidrs of node [%s]: %v", name, err)
-			badNodes = append(badNodes, name)
+			peerLog(key, "validate").WithError(err).Warning("failed to parse pod cidrs of node")
+			badNodes = append(badNodes, key)
 			continue
 		}
-		if node.DiffersFrom(&model.Node{Name: name, IP: nodeIP, PodCIDRs: nodePodCIDRs}) {
-			log.Warningf("node [%s] IP or pod CIDRs changed, removing", name)
-			log.Debugf("IP: [%v]/[%v], CIDRs:%s/%s", node.IP, nodeIP, node.PodCIDRs, util.FormatIPNets(nodePodCIDRs))
-			badNodes = append(badNodes, name)
+		zone, zoneGateway := shiba.nodeZone(node.Source, &n)
+		if node.DiffersFrom(&model.Node{
+			Name: node.Name, IP: nodeIP, PodCIDRs: nodePodCIDRs, Source: node.Source, Paths: paths,
+			Zone: zone, ZoneGateway: zoneGateway,
+			IPsecNonce: n.Annotations[ipsecNonceAnnotation],
+		}) {
+			peerLog(key, "validate").Warning("node IP, pod CIDRs, zone or ipsec nonce changed, removing")
+			peerLog(key, "validate").Debugf("IP: [%v]/[%v], CIDRs:%s/%s",
+				node.IP, nodeIP, util.FormatIPNets(node.PodCIDRs), util.FormatIPNets(nodePodCIDRs))
+			badNodes = append(badNodes, key)
 			continue
 		}
 	}
@@ -121,21 +205,27 @@ func (shiba *Shiba) validateNodeMap() {
 }
 
 func (shiba *Shiba) dumpNodeMap() {
-	path := filepath.Join(os.TempDir(), nodeMapFilename)
+	if shiba.dryRun {
+		return // Leave the cache to the shiba that manages the host.
+	}
+	path := shiba.nodeMapPath
+	if len(path) == 0 {
+		return
+	}
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
-		log.Errorf("failed to open node map file [%s] for writing: %v", path, err)
+		log.WithField(fieldPath, path).WithError(err).Error("failed to open node map file for writing")
 		return
 	}
 	defer func() {
 		if err := f.Close(); err != nil {
-			log.Errorf("failed to close node map file [%s]: %v", path, err)
+			log.WithField(fieldPath, path).WithError(err).Error("failed to close node map file")
 		}
 	}()
 	encoder := json.NewEncoder(f)
 	nodeMap := shiba.cloneNodeMap()
 	if err := encoder.Encode(nodeMap); err != nil {
-		log.Errorf("failed to marshal node map to [%s]: %v", path, err)
+		log.WithField(fieldPath, path).WithError(err).Error("failed to marshal node map")
 	}
 }
 
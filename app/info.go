@@ -2,16 +2,18 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math/big"
 	"net"
 	"strings"
 
 	"github.com/moycat/shiba/model"
 	"github.com/moycat/shiba/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
 	"gopkg.in/yaml.v3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 // initSelf populates the IP address and pod CIDRs of the current node.
@@ -22,12 +24,54 @@ func (shiba *Shiba) initSelf() error {
 	if err != nil {
 		return fmt.Errorf("failed to get node [%s]: %w", shiba.nodeName, err)
 	}
-	// Find the first IPv6 internal address of the node.
-	shiba.nodeIP = util.FindNodeIPv6(node)
-	if len(shiba.nodeIP) == 0 {
+	shiba.nodeUID = string(node.UID)
+	// Find the underlay IPv6 address of the node.
+	overridden := len(util.AnnotationIPv6s(node, underlayIPAnnotation)) > 0
+	published, hasPublished := node.Annotations[publishedIPAnnotation]
+	if len(shiba.underlayInterface) > 0 && !overridden {
+		shiba.nodeIPs, err = shiba.findInterfaceIPv6s(shiba.underlayInterface)
+		if err != nil {
+			return fmt.Errorf("failed to find ipv6 address of interface [%s]: %w", shiba.underlayInterface, err)
+		}
+		if !shiba.multipath {
+			shiba.nodeIPs = shiba.nodeIPs[:1]
+		}
+		// Let peers know which addresses are selected.
+		ipStrings := make([]string, 0, len(shiba.nodeIPs))
+		for _, ip := range shiba.nodeIPs {
+			ipStrings = append(ipStrings, ip.String())
+		}
+		value := strings.Join(ipStrings, ",")
+		if published != value && !shiba.dryRun {
+			if err := shiba.annotateNode(map[string]interface{}{publishedIPAnnotation: value}); err != nil {
+				return fmt.Errorf("failed to annotate node [%s] with underlay ip: %w", shiba.nodeName, err)
+			}
+		}
+	} else {
+		if overridden && len(shiba.underlayInterface) > 0 {
+			log.Warningf("node [%s] has underlay ip overridden by annotation, ignoring interface [%s]",
+				shiba.nodeName, shiba.underlayInterface)
+		}
+		if hasPublished {
+			// Peers would keep using the addresses published before.
+			if !shiba.dryRun {
+				if err := shiba.annotateNode(map[string]interface{}{publishedIPAnnotation: nil}); err != nil {
+					return fmt.Errorf("failed to remove published underlay ip of node [%s]: %w", shiba.nodeName, err)
+				}
+			}
+			node = node.DeepCopy()
+			delete(node.Annotations, publishedIPAnnotation)
+		}
+		shiba.nodeIPs = shiba.nodeIPPolicy.FindNodeIPv6s(node)
+		if !shiba.multipath && len(shiba.nodeIPs) > 0 {
+			shiba.nodeIPs = shiba.nodeIPs[:1]
+		}
+	}
+	if len(shiba.nodeIPs) == 0 {
 		return fmt.Errorf("node [%s] does not have an ipv6 address", shiba.nodeName)
 	}
-	log.Debugf("node [%s] has ip [%s]", shiba.nodeName, shiba.nodeIP)
+	shiba.nodeIP = shiba.nodeIPs[0]
+	log.Debugf("node [%s] has ips %v", shiba.nodeName, shiba.nodeIPs)
 	// Find the pod CIDRs of the node.
 	shiba.nodePodCIDRs, err = util.ParseNodePodCIDRs(node)
 	if err != nil {
@@ -39,42 +83,79 @@ func (shiba *Shiba) initSelf() error {
 	log.Infof("node [%s] has pod cidrs %v", shiba.nodeName, util.FormatIPNets(shiba.nodePodCIDRs))
 	// Generate the gateway IPs.
 	for _, cidr := range shiba.nodePodCIDRs {
-		gatewayIP := net.IP(big.NewInt(0).Add(big.NewInt(0).SetBytes(cidr.IP), big.NewInt(1)).Bytes())
+		gatewayIP := util.GatewayIP(cidr)
 		shiba.nodeGateways = append(shiba.nodeGateways, gatewayIP)
 		shiba.nodeGatewayMap[gatewayIP.String()] = true
 	}
 	log.Infof("node [%s] has gateway ips %v", shiba.nodeName, shiba.nodeGateways)
+	// Find the scope of the node.
+	shiba.zone, shiba.zoneGateway = shiba.nodeZone(model.SourceCluster, node)
+	if !shiba.isNodeSelected(node) {
+		log.Warningf("node [%s] is not selected, peers won't tunnel to it", shiba.nodeName)
+	}
+	log.Infof("node [%s] peers by %s", shiba.nodeName, shiba.describeScope())
 	return nil
 }
 
+// findInterfaceIPv6s returns the global IPv6 addresses of the interface in the order of the node IP policy.
+func (shiba *Shiba) findInterfaceIPv6s(name string) ([]net.IP, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []net.IP
+	for _, addr := range addrs {
+		if addr.IP.IsGlobalUnicast() {
+			candidates = append(candidates, addr.IP)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.New("no global ipv6 address")
+	}
+	return shiba.nodeIPPolicy.SortIPs(candidates), nil
+}
+
 // initCluster gets the cluster information from kubeadm config map if not provided.
 func (shiba *Shiba) initCluster() error {
 	if len(shiba.clusterPodCIDRs) > 0 {
 		log.Infof("cluster has privided pod cidrs %v", util.FormatIPNets(shiba.clusterPodCIDRs))
 		return nil
 	}
+	podCIDRs, err := shiba.getKubeadmPodCIDRs(shiba.client)
+	if err != nil {
+		return fmt.Errorf("cluster pod cidrs not provided: %w", err)
+	}
+	shiba.clusterPodCIDRs = podCIDRs
+	log.Infof("cluster has pod cidrs %v by kubeadm", shiba.clusterPodCIDRs)
+	return nil
+}
+
+// getKubeadmPodCIDRs returns the pod CIDRs of a cluster from its kubeadm config map.
+func (shiba *Shiba) getKubeadmPodCIDRs(client kubernetes.Interface) ([]*net.IPNet, error) {
 	ctx, cancel := shiba.getAPIContext()
 	defer cancel()
-	kubeadmConfig, err := shiba.client.CoreV1().ConfigMaps("kube-system").Get(ctx, "kubeadm-config", metav1.GetOptions{})
+	kubeadmConfig, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "kubeadm-config", metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("cluster pod cidrs not provided, and failed to get kubeadm config")
+		return nil, fmt.Errorf("failed to get kubeadm config: %w", err)
 	}
 	clusterConfig := &model.KubeadmClusterConfiguration{}
 	if err := yaml.Unmarshal([]byte(kubeadmConfig.Data["ClusterConfiguration"]), clusterConfig); err != nil {
-		return fmt.Errorf("failed to unmarshal kubeadm cluster config: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal kubeadm cluster config: %w", err)
 	}
 	podSubnet := clusterConfig.Networking.PodSubnet
 	if len(podSubnet) == 0 {
-		return fmt.Errorf("kubeadm cluster config has empty pod subnet: %w", err)
+		return nil, fmt.Errorf("kubeadm cluster config has empty pod subnet: %w", err)
 	}
 	podCIDRs, err := util.ParseIPNets(strings.Split(podSubnet, ","))
 	if err != nil {
-		return fmt.Errorf("failed to parse pod subnet from kubeadm config: %w", err)
+		return nil, fmt.Errorf("failed to parse pod subnet from kubeadm config: %w", err)
 	}
 	if len(podCIDRs) == 0 {
-		return fmt.Errorf("kubeadm cluster config has empty pod subnet")
+		return nil, fmt.Errorf("kubeadm cluster config has empty pod subnet")
 	}
-	shiba.clusterPodCIDRs = podCIDRs
-	log.Infof("cluster has pod cidrs %v by kubeadm", shiba.clusterPodCIDRs)
-	return nil
+	return podCIDRs, nil
 }
@@ -0,0 +1,283 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	ipamLockFile = "lock" // Locked by host-local while changing allocations.
+	stageIPAM    = "ipam"
+)
+
+// ipamAllocation is an address allocated by host-local, which is a file named by the address.
+type ipamAllocation struct {
+	ip          net.IP
+	containerID string // The pod sandbox the address is allocated to.
+	pod         string // Namespace and name of the pod, only known for pool allocations.
+	path        string
+	modTime     time.Time
+}
+
+// ipamStats is the result of IPAM garbage collection, guarded by ipamLock.
+type ipamStats struct {
+	allocated int
+	stale     int // Stale allocations in the grace period.
+	released  int // Total released allocations.
+}
+
+// runIPAMGC releases the leaked host-local allocations every interval until stopCh is closed.
+func (shiba *Shiba) runIPAMGC(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(shiba.ipamGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			shiba.gcIPAM()
+		}
+	}
+}
+
+// gcIPAM releases the allocations that are not used by pods on the node nor by pod sandboxes of the runtime, once
+// they're older than the grace period. Allocations of pools are collected as well.
+func (shiba *Shiba) gcIPAM() {
+	log.Debug("collecting ipam garbage")
+	shiba.resetPlan(stageIPAM)
+	podIPs, err := shiba.listPodIPs()
+	if err != nil {
+		log.WithError(err).Error("failed to list pods on the node, skipping ipam garbage collection")
+		return
+	}
+	var sandboxes map[string]bool
+	if len(shiba.sandboxStatePath) > 0 {
+		if sandboxes, err = listSandboxes(shiba.sandboxStatePath); err != nil {
+			log.WithError(err).Error("failed to list pod sandboxes, skipping ipam garbage collection")
+			return
+		}
+	}
+	var stats ipamStats
+	shiba.gcIPAMDir(filepath.Join(shiba.ipamDataPath, cniNetName), podIPs, sandboxes, &stats)
+	if len(shiba.ipPools) > 0 {
+		shiba.poolLock.Lock()
+		if shiba.gcIPAMDir(filepath.Join(shiba.ipamDataPath, poolNetName), podIPs, sandboxes, &stats) {
+			if err := shiba.publishPoolIPs(false); err != nil {
+				log.WithError(err).Error("failed to publish pool ips")
+			}
+		}
+		shiba.poolLock.Unlock()
+	}
+	shiba.ipamLock.Lock()
+	shiba.ipamStats.allocated = stats.allocated
+	shiba.ipamStats.stale = stats.stale
+	shiba.ipamStats.released += stats.released
+	shiba.ipamLock.Unlock()
+}
+
+// gcIPAMDir releases the stale allocations in the directory and adds up the stats, returning whether any
+// allocation is released.
+func (shiba *Shiba) gcIPAMDir(dir string, podIPs, sandboxes map[string]bool, stats *ipamStats) bool {
+	allocations, err := listIPAMAllocations(dir)
+	if err != nil {
+		log.WithError(err).Errorf("failed to list ipam allocations in [%s]", dir)
+		return false
+	}
+	stale := findStaleAllocations(allocations, podIPs, sandboxes)
+	var released int
+	for _, allocation := range stale {
+		age := time.Since(allocation.modTime)
+		logger := log.WithFields(log.Fields{
+			fieldCIDR: allocation.ip.String(), fieldContainer: allocation.containerID, fieldOperation: "release",
+		})
+		if age < shiba.ipamGCGracePeriod {
+			logger.Debugf("allocation is stale for %v, waiting for the grace period", age.Round(time.Second))
+			continue
+		}
+		logger.Info("releasing leaked ipam allocation")
+		if err := shiba.apply(stageIPAM, model.Change{
+			Kind: "file", Action: "delete", Target: allocation.path, Detail: allocation.containerID,
+		}, func() error {
+			return releaseIPAMAllocation(dir, allocation)
+		}); err != nil {
+			logger.WithError(err).Error("failed to release ipam allocation")
+			continue
+		}
+		if !shiba.dryRun {
+			released++
+		}
+	}
+	stats.allocated += len(allocations) - released
+	stats.stale += len(stale) - released
+	stats.released += released
+	return released > 0
+}
+
+// findStaleAllocations returns the allocations whose addresses are not used by any pod, and whose sandboxes don't
+// exist if known (sandboxes is not nil).
+func findStaleAllocations(allocations []ipamAllocation, podIPs, sandboxes map[string]bool) []ipamAllocation {
+	var stale []ipamAllocation
+	for _, allocation := range allocations {
+		if podIPs[allocation.ip.String()] {
+			continue
+		}
+		if sandboxes != nil && sandboxes[allocation.containerID] {
+			continue
+		}
+		stale = append(stale, allocation)
+	}
+	return stale
+}
+
+// listIPAMAllocations lists the allocations in the host-local directory of the network.
+func listIPAMAllocations(dir string) ([]ipamAllocation, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // No pod yet.
+		}
+		return nil, err
+	}
+	var allocations []ipamAllocation
+	for _, entry := range entries {
+		ip := net.ParseIP(entry.Name()) // Skips the lock and the last reserved addresses.
+		if ip == nil || entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			continue // Released in the meantime.
+		}
+		containerID, pod := readAllocation(path)
+		allocations = append(allocations, ipamAllocation{
+			ip:          ip,
+			containerID: containerID,
+			pod:         pod,
+			path:        path,
+			modTime:     info.ModTime(),
+		})
+	}
+	return allocations, nil
+}
+
+// readAllocation returns the container ID in the first line of the allocation file, and the pod in the third line
+// if any.
+func readAllocation(path string) (containerID, pod string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for len(lines) < 3 && scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if len(lines) > 0 {
+		containerID = lines[0]
+	}
+	if len(lines) > 2 {
+		pod = lines[2]
+	}
+	return containerID, pod
+}
+
+// lockDir holds the lock of host-local in the directory, which is released by the returned function.
+func lockDir(dir string) (func(), error) {
+	lock, err := os.OpenFile(filepath.Join(dir, ipamLockFile), os.O_RDONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		_ = lock.Close()
+		return nil, fmt.Errorf("failed to lock: %w", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		_ = lock.Close()
+	}, nil
+}
+
+// releaseIPAMAllocation deletes the allocation file holding the lock of host-local, if it's still allocated to the
+// same container.
+func releaseIPAMAllocation(dir string, allocation ipamAllocation) error {
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if containerID, _ := readAllocation(allocation.path); containerID != allocation.containerID {
+		return fmt.Errorf("allocation is taken by another container")
+	}
+	return os.Remove(allocation.path)
+}
+
+// listPodIPs returns the addresses of the non-terminated pods on the node.
+func (shiba *Shiba) listPodIPs() (map[string]bool, error) {
+	ctx, cancel := shiba.getAPIContext()
+	defer cancel()
+	pods, err := shiba.client.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", shiba.nodeName).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	podIPs := make(map[string]bool)
+	for _, pod := range pods.Items {
+		if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			if ip := net.ParseIP(podIP.IP); ip != nil {
+				podIPs[ip.String()] = true
+			}
+		}
+	}
+	return podIPs, nil
+}
+
+// listSandboxes returns the IDs of the running pod sandboxes, which are the directories in the state path of the
+// runtime, like /run/containerd/io.containerd.runtime.v2.task/k8s.io for containerd.
+func listSandboxes(statePath string) (map[string]bool, error) {
+	entries, err := os.ReadDir(statePath)
+	if err != nil {
+		return nil, err
+	}
+	sandboxes := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			sandboxes[entry.Name()] = true
+		}
+	}
+	return sandboxes, nil
+}
+
+func (shiba *Shiba) writeIPAMMetrics(m *util.MetricWriter) {
+	if shiba.ipamGCInterval <= 0 {
+		return
+	}
+	shiba.ipamLock.Lock()
+	stats := shiba.ipamStats
+	shiba.ipamLock.Unlock()
+	m.Header("shiba_ipam_allocated", "gauge", "Number of addresses allocated by host-local on the node.")
+	m.Sample("shiba_ipam_allocated", float64(stats.allocated))
+	m.Header("shiba_ipam_stale", "gauge", "Number of stale allocations waiting for the grace period.")
+	m.Sample("shiba_ipam_stale", float64(stats.stale))
+	m.Header("shiba_ipam_released_total", "counter", "Number of leaked allocations released.")
+	m.Sample("shiba_ipam_released_total", float64(stats.released))
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/moycat/shiba/model"
+)
+
+func TestShiba_gcIPAM(t *testing.T) {
+	dataPath := t.TempDir()
+	dir := filepath.Join(dataPath, cniNetName)
+	assert.NilError(t, os.MkdirAll(dir, 0o755))
+	old := time.Now().Add(-time.Hour)
+	for name, content := range map[string]string{
+		"10.244.1.2":               "running\neth0\n", // IP of a pod.
+		"10.244.1.3":               "sandbox\neth0\n", // Sandbox not reported to the API yet.
+		"10.244.1.4":               "leaked\neth0\n",
+		"fd00:1::4":                "leaked\neth0\n",
+		"last_reserved_ip.0":       "10.244.1.4",
+		ipamLockFile:               "",
+		"10.244.1.5":               "new\neth0\n", // In the grace period.
+		"10.244.1.6":               "done\neth0\n",
+		"last_reserved_ip.1":       "fd00:1::4",
+		"not-an-allocation.backup": "",
+	} {
+		path := filepath.Join(dir, name)
+		assert.NilError(t, os.WriteFile(path, []byte(content), 0o644))
+		if name != "10.244.1.5" {
+			assert.NilError(t, os.Chtimes(path, old, old))
+		}
+	}
+	sandboxPath := t.TempDir()
+	assert.NilError(t, os.Mkdir(filepath.Join(sandboxPath, "sandbox"), 0o755))
+	client := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: "self"},
+			Status: corev1.PodStatus{
+				Phase:  corev1.PodRunning,
+				PodIPs: []corev1.PodIP{{IP: "10.244.1.2"}},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "done", Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: "self"},
+			Status: corev1.PodStatus{
+				Phase:  corev1.PodSucceeded,
+				PodIPs: []corev1.PodIP{{IP: "10.244.1.6"}},
+			},
+		},
+	)
+	shiba := &Shiba{
+		client:            client,
+		nodeName:          "self",
+		plan:              make(model.Plan),
+		ipamGCInterval:    time.Minute,
+		ipamGCGracePeriod: 10 * time.Minute,
+		ipamDataPath:      dataPath,
+		sandboxStatePath:  sandboxPath,
+	}
+	shiba.gcIPAM()
+
+	entries, err := os.ReadDir(dir)
+	assert.NilError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.DeepEqual(t, names, []string{
+		"10.244.1.2", "10.244.1.3", "10.244.1.5", "last_reserved_ip.0", "last_reserved_ip.1", "lock",
+		"not-an-allocation.backup",
+	})
+	assert.Equal(t, shiba.ipamStats, ipamStats{allocated: 3, stale: 1, released: 3})
+}
+
+func TestReleaseIPAMAllocation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "10.244.1.2")
+	assert.NilError(t, os.WriteFile(path, []byte("new\r\neth0"), 0o644))
+	allocation := ipamAllocation{containerID: "old", path: path}
+	assert.ErrorContains(t, releaseIPAMAllocation(dir, allocation), "taken by another container")
+	allocation.containerID = "new"
+	assert.NilError(t, releaseIPAMAllocation(dir, allocation))
+	_, err := os.Stat(path)
+	assert.Assert(t, os.IsNotExist(err))
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/moycat/shiba/model"
+)
+
+// serveIPAM serves the shiba-ipam plugin on the unix socket until stopCh is closed.
+func (shiba *Shiba) serveIPAM(stopCh <-chan struct{}) {
+	if err := os.MkdirAll(filepath.Dir(shiba.ipamSocketPath), 0o755); err != nil {
+		log.WithError(err).Error("failed to create the directory of ipam socket")
+		return
+	}
+	_ = os.Remove(shiba.ipamSocketPath) // Left by the last run.
+	listener, err := net.Listen("unix", shiba.ipamSocketPath)
+	if err != nil {
+		log.WithError(err).Errorf("failed to listen on ipam socket [%s]", shiba.ipamSocketPath)
+		return
+	}
+	server := &http.Server{Handler: http.HandlerFunc(shiba.handleIPAM)}
+	go func() {
+		<-stopCh
+		_ = server.Close()
+	}()
+	log.Infof("serving ipam on [%s]", shiba.ipamSocketPath)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("ipam server failed")
+	}
+}
+
+func (shiba *Shiba) handleIPAM(w http.ResponseWriter, r *http.Request) {
+	var request model.IPAMRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := shiba.processIPAM(request)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithError(err).Error("failed to write ipam response")
+	}
+}
+
+// processIPAM allocates or releases the pool addresses of a pod. Pods without the annotations are delegated to
+// host-local.
+func (shiba *Shiba) processIPAM(request model.IPAMRequest) model.IPAMResponse {
+	podKey := request.Namespace + "/" + request.Name
+	logger := log.WithFields(log.Fields{
+		fieldPod: podKey, fieldContainer: request.ContainerID, fieldOperation: "ipam-" + strings.ToLower(request.Command),
+	})
+	logger.Debug("received ipam request")
+	fail := func(err error) model.IPAMResponse {
+		logger.WithError(err).Error("failed to process ipam request")
+		return model.IPAMResponse{Error: err.Error(), Retry: errors.Is(err, errAddressInUse)}
+	}
+	switch request.Command {
+	case "ADD":
+		ctx, cancel := shiba.getAPIContext()
+		defer cancel()
+		pod, err := shiba.client.CoreV1().Pods(request.Namespace).Get(ctx, request.Name, metav1.GetOptions{})
+		if err != nil {
+			return fail(err)
+		}
+		requests, err := shiba.parsePoolRequests(pod)
+		if err != nil {
+			return fail(err)
+		}
+		if len(requests) == 0 {
+			return model.IPAMResponse{Delegate: true}
+		}
+		addresses, err := shiba.allocatePodIPs(request.ContainerID, request.IfName, pod, requests)
+		if err != nil {
+			return fail(err)
+		}
+		return model.IPAMResponse{IPs: addresses}
+	case "DEL":
+		// Host-local is always called, in case the annotations were added after the pod is created.
+		if _, err := shiba.releasePodIPs(request.ContainerID); err != nil {
+			return fail(err)
+		}
+		return model.IPAMResponse{Delegate: true}
+	case "CHECK":
+		allocated, err := shiba.hasPodIPs(request.ContainerID)
+		if err != nil {
+			return fail(err)
+		}
+		return model.IPAMResponse{Delegate: !allocated}
+	default:
+		return model.IPAMResponse{Error: "unknown command " + request.Command}
+	}
+}
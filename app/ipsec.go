@@ -0,0 +1,513 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/moycat/shiba/model"
+)
+
+const (
+	ipsecKeyPrefix  = "key-"    // Secret data keys of pre-shared keys, followed by the key ID.
+	ipsecCurrentKey = "current" // Secret data key of the ID of the key to encrypt with, the largest ID by default.
+	ipsecMinKeyLen  = 32
+	ipsecAlgo       = "rfc4106(gcm(aes))"
+	ipsecAlgoKeyLen = 36 // 256-bit key and 32-bit salt.
+	ipsecICVLen     = 128
+	ipsecReqID      = 0x5b1ba // Marks the states and policies owned by shiba.
+	ipsecInfo       = "shiba ipsec"
+	ipsecNonceLen   = 16
+	stageIPsec      = "ipsec"
+)
+
+// Upper layer protocols between underlay addresses to encrypt, which are what ip6tnl carries.
+var ipsecProtos = []netlink.Proto{4, 41}
+
+// ipsecKey is a pre-shared key in the IPsec secret.
+type ipsecKey struct {
+	id  int
+	psk []byte
+}
+
+// ipsecKeySet is the keys in the IPsec secret. States are installed for all keys to decrypt,
+// while only the current one is used to encrypt, so keys can be rolled over without downtime.
+type ipsecKeySet struct {
+	keys    []ipsecKey // Sorted by ID.
+	current ipsecKey
+}
+
+// parseIPsecSecret parses the keys from the data of the IPsec secret.
+func parseIPsecSecret(data map[string][]byte) (*ipsecKeySet, error) {
+	keySet := &ipsecKeySet{}
+	var problems []string
+	for key, value := range data {
+		if key == ipsecCurrentKey || !strings.HasPrefix(key, ipsecKeyPrefix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(key, ipsecKeyPrefix))
+		if err != nil || id <= 0 {
+			problems = append(problems, fmt.Sprintf("bad key id in [%s], should be a positive integer", key))
+			continue
+		}
+		if len(value) < ipsecMinKeyLen {
+			problems = append(problems, fmt.Sprintf("key [%s] is shorter than %d bytes", key, ipsecMinKeyLen))
+			continue
+		}
+		keySet.keys = append(keySet.keys, ipsecKey{id: id, psk: value})
+	}
+	sort.Slice(keySet.keys, func(i, j int) bool {
+		return keySet.keys[i].id < keySet.keys[j].id
+	})
+	if len(keySet.keys) == 0 && len(problems) == 0 {
+		problems = append(problems, fmt.Sprintf("no key found, should be set as %s<id>", ipsecKeyPrefix))
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	keySet.current = keySet.keys[len(keySet.keys)-1]
+	if value, ok := data[ipsecCurrentKey]; ok {
+		id, err := strconv.Atoi(strings.TrimSpace(string(value)))
+		found := false
+		for _, key := range keySet.keys {
+			if key.id == id {
+				keySet.current, found = key, true
+			}
+		}
+		if err != nil || !found {
+			return nil, fmt.Errorf("current key [%s] is not found", strings.TrimSpace(string(value)))
+		}
+	}
+	return keySet, nil
+}
+
+// deriveIPsecKey derives the key of traffic from src to dst by HKDF-Expand with the pre-shared key, so each
+// direction of each pair of nodes has its own key. The nonce of the sender changes whenever its outgoing states
+// may be reinstalled, so a key is never used again with the sequence numbers reset, which would reuse GCM nonces.
+func deriveIPsecKey(key ipsecKey, nonce string, src, dst net.IP) []byte {
+	info := ipsecPairInfo(key.id, nonce, src, dst)
+	var derived, last []byte
+	for i := byte(1); len(derived) < ipsecAlgoKeyLen; i++ {
+		mac := hmac.New(sha256.New, key.psk)
+		mac.Write(last)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		last = mac.Sum(nil)
+		derived = append(derived, last...)
+	}
+	return derived[:ipsecAlgoKeyLen]
+}
+
+// ipsecSPI returns the SPI of traffic from src to dst with the key and the nonce of the sender, which both sides
+// agree on. SPIs below 256 are reserved.
+func ipsecSPI(keyID int, nonce string, src, dst net.IP) int {
+	sum := sha256.Sum256(ipsecPairInfo(keyID, nonce, src, dst))
+	spi := int(binary.BigEndian.Uint32(sum[:4]) & 0x7fffffff)
+	if spi < 256 {
+		spi += 256
+	}
+	return spi
+}
+
+func ipsecPairInfo(keyID int, nonce string, src, dst net.IP) []byte {
+	info := []byte(ipsecInfo)
+	info = append(info, src.To16()...)
+	info = append(info, dst.To16()...)
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, uint32(keyID))
+	info = append(info, id...)
+	return append(info, nonce...)
+}
+
+// newIPsecNonce returns a random nonce of the outgoing keys.
+func newIPsecNonce() (string, error) {
+	b := make([]byte, ipsecNonceLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate ipsec nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ipsecStates returns the expected states of a path, the outgoing one with the current key and the local nonce
+// first, then incoming ones with all keys and the nonce of the peer.
+func ipsecStates(keySet *ipsecKeySet, localNonce, remoteNonce string, local, remote net.IP) []netlink.XfrmState {
+	newState := func(key ipsecKey, nonce string, src, dst net.IP) netlink.XfrmState {
+		return netlink.XfrmState{
+			Src:          src,
+			Dst:          dst,
+			Proto:        netlink.XFRM_PROTO_ESP,
+			Mode:         netlink.XFRM_MODE_TRANSPORT,
+			Spi:          ipsecSPI(key.id, nonce, src, dst),
+			Reqid:        ipsecReqID,
+			ReplayWindow: 32,
+			Aead: &netlink.XfrmStateAlgo{
+				Name: ipsecAlgo, Key: deriveIPsecKey(key, nonce, src, dst), ICVLen: ipsecICVLen,
+			},
+		}
+	}
+	states := []netlink.XfrmState{newState(keySet.current, localNonce, local, remote)}
+	for _, key := range keySet.keys {
+		states = append(states, newState(key, remoteNonce, remote, local))
+	}
+	return states
+}
+
+// ipsecPolicies returns the expected policies of a path, requiring ESP for tunneled traffic in both directions.
+func ipsecPolicies(local, remote net.IP) []netlink.XfrmPolicy {
+	var policies []netlink.XfrmPolicy
+	for _, proto := range ipsecProtos {
+		for _, dir := range []netlink.Dir{netlink.XFRM_DIR_OUT, netlink.XFRM_DIR_IN} {
+			src, dst := local, remote
+			if dir == netlink.XFRM_DIR_IN {
+				src, dst = remote, local
+			}
+			policies = append(policies, netlink.XfrmPolicy{
+				Src:   &net.IPNet{IP: src, Mask: net.CIDRMask(128, 128)},
+				Dst:   &net.IPNet{IP: dst, Mask: net.CIDRMask(128, 128)},
+				Proto: proto,
+				Dir:   dir,
+				Tmpls: []netlink.XfrmPolicyTmpl{{
+					Src:   src,
+					Dst:   dst,
+					Proto: netlink.XFRM_PROTO_ESP,
+					Mode:  netlink.XFRM_MODE_TRANSPORT,
+					Reqid: ipsecReqID,
+				}},
+			})
+		}
+	}
+	return policies
+}
+
+func ipsecStateID(state netlink.XfrmState) string {
+	return fmt.Sprintf("%s>%s spi %#x", state.Src, state.Dst, state.Spi)
+}
+
+func ipsecPolicyID(policy netlink.XfrmPolicy) string {
+	return fmt.Sprintf("%s>%s proto %d dir %s", policy.Src, policy.Dst, policy.Proto, policy.Dir)
+}
+
+// syncIPsec makes the XFRM states and policies match the paths to peers, so traffic through the tunnels is
+// encrypted. States and policies of removed peers or keys are deleted. Peers without a nonce get the policies
+// but no states, so the traffic to them is dropped instead of sent in plain text.
+func (shiba *Shiba) syncIPsec(nodeMap model.NodeMap) {
+	shiba.ipsecLock.Lock()
+	keySet, nonce := shiba.ipsecKeySet, shiba.ipsecNonce
+	shiba.ipsecLock.Unlock()
+	if keySet == nil {
+		return
+	}
+	log.Info("syncing ipsec")
+	shiba.resetPlan(stageIPsec)
+	var (
+		states   []netlink.XfrmState
+		policies []netlink.XfrmPolicy
+		outgoing []string
+	)
+	for _, node := range nodeMap {
+		for _, path := range shiba.nodePaths(node) {
+			if path.Local == nil || path.Remote == nil {
+				continue
+			}
+			policies = append(policies, ipsecPolicies(path.Local, path.Remote)...)
+			if len(node.IPsecNonce) == 0 {
+				peerLog(node.Key(), "sync-ipsec").Warning("peer has no ipsec nonce, dropping the traffic to it")
+				continue
+			}
+			pathStates := ipsecStates(keySet, nonce, node.IPsecNonce, path.Local, path.Remote)
+			outgoing = append(outgoing, ipsecStateID(pathStates[0]))
+			states = append(states, pathStates...)
+		}
+	}
+	existingStates, err := netlink.XfrmStateList(netlink.FAMILY_V6)
+	if err != nil {
+		log.WithError(err).Error("failed to list xfrm states")
+		shiba.recordSyncError(stageIPsec, fmt.Errorf("failed to list xfrm states: %w", err))
+		return
+	}
+	existingPolicies, err := netlink.XfrmPolicyList(netlink.FAMILY_V6)
+	if err != nil {
+		log.WithError(err).Error("failed to list xfrm policies")
+		shiba.recordSyncError(stageIPsec, fmt.Errorf("failed to list xfrm policies: %w", err))
+		return
+	}
+	existing := make(map[string]bool, len(existingStates))
+	for _, state := range existingStates {
+		if state.Reqid == ipsecReqID {
+			existing[ipsecStateID(state)] = true
+		}
+	}
+	// An outgoing state installed before with the same nonce starts over from sequence number 1 if installed again,
+	// reusing the GCM nonces of the same key, so the nonce is rotated to reinstall all outgoing states with new keys.
+	if !shiba.dryRun && shiba.ipsecReinstalls(outgoing, existing) {
+		log.Warning("outgoing xfrm states are gone, rotating the ipsec nonce")
+		if err := shiba.rotateIPsecNonce(); err != nil {
+			log.WithError(err).Error("failed to rotate ipsec nonce")
+			shiba.recordSyncError(stageIPsec, fmt.Errorf("failed to rotate ipsec nonce: %w", err))
+			return
+		}
+		shiba.fire()
+		return
+	}
+	added := shiba.reconcileIPsec(states, policies, existingStates, existingPolicies)
+	if shiba.dryRun {
+		return
+	}
+	shiba.ipsecLock.Lock()
+	defer shiba.ipsecLock.Unlock()
+	for _, id := range outgoing {
+		if existing[id] || added[id] {
+			shiba.ipsecInstalled[id] = true
+		}
+	}
+}
+
+// ipsecReinstalls returns whether any outgoing state installed with the current nonce is to be installed again.
+func (shiba *Shiba) ipsecReinstalls(outgoing []string, existing map[string]bool) bool {
+	shiba.ipsecLock.Lock()
+	defer shiba.ipsecLock.Unlock()
+	for _, id := range outgoing {
+		if !existing[id] && shiba.ipsecInstalled[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileIPsec installs the expected states and policies owned by shiba, and deletes the others.
+// It returns the IDs of the states added.
+func (shiba *Shiba) reconcileIPsec(states []netlink.XfrmState, policies []netlink.XfrmPolicy,
+	existingStates []netlink.XfrmState, existingPolicies []netlink.XfrmPolicy) map[string]bool {
+	// States are installed before the policies referring to them, and deleted after.
+	stateMap := make(map[string]netlink.XfrmState)
+	for _, state := range existingStates {
+		if state.Reqid == ipsecReqID {
+			stateMap[ipsecStateID(state)] = state
+		}
+	}
+	added := make(map[string]bool)
+	expectedStates := make(map[string]bool, len(states))
+	for _, state := range states {
+		state := state
+		id := ipsecStateID(state)
+		expectedStates[id] = true
+		existing, ok := stateMap[id]
+		if ok && existing.Aead != nil && bytes.Equal(existing.Aead.Key, state.Aead.Key) {
+			continue
+		}
+		action, fn := "add", netlink.XfrmStateAdd
+		if ok {
+			action, fn = "update", netlink.XfrmStateUpdate
+		}
+		logger := log.WithFields(log.Fields{fieldPath: id, fieldOperation: action + "-state"})
+		logger.Info("installing xfrm state")
+		if err := shiba.apply(stageIPsec, model.Change{Kind: "xfrm-state", Action: action, Target: id}, func() error {
+			return fn(&state)
+		}); err != nil {
+			logger.WithError(err).Error("failed to install xfrm state")
+			continue
+		}
+		added[id] = true
+	}
+	policyMap := make(map[string]netlink.XfrmPolicy)
+	for _, policy := range existingPolicies {
+		if len(policy.Tmpls) > 0 && policy.Tmpls[0].Reqid == ipsecReqID {
+			policyMap[ipsecPolicyID(policy)] = policy
+		}
+	}
+	expectedPolicies := make(map[string]bool, len(policies))
+	for _, policy := range policies {
+		policy := policy
+		id := ipsecPolicyID(policy)
+		expectedPolicies[id] = true
+		if _, ok := policyMap[id]; ok {
+			continue
+		}
+		logger := log.WithFields(log.Fields{fieldPath: id, fieldOperation: "add-policy"})
+		logger.Info("installing xfrm policy")
+		if err := shiba.apply(stageIPsec, model.Change{Kind: "xfrm-policy", Action: "add", Target: id}, func() error {
+			return netlink.XfrmPolicyUpdate(&policy)
+		}); err != nil {
+			logger.WithError(err).Error("failed to install xfrm policy")
+		}
+	}
+	for id, policy := range policyMap {
+		if expectedPolicies[id] {
+			continue
+		}
+		policy := policy
+		logger := log.WithFields(log.Fields{fieldPath: id, fieldOperation: "delete-policy"})
+		logger.Info("deleting xfrm policy")
+		if err := shiba.apply(stageIPsec, model.Change{Kind: "xfrm-policy", Action: "delete", Target: id}, func() error {
+			return netlink.XfrmPolicyDel(&policy)
+		}); err != nil {
+			logger.WithError(err).Error("failed to delete xfrm policy")
+		}
+	}
+	for id, state := range stateMap {
+		if expectedStates[id] {
+			continue
+		}
+		state := state
+		logger := log.WithFields(log.Fields{fieldPath: id, fieldOperation: "delete-state"})
+		logger.Info("deleting xfrm state")
+		if err := shiba.apply(stageIPsec, model.Change{Kind: "xfrm-state", Action: "delete", Target: id}, func() error {
+			return netlink.XfrmStateDel(&state)
+		}); err != nil {
+			logger.WithError(err).Error("failed to delete xfrm state")
+		}
+	}
+	return added
+}
+
+// removeIPsec removes the states and policies left by a previous run with IPsec enabled.
+func (shiba *Shiba) removeIPsec() {
+	shiba.resetPlan(stageIPsec)
+	existingStates, err := netlink.XfrmStateList(netlink.FAMILY_V6)
+	if err != nil {
+		log.WithError(err).Warning("failed to list xfrm states, not removing ipsec")
+		return
+	}
+	existingPolicies, err := netlink.XfrmPolicyList(netlink.FAMILY_V6)
+	if err != nil {
+		log.WithError(err).Warning("failed to list xfrm policies, not removing ipsec")
+		return
+	}
+	shiba.reconcileIPsec(nil, nil, existingStates, existingPolicies)
+}
+
+// rotateIPsecNonce publishes a new nonce, so all outgoing states are installed again with new keys and SPIs.
+// Peers install the incoming states when they see the new nonce.
+func (shiba *Shiba) rotateIPsecNonce() error {
+	nonce, err := newIPsecNonce()
+	if err != nil {
+		return err
+	}
+	if !shiba.dryRun {
+		if err := shiba.annotateNode(map[string]interface{}{ipsecNonceAnnotation: nonce}); err != nil {
+			return fmt.Errorf("failed to publish ipsec nonce: %w", err)
+		}
+	}
+	shiba.ipsecLock.Lock()
+	shiba.ipsecNonce, shiba.ipsecInstalled = nonce, make(map[string]bool)
+	shiba.ipsecLock.Unlock()
+	log.Infof("ipsec nonce is rotated to [%s]", nonce)
+	return nil
+}
+
+// initIPsec loads the keys from the IPsec secret. Unlike the runtime config, it's required if set,
+// so traffic is never sent in plain text by mistake.
+func (shiba *Shiba) initIPsec() error {
+	if len(shiba.ipsecSecretName) == 0 {
+		return nil
+	}
+	ctx, cancel := shiba.getAPIContext()
+	defer cancel()
+	secret, err := shiba.client.CoreV1().Secrets(shiba.ipsecSecretNamespace).Get(ctx, shiba.ipsecSecretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get ipsec secret [%s/%s]: %w", shiba.ipsecSecretNamespace, shiba.ipsecSecretName, err)
+	}
+	keySet, err := parseIPsecSecret(secret.Data)
+	if err != nil {
+		return fmt.Errorf("bad ipsec secret [%s/%s]: %w", shiba.ipsecSecretNamespace, shiba.ipsecSecretName, err)
+	}
+	shiba.ipsecKeySet = keySet
+	log.Infof("loaded %d ipsec keys, encrypting with key %d", len(keySet.keys), keySet.current.id)
+	// The states of the last run may have been used with the last nonce, so a new one is published on every start.
+	return shiba.rotateIPsecNonce()
+}
+
+// watchIPsecSecret reloads the keys when the IPsec secret changes until stopCh is closed.
+// The last keys are kept if the secret is deleted or becomes invalid.
+func (shiba *Shiba) watchIPsecSecret(stopCh <-chan struct{}) {
+	listOptions := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", shiba.ipsecSecretName).String()}
+	for {
+		watcher, err := shiba.client.CoreV1().Secrets(shiba.ipsecSecretNamespace).Watch(context.Background(), listOptions)
+		if err != nil {
+			log.WithError(err).Errorf("failed to watch ipsec secret [%s/%s]", shiba.ipsecSecretNamespace, shiba.ipsecSecretName)
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(configRetryInterval):
+				continue
+			}
+		}
+		if !shiba.reloadIPsecKeys(stopCh, watcher) {
+			return
+		}
+		log.Info("watch channel of ipsec secret closed")
+	}
+}
+
+// reloadIPsecKeys returns false if stopCh is closed.
+func (shiba *Shiba) reloadIPsecKeys(stopCh <-chan struct{}, watcher watch.Interface) bool {
+	defer watcher.Stop()
+	watcherCh := watcher.ResultChan()
+	for {
+		select {
+		case <-stopCh:
+			return false
+		case event, ok := <-watcherCh:
+			if !ok {
+				return true
+			}
+			secret, ok := event.Object.(*corev1.Secret)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				log.Warningf("ipsec secret [%s/%s] is deleted, keeping the last keys", secret.Namespace, secret.Name)
+				continue
+			}
+			keySet, err := parseIPsecSecret(secret.Data)
+			if err != nil {
+				log.WithError(err).Errorf("rejected invalid ipsec secret [%s/%s], keeping the last keys",
+					secret.Namespace, secret.Name)
+				if shiba.recorder != nil {
+					shiba.recorder.Eventf(secret, corev1.EventTypeWarning, "InvalidSecret",
+						"Node %s rejected the ipsec keys: %v", shiba.nodeName, err)
+				}
+				continue
+			}
+			shiba.ipsecLock.Lock()
+			changed := !keySet.equals(shiba.ipsecKeySet)
+			shiba.ipsecKeySet = keySet
+			shiba.ipsecLock.Unlock()
+			if changed {
+				log.Infof("reloaded %d ipsec keys, encrypting with key %d", len(keySet.keys), keySet.current.id)
+				shiba.fire()
+			}
+		}
+	}
+}
+
+func (keySet *ipsecKeySet) equals(other *ipsecKeySet) bool {
+	if other == nil || len(keySet.keys) != len(other.keys) || keySet.current.id != other.current.id {
+		return false
+	}
+	for i := range keySet.keys {
+		if keySet.keys[i].id != other.keys[i].id || !bytes.Equal(keySet.keys[i].psk, other.keys[i].psk) {
+			return false
+		}
+	}
+	return true
+}
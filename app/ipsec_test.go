@@ -0,0 +1,74 @@
+package app
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseIPsecSecret(t *testing.T) {
+	psk1 := bytes.Repeat([]byte{1}, ipsecMinKeyLen)
+	psk2 := bytes.Repeat([]byte{2}, ipsecMinKeyLen)
+
+	keySet, err := parseIPsecSecret(map[string][]byte{"key-2": psk2, "key-1": psk1})
+	assert.NilError(t, err)
+	assert.Equal(t, len(keySet.keys), 2)
+	assert.Equal(t, keySet.keys[0].id, 1)
+	assert.Equal(t, keySet.current.id, 2) // The largest by default.
+
+	keySet, err = parseIPsecSecret(map[string][]byte{"key-2": psk2, "key-1": psk1, "current": []byte("1\n")})
+	assert.NilError(t, err)
+	assert.Equal(t, keySet.current.id, 1)
+
+	_, err = parseIPsecSecret(map[string][]byte{"key-1": psk1, "current": []byte("3")})
+	assert.ErrorContains(t, err, "current key [3] is not found")
+	_, err = parseIPsecSecret(map[string][]byte{"key-x": psk1, "key-2": []byte("short")})
+	assert.ErrorContains(t, err, "bad key id in [key-x]")
+	assert.ErrorContains(t, err, "key [key-2] is shorter than 32 bytes")
+	_, err = parseIPsecSecret(map[string][]byte{"other": psk1})
+	assert.ErrorContains(t, err, "no key found")
+}
+
+func TestIPsecStates(t *testing.T) {
+	key1 := ipsecKey{id: 1, psk: bytes.Repeat([]byte{1}, ipsecMinKeyLen)}
+	key2 := ipsecKey{id: 2, psk: bytes.Repeat([]byte{2}, ipsecMinKeyLen)}
+	keySet := &ipsecKeySet{keys: []ipsecKey{key1, key2}, current: key2}
+	a, b := net.ParseIP("2001:db8::a"), net.ParseIP("2001:db8::b")
+
+	// Both sides agree on each direction, which has its own key.
+	statesA := ipsecStates(keySet, "nonce-a", "nonce-b", a, b)
+	statesB := ipsecStates(keySet, "nonce-b", "nonce-a", b, a)
+	assert.Equal(t, len(statesA), 3) // Outgoing with the current key, incoming with all keys.
+	assert.Equal(t, ipsecStateID(statesA[0]), ipsecStateID(statesB[2]))
+	assert.DeepEqual(t, statesA[0].Aead.Key, statesB[2].Aead.Key)
+	assert.Equal(t, len(statesA[0].Aead.Key), ipsecAlgoKeyLen)
+	assert.Assert(t, !bytes.Equal(deriveIPsecKey(key2, "", a, b), deriveIPsecKey(key2, "", b, a)))
+	assert.Assert(t, !bytes.Equal(deriveIPsecKey(key1, "", a, b), deriveIPsecKey(key2, "", a, b)))
+	assert.Assert(t, ipsecSPI(1, "", a, b) != ipsecSPI(2, "", a, b))
+	assert.Assert(t, ipsecSPI(1, "", a, b) >= 256)
+
+	// A new nonce of the sender gives new keys and SPIs to its outgoing traffic only.
+	rotatedA := ipsecStates(keySet, "nonce-a2", "nonce-b", a, b)
+	assert.Assert(t, ipsecStateID(rotatedA[0]) != ipsecStateID(statesA[0]))
+	assert.Assert(t, !bytes.Equal(rotatedA[0].Aead.Key, statesA[0].Aead.Key))
+	assert.Equal(t, ipsecStateID(rotatedA[1]), ipsecStateID(statesA[1]))
+
+	policies := ipsecPolicies(a, b)
+	assert.Equal(t, len(policies), 4)
+	for _, policy := range policies {
+		assert.Equal(t, policy.Tmpls[0].Reqid, ipsecReqID)
+		if policy.Dir == netlink.XFRM_DIR_IN {
+			assert.Assert(t, policy.Src.IP.Equal(b) && policy.Dst.IP.Equal(a))
+		}
+	}
+}
+
+func TestShiba_ipsecReinstalls(t *testing.T) {
+	s := &Shiba{ipsecInstalled: map[string]bool{"a>b spi 0x100": true}}
+	assert.Assert(t, !s.ipsecReinstalls([]string{"a>b spi 0x100"}, map[string]bool{"a>b spi 0x100": true}))
+	assert.Assert(t, !s.ipsecReinstalls([]string{"a>c spi 0x200"}, nil), "never installed")
+	assert.Assert(t, s.ipsecReinstalls([]string{"a>b spi 0x100"}, nil), "installed before and gone")
+}
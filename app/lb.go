@@ -0,0 +1,579 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	// LoadBalancerClass is the class of services served by shiba. Services without a class are only served if
+	// enabled explicitly, so shiba never competes with another implementation for them.
+	LoadBalancerClass    = "shiba.io/l2"
+	loadBalancerLease    = "shiba-lb-allocator"
+	stageLoadBalancer    = "loadbalancer"
+	leaseDuration        = 15 * time.Second
+	leaseRenewDeadline   = 10 * time.Second
+	leaseRetryPeriod     = 2 * time.Second
+	infiniteAddrLifetime = 0xffffffff
+)
+
+// loadBalancer allocates the ingress IPs of LoadBalancer services from the pools on the leader of the lease, and
+// announces the IPs of each service from one ready node elected among all nodes by the service (L2 mode).
+type loadBalancer struct {
+	shiba          *Shiba
+	cidrs          []*net.IPNet
+	ifName         string
+	classless      bool // Whether to serve services without a load balancer class.
+	services       cache.SharedIndexInformer
+	endpointSlices cache.SharedIndexInformer
+	nodes          cache.SharedIndexInformer // All nodes, so every node elects from the same candidates.
+	leading        bool                      // Whether to allocate IPs.
+	lock           sync.Mutex
+	stopped        bool // Guarded by syncLock.
+	syncLock       sync.Mutex
+	fireCh         chan struct{}
+}
+
+func newLoadBalancer(shiba *Shiba, cidrs []*net.IPNet, ifName string, classless bool) *loadBalancer {
+	lb := &loadBalancer{
+		shiba:          shiba,
+		cidrs:          cidrs,
+		ifName:         ifName,
+		classless:      classless,
+		services:       shiba.informers.Core().V1().Services().Informer(),
+		endpointSlices: shiba.informers.Discovery().V1().EndpointSlices().Informer(),
+		nodes:          shiba.informers.Core().V1().Nodes().Informer(),
+		fireCh:         make(chan struct{}, 1),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { lb.fire() },
+		UpdateFunc: func(interface{}, interface{}) { lb.fire() },
+		DeleteFunc: func(interface{}) { lb.fire() },
+	}
+	lb.services.AddEventHandler(handler)
+	lb.endpointSlices.AddEventHandler(handler)
+	lb.nodes.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { lb.fire() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Nodes are updated often, but only the readiness and the selection matter.
+			oldNode, newNode := oldObj.(*corev1.Node), newObj.(*corev1.Node)
+			if util.IsNodeReady(oldNode) != util.IsNodeReady(newNode) ||
+				!reflect.DeepEqual(oldNode.Labels, newNode.Labels) ||
+				!reflect.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints) {
+				lb.fire()
+			}
+		},
+		DeleteFunc: func(interface{}) { lb.fire() },
+	})
+	return lb
+}
+
+// initLoadBalancer checks the pools and the interface to announce the IPs on.
+func (shiba *Shiba) initLoadBalancer(cidrs []*net.IPNet, ifName string, classless bool) error {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	for _, cidr := range cidrs {
+		for _, podCIDR := range shiba.clusterPodCIDRs {
+			if cidr.Contains(podCIDR.IP) || podCIDR.Contains(cidr.IP) {
+				return fmt.Errorf("load balancer cidr [%s] overlaps pod cidr [%s]", cidr, podCIDR)
+			}
+		}
+	}
+	if _, err := netlink.LinkByName(ifName); err != nil {
+		return fmt.Errorf("failed to get load balancer interface [%s]: %w", ifName, err)
+	}
+	shiba.loadBalancer = newLoadBalancer(shiba, cidrs, ifName, classless)
+	log.Infof("load balancer ips are allocated from %v and announced on [%s]", util.FormatIPNets(cidrs), ifName)
+	return nil
+}
+
+// run keeps the allocation and announcement in sync with the services, endpoint slices and nodes until stopCh is
+// closed.
+func (lb *loadBalancer) run(stopCh <-chan struct{}) {
+	// Electing from a partial list of nodes would announce the IPs from more than one node.
+	if !cache.WaitForCacheSync(stopCh, lb.services.HasSynced, lb.endpointSlices.HasSynced, lb.nodes.HasSynced) {
+		return
+	}
+	log.Info("load balancer started")
+	lb.fire()
+	if lb.shiba.dryRun {
+		lb.setLeading(true) // Only planned, so it never holds the lease.
+	} else {
+		go lb.elect(stopCh)
+	}
+	ticker := time.NewTicker(fireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			lb.fire()
+		case <-lb.fireCh:
+			time.Sleep(executeGracePeriod)
+			select {
+			case <-lb.fireCh:
+			default:
+			}
+			lb.sync()
+		}
+	}
+}
+
+// elect campaigns for the lease of the allocator until stopCh is closed.
+func (lb *loadBalancer) elect(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: loadBalancerLease, Namespace: lb.shiba.configNamespace},
+		Client:     lb.shiba.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: lb.shiba.nodeName},
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   leaseRenewDeadline,
+			RetryPeriod:     leaseRetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            loadBalancerLease,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					log.Info("became the load balancer ip allocator")
+					lb.setLeading(true)
+					lb.fire()
+				},
+				OnStoppedLeading: func() {
+					log.Info("stopped being the load balancer ip allocator")
+					lb.setLeading(false)
+				},
+			},
+		})
+	}
+}
+
+func (lb *loadBalancer) fire() {
+	select {
+	case lb.fireCh <- struct{}{}:
+	default:
+	}
+}
+
+func (lb *loadBalancer) setLeading(leading bool) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	lb.leading = leading
+}
+
+// cleanup withdraws all announced IPs and stops syncing, so other nodes take over the services.
+func (lb *loadBalancer) cleanup() {
+	lb.syncLock.Lock()
+	defer lb.syncLock.Unlock()
+	lb.stopped = true
+	lb.announce(nil, nil)
+}
+
+func (lb *loadBalancer) sync() {
+	lb.syncLock.Lock()
+	defer lb.syncLock.Unlock()
+	if lb.stopped {
+		return
+	}
+	log.Debug("syncing load balancer")
+	lb.shiba.resetPlan(stageLoadBalancer)
+	lb.lock.Lock()
+	leading := lb.leading
+	lb.lock.Unlock()
+	services := make(map[string]*corev1.Service)
+	for _, object := range lb.services.GetStore().List() {
+		svc := object.(*corev1.Service)
+		services[svc.Namespace+"/"+svc.Name] = svc
+	}
+	endpointSlices := make(map[string]*discoveryv1.EndpointSlice)
+	for _, object := range lb.endpointSlices.GetStore().List() {
+		slice := object.(*discoveryv1.EndpointSlice)
+		endpointSlices[slice.Namespace+"/"+slice.Name] = slice
+	}
+	if leading {
+		lb.allocate(services)
+	}
+	lb.announce(services, endpointSlices)
+}
+
+// allocate updates the ingress IPs of the services from the pools.
+func (lb *loadBalancer) allocate(services map[string]*corev1.Service) {
+	allocations, problems := allocateLoadBalancerIPs(lb.cidrs, services, lb.classless)
+	for key, err := range problems {
+		log.WithField(fieldService, key).WithError(err).Error("failed to allocate load balancer ip")
+		if lb.shiba.recorder != nil {
+			lb.shiba.recorder.Eventf(services[key], corev1.EventTypeWarning, "AllocationFailed",
+				"Failed to allocate load balancer IP: %v", err)
+		}
+	}
+	for key, ips := range allocations {
+		svc := services[key].DeepCopy()
+		var ingress []corev1.LoadBalancerIngress
+		for _, entry := range svc.Status.LoadBalancer.Ingress {
+			if !lb.inPools(net.ParseIP(entry.IP)) {
+				ingress = append(ingress, entry) // Not ours.
+			}
+		}
+		for _, ip := range ips {
+			ingress = append(ingress, corev1.LoadBalancerIngress{IP: ip})
+		}
+		svc.Status.LoadBalancer.Ingress = ingress
+		logger := log.WithFields(log.Fields{fieldService: key, fieldOperation: "allocate"})
+		logger.Infof("setting load balancer ips to %v", ips)
+		if err := lb.shiba.apply(stageLoadBalancer, model.Change{
+			Kind: "service", Action: "update-status", Target: key, Detail: strings.Join(ips, ","),
+		}, func() error {
+			ctx, cancel := lb.shiba.getAPIContext()
+			defer cancel()
+			_, err := lb.shiba.client.CoreV1().Services(svc.Namespace).UpdateStatus(ctx, svc, metav1.UpdateOptions{})
+			return err
+		}); err != nil {
+			logger.WithError(err).Error("failed to update load balancer ips")
+		}
+	}
+}
+
+// announce makes the IPs of the services announced by this node the only ones from the pools on the interface.
+func (lb *loadBalancer) announce(services map[string]*corev1.Service,
+	endpointSlices map[string]*discoveryv1.EndpointSlice) {
+	expected := make(map[string]net.IP)
+	for key, svc := range services {
+		if !isShibaLoadBalancer(svc, lb.classless) {
+			continue
+		}
+		var ips []net.IP
+		for _, entry := range svc.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(entry.IP); lb.inPools(ip) {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) == 0 || electAnnouncer(key, lb.candidates(svc, endpointSlices)) != lb.shiba.nodeName {
+			continue
+		}
+		for _, ip := range ips {
+			expected[ip.String()] = ip
+		}
+	}
+	link, err := netlink.LinkByName(lb.ifName)
+	if err != nil {
+		log.WithError(err).Errorf("failed to get load balancer interface [%s]", lb.ifName)
+		return
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		log.WithError(err).Errorf("failed to list addresses of [%s]", lb.ifName)
+		return
+	}
+	for _, addr := range addrs {
+		if ones, bits := addr.Mask.Size(); ones != bits || !lb.inPools(addr.IP) {
+			continue
+		}
+		if _, ok := expected[addr.IP.String()]; ok {
+			delete(expected, addr.IP.String())
+			continue
+		}
+		addr := addr
+		logger := log.WithFields(log.Fields{fieldCIDR: addr.IPNet.String(), fieldOperation: "withdraw"})
+		logger.Info("withdrawing load balancer ip")
+		if err := lb.shiba.apply(stageLoadBalancer, model.Change{
+			Kind: "addr", Action: "delete", Target: lb.ifName, Detail: addr.IPNet.String(),
+		}, func() error {
+			return netlink.AddrDel(link, &addr)
+		}); err != nil {
+			logger.WithError(err).Error("failed to withdraw load balancer ip")
+		}
+	}
+	for _, ip := range expected {
+		addr := &netlink.Addr{
+			IPNet: hostPrefix(ip),
+			// Deprecated, so it's never chosen as the source address.
+			PreferedLft: 0,
+			ValidLft:    infiniteAddrLifetime,
+		}
+		if ip.To4() == nil {
+			addr.Flags = syscall.IFA_F_NODAD
+		}
+		logger := log.WithFields(log.Fields{fieldCIDR: addr.IPNet.String(), fieldOperation: "announce"})
+		logger.Info("announcing load balancer ip")
+		if err := lb.shiba.apply(stageLoadBalancer, model.Change{
+			Kind: "addr", Action: "add", Target: lb.ifName, Detail: addr.IPNet.String(),
+		}, func() error {
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return err
+			}
+			return util.AnnounceIP(lb.ifName, ip)
+		}); err != nil {
+			logger.WithError(err).Error("failed to announce load balancer ip")
+		}
+	}
+}
+
+// candidates returns the nodes eligible to announce the service, the ready nodes selected by shiba. Only nodes
+// with ready endpoints of the service are eligible if its external traffic policy is Local.
+func (lb *loadBalancer) candidates(svc *corev1.Service, endpointSlices map[string]*discoveryv1.EndpointSlice) []string {
+	var endpointNodes map[string]bool
+	if svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal {
+		endpointNodes = serviceEndpointNodes(svc, endpointSlices)
+	}
+	var nodes []string
+	for _, object := range lb.nodes.GetStore().List() {
+		node := object.(*corev1.Node)
+		if !util.IsNodeReady(node) || !lb.shiba.isNodeSelected(node) {
+			continue
+		}
+		if endpointNodes == nil || endpointNodes[node.Name] {
+			nodes = append(nodes, node.Name)
+		}
+	}
+	return nodes
+}
+
+func (lb *loadBalancer) inPools(ip net.IP) bool {
+	for _, cidr := range lb.cidrs {
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isShibaLoadBalancer returns whether the service is a LoadBalancer served by shiba, of the class of shiba, or
+// without a class if classless is set.
+func isShibaLoadBalancer(svc *corev1.Service, classless bool) bool {
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return false
+	}
+	if svc.Spec.LoadBalancerClass == nil {
+		return classless
+	}
+	return *svc.Spec.LoadBalancerClass == LoadBalancerClass
+}
+
+// electAnnouncer returns the node announcing the service, the one with the highest hash of the service and the
+// node, so all nodes agree with the same candidates, and only the services of a lost node move. Empty if there's
+// no candidate.
+func electAnnouncer(key string, candidates []string) string {
+	var (
+		elected string
+		highest [sha256.Size]byte
+	)
+	for _, node := range candidates {
+		hash := sha256.Sum256([]byte(key + "/" + node))
+		if len(elected) == 0 || string(hash[:]) > string(highest[:]) {
+			elected, highest = node, hash
+		}
+	}
+	return elected
+}
+
+// serviceEndpointNodes returns the nodes with ready endpoints of the service.
+func serviceEndpointNodes(svc *corev1.Service, endpointSlices map[string]*discoveryv1.EndpointSlice) map[string]bool {
+	nodes := make(map[string]bool)
+	for _, slice := range endpointSlices {
+		if slice.Namespace != svc.Namespace || slice.Labels[discoveryv1.LabelServiceName] != svc.Name {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if endpoint.NodeName != nil {
+				nodes[*endpoint.NodeName] = true
+			}
+		}
+	}
+	return nodes
+}
+
+// allocateLoadBalancerIPs returns the IPs from the pools to set as the ingress of each service whose IPs are
+// missing or taken, and the problems of the services that can't be fully served. Services are served in the order
+// of creation, so older ones keep their IPs in conflicts. Services no longer served get no IPs. Each service gets
+// an IP of each of its families, spec.loadBalancerIP if set, or a free one that is stable for the service.
+func allocateLoadBalancerIPs(cidrs []*net.IPNet, services map[string]*corev1.Service, classless bool) (
+	map[string][]string, map[string]error) {
+	keys := make([]string, 0, len(services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := services[keys[i]].CreationTimestamp, services[keys[j]].CreationTimestamp
+		if !a.Equal(&b) {
+			return a.Before(&b)
+		}
+		return keys[i] < keys[j]
+	})
+	inPools := func(ip net.IP) bool {
+		for _, cidr := range cidrs {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	current := make(map[string][]net.IP, len(keys))
+	for _, key := range keys {
+		for _, entry := range services[key].Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(entry.IP); inPools(ip) {
+				current[key] = append(current[key], ip)
+			}
+		}
+	}
+
+	// Keep the current IPs first, so no IP in use is given to another service.
+	used := make(map[string]string) // IP -> the service.
+	kept := make(map[string]map[*ipFamily]net.IP, len(keys))
+	for _, key := range keys {
+		kept[key] = make(map[*ipFamily]net.IP)
+		if !isShibaLoadBalancer(services[key], classless) {
+			continue
+		}
+		families := serviceFamilies(services[key])
+		for _, ip := range current[key] {
+			family := familyOf(ip)
+			if _, ok := used[ip.String()]; ok || kept[key][family] != nil || !containsFamily(families, family) {
+				continue
+			}
+			used[ip.String()] = key
+			kept[key][family] = ip
+		}
+	}
+
+	allocations := make(map[string][]string)
+	problems := make(map[string]error)
+	for _, key := range keys {
+		svc := services[key]
+		if !isShibaLoadBalancer(svc, classless) {
+			if len(current[key]) > 0 {
+				allocations[key] = nil
+			}
+			continue
+		}
+		requested := net.ParseIP(svc.Spec.LoadBalancerIP)
+		var ips []string
+		var failures []string
+		for _, family := range serviceFamilies(svc) {
+			ip := kept[key][family]
+			if ip != nil && requested != nil && familyOf(requested) == family && !ip.Equal(requested) {
+				delete(used, ip.String()) // The requested IP is changed.
+				ip = nil
+			}
+			if ip == nil {
+				var err error
+				if ip, err = allocateServiceIP(cidrs, key, family, requested, used); err != nil {
+					failures = append(failures, err.Error())
+					continue
+				}
+				used[ip.String()] = key
+			}
+			ips = append(ips, ip.String())
+		}
+		if len(failures) > 0 {
+			problems[key] = errors.New(strings.Join(failures, "; "))
+		}
+		if formatIPStrings(current[key]) != strings.Join(ips, ",") {
+			allocations[key] = ips
+		}
+	}
+	return allocations, problems
+}
+
+// allocateServiceIP returns the requested IP if it's of the family, or a free IP of the family from the pools.
+func allocateServiceIP(cidrs []*net.IPNet, key string, family *ipFamily, requested net.IP,
+	used map[string]string) (net.IP, error) {
+	if requested != nil && familyOf(requested) == family {
+		for _, cidr := range cidrs {
+			if !cidr.Contains(requested) {
+				continue
+			}
+			if owner, ok := used[requested.String()]; ok {
+				return nil, fmt.Errorf("requested ip [%s] is used by [%s]", requested, owner)
+			}
+			return requested, nil
+		}
+		return nil, fmt.Errorf("requested ip [%s] is not in any pool", requested)
+	}
+	var found bool
+	for _, cidr := range cidrs {
+		if familyOf(cidr.IP) != family {
+			continue
+		}
+		found = true
+		if ip := nextFreeIP(cidr, key, func(ip net.IP) bool {
+			_, ok := used[ip.String()]
+			return ok
+		}); ip != nil {
+			return ip, nil
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no %s pool", family.name)
+	}
+	return nil, fmt.Errorf("no free %s address", family.name)
+}
+
+// serviceFamilies returns the IP families of the service in order, IPv4 if unknown.
+func serviceFamilies(svc *corev1.Service) []*ipFamily {
+	var families []*ipFamily
+	for _, ipFamily := range svc.Spec.IPFamilies {
+		switch ipFamily {
+		case corev1.IPv4Protocol:
+			families = append(families, familyV4)
+		case corev1.IPv6Protocol:
+			families = append(families, familyV6)
+		}
+	}
+	if len(families) == 0 {
+		if ip := net.ParseIP(svc.Spec.ClusterIP); ip != nil && ip.To4() == nil {
+			return []*ipFamily{familyV6}
+		}
+		return []*ipFamily{familyV4}
+	}
+	return families
+}
+
+func containsFamily(families []*ipFamily, family *ipFamily) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+func formatIPStrings(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ",")
+}
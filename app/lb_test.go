@@ -0,0 +1,171 @@
+package app
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/moycat/shiba/util"
+)
+
+func TestAllocateLoadBalancerIPs(t *testing.T) {
+	cidrs, err := util.ParseIPNets([]string{"192.0.2.0/30", "2001:db8::/126"})
+	assert.NilError(t, err)
+	created := time.Now()
+	service := func(name string, age int, families []corev1.IPFamily, ingress ...string) *corev1.Service {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(created.Add(-time.Duration(age) * time.Hour)),
+			},
+			Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, IPFamilies: families},
+		}
+		for _, ip := range ingress {
+			svc.Status.LoadBalancer.Ingress = append(svc.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+		}
+		return svc
+	}
+	v4 := []corev1.IPFamily{corev1.IPv4Protocol}
+	dual := []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}
+	services := map[string]*corev1.Service{
+		"default/old":   service("old", 3, v4, "192.0.2.1"),
+		"default/dual":  service("dual", 2, dual, "192.0.2.2"),
+		"default/taken": service("taken", 1, v4, "192.0.2.1"), // Conflicts with the older one.
+		"default/full":  service("full", 0, v4),
+	}
+	other := "example.com/other"
+	services["default/other"] = service("other", 0, v4, "192.0.2.3")
+	services["default/other"].Spec.LoadBalancerClass = &other
+
+	allocations, problems := allocateLoadBalancerIPs(cidrs, services, true)
+	// The old one is kept, and the IP of the other class is released.
+	_, ok := allocations["default/old"]
+	assert.Assert(t, !ok)
+	assert.DeepEqual(t, allocations["default/other"], []string(nil))
+	// IPv6 is added in the order of families.
+	assert.Equal(t, len(allocations["default/dual"]), 2)
+	assert.Equal(t, allocations["default/dual"][1], "192.0.2.2")
+	assert.Assert(t, cidrs[1].Contains(net.ParseIP(allocations["default/dual"][0])))
+	// The pool is exhausted, and the taken IP is removed.
+	assert.DeepEqual(t, allocations["default/taken"], []string(nil))
+	assert.ErrorContains(t, problems["default/taken"], "no free ipv4 address")
+	_, ok = allocations["default/full"]
+	assert.Assert(t, !ok)
+	assert.ErrorContains(t, problems["default/full"], "no free ipv4 address")
+
+	// The requested IP replaces the current one.
+	services = map[string]*corev1.Service{"default/old": service("old", 3, v4, "192.0.2.1")}
+	services["default/old"].Spec.LoadBalancerIP = "192.0.2.2"
+	allocations, problems = allocateLoadBalancerIPs(cidrs, services, true)
+	assert.DeepEqual(t, allocations["default/old"], []string{"192.0.2.2"})
+	assert.Equal(t, len(problems), 0)
+	services["default/old"].Spec.LoadBalancerIP = "198.51.100.1"
+	_, problems = allocateLoadBalancerIPs(cidrs, services, true)
+	assert.ErrorContains(t, problems["default/old"], "not in any pool")
+
+	// Services without a class are released unless served explicitly.
+	services = map[string]*corev1.Service{"default/old": service("old", 3, v4, "192.0.2.1")}
+	allocations, _ = allocateLoadBalancerIPs(cidrs, services, false)
+	assert.DeepEqual(t, allocations["default/old"], []string(nil))
+	class := LoadBalancerClass
+	services["default/old"].Spec.LoadBalancerClass = &class
+	allocations, _ = allocateLoadBalancerIPs(cidrs, services, false)
+	assert.Equal(t, len(allocations), 0)
+}
+
+func TestLoadBalancer_candidates(t *testing.T) {
+	selector, err := newNodeSelector("")
+	assert.NilError(t, err)
+	shiba := &Shiba{
+		nodeName:      "self",
+		informers:     informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0),
+		nodeSelector:  selector,
+		excludeTaints: []string{"example.com/no-overlay"},
+	}
+	lb := newLoadBalancer(shiba, nil, "eth0", false)
+	node := func(name string, ready bool) *corev1.Node {
+		status := corev1.ConditionTrue
+		if !ready {
+			status = corev1.ConditionFalse
+		}
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		node.Status.Conditions = []corev1.NodeCondition{{Type: corev1.NodeReady, Status: status}}
+		return node
+	}
+	excluded := node("self", true) // Unselected nodes never announce, even the current one.
+	excluded.Spec.Taints = []corev1.Taint{{Key: "example.com/no-overlay", Effect: corev1.TaintEffectNoSchedule}}
+	for _, n := range []*corev1.Node{excluded, node("ready", true), node("not-ready", false), node("local", true)} {
+		assert.NilError(t, lb.nodes.GetStore().Add(n))
+	}
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	candidates := lb.candidates(svc, nil)
+	sort.Strings(candidates)
+	assert.DeepEqual(t, candidates, []string{"local", "ready"})
+
+	local := "local"
+	svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyTypeLocal
+	assert.DeepEqual(t, lb.candidates(svc, map[string]*discoveryv1.EndpointSlice{"default/web-abcde": {
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "web-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "web"},
+		},
+		Endpoints: []discoveryv1.Endpoint{{NodeName: &local}},
+	}}), []string{"local"})
+}
+
+func TestElectAnnouncer(t *testing.T) {
+	assert.Equal(t, electAnnouncer("default/web", nil), "")
+	nodes := []string{"a", "b", "c", "d"}
+	elected := electAnnouncer("default/web", nodes)
+	// The order of candidates doesn't matter.
+	assert.Equal(t, electAnnouncer("default/web", []string{"d", "c", "b", "a"}), elected)
+	// Only the services of a lost node move.
+	var remaining []string
+	for _, node := range nodes {
+		if node != elected {
+			remaining = append(remaining, node)
+		}
+	}
+	for _, key := range []string{"default/a", "default/b", "default/c", "default/d", "default/e"} {
+		if before := electAnnouncer(key, nodes); before != elected {
+			assert.Equal(t, electAnnouncer(key, remaining), before, key)
+		}
+	}
+}
+
+func TestServiceEndpointNodes(t *testing.T) {
+	self, other, notReady := "self", "other", "not-ready"
+	ready, unready := true, false
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	endpointSlices := map[string]*discoveryv1.EndpointSlice{
+		"default/web-abcde": {
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "web-abcde",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+			},
+			Endpoints: []discoveryv1.Endpoint{
+				{NodeName: &self},
+				{NodeName: &other, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+				{NodeName: &notReady, Conditions: discoveryv1.EndpointConditions{Ready: &unready}},
+			},
+		},
+		"default/api-abcde": {
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "api-abcde",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "api"},
+			},
+			Endpoints: []discoveryv1.Endpoint{{NodeName: &notReady}},
+		},
+	}
+	assert.DeepEqual(t, serviceEndpointNodes(svc, endpointSlices), map[string]bool{self: true, other: true})
+}
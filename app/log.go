@@ -0,0 +1,28 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Keys of structured log fields.
+const (
+	fieldPeer      = "peer"
+	fieldTunnel    = "tunnel"
+	fieldCIDR      = "cidr"
+	fieldOperation = "operation"
+	fieldEvent     = "event"
+	fieldPath      = "path"
+	fieldContainer = "container"
+	fieldPod       = "pod"
+	fieldService   = "service"
+)
+
+// peerLog returns the logger with the peer and the operation on it.
+func peerLog(peer, operation string) *log.Entry {
+	return log.WithFields(log.Fields{fieldPeer: peer, fieldOperation: operation})
+}
+
+// tunnelLog returns the logger with the tunnel to the peer and the operation on it.
+func tunnelLog(peer, tunnel, operation string) *log.Entry {
+	return log.WithFields(log.Fields{fieldPeer: peer, fieldTunnel: tunnel, fieldOperation: operation})
+}
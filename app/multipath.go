@@ -0,0 +1,236 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+// pairUnderlayIPs pairs the local and remote underlay addresses into paths.
+// With underlay CIDRs, the first addresses of both sides in each CIDR are paired, so each fabric gets a path.
+// Otherwise, the addresses are paired in order. The first addresses are paired if nothing else matches.
+func pairUnderlayIPs(local, remote []net.IP, cidrs []*net.IPNet) []model.Path {
+	if len(local) == 0 || len(remote) == 0 {
+		return nil
+	}
+	var paths []model.Path
+	if len(cidrs) > 0 {
+		for _, cidr := range cidrs {
+			localIP, remoteIP := firstIPIn(local, cidr), firstIPIn(remote, cidr)
+			if localIP != nil && remoteIP != nil {
+				paths = append(paths, model.Path{Local: localIP, Remote: remoteIP})
+			}
+		}
+	} else {
+		for i := 0; i < len(local) && i < len(remote); i++ {
+			paths = append(paths, model.Path{Local: local[i], Remote: remote[i]})
+		}
+	}
+	if len(paths) == 0 {
+		paths = append(paths, model.Path{Local: local[0], Remote: remote[0]})
+	}
+	return paths
+}
+
+func firstIPIn(ips []net.IP, cidr *net.IPNet) net.IP {
+	for _, ip := range ips {
+		if cidr.Contains(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// findNodePaths returns the underlay address of the node and the paths to it without tunnel names.
+// The paths are nil if multi-path is disabled, and the address is nil if not found.
+func (shiba *Shiba) findNodePaths(node *corev1.Node) (net.IP, []model.Path) {
+	if !shiba.multipath {
+		return shiba.nodeIPPolicy.FindNodeIPv6(node), nil
+	}
+	paths := pairUnderlayIPs(shiba.nodeIPs, shiba.nodeIPPolicy.FindNodeIPv6s(node), shiba.nodeIPPolicy.PreferredCIDRs)
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return paths[0].Remote, paths
+}
+
+// nodePaths returns the paths to the node, which is a single one through the node IP if not in multi-path mode.
+func (shiba *Shiba) nodePaths(node *model.Node) []model.Path {
+	if len(node.Paths) > 0 {
+		return node.Paths
+	}
+	return []model.Path{{Local: shiba.nodeIP, Remote: node.IP, Tunnel: node.Tunnel}}
+}
+
+// usablePaths returns the paths whose local underlay address is on an up interface, or all if none is.
+func (shiba *Shiba) usablePaths(paths []model.Path) []model.Path {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("failed to list links: %v", err)
+		return paths
+	}
+	upMap := make(map[string]bool) // Address -> whether its link is up.
+	for _, link := range links {
+		if strings.HasPrefix(link.Attrs().Name, tunnelPrefix) {
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+		if err != nil {
+			log.Errorf("failed to get addr list of link [%s]: %v", link.Attrs().Name, err)
+			continue
+		}
+		up := link.Attrs().Flags&net.FlagUp != 0 && link.Attrs().OperState != netlink.OperDown
+		for _, addr := range addrs {
+			upMap[addr.IP.String()] = up
+		}
+	}
+	var usable []model.Path
+	for _, path := range paths {
+		if !upMap[path.Local.String()] {
+			log.Debugf("uplink of local address [%s] of tunnel [%s] is down", path.Local, path.Tunnel)
+			continue
+		}
+		usable = append(usable, path)
+	}
+	if len(usable) == 0 {
+		return paths
+	}
+	return usable
+}
+
+// syncMultipathRoutes routes the pod CIDRs of the node through the tunnels of all usable paths.
+func (shiba *Shiba) syncMultipathRoutes(node *model.Node, paths []model.Path) {
+	var (
+		nexthops []*netlink.NexthopInfo
+		tunnels  []string
+	)
+	for _, path := range shiba.usablePaths(paths) {
+		link, err := netlink.LinkByName(path.Tunnel)
+		if err != nil {
+			if !shiba.dryRun {
+				log.Errorf("failed to get tunnel [%s] to node [%s]: %v", path.Tunnel, node.Name, err)
+				shiba.recordSyncError(stageRoutes, fmt.Errorf("failed to get tunnel [%s]: %w", path.Tunnel, err))
+				continue
+			}
+			link = &netlink.Ip6tnl{} // The tunnel is only planned.
+		} else {
+			shiba.deleteTunnelRoutes(node, path.Tunnel, link) // Multi-path routes are not bound to a link.
+		}
+		nexthops = append(nexthops, &netlink.NexthopInfo{LinkIndex: link.Attrs().Index})
+		tunnels = append(tunnels, path.Tunnel)
+	}
+	if len(nexthops) == 0 {
+		return
+	}
+	for _, podCIDR := range node.PodCIDRs {
+		route := netlink.Route{Dst: podCIDR, MultiPath: nexthops, Protocol: routeProtocol, Table: shiba.routeTable}
+		if shiba.isMultipathRouteInSync(route) {
+			log.Debugf("multi-path route to [%s] on node [%s] exists", podCIDR, node.Name)
+			continue
+		}
+		log.Infof("setting multi-path route to [%s] on node [%s] via tunnels %v", podCIDR, node.Name, tunnels)
+		if err := shiba.apply(stageRoutes, model.Change{
+			Kind: "route", Action: "replace", Target: podCIDR.String(),
+			Detail: fmt.Sprintf("nexthops %s (node %s)", strings.Join(tunnels, ","), node.Name),
+		}, func() error {
+			return netlink.RouteReplace(&route)
+		}); err != nil {
+			log.Errorf("failed to set multi-path route to [%s] on node [%s]: %v", podCIDR, node.Name, err)
+		}
+	}
+}
+
+// deleteTunnelRoutes deletes the single-path routes on the tunnel to a multi-path node.
+func (shiba *Shiba) deleteTunnelRoutes(node *model.Node, tunnel string, link netlink.Link) {
+	routes, err := shiba.listTunnelRoutes(link)
+	if err != nil {
+		log.Errorf("failed to list routes of tunnel [%s] to node [%s]: %v", tunnel, node.Name, err)
+		shiba.recordSyncError(stageRoutes, fmt.Errorf("failed to list routes of tunnel [%s]: %w", tunnel, err))
+		return
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.Protocol != routeProtocol {
+			continue
+		}
+		log.Debugf("deleting single-path route on tunnel [%s]: %v", tunnel, route)
+		route := route
+		if err := shiba.apply(stageRoutes, model.Change{
+			Kind: "route", Action: "delete", Target: tunnel, Detail: route.String(),
+		}, func() error {
+			return netlink.RouteDel(&route)
+		}); err != nil {
+			log.Errorf("failed to delete route on tunnel [%s]: %v", tunnel, err)
+		}
+	}
+}
+
+func (shiba *Shiba) isMultipathRouteInSync(route netlink.Route) bool {
+	family := netlink.FAMILY_V6
+	if util.IsV4(route.Dst.IP) {
+		family = netlink.FAMILY_V4
+	}
+	routes, err := shiba.listRoutes(family, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Errorf("failed to list routes to [%s]: %v", route.Dst, err)
+		return false
+	}
+	if len(routes) != 1 || routes[0].Protocol != route.Protocol || len(routes[0].MultiPath) != len(route.MultiPath) {
+		return false
+	}
+	existing := make([]int, 0, len(route.MultiPath))
+	expected := make([]int, 0, len(route.MultiPath))
+	for i := range route.MultiPath {
+		existing = append(existing, routes[0].MultiPath[i].LinkIndex)
+		expected = append(expected, route.MultiPath[i].LinkIndex)
+	}
+	sort.Ints(existing)
+	sort.Ints(expected)
+	for i := range expected {
+		if existing[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// watchUplinks triggers a sync when a non-tunnel link goes up or down, so multi-path routes can fail over.
+func (shiba *Shiba) watchUplinks(stopCh <-chan struct{}) {
+	updateCh := make(chan netlink.LinkUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.LinkSubscribe(updateCh, done); err != nil {
+		log.Errorf("failed to subscribe link updates, multi-path routes won't fail over in time: %v", err)
+		return
+	}
+	upMap := make(map[string]bool)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case update, ok := <-updateCh:
+			if !ok {
+				log.Warning("link update channel closed")
+				return
+			}
+			name := update.Attrs().Name
+			if strings.HasPrefix(name, tunnelPrefix) {
+				continue
+			}
+			up := update.Attrs().Flags&net.FlagUp != 0 && update.Attrs().OperState != netlink.OperDown
+			if last, ok := upMap[name]; ok && last == up {
+				continue
+			}
+			upMap[name] = up
+			log.Infof("link [%s] changed, up: %v", name, up)
+			shiba.fire()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package app
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func TestPairUnderlayIPs(t *testing.T) {
+	local := []net.IP{net.ParseIP("2001:db8:a::1"), net.ParseIP("2001:db8:b::1")}
+	remote := []net.IP{net.ParseIP("2001:db8:b::2"), net.ParseIP("2001:db8:a::2")}
+	// Paired in order.
+	assert.DeepEqual(t, pairUnderlayIPs(local, remote, nil), []model.Path{
+		{Local: local[0], Remote: remote[0]},
+		{Local: local[1], Remote: remote[1]},
+	})
+	// Paired by fabric.
+	cidrs, err := util.ParseIPNets([]string{"2001:db8:a::/48", "2001:db8:b::/48"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pairUnderlayIPs(local, remote, cidrs), []model.Path{
+		{Local: local[0], Remote: remote[1]},
+		{Local: local[1], Remote: remote[0]},
+	})
+	// Nothing in the same fabric.
+	assert.DeepEqual(t, pairUnderlayIPs(local[:1], remote[:1], cidrs), []model.Path{
+		{Local: local[0], Remote: remote[0]},
+	})
+	assert.Assert(t, pairUnderlayIPs(local, nil, cidrs) == nil)
+}
+
+func TestShiba_parseNode_multipath(t *testing.T) {
+	s := &Shiba{
+		multipath: true,
+		nodeIPs:   []net.IP{net.ParseIP("2001:db8:a::1"), net.ParseIP("2001:db8:b::1")},
+	}
+	node := newTestNode("node-1", "2001:db8:a::2", "10.0.1.0/24")
+	node.Status.Addresses = append(node.Status.Addresses,
+		corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "2001:db8:b::2"})
+	parsedNode := s.parseNode(model.SourceCluster, node)
+	assert.Assert(t, parsedNode != nil)
+	assert.Equal(t, len(parsedNode.Paths), 2)
+	assert.Equal(t, parsedNode.Paths[0].Tunnel, parsedNode.Tunnel)
+	assert.Assert(t, parsedNode.Paths[1].Tunnel != parsedNode.Tunnel)
+	assert.Assert(t, parsedNode.IP.Equal(net.ParseIP("2001:db8:a::2")))
+	assert.Assert(t, parsedNode.Paths[1].Local.Equal(net.ParseIP("2001:db8:b::1")))
+	assert.Assert(t, parsedNode.Paths[1].Remote.Equal(net.ParseIP("2001:db8:b::2")))
+	assert.Equal(t, len(s.nodePaths(parsedNode)), 2)
+
+	s.multipath = false
+	parsedNode = s.parseNode(model.SourceCluster, node)
+	assert.Assert(t, parsedNode.Paths == nil)
+	assert.Equal(t, len(s.nodePaths(parsedNode)), 1)
+}
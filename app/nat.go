@@ -2,59 +2,169 @@ package app
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
+	"github.com/moycat/shiba/model"
 	"github.com/moycat/shiba/util"
 	log "github.com/sirupsen/logrus"
 )
 
+// remoteExclusionComment marks the NAT exclusions of the pod CIDRs of remote clusters.
+const remoteExclusionComment = "shiba remote pod cidrs"
+
 // initNAT sets up NAT for cluster pod CIDRs using iptables.
 func (shiba *Shiba) initNAT() error {
+	shiba.resetPlan(stageNAT)
 	addRules := func(tables *util.Tables, chain string, subnets []string) error {
-		if err := tables.NewChainUnique("nat", chain); err != nil {
+		if err := shiba.newChainUnique(tables, "nat", chain); err != nil {
 			return fmt.Errorf("failed to create a unique chain: %w", err)
 		}
-		if err := tables.AppendUnique("nat", chain, "-p", "tcp", "-m", "tcp", "--tcp-flags", "SYN,RST", "SYN",
+		if err := shiba.appendUnique(tables, "nat", chain, "-p", "tcp", "-m", "tcp", "--tcp-flags", "SYN,RST", "SYN",
 			"-j", "TCPMSS", "--clamp-mss-to-pmtu"); err != nil {
 			return fmt.Errorf("failed to enable tcp mss clamping: %w", err)
 		}
-		if err := tables.AppendUnique("nat", chain, "-j", "MASQUERADE"); err != nil {
+		if err := shiba.appendUnique(tables, "nat", chain, "-j", "MASQUERADE"); err != nil {
 			return fmt.Errorf("failed to append the nat rule: %w", err)
 		}
 		for _, subnet := range subnets {
 			log.Debugf("adding nat rules for [%s]", subnet)
 			// NAT if traffic comes from the subnet.
-			if err := tables.AppendUnique("nat", "POSTROUTING", "--src", subnet, "-j", chain); err != nil {
+			if err := shiba.appendUnique(tables, "nat", "POSTROUTING", "--src", subnet, "-j", chain); err != nil {
 				return fmt.Errorf("failed to redirect outgoing traffic from [%s]: %w", subnet, err)
 			}
 			// However, skip if traffic goes to the subnet.
-			if err := tables.InsertUnique("nat", chain, 1, "--dst", subnet, "-j", "RETURN"); err != nil {
+			if err := shiba.insertUnique(tables, "nat", chain, 1, "--dst", subnet, "-j", "RETURN"); err != nil {
 				return fmt.Errorf("failed to add nat exclusion rule for [%s]: %w", subnet, err)
 			}
 		}
 		return nil
 	}
-	var v4Subnets, v6Subnets []string
-	for _, cidr := range shiba.clusterPodCIDRs {
-		switch {
-		case util.IsV4(cidr.IP):
-			v4Subnets = append(v4Subnets, cidr.String())
-		case util.IsV6(cidr.IP):
-			v6Subnets = append(v6Subnets, cidr.String())
-		default:
-			return fmt.Errorf("[%s] is neither ipv4 or ipv6 subnet", cidr.String())
-		}
+	split, err := splitByFamily(shiba.clusterPodCIDRs)
+	if err != nil {
+		return err
 	}
-	if len(v4Subnets) > 0 {
-		if err := addRules(util.V4tables, iptablesChain, v4Subnets); err != nil {
-			return fmt.Errorf("failed to setup nat for v4 subnets: %w", err)
+	for _, family := range ipFamilies {
+		if len(split[family]) == 0 {
+			continue
+		}
+		var subnets []string
+		for _, subnet := range split[family] {
+			subnets = append(subnets, subnet.String())
 		}
-		log.Info("ipv4 nat rules are ready")
+		if err := addRules(family.tables, iptablesChain, subnets); err != nil {
+			return fmt.Errorf("failed to setup nat for %s subnets: %w", family.name, err)
+		}
+		log.Infof("%s nat rules are ready", family.name)
+	}
+	if err := shiba.syncRemoteExclusions(); err != nil {
+		return fmt.Errorf("failed to exclude remote pod cidrs: %w", err)
+	}
+	return nil
+}
+
+// syncRemoteExclusions excludes the pod CIDRs of remote clusters from NAT, since they are reached directly as well.
+func (shiba *Shiba) syncRemoteExclusions() error {
+	var cidrs []*net.IPNet
+	for _, cluster := range shiba.remoteClusters {
+		cidrs = append(cidrs, cluster.getPodCIDRs()...)
 	}
-	if len(v6Subnets) > 0 {
-		if err := addRules(util.V6tables, iptablesChain, v6Subnets); err != nil {
-			return fmt.Errorf("failed to setup nat for v6 subnets: %w", err)
+	return shiba.syncNATExclusions(remoteExclusionComment, cidrs)
+}
+
+// syncNATExclusions makes the exclusion rules with the comment in the NAT chain match the CIDRs.
+func (shiba *Shiba) syncNATExclusions(comment string, cidrs []*net.IPNet) error {
+	split, err := splitByFamily(cidrs)
+	if err != nil {
+		return err
+	}
+	clusterSplit, err := splitByFamily(shiba.clusterPodCIDRs)
+	if err != nil {
+		return err
+	}
+	for _, family := range ipFamilies {
+		if len(clusterSplit[family]) == 0 {
+			continue // No NAT chain of the family.
+		}
+		expected := make(map[string]bool)
+		for _, cidr := range split[family] {
+			expected[cidr.String()] = true
+		}
+		rules, err := family.tables.List("nat", iptablesChain)
+		if err != nil && !shiba.dryRun {
+			return fmt.Errorf("failed to list %s nat rules: %w", family.name, err)
+		}
+		for _, rule := range rules {
+			if !strings.Contains(rule, comment) {
+				continue
+			}
+			cidr := parseRuleDestination(rule)
+			if expected[cidr] {
+				delete(expected, cidr)
+				continue
+			}
+			log.Infof("removing nat exclusion [%s] for [%s]", comment, cidr)
+			if err := shiba.apply(stageNAT, model.Change{
+				Kind: "rule", Action: "delete", Target: fmt.Sprintf("%s/nat/%s", family.tables.Name(), iptablesChain),
+				Detail: strings.Join(exclusionRuleSpec(comment, cidr), " "),
+			}, func() error {
+				return family.tables.Delete("nat", iptablesChain, exclusionRuleSpec(comment, cidr)...)
+			}); err != nil {
+				return fmt.Errorf("failed to remove nat exclusion for [%s]: %w", cidr, err)
+			}
+		}
+		for cidr := range expected {
+			log.Infof("adding nat exclusion [%s] for [%s]", comment, cidr)
+			spec := exclusionRuleSpec(comment, cidr)
+			if err := shiba.insertUnique(family.tables, "nat", iptablesChain, 1, spec...); err != nil {
+				return fmt.Errorf("failed to add nat exclusion for [%s]: %w", cidr, err)
+			}
 		}
-		log.Info("ipv6 nat rules are ready")
 	}
 	return nil
 }
+
+func (shiba *Shiba) newChainUnique(tables *util.Tables, table, chain string) error {
+	if !shiba.dryRun {
+		return tables.NewChainUnique(table, chain)
+	}
+	exists, err := tables.ChainExists(table, chain)
+	if err != nil || exists {
+		return err
+	}
+	return shiba.apply(stageNAT, model.Change{
+		Kind: "chain", Action: "add", Target: fmt.Sprintf("%s/%s/%s", tables.Name(), table, chain),
+	}, nil)
+}
+
+func (shiba *Shiba) appendUnique(tables *util.Tables, table, chain string, rulespec ...string) error {
+	if !shiba.dryRun {
+		return tables.AppendUnique(table, chain, rulespec...)
+	}
+	return shiba.planRule(tables, "append", table, chain, rulespec)
+}
+
+func (shiba *Shiba) insertUnique(tables *util.Tables, table, chain string, pos int, rulespec ...string) error {
+	if !shiba.dryRun {
+		return tables.InsertUnique(table, chain, pos, rulespec...)
+	}
+	return shiba.planRule(tables, fmt.Sprintf("insert@%d", pos), table, chain, rulespec)
+}
+
+// planRule records a rule change if the rule doesn't exist yet.
+func (shiba *Shiba) planRule(tables *util.Tables, action, table, chain string, rulespec []string) error {
+	exists, err := tables.Exists(table, chain, rulespec...)
+	if err != nil {
+		// The chain may be only planned, thus not existing.
+		exists = false
+	}
+	if exists {
+		return nil
+	}
+	return shiba.apply(stageNAT, model.Change{
+		Kind:   "rule",
+		Action: action,
+		Target: fmt.Sprintf("%s/%s/%s", tables.Name(), table, chain),
+		Detail: strings.Join(rulespec, " "),
+	}, nil)
+}
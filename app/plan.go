@@ -0,0 +1,92 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/moycat/shiba/model"
+)
+
+const (
+	stageCNI     = "cni"
+	stageNAT     = "nat"
+	stageTunnels = "tunnels"
+	stageRoutes  = "routes"
+)
+
+// apply runs fn to make the change, or only records it in dry-run mode. A failure is recorded as the error of the
+// stage.
+func (shiba *Shiba) apply(stage string, change model.Change, fn func() error) error {
+	if !shiba.dryRun {
+		err := fn()
+		if err != nil {
+			shiba.recordSyncError(stage, fmt.Errorf("failed to %s %s [%s]: %w", change.Action, change.Kind,
+				change.Target, err))
+		}
+		return err
+	}
+	log.Infof("[dry-run] would %s %s [%s] %s", change.Action, change.Kind, change.Target, change.Detail)
+	shiba.planLock.Lock()
+	shiba.plan[stage] = append(shiba.plan[stage], change)
+	shiba.planLock.Unlock()
+	return nil
+}
+
+// resetPlan drops the recorded changes and errors of a stage before it's computed again.
+func (shiba *Shiba) resetPlan(stage string) {
+	shiba.planLock.Lock()
+	defer shiba.planLock.Unlock()
+	delete(shiba.syncErrors, stage)
+	if shiba.dryRun {
+		shiba.plan[stage] = nil
+	}
+}
+
+// recordSyncError records the last error of a stage until it's computed again.
+func (shiba *Shiba) recordSyncError(stage string, err error) {
+	shiba.planLock.Lock()
+	defer shiba.planLock.Unlock()
+	if shiba.syncErrors == nil {
+		shiba.syncErrors = make(map[string]error)
+	}
+	shiba.syncErrors[stage] = err
+}
+
+// syncErrorMessages returns the errors of the stages that failed, in the order of the stages.
+func (shiba *Shiba) syncErrorMessages(stages ...string) []string {
+	shiba.planLock.Lock()
+	defer shiba.planLock.Unlock()
+	var messages []string
+	for _, stage := range stages {
+		if err := shiba.syncErrors[stage]; err != nil {
+			messages = append(messages, fmt.Sprintf("%s: %v", stage, err))
+		}
+	}
+	return messages
+}
+
+func (shiba *Shiba) clonePlan() model.Plan {
+	shiba.planLock.Lock()
+	defer shiba.planLock.Unlock()
+	plan := make(model.Plan, len(shiba.plan))
+	for stage, changes := range shiba.plan {
+		plan[stage] = append([]model.Change(nil), changes...)
+	}
+	return plan
+}
+
+func (shiba *Shiba) servePlan(w http.ResponseWriter, _ *http.Request) {
+	if !shiba.dryRun {
+		http.Error(w, "shiba is not running in dry-run mode", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(shiba.clonePlan()); err != nil {
+		log.Errorf("failed to write plan: %v", err)
+	}
+}
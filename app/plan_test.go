@@ -0,0 +1,28 @@
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/moycat/shiba/model"
+)
+
+func TestShiba_apply(t *testing.T) {
+	change := model.Change{Kind: "link", Action: "add", Target: "shiba.test"}
+	s := &Shiba{plan: make(model.Plan)}
+	err := s.apply(stageTunnels, change, func() error { return errors.New("applied") })
+	assert.Error(t, err, "applied")
+	assert.Equal(t, len(s.clonePlan()[stageTunnels]), 0)
+	assert.DeepEqual(t, s.syncErrorMessages(stageTunnels), []string{"tunnels: failed to add link [shiba.test]: applied"})
+	s.resetPlan(stageTunnels)
+	assert.Equal(t, len(s.syncErrorMessages(stageTunnels)), 0)
+
+	s.dryRun = true
+	err = s.apply(stageTunnels, change, func() error { return errors.New("applied") })
+	assert.NilError(t, err)
+	assert.DeepEqual(t, s.clonePlan()[stageTunnels], []model.Change{change})
+	s.resetPlan(stageTunnels)
+	assert.Equal(t, len(s.clonePlan()[stageTunnels]), 0)
+}
@@ -0,0 +1,448 @@
+package app
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	// IPAMPluginType is the type of the IPAM plugin asking shiba for the addresses of pods, which delegates to
+	// host-local for pods not requesting a static IP or a pool. It's the shiba binary named so.
+	IPAMPluginType = "shiba-ipam"
+	poolNetName    = "shiba-pools" // Allocations of pools are kept in this directory under the IPAM data path.
+	maxPoolScan    = 1 << 16       // Addresses to try before a pool is considered exhausted.
+)
+
+// errAddressInUse means the requested address is still used by another pod, which is retried by the runtime.
+var errAddressInUse = errors.New("address is in use")
+
+// IPPool is a named range of pod addresses, which pods request by the shiba.io/ip-pool annotation.
+type IPPool struct {
+	Name string
+	// CIDR is the range of a cluster-wide pool, whose addresses are routed to the nodes of their pods.
+	// Nil for a node-local pool.
+	CIDR *net.IPNet
+	// PrefixLen is the size of a node-local pool, which is carved from the end of the node pod CIDR.
+	// The pool is IPv4 if it's at most 32, or IPv6 otherwise.
+	PrefixLen int
+}
+
+// ParseIPPool parses a pool in the form of name=cidr for a cluster-wide pool, or name=/prefix-length for a
+// node-local pool.
+func ParseIPPool(spec string) (IPPool, error) {
+	name, value, ok := strings.Cut(spec, "=")
+	if !ok || len(name) == 0 || len(value) == 0 || strings.ContainsAny(name, "/,") {
+		return IPPool{}, fmt.Errorf("bad ip pool [%s], should be name=cidr or name=/prefix-length", spec)
+	}
+	if strings.HasPrefix(value, "/") {
+		prefixLen, err := strconv.Atoi(value[1:])
+		if err != nil || prefixLen <= 0 || prefixLen > 128 {
+			return IPPool{}, fmt.Errorf("bad prefix length of ip pool [%s]", spec)
+		}
+		return IPPool{Name: name, PrefixLen: prefixLen}, nil
+	}
+	_, cidr, err := net.ParseCIDR(value)
+	if err != nil {
+		return IPPool{}, fmt.Errorf("bad cidr of ip pool [%s]: %w", spec, err)
+	}
+	return IPPool{Name: name, CIDR: cidr}, nil
+}
+
+// initPools finds the ranges of the pools on the node, and republishes the addresses of cluster-wide pools
+// allocated on the node. Cluster-wide pools are treated as cluster pod CIDRs.
+func (shiba *Shiba) initPools() error {
+	if len(shiba.ipPools) == 0 {
+		return nil
+	}
+	var err error
+	shiba.poolCIDRs, shiba.poolRangeEnds, err = carveNodePools(shiba.ipPools, shiba.nodePodCIDRs)
+	if err != nil {
+		return err
+	}
+	for _, pool := range shiba.ipPools {
+		if pool.CIDR == nil {
+			log.Infof("node-local ip pool [%s] is [%s]", pool.Name, shiba.poolCIDRs[pool.Name])
+			continue
+		}
+		for _, cidr := range shiba.clusterPodCIDRs {
+			if cidr.Contains(pool.CIDR.IP) || pool.CIDR.Contains(cidr.IP) {
+				return fmt.Errorf("ip pool [%s] overlaps cluster pod cidr [%s]", pool.Name, cidr)
+			}
+		}
+		shiba.clusterPoolCIDRs = append(shiba.clusterPoolCIDRs, pool.CIDR)
+	}
+	shiba.clusterPodCIDRs = append(shiba.clusterPodCIDRs, shiba.clusterPoolCIDRs...)
+	shiba.poolLock.Lock()
+	defer shiba.poolLock.Unlock()
+	return shiba.publishPoolIPs(true)
+}
+
+// carveNodePools carves the node-local pools from the end of the node pod CIDRs in order. It returns the CIDRs of
+// all pools by name, and the last address of each node pod CIDR left to host-local.
+func carveNodePools(pools []IPPool, nodePodCIDRs []*net.IPNet) (map[string]*net.IPNet, map[string]net.IP, error) {
+	poolCIDRs := make(map[string]*net.IPNet, len(pools))
+	ceilings := make(map[string]*big.Int) // Node pod CIDR -> the first address carved.
+	for _, pool := range pools {
+		if _, ok := poolCIDRs[pool.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicated ip pool [%s]", pool.Name)
+		}
+		if pool.CIDR != nil {
+			poolCIDRs[pool.Name] = pool.CIDR
+			continue
+		}
+		var nodeCIDR *net.IPNet
+		for _, cidr := range nodePodCIDRs {
+			if _, bits := cidr.Mask.Size(); (bits == 32) == (pool.PrefixLen <= 32) {
+				nodeCIDR = cidr
+				break
+			}
+		}
+		if nodeCIDR == nil {
+			return nil, nil, fmt.Errorf("no node pod cidr of the family of ip pool [%s]", pool.Name)
+		}
+		ones, bits := nodeCIDR.Mask.Size()
+		base := new(big.Int).SetBytes(nodeCIDR.IP)
+		ceiling, ok := ceilings[nodeCIDR.String()]
+		if !ok {
+			ceiling = new(big.Int).Add(base, new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)))
+		}
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-pool.PrefixLen))
+		start := new(big.Int).Sub(ceiling, size)
+		start.Div(start, size).Mul(start, size) // Aligned.
+		// Leave the network address and the gateway to host-local at least.
+		if pool.PrefixLen <= ones || start.Cmp(new(big.Int).Add(base, big.NewInt(2))) < 0 {
+			return nil, nil, fmt.Errorf("ip pool [%s] doesn't fit in node pod cidr [%s]", pool.Name, nodeCIDR)
+		}
+		ceilings[nodeCIDR.String()] = start
+		poolCIDRs[pool.Name] = &net.IPNet{IP: bigToIP(start, bits), Mask: net.CIDRMask(pool.PrefixLen, bits)}
+	}
+	rangeEnds := make(map[string]net.IP, len(ceilings))
+	for _, cidr := range nodePodCIDRs {
+		if ceiling, ok := ceilings[cidr.String()]; ok {
+			_, bits := cidr.Mask.Size()
+			rangeEnds[cidr.String()] = bigToIP(new(big.Int).Sub(ceiling, big.NewInt(1)), bits)
+		}
+	}
+	return poolCIDRs, rangeEnds, nil
+}
+
+func bigToIP(i *big.Int, bits int) net.IP {
+	return i.FillBytes(make([]byte, bits/8))
+}
+
+// poolRequest is an address requested by a pod, either a static IP or any address of a pool.
+type poolRequest struct {
+	pool string
+	ip   net.IP // Nil for any address of the pool.
+}
+
+// parsePoolRequests returns the addresses requested by the annotations of the pod, at most one of each family.
+func (shiba *Shiba) parsePoolRequests(pod *corev1.Pod) ([]poolRequest, error) {
+	var requests []poolRequest
+	if value := pod.Annotations[staticIPAnnotation]; len(value) > 0 {
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return nil, fmt.Errorf("bad static ip [%s]", s)
+			}
+			pool := shiba.findPool(ip)
+			if len(pool) == 0 {
+				return nil, fmt.Errorf("static ip [%s] is not in any ip pool", ip)
+			}
+			requests = append(requests, poolRequest{pool: pool, ip: ip})
+		}
+	}
+	if value := pod.Annotations[ipPoolAnnotation]; len(value) > 0 {
+		for _, s := range strings.Split(value, ",") {
+			pool := strings.TrimSpace(s)
+			if _, ok := shiba.poolCIDRs[pool]; !ok {
+				return nil, fmt.Errorf("unknown ip pool [%s]", pool)
+			}
+			requests = append(requests, poolRequest{pool: pool})
+		}
+	}
+	families := make(map[*ipFamily]bool)
+	for _, request := range requests {
+		family := familyOf(shiba.poolCIDRs[request.pool].IP)
+		if families[family] {
+			return nil, fmt.Errorf("more than one %s address is requested", family.name)
+		}
+		families[family] = true
+	}
+	return requests, nil
+}
+
+// findPool returns the name of the pool containing ip, empty if none.
+func (shiba *Shiba) findPool(ip net.IP) string {
+	for _, pool := range shiba.ipPools {
+		if shiba.poolCIDRs[pool.Name].Contains(ip) {
+			return pool.Name
+		}
+	}
+	return ""
+}
+
+// isClusterPoolIP returns whether ip is in a cluster-wide pool.
+func (shiba *Shiba) isClusterPoolIP(ip net.IP) bool {
+	for _, cidr := range shiba.clusterPoolCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allocatePodIPs assigns the requested addresses to the container of the pod. An address held by another
+// container of the same pod is taken over, so a static IP survives the restarts of the pod.
+func (shiba *Shiba) allocatePodIPs(containerID, ifName string, pod *corev1.Pod,
+	requests []poolRequest) ([]model.IPAMAddress, error) {
+	shiba.poolLock.Lock()
+	defer shiba.poolLock.Unlock()
+	dir := filepath.Join(shiba.ipamDataPath, poolNetName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	unlock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	allocations, err := listIPAMAllocations(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list allocations: %w", err)
+	}
+	podKey := pod.Namespace + "/" + pod.Name
+	var ips []net.IP
+	used := make(map[string]ipamAllocation, len(allocations))
+	for _, allocation := range allocations {
+		if allocation.containerID == containerID {
+			ips = append(ips, allocation.ip) // Already allocated.
+		}
+		used[allocation.ip.String()] = allocation
+	}
+	if len(ips) > 0 {
+		return shiba.podAddresses(ips), nil
+	}
+	remoteIPs := shiba.remotePoolIPs()
+	var paths []string
+	for _, request := range requests {
+		ip := request.ip
+		if ip == nil {
+			cidr := shiba.poolCIDRs[request.pool]
+			if ip = nextFreeIP(cidr, containerID, func(ip net.IP) bool {
+				_, ok := used[ip.String()]
+				return ok || len(remoteIPs[ip.String()]) > 0
+			}); ip == nil {
+				err = fmt.Errorf("ip pool [%s] is exhausted", request.pool)
+				break
+			}
+		} else if allocation, ok := used[ip.String()]; ok && allocation.pod != podKey {
+			err = fmt.Errorf("%w by container [%s]", errAddressInUse, allocation.containerID)
+			break
+		} else if node := remoteIPs[ip.String()]; len(node) > 0 {
+			err = fmt.Errorf("%w on node [%s]", errAddressInUse, node)
+			break
+		}
+		path := filepath.Join(dir, ip.String())
+		content := fmt.Sprintf("%s\n%s\n%s\n", containerID, ifName, podKey) // The format of host-local plus the pod.
+		if err = util.WriteFileAtomic(path, []byte(content), 0o644); err != nil {
+			break
+		}
+		log.WithFields(log.Fields{
+			fieldCIDR: ip.String(), fieldContainer: containerID, fieldOperation: "allocate",
+		}).Infof("allocated address of pool [%s] to pod [%s]", request.pool, podKey)
+		ips = append(ips, ip)
+		paths = append(paths, path)
+	}
+	if err == nil {
+		err = shiba.publishPoolIPs(false)
+	}
+	if err != nil {
+		for _, path := range paths {
+			_ = os.Remove(path)
+		}
+		return nil, err
+	}
+	return shiba.podAddresses(ips), nil
+}
+
+// releasePodIPs releases the pool addresses of the container, returning whether there were any.
+func (shiba *Shiba) releasePodIPs(containerID string) (bool, error) {
+	shiba.poolLock.Lock()
+	defer shiba.poolLock.Unlock()
+	dir := filepath.Join(shiba.ipamDataPath, poolNetName)
+	unlock, err := lockDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer unlock()
+	allocations, err := listIPAMAllocations(dir)
+	if err != nil {
+		return false, fmt.Errorf("failed to list allocations: %w", err)
+	}
+	var released bool
+	for _, allocation := range allocations {
+		if allocation.containerID != containerID {
+			continue
+		}
+		if err := os.Remove(allocation.path); err != nil && !os.IsNotExist(err) {
+			return released, err
+		}
+		log.WithFields(log.Fields{
+			fieldCIDR: allocation.ip.String(), fieldContainer: containerID, fieldOperation: "release",
+		}).Infof("released address of pod [%s]", allocation.pod)
+		released = true
+	}
+	if released {
+		return true, shiba.publishPoolIPs(false)
+	}
+	return false, nil
+}
+
+// hasPodIPs returns whether the container has pool addresses.
+func (shiba *Shiba) hasPodIPs(containerID string) (bool, error) {
+	allocations, err := listIPAMAllocations(filepath.Join(shiba.ipamDataPath, poolNetName))
+	if err != nil {
+		return false, err
+	}
+	for _, allocation := range allocations {
+		if allocation.containerID == containerID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// podAddresses returns the addresses of the pod with the gateways of the node. Addresses of cluster-wide pools are
+// host prefixes, and the others are in the node pod CIDR like those of host-local.
+func (shiba *Shiba) podAddresses(ips []net.IP) []model.IPAMAddress {
+	addresses := make([]model.IPAMAddress, 0, len(ips))
+	for _, ip := range ips {
+		address := model.IPAMAddress{Address: hostPrefix(ip).String()}
+		for i, cidr := range shiba.nodePodCIDRs {
+			if familyOf(cidr.IP) != familyOf(ip) {
+				continue
+			}
+			if cidr.Contains(ip) {
+				address.Address = (&net.IPNet{IP: ip, Mask: cidr.Mask}).String()
+			}
+			address.Gateway = shiba.nodeGateways[i].String()
+			break
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// nextFreeIP returns a free address of the pool, nil if none is found. The scan starts at an offset by the
+// container ID, so nodes allocating from a cluster-wide pool at the same time are unlikely to collide.
+// The first address, and the last one of IPv4, are skipped.
+func nextFreeIP(cidr *net.IPNet, containerID string, used func(ip net.IP) bool) net.IP {
+	ones, bits := cidr.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	hash := sha256.Sum256([]byte(containerID))
+	offset := new(big.Int).Mod(new(big.Int).SetBytes(hash[:]), size)
+	base := new(big.Int).SetBytes(cidr.IP.Mask(cidr.Mask))
+	last := new(big.Int).Sub(size, big.NewInt(1))
+	for i := 0; i < maxPoolScan && big.NewInt(int64(i)).Cmp(size) < 0; i++ {
+		if offset.Sign() != 0 && (bits != 32 || ones >= 31 || offset.Cmp(last) != 0) {
+			ip := bigToIP(new(big.Int).Add(base, offset), bits)
+			if !used(ip) {
+				return ip
+			}
+		}
+		offset.Add(offset, big.NewInt(1))
+		if offset.Cmp(size) >= 0 {
+			offset.SetInt64(0)
+		}
+	}
+	return nil
+}
+
+func hostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// remotePoolIPs returns the addresses of cluster-wide pools published by peers, mapped to the peers.
+func (shiba *Shiba) remotePoolIPs() map[string]string {
+	ips := make(map[string]string)
+	for _, node := range shiba.cloneNodeMap() {
+		for _, cidr := range node.PodCIDRs {
+			if ones, bits := cidr.Mask.Size(); ones == bits && shiba.isClusterPoolIP(cidr.IP) {
+				ips[cidr.IP.String()] = node.Key()
+			}
+		}
+	}
+	return ips
+}
+
+// publishPoolIPs annotates the node with the addresses of cluster-wide pools allocated on it, so peers route them
+// to the node. It's only patched if changed, unless forced. The caller must hold poolLock.
+func (shiba *Shiba) publishPoolIPs(force bool) error {
+	if len(shiba.clusterPoolCIDRs) == 0 || shiba.dryRun {
+		return nil
+	}
+	allocations, err := listIPAMAllocations(filepath.Join(shiba.ipamDataPath, poolNetName))
+	if err != nil {
+		return fmt.Errorf("failed to list allocations: %w", err)
+	}
+	var ips []string
+	for _, allocation := range allocations {
+		if shiba.isClusterPoolIP(allocation.ip) {
+			ips = append(ips, allocation.ip.String())
+		}
+	}
+	sort.Strings(ips)
+	value := strings.Join(ips, ",")
+	if !force && value == shiba.publishedPoolIPs {
+		return nil
+	}
+	var annotation interface{} = value
+	if len(value) == 0 {
+		annotation = nil
+	}
+	if err := shiba.annotateNode(map[string]interface{}{poolIPsAnnotation: annotation}); err != nil {
+		return fmt.Errorf("failed to annotate node [%s] with pool ips: %w", shiba.nodeName, err)
+	}
+	shiba.publishedPoolIPs = value
+	log.Infof("published pool ips [%s]", value)
+	return nil
+}
+
+// parseNodePodCIDRs returns the pod CIDRs of a node, with the host prefixes of the addresses of cluster-wide pools
+// published by the node.
+func (shiba *Shiba) parseNodePodCIDRs(node *corev1.Node) ([]*net.IPNet, error) {
+	podCIDRs, err := util.ParseNodePodCIDRs(node)
+	value := node.Annotations[poolIPsAnnotation]
+	if err != nil || len(shiba.clusterPoolCIDRs) == 0 || len(value) == 0 {
+		return podCIDRs, err
+	}
+	for _, s := range strings.Split(value, ",") {
+		if ip := net.ParseIP(s); ip != nil && shiba.isClusterPoolIP(ip) {
+			podCIDRs = append(podCIDRs, hostPrefix(ip))
+		}
+	}
+	sort.Slice(podCIDRs, func(i, j int) bool {
+		return podCIDRs[i].String() < podCIDRs[j].String()
+	})
+	return podCIDRs, nil
+}
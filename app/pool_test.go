@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func TestParseIPPool(t *testing.T) {
+	pool, err := ParseIPPool("shared=10.250.0.0/24")
+	assert.NilError(t, err)
+	assert.Equal(t, pool.Name, "shared")
+	assert.Equal(t, pool.CIDR.String(), "10.250.0.0/24")
+	pool, err = ParseIPPool("stable=/28")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pool, IPPool{Name: "stable", PrefixLen: 28})
+	for _, spec := range []string{"stable", "=/28", "stable=/0", "stable=/129", "a/b=/28", "shared=10.250.0.0"} {
+		_, err := ParseIPPool(spec)
+		assert.Assert(t, err != nil, spec)
+	}
+}
+
+func TestCarveNodePools(t *testing.T) {
+	nodePodCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24", "fd00:1::/64"})
+	assert.NilError(t, err)
+	_, shared, _ := net.ParseCIDR("10.250.0.0/24")
+	pools := []IPPool{
+		{Name: "a", PrefixLen: 28},
+		{Name: "shared", CIDR: shared},
+		{Name: "b", PrefixLen: 27},
+		{Name: "c", PrefixLen: 120},
+	}
+	poolCIDRs, rangeEnds, err := carveNodePools(pools, nodePodCIDRs)
+	assert.NilError(t, err)
+	assert.Equal(t, poolCIDRs["a"].String(), "10.244.1.240/28")
+	assert.Equal(t, poolCIDRs["b"].String(), "10.244.1.192/27") // Aligned below a.
+	assert.Equal(t, poolCIDRs["c"].String(), "fd00:1::ffff:ffff:ffff:ff00/120")
+	assert.Equal(t, poolCIDRs["shared"], shared)
+	assert.Equal(t, rangeEnds["10.244.1.0/24"].String(), "10.244.1.191")
+	assert.Equal(t, rangeEnds["fd00:1::/64"].String(), "fd00:1::ffff:ffff:ffff:feff")
+
+	_, _, err = carveNodePools([]IPPool{{Name: "a", PrefixLen: 25}, {Name: "b", PrefixLen: 25}}, nodePodCIDRs)
+	assert.ErrorContains(t, err, "ip pool [b] doesn't fit")
+	_, _, err = carveNodePools([]IPPool{{Name: "a", PrefixLen: 28}}, nodePodCIDRs[1:])
+	assert.ErrorContains(t, err, "no node pod cidr")
+}
+
+func TestNextFreeIP(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.250.0.0/30")
+	used := map[string]bool{}
+	var ips []string
+	for {
+		ip := nextFreeIP(cidr, "container", func(ip net.IP) bool { return used[ip.String()] })
+		if ip == nil {
+			break
+		}
+		used[ip.String()] = true
+		ips = append(ips, ip.String())
+	}
+	// The network and broadcast addresses are skipped.
+	assert.Equal(t, len(ips), 2)
+	assert.Assert(t, used["10.250.0.1"] && used["10.250.0.2"])
+}
+
+func TestShiba_allocatePodIPs(t *testing.T) {
+	nodePodCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24"})
+	assert.NilError(t, err)
+	_, shared, _ := net.ParseCIDR("10.250.0.0/24")
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "self"}})
+	shiba := &Shiba{
+		client:       client,
+		nodeName:     "self",
+		nodeMap:      model.NodeMap{},
+		nodePodCIDRs: nodePodCIDRs,
+		nodeGateways: []net.IP{net.ParseIP("10.244.1.1")},
+		ipamDataPath: t.TempDir(),
+		ipPools:      []IPPool{{Name: "stable", PrefixLen: 28}, {Name: "shared", CIDR: shared}},
+	}
+	assert.NilError(t, shiba.initPools())
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "web", Namespace: "default", Annotations: map[string]string{staticIPAnnotation: "10.250.0.10"},
+	}}
+	requests, err := shiba.parsePoolRequests(pod)
+	assert.NilError(t, err)
+	addresses, err := shiba.allocatePodIPs("c1", "eth0", pod, requests)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, addresses, []model.IPAMAddress{{Address: "10.250.0.10/32", Gateway: "10.244.1.1"}})
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, node.Annotations[poolIPsAnnotation], "10.250.0.10")
+
+	// Taken over by the new sandbox of the same pod, but not by another pod.
+	_, err = shiba.allocatePodIPs("c2", "eth0", pod, requests)
+	assert.NilError(t, err)
+	other := pod.DeepCopy()
+	other.Name = "other"
+	_, err = shiba.allocatePodIPs("c3", "eth0", other, requests)
+	assert.Assert(t, errors.Is(err, errAddressInUse))
+
+	pod.Annotations = map[string]string{ipPoolAnnotation: "stable"}
+	requests, err = shiba.parsePoolRequests(pod)
+	assert.NilError(t, err)
+	addresses, err = shiba.allocatePodIPs("c4", "eth0", pod, requests)
+	assert.NilError(t, err)
+	ip, _, err := net.ParseCIDR(addresses[0].Address)
+	assert.NilError(t, err)
+	assert.Assert(t, shiba.poolCIDRs["stable"].Contains(ip))
+	assert.Equal(t, addresses[0].Address[len(addresses[0].Address)-3:], "/24") // In the node pod CIDR.
+
+	released, err := shiba.releasePodIPs("c2")
+	assert.NilError(t, err)
+	assert.Assert(t, released)
+	node, err = client.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+	assert.NilError(t, err)
+	_, ok := node.Annotations[poolIPsAnnotation]
+	assert.Assert(t, !ok)
+
+	pod.Annotations = map[string]string{ipPoolAnnotation: "stable,shared"}
+	_, err = shiba.parsePoolRequests(pod)
+	assert.ErrorContains(t, err, "more than one ipv4 address")
+	pod.Annotations = map[string]string{staticIPAnnotation: "10.251.0.1"}
+	_, err = shiba.parsePoolRequests(pod)
+	assert.ErrorContains(t, err, "not in any ip pool")
+}
+
+func TestShiba_parseNodePodCIDRs(t *testing.T) {
+	_, shared, _ := net.ParseCIDR("10.250.0.0/24")
+	shiba := &Shiba{clusterPoolCIDRs: []*net.IPNet{shared}}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{poolIPsAnnotation: "10.250.0.10,10.1.0.1,bad"}},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.244.2.0/24"},
+	}
+	podCIDRs, err := shiba.parseNodePodCIDRs(node)
+	assert.NilError(t, err)
+	// Addresses out of the pools are ignored.
+	assert.Equal(t, util.FormatIPNets(podCIDRs), "[10.244.2.0/24 10.250.0.10/32]")
+}
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+// probeConn is a raw ICMP socket of one IP family.
+type probeConn struct {
+	conn      *icmp.PacketConn
+	echo      icmp.Type
+	echoReply icmp.Type
+}
+
+type probeTarget struct {
+	node    string // Key of the node.
+	gateway net.IP
+}
+
+// probe pings the gateway IPs of peers through the overlay every probeInterval until stopCh is closed.
+func (shiba *Shiba) probe(stopCh <-chan struct{}) {
+	conns := make(map[bool]*probeConn) // Is IPv4 -> conn.
+	if conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err != nil {
+		log.Errorf("failed to open icmp socket, not probing ipv4 peers: %v", err)
+	} else {
+		conns[true] = &probeConn{conn: conn, echo: ipv4.ICMPTypeEcho, echoReply: ipv4.ICMPTypeEchoReply}
+	}
+	if conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::"); err != nil {
+		log.Errorf("failed to open icmpv6 socket, not probing ipv6 peers: %v", err)
+	} else {
+		conns[false] = &probeConn{conn: conn, echo: ipv6.ICMPTypeEchoRequest, echoReply: ipv6.ICMPTypeEchoReply}
+	}
+	defer func() {
+		for _, c := range conns {
+			_ = c.conn.Close()
+		}
+	}()
+	if len(conns) == 0 {
+		return
+	}
+	log.Infof("probing peers every %v", shiba.probeInterval)
+	ticker := time.NewTicker(shiba.probeInterval)
+	defer ticker.Stop()
+	var seq int
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			seq = (seq + 1) & 0xffff
+			shiba.probeOnce(conns, seq)
+		}
+	}
+}
+
+func (shiba *Shiba) probeOnce(conns map[bool]*probeConn, seq int) {
+	id := os.Getpid() & 0xffff
+	timeout := probeTimeout
+	if shiba.probeInterval < timeout {
+		timeout = shiba.probeInterval
+	}
+	targets := shiba.probeTargets()
+	sentAt := make(map[string]time.Time, len(targets))
+	for _, target := range targets {
+		c, ok := conns[util.IsV4(target.gateway)]
+		if !ok {
+			continue
+		}
+		b, err := (&icmp.Message{
+			Type: c.echo,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("shiba")},
+		}).Marshal(nil)
+		if err != nil {
+			log.Errorf("failed to marshal icmp echo: %v", err)
+			return
+		}
+		sentAt[target.gateway.String()] = time.Now()
+		if _, err := c.conn.WriteTo(b, &net.IPAddr{IP: target.gateway}); err != nil {
+			log.Debugf("failed to probe gateway [%s] of node [%s]: %v", target.gateway, target.node, err)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		rtts     = make(map[string]time.Duration, len(targets))
+		deadline = time.Now().Add(timeout)
+	)
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *probeConn) {
+			defer wg.Done()
+			_ = c.conn.SetReadDeadline(deadline)
+			buf := make([]byte, 1500)
+			for {
+				n, peer, err := c.conn.ReadFrom(buf)
+				if err != nil {
+					return // Most likely the deadline is reached.
+				}
+				msg, err := icmp.ParseMessage(c.echoReply.Protocol(), buf[:n])
+				if err != nil || msg.Type != c.echoReply {
+					continue
+				}
+				echo, ok := msg.Body.(*icmp.Echo)
+				if !ok || echo.ID != id || echo.Seq != seq {
+					continue
+				}
+				addr, ok := peer.(*net.IPAddr)
+				if !ok {
+					continue
+				}
+				if t, ok := sentAt[addr.IP.String()]; ok {
+					lock.Lock()
+					rtts[addr.IP.String()] = time.Since(t)
+					lock.Unlock()
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	shiba.updatePeerHealth(targets, sentAt, rtts)
+}
+
+func (shiba *Shiba) probeTargets() []probeTarget {
+	var targets []probeTarget
+	for _, node := range shiba.cloneNodeMap() {
+		if node.Source == model.SourceStatic {
+			continue // Static peers may not have gateways.
+		}
+		for _, cidr := range node.PodCIDRs {
+			if ones, bits := cidr.Mask.Size(); ones == bits {
+				continue // Addresses of cluster-wide pools.
+			}
+			targets = append(targets, probeTarget{node: node.Key(), gateway: util.GatewayIP(cidr)})
+		}
+	}
+	return targets
+}
+
+func (shiba *Shiba) updatePeerHealth(targets []probeTarget, sentAt map[string]time.Time, rtts map[string]time.Duration) {
+	shiba.peerHealthLock.Lock()
+	peerHealth := make(map[string]*model.PeerHealth, len(targets))
+	unreachable := make(map[string]bool)
+	for _, target := range targets {
+		key := target.gateway.String()
+		health, ok := shiba.peerHealth[key]
+		if !ok || health.Node != target.node {
+			health = &model.PeerHealth{Node: target.node, Gateway: target.gateway}
+		}
+		if _, ok := sentAt[key]; ok {
+			health.Sent++
+		}
+		if rtt, ok := rtts[key]; ok {
+			health.Received++
+			health.Failures = 0
+			health.RTT = rtt
+			health.LastSeen = time.Now()
+		} else {
+			health.Failures++
+		}
+		if !health.Reachable(probeFailureThreshold) {
+			unreachable[target.node] = true
+		}
+		peerHealth[key] = health
+	}
+	shiba.peerHealth = peerHealth
+	lastUnreachable := shiba.unreachablePeers
+	shiba.unreachablePeers = unreachable
+	shiba.peerHealthLock.Unlock()
+
+	changed := len(unreachable) != len(lastUnreachable)
+	for node := range unreachable {
+		if !lastUnreachable[node] {
+			changed = true
+			log.Warningf("peer [%s] is unreachable through the overlay", node)
+			shiba.recordNodeEvent(corev1.EventTypeWarning, "PeerUnreachable",
+				fmt.Sprintf("Peer %s is unreachable through the overlay", node))
+		}
+	}
+	for node := range lastUnreachable {
+		if !unreachable[node] {
+			changed = true
+			log.Infof("peer [%s] is reachable again", node)
+			shiba.recordNodeEvent(corev1.EventTypeNormal, "PeerReachable",
+				fmt.Sprintf("Peer %s is reachable through the overlay again", node))
+		}
+	}
+	if changed {
+		shiba.annotateUnreachablePeers(unreachable)
+	}
+}
+
+// annotateUnreachablePeers sets the names of unreachable peers to the annotation of the current node.
+func (shiba *Shiba) annotateUnreachablePeers(unreachable map[string]bool) {
+	if shiba.dryRun {
+		return
+	}
+	var value interface{} // Remove the annotation if no peer is unreachable.
+	if len(unreachable) > 0 {
+		nodes := make([]string, 0, len(unreachable))
+		for node := range unreachable {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		value = strings.Join(nodes, ",")
+	}
+	if err := shiba.annotateNode(map[string]interface{}{unreachablePeersAnnotation: value}); err != nil {
+		log.Errorf("failed to annotate node [%s] with unreachable peers: %v", shiba.nodeName, err)
+	}
+}
+
+func (shiba *Shiba) clonePeerHealth() []model.PeerHealth {
+	shiba.peerHealthLock.Lock()
+	defer shiba.peerHealthLock.Unlock()
+	peerHealth := make([]model.PeerHealth, 0, len(shiba.peerHealth))
+	for _, health := range shiba.peerHealth {
+		peerHealth = append(peerHealth, *health)
+	}
+	sort.Slice(peerHealth, func(i, j int) bool {
+		if peerHealth[i].Node != peerHealth[j].Node {
+			return peerHealth[i].Node < peerHealth[j].Node
+		}
+		return peerHealth[i].Gateway.String() < peerHealth[j].Gateway.String()
+	})
+	return peerHealth
+}
+
+func (shiba *Shiba) servePeerHealth(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(shiba.clonePeerHealth()); err != nil {
+		log.Errorf("failed to write peer health: %v", err)
+	}
+}
+
+func (shiba *Shiba) writeProbeMetrics(m *util.MetricWriter) {
+	peerHealth := shiba.clonePeerHealth()
+	m.Header("shiba_probe_sent_total", "counter", "Number of probes sent to the peer gateway.")
+	for _, h := range peerHealth {
+		m.Sample("shiba_probe_sent_total", float64(h.Sent), "peer", h.Node, "gateway", h.Gateway.String())
+	}
+	m.Header("shiba_probe_received_total", "counter", "Number of probe replies received from the peer gateway.")
+	for _, h := range peerHealth {
+		m.Sample("shiba_probe_received_total", float64(h.Received), "peer", h.Node, "gateway", h.Gateway.String())
+	}
+	m.Header("shiba_probe_rtt_seconds", "gauge", "RTT of the last successful probe to the peer gateway.")
+	for _, h := range peerHealth {
+		m.Sample("shiba_probe_rtt_seconds", h.RTT.Seconds(), "peer", h.Node, "gateway", h.Gateway.String())
+	}
+	m.Header("shiba_peer_reachable", "gauge", "Whether the peer gateway is reachable through the overlay.")
+	for _, h := range peerHealth {
+		var reachable float64
+		if h.Reachable(probeFailureThreshold) {
+			reachable = 1
+		}
+		m.Sample("shiba_peer_reachable", reachable, "peer", h.Node, "gateway", h.Gateway.String())
+	}
+}
@@ -0,0 +1,43 @@
+package app
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestShiba_updatePeerHealth(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "self"}})
+	s := &Shiba{client: client, nodeName: "self"}
+	gateway := net.ParseIP("10.244.1.1")
+	targets := []probeTarget{{node: "peer", gateway: gateway}}
+	sentAt := map[string]time.Time{gateway.String(): time.Now()}
+
+	for i := 0; i < probeFailureThreshold; i++ {
+		s.updatePeerHealth(targets, sentAt, nil)
+	}
+	health := s.clonePeerHealth()
+	assert.Equal(t, len(health), 1)
+	assert.Equal(t, health[0].Sent, uint64(probeFailureThreshold))
+	assert.Equal(t, health[0].Received, uint64(0))
+	assert.Assert(t, s.unreachablePeers["peer"])
+	node, err := client.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, node.Annotations[unreachablePeersAnnotation], "peer")
+
+	s.updatePeerHealth(targets, sentAt, map[string]time.Duration{gateway.String(): time.Millisecond})
+	health = s.clonePeerHealth()
+	assert.Equal(t, health[0].Received, uint64(1))
+	assert.Equal(t, health[0].RTT, time.Millisecond)
+	assert.Equal(t, len(s.unreachablePeers), 0)
+	node, err = client.CoreV1().Nodes().Get(context.Background(), "self", metav1.GetOptions{})
+	assert.NilError(t, err)
+	_, ok := node.Annotations[unreachablePeersAnnotation]
+	assert.Assert(t, !ok)
+}
@@ -0,0 +1,377 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	proxyMasqueradeMark = 0x4000
+	proxyTable          = "shiba-proxy"
+	stageProxy          = "proxy"
+)
+
+// serviceProxy programs the load balancing of services with nftables, replacing kube-proxy.
+type serviceProxy struct {
+	shiba          *Shiba
+	services       cache.SharedIndexInformer
+	endpointSlices cache.SharedIndexInformer
+	fireCh         chan struct{}
+	applied        map[*ipFamily]string // The last successfully applied script of each family.
+}
+
+type proxyEndpoint struct {
+	ip    net.IP
+	port  int32
+	local bool
+}
+
+func newServiceProxy(shiba *Shiba) *serviceProxy {
+	proxy := &serviceProxy{
+		shiba:          shiba,
+		services:       shiba.informers.Core().V1().Services().Informer(),
+		endpointSlices: shiba.informers.Discovery().V1().EndpointSlices().Informer(),
+		fireCh:         make(chan struct{}, 1),
+		applied:        make(map[*ipFamily]string),
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { proxy.fire() },
+		UpdateFunc: func(interface{}, interface{}) { proxy.fire() },
+		DeleteFunc: func(interface{}) { proxy.fire() },
+	}
+	proxy.services.AddEventHandler(handler)
+	proxy.endpointSlices.AddEventHandler(handler)
+	return proxy
+}
+
+// run keeps nftables in sync with the services and endpoint slices until stopCh is closed.
+func (proxy *serviceProxy) run(stopCh <-chan struct{}) {
+	// Rendering a partial list would remove live services.
+	if !cache.WaitForCacheSync(stopCh, proxy.services.HasSynced, proxy.endpointSlices.HasSynced) {
+		return
+	}
+	log.Info("service proxy started")
+	proxy.fire()
+	ticker := time.NewTicker(fireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			proxy.fire()
+		case <-proxy.fireCh:
+			time.Sleep(executeGracePeriod)
+			select {
+			case <-proxy.fireCh:
+			default:
+			}
+			proxy.sync()
+		}
+	}
+}
+
+func (proxy *serviceProxy) fire() {
+	select {
+	case proxy.fireCh <- struct{}{}:
+	default:
+	}
+}
+
+func (proxy *serviceProxy) sync() {
+	log.Debug("syncing service proxy rules")
+	proxy.shiba.resetPlan(stageProxy)
+	podCIDRs, err := splitByFamily(proxy.shiba.clusterPodCIDRs)
+	if err != nil {
+		log.Errorf("failed to split cluster pod cidrs: %v", err)
+		return
+	}
+	services := make(map[string]*corev1.Service)
+	for _, object := range proxy.services.GetStore().List() {
+		svc := object.(*corev1.Service)
+		services[svc.Namespace+"/"+svc.Name] = svc
+	}
+	endpointSlices := make(map[string]*discoveryv1.EndpointSlice)
+	for _, object := range proxy.endpointSlices.GetStore().List() {
+		slice := object.(*discoveryv1.EndpointSlice)
+		endpointSlices[slice.Namespace+"/"+slice.Name] = slice
+	}
+	for _, family := range ipFamilies {
+		script := renderProxyRules(family, proxy.shiba.nodeName, podCIDRs[family], services, endpointSlices)
+		if proxy.applied[family] == script {
+			continue
+		}
+		if err := proxy.shiba.apply(stageProxy, model.Change{
+			Kind: "nft", Action: "write", Target: family.nftFamily + " " + proxyTable, Detail: script,
+		}, func() error {
+			return util.ApplyNft(script)
+		}); err != nil {
+			log.Errorf("failed to apply %s service proxy rules: %v", family.name, err)
+			delete(proxy.applied, family) // Retry next time.
+			continue
+		}
+		if proxy.shiba.dryRun {
+			continue // Plan the change again next time.
+		}
+		proxy.applied[family] = script
+		log.Infof("%s service proxy rules are applied", family.name)
+	}
+}
+
+// removeProxyRules removes the proxy tables left by a previous run with the service proxy enabled.
+func (shiba *Shiba) removeProxyRules() {
+	shiba.resetPlan(stageProxy)
+	for _, family := range ipFamilies {
+		if !util.NftTableExists(family.nftFamily, proxyTable) {
+			continue
+		}
+		if err := shiba.apply(stageProxy, model.Change{
+			Kind: "nft", Action: "delete", Target: family.nftFamily + " " + proxyTable,
+		}, func() error {
+			return util.DeleteNftTable(family.nftFamily, proxyTable)
+		}); err != nil {
+			log.WithError(err).Errorf("failed to remove %s service proxy rules", family.name)
+			continue
+		}
+		log.Infof("%s service proxy rules are removed", family.name)
+	}
+}
+
+// renderProxyRules renders the nft script that replaces the whole proxy table of the family.
+// Note that the session affinity states are reset as the table is recreated.
+func renderProxyRules(family *ipFamily, nodeName string, podCIDRs []*net.IPNet,
+	services map[string]*corev1.Service, endpointSlices map[string]*discoveryv1.EndpointSlice) string {
+	var (
+		sets, serviceRules, nodePorts, noEndpoints strings.Builder
+		chains                                     []string
+	)
+	keys := make([]string, 0, len(services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var podSet string
+	if len(podCIDRs) > 0 {
+		var cidrs []string
+		for _, cidr := range podCIDRs {
+			cidrs = append(cidrs, cidr.String())
+		}
+		podSet = "{ " + strings.Join(cidrs, ", ") + " }"
+	}
+	match := family.nftFamily
+
+	for _, key := range keys {
+		svc := services[key]
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+		var clusterIPs []net.IP
+		for _, ipString := range svc.Spec.ClusterIPs {
+			if ip := net.ParseIP(ipString); ip != nil && family.match(ip) {
+				clusterIPs = append(clusterIPs, ip)
+			}
+		}
+		if len(clusterIPs) == 0 {
+			continue // Headless, or not of this family.
+		}
+		var ingressIPs []net.IP
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ip := net.ParseIP(ingress.IP); ip != nil && family.match(ip) {
+				ingressIPs = append(ingressIPs, ip)
+			}
+		}
+		var affinityTimeout int32
+		if svc.Spec.SessionAffinity == corev1.ServiceAffinityClientIP {
+			affinityTimeout = corev1.DefaultClientIPServiceAffinitySeconds
+			if config := svc.Spec.SessionAffinityConfig; config != nil && config.ClientIP != nil &&
+				config.ClientIP.TimeoutSeconds != nil {
+				affinityTimeout = *config.ClientIP.TimeoutSeconds
+			}
+		}
+		internalLocal := svc.Spec.InternalTrafficPolicy != nil &&
+			*svc.Spec.InternalTrafficPolicy == corev1.ServiceInternalTrafficPolicyLocal
+		externalLocal := svc.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal
+
+		for _, port := range svc.Spec.Ports {
+			portKey := port.Name
+			if len(portKey) == 0 {
+				portKey = strconv.Itoa(int(port.Port))
+			}
+			chainName := fmt.Sprintf("svc-%s/%s", key, portKey)
+			proto := strings.ToLower(string(port.Protocol))
+			if len(proto) == 0 {
+				proto = "tcp"
+			}
+			endpoints := findProxyEndpoints(family, nodeName, svc, port, endpointSlices)
+			var localEndpoints []proxyEndpoint
+			for _, endpoint := range endpoints {
+				if endpoint.local {
+					localEndpoints = append(localEndpoints, endpoint)
+				}
+			}
+
+			// The chains doing the load balancing, one for all endpoints and one for local ones.
+			renderBalancer := func(name string, endpoints []proxyEndpoint) {
+				var chain strings.Builder
+				fmt.Fprintf(&chain, "\tchain %s {\n", name)
+				if len(endpoints) == 0 {
+					chain.WriteString("\t\tdrop\n")
+				}
+				var verdicts []string
+				for i, endpoint := range endpoints {
+					epChain := fmt.Sprintf("%s/ep%d", name, i)
+					setName := fmt.Sprintf("aff-%s/ep%d", strings.TrimPrefix(name, "svc-"), i)
+					if affinityTimeout > 0 {
+						fmt.Fprintf(&sets, "\tset %s {\n\t\ttype %s\n\t\tflags dynamic, timeout\n\t\ttimeout %ds\n\t}\n",
+							setName, family.nftAddr, affinityTimeout)
+						fmt.Fprintf(&chain, "\t\t%s saddr @%s goto %s\n", match, setName, epChain)
+					}
+					verdicts = append(verdicts, fmt.Sprintf("%d : goto %s", i, epChain))
+					var ep strings.Builder
+					fmt.Fprintf(&ep, "\tchain %s {\n", epChain)
+					// Masquerade hairpin traffic, or the reply would skip the reverse NAT.
+					fmt.Fprintf(&ep, "\t\t%s saddr %s meta mark set meta mark | %#x\n",
+						match, endpoint.ip, proxyMasqueradeMark)
+					if affinityTimeout > 0 {
+						fmt.Fprintf(&ep, "\t\tupdate @%s { %s saddr }\n", setName, match)
+					}
+					fmt.Fprintf(&ep, "\t\tmeta l4proto %s dnat to %s\n\t}\n", proto, net.JoinHostPort(endpoint.ip.String(), strconv.Itoa(int(endpoint.port))))
+					chains = append(chains, ep.String())
+				}
+				if len(endpoints) > 0 {
+					fmt.Fprintf(&chain, "\t\tnumgen random mod %d vmap { %s }\n", len(endpoints), strings.Join(verdicts, ", "))
+				}
+				chain.WriteString("\t}\n")
+				chains = append(chains, chain.String())
+			}
+			renderBalancer(chainName, endpoints)
+			localChainName := chainName + "/local"
+			if internalLocal || (externalLocal && (port.NodePort != 0 || len(ingressIPs) > 0)) {
+				renderBalancer(localChainName, localEndpoints)
+			}
+
+			for _, clusterIP := range clusterIPs {
+				if len(endpoints) == 0 {
+					fmt.Fprintf(&noEndpoints, "\t\t%s daddr %s %s dport %d reject\n", match, clusterIP, proto, port.Port)
+					continue
+				}
+				if len(podSet) > 0 {
+					// Masquerade traffic from outside the cluster.
+					fmt.Fprintf(&serviceRules, "\t\t%s saddr != %s %s daddr %s %s dport %d meta mark set meta mark | %#x\n",
+						match, podSet, match, clusterIP, proto, port.Port, proxyMasqueradeMark)
+				}
+				target := chainName
+				if internalLocal {
+					target = localChainName
+				}
+				fmt.Fprintf(&serviceRules, "\t\t%s daddr %s %s dport %d goto %s\n", match, clusterIP, proto, port.Port, target)
+			}
+			// Load balancer IPs are external, so the source is kept only with the local policy.
+			for _, ingressIP := range ingressIPs {
+				if len(endpoints) == 0 {
+					fmt.Fprintf(&noEndpoints, "\t\t%s daddr %s %s dport %d reject\n", match, ingressIP, proto, port.Port)
+				} else if externalLocal {
+					fmt.Fprintf(&serviceRules, "\t\t%s daddr %s %s dport %d goto %s\n",
+						match, ingressIP, proto, port.Port, localChainName)
+				} else {
+					fmt.Fprintf(&serviceRules, "\t\t%s daddr %s %s dport %d meta mark set meta mark | %#x goto %s\n",
+						match, ingressIP, proto, port.Port, proxyMasqueradeMark, chainName)
+				}
+			}
+			if port.NodePort != 0 {
+				if len(endpoints) == 0 {
+					fmt.Fprintf(&noEndpoints, "\t\tfib daddr type local %s dport %d reject\n", proto, port.NodePort)
+				} else if externalLocal {
+					fmt.Fprintf(&nodePorts, "\t\t%s dport %d goto %s\n", proto, port.NodePort, localChainName)
+				} else {
+					fmt.Fprintf(&nodePorts, "\t\t%s dport %d meta mark set meta mark | %#x goto %s\n",
+						proto, port.NodePort, proxyMasqueradeMark, chainName)
+				}
+			}
+		}
+	}
+
+	// Chains are defined before being referred to.
+	var b strings.Builder
+	table := family.nftFamily + " " + proxyTable
+	fmt.Fprintf(&b, "add table %s\ndelete table %s\ntable %s {\n", table, table, table)
+	b.WriteString(sets.String())
+	for _, chain := range chains {
+		b.WriteString(chain)
+	}
+	fmt.Fprintf(&b, "\tchain nodeports {\n%s\t}\n", nodePorts.String())
+	fmt.Fprintf(&b, "\tchain services {\n%s\t\tfib daddr type local jump nodeports\n\t}\n", serviceRules.String())
+	fmt.Fprintf(&b, "\tchain no-endpoints {\n%s\t}\n", noEndpoints.String())
+	b.WriteString("\tchain prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n\t\tjump services\n\t}\n")
+	b.WriteString("\tchain output {\n\t\ttype nat hook output priority dstnat; policy accept;\n\t\tjump services\n\t}\n")
+	fmt.Fprintf(&b, "\tchain postrouting {\n\t\ttype nat hook postrouting priority srcnat; policy accept;\n"+
+		"\t\tmeta mark & %#x == %#x masquerade\n\t}\n", proxyMasqueradeMark, proxyMasqueradeMark)
+	for _, hook := range []string{"input", "forward", "output"} {
+		fmt.Fprintf(&b, "\tchain filter-%s {\n\t\ttype filter hook %s priority filter; policy accept;\n"+
+			"\t\tct state new jump no-endpoints\n\t}\n", hook, hook)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// findProxyEndpoints returns the ready endpoints of a service port in the family, sorted.
+func findProxyEndpoints(family *ipFamily, nodeName string, svc *corev1.Service, port corev1.ServicePort,
+	endpointSlices map[string]*discoveryv1.EndpointSlice) []proxyEndpoint {
+	var endpoints []proxyEndpoint
+	seen := make(map[string]bool)
+	for _, slice := range endpointSlices {
+		if slice.Namespace != svc.Namespace || slice.Labels[discoveryv1.LabelServiceName] != svc.Name ||
+			slice.AddressType != family.addrType {
+			continue
+		}
+		var targetPort int32
+		for _, slicePort := range slice.Ports {
+			var name string
+			if slicePort.Name != nil {
+				name = *slicePort.Name
+			}
+			if name == port.Name && slicePort.Port != nil &&
+				(slicePort.Protocol == nil || *slicePort.Protocol == port.Protocol) {
+				targetPort = *slicePort.Port
+				break
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			ip := net.ParseIP(endpoint.Addresses[0])
+			if ip == nil || !family.match(ip) || seen[ip.String()] {
+				continue
+			}
+			seen[ip.String()] = true
+			endpoints = append(endpoints, proxyEndpoint{
+				ip:    ip,
+				port:  targetPort,
+				local: endpoint.NodeName != nil && *endpoint.NodeName == nodeName,
+			})
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].ip.String() < endpoints[j].ip.String()
+	})
+	return endpoints
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/moycat/shiba/util"
+)
+
+func TestRenderProxyRules(t *testing.T) {
+	portName := "http"
+	port := int32(8080)
+	self, other := "self", "other"
+	services := map[string]*corev1.Service{
+		"default/web": {
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: corev1.ServiceSpec{
+				Type:                  corev1.ServiceTypeLoadBalancer,
+				ClusterIPs:            []string{"10.96.0.10", "fd00:96::10"},
+				Ports:                 []corev1.ServicePort{{Name: portName, Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+				SessionAffinity:       corev1.ServiceAffinityClientIP,
+				ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "192.0.2.10"}, {IP: "2001:db8::10"}},
+			}},
+		},
+	}
+	endpointSlices := map[string]*discoveryv1.EndpointSlice{
+		"default/web-abcde": {
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "web-abcde",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+			},
+			AddressType: discoveryv1.AddressTypeIPv4,
+			Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.244.1.5"}, NodeName: &self},
+				{Addresses: []string{"10.244.2.5"}, NodeName: &other},
+			},
+		},
+	}
+	podCIDRs, err := util.ParseIPNets([]string{"10.244.0.0/16"})
+	assert.NilError(t, err)
+
+	script := renderProxyRules(familyV4, self, podCIDRs, services, endpointSlices)
+	for _, line := range []string{
+		"add table ip shiba-proxy",
+		"ip saddr != { 10.244.0.0/16 } ip daddr 10.96.0.10 tcp dport 80 meta mark set meta mark | 0x4000",
+		"ip daddr 10.96.0.10 tcp dport 80 goto svc-default/web/http",
+		"numgen random mod 2 vmap { 0 : goto svc-default/web/http/ep0, 1 : goto svc-default/web/http/ep1 }",
+		"ip saddr @aff-default/web/http/ep0 goto svc-default/web/http/ep0",
+		"update @aff-default/web/http/ep0 { ip saddr }",
+		"meta l4proto tcp dnat to 10.244.2.5:8080",
+		// Only the local endpoint for node ports and load balancer IPs.
+		"tcp dport 30080 goto svc-default/web/http/local",
+		"ip daddr 192.0.2.10 tcp dport 80 goto svc-default/web/http/local",
+		"numgen random mod 1 vmap { 0 : goto svc-default/web/http/local/ep0 }",
+	} {
+		assert.Assert(t, strings.Contains(script, line), "missing [%s] in:\n%s", line, script)
+	}
+
+	// No endpoints of IPv6, so the service is rejected.
+	script = renderProxyRules(familyV6, self, nil, services, endpointSlices)
+	assert.Assert(t, strings.Contains(script, "ip6 daddr fd00:96::10 tcp dport 80 reject"), script)
+	assert.Assert(t, strings.Contains(script, "fib daddr type local tcp dport 30080 reject"), script)
+	assert.Assert(t, strings.Contains(script, "ip6 daddr 2001:db8::10 tcp dport 80 reject"), script)
+}
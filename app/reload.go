@@ -0,0 +1,301 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/moycat/shiba/util"
+)
+
+// Keys of the runtime config map.
+const (
+	configKeyMTU                  = "mtu"
+	configKeyMasqueradeExclusions = "masqueradeExclusions"
+	configKeyLogLevel             = "logLevel"
+	configKeySyncInterval         = "syncInterval"
+	configKeyNodeSelector         = "nodeSelector"
+	configKeyEgressGateways       = "egressGateways"
+)
+
+// The range of tunnel MTUs.
+const (
+	MinMTU = 1280 // The minimum MTU of IPv6.
+	MaxMTU = 65535
+)
+
+const (
+	minSyncInterval     = 10 * time.Second
+	exclusionComment    = "shiba masquerade exclusion"
+	configRetryInterval = 10 * time.Second
+)
+
+// runtimeConfig is the settings that can be changed without restarting.
+type runtimeConfig struct {
+	mtu                  int
+	masqueradeExclusions []*net.IPNet
+	logLevel             log.Level
+	syncInterval         time.Duration
+	nodeSelector         labels.Selector
+	egressPolicies       []*egressPolicy
+}
+
+// parseRuntimeConfig parses the data of the config map, with unset keys taken from base.
+// All problems are reported at once.
+func parseRuntimeConfig(data map[string]string, base runtimeConfig) (runtimeConfig, error) {
+	config := base
+	var problems []string
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := strings.TrimSpace(data[key])
+		switch key {
+		case configKeyMTU:
+			mtu, err := strconv.Atoi(value)
+			if err != nil || mtu < MinMTU || mtu > MaxMTU {
+				problems = append(problems, fmt.Sprintf("%s should be an integer in [%d, %d]", key, MinMTU, MaxMTU))
+				continue
+			}
+			config.mtu = mtu
+		case configKeyMasqueradeExclusions:
+			if len(value) == 0 {
+				config.masqueradeExclusions = nil
+				continue
+			}
+			cidrStrings := strings.Split(value, ",")
+			for i := range cidrStrings {
+				cidrStrings[i] = strings.TrimSpace(cidrStrings[i])
+			}
+			cidrs, err := util.ParseIPNets(cidrStrings)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s has a bad cidr: %v", key, err))
+				continue
+			}
+			config.masqueradeExclusions = cidrs
+		case configKeyLogLevel:
+			level, err := log.ParseLevel(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is bad: %v", key, err))
+				continue
+			}
+			config.logLevel = level
+		case configKeySyncInterval:
+			interval, err := time.ParseDuration(value)
+			if err != nil || interval < minSyncInterval {
+				problems = append(problems, fmt.Sprintf("%s should be a duration no less than %v", key, minSyncInterval))
+				continue
+			}
+			config.syncInterval = interval
+		case configKeyNodeSelector:
+			selector, err := newNodeSelector(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is bad: %v", key, err))
+				continue
+			}
+			config.nodeSelector = selector
+		case configKeyEgressGateways:
+			policies, err := parseEgressPolicies(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is bad: %v", key, err))
+				continue
+			}
+			config.egressPolicies = policies
+		default:
+			problems = append(problems, fmt.Sprintf("unknown key %s", key))
+		}
+	}
+	if len(problems) > 0 {
+		return base, errors.New(strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// initConfig loads the runtime config map once before the subsystems are initialized.
+func (shiba *Shiba) initConfig() {
+	shiba.setConfig(shiba.baseConfig)
+	if len(shiba.configNamespace) == 0 {
+		return
+	}
+	ctx, cancel := shiba.getAPIContext()
+	defer cancel()
+	configMap, err := shiba.client.CoreV1().ConfigMaps(shiba.configNamespace).Get(ctx, configMapName, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Errorf("failed to get config map [%s/%s], using the default config: %v",
+				shiba.configNamespace, configMapName, err)
+		}
+		return
+	}
+	config, err := parseRuntimeConfig(configMap.Data, shiba.baseConfig)
+	if err != nil {
+		shiba.rejectConfig(configMap, err)
+		return
+	}
+	shiba.setConfig(config)
+	log.Infof("loaded config map [%s/%s]", shiba.configNamespace, configMapName)
+}
+
+// watchConfig forwards the changes of the runtime config map to configCh until stopCh is closed.
+// A nil config map is sent if it's deleted.
+func (shiba *Shiba) watchConfig(stopCh <-chan struct{}) {
+	listOptions := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", configMapName).String()}
+	for {
+		watcher, err := shiba.client.CoreV1().ConfigMaps(shiba.configNamespace).Watch(context.Background(), listOptions)
+		if err != nil {
+			log.Errorf("failed to watch config map [%s/%s]: %v", shiba.configNamespace, configMapName, err)
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(configRetryInterval):
+				continue
+			}
+		}
+		if !shiba.forwardConfig(stopCh, watcher) {
+			return
+		}
+		log.Info("watch channel of config map closed")
+	}
+}
+
+// forwardConfig returns false if stopCh is closed.
+func (shiba *Shiba) forwardConfig(stopCh <-chan struct{}, watcher watch.Interface) bool {
+	defer watcher.Stop()
+	watcherCh := watcher.ResultChan()
+	for {
+		select {
+		case <-stopCh:
+			return false
+		case event, ok := <-watcherCh:
+			if !ok {
+				return true
+			}
+			configMap, ok := event.Object.(*corev1.ConfigMap)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				configMap = nil
+			}
+			select {
+			case <-stopCh:
+				return false
+			case shiba.configCh <- configMap:
+			}
+		}
+	}
+}
+
+// reloadConfig applies the runtime config map, returning whether the node watch needs restarting.
+func (shiba *Shiba) reloadConfig(configMap *corev1.ConfigMap) bool {
+	config := shiba.baseConfig
+	if configMap != nil {
+		var err error
+		if config, err = parseRuntimeConfig(configMap.Data, shiba.baseConfig); err != nil {
+			shiba.rejectConfig(configMap, err)
+			return false
+		}
+	}
+	last := shiba.setConfig(config)
+	if last.logLevel != config.logLevel {
+		log.Infof("log level changed to [%s]", config.logLevel)
+	}
+	if last.syncInterval != config.syncInterval {
+		log.Infof("sync interval changed to %v", config.syncInterval)
+		if shiba.syncTicker != nil {
+			shiba.syncTicker.Reset(config.syncInterval)
+		}
+	}
+	if util.FormatIPNets(last.masqueradeExclusions) != util.FormatIPNets(config.masqueradeExclusions) {
+		log.Infof("masquerade exclusions changed to %v", util.FormatIPNets(config.masqueradeExclusions))
+		if err := shiba.syncMasqueradeExclusions(); err != nil {
+			log.Errorf("failed to sync masquerade exclusions: %v", err)
+		}
+	}
+	if last.mtu != config.mtu {
+		log.Infof("tunnel mtu changed to %d", config.mtu)
+		shiba.fire()
+	}
+	if formatEgressPolicies(last.egressPolicies) != formatEgressPolicies(config.egressPolicies) {
+		log.Infof("egress policies changed to %v", config.egressPolicies)
+		select {
+		case shiba.egressCh <- struct{}{}:
+		default:
+		}
+		shiba.fire()
+	}
+	if last.nodeSelector.String() != config.nodeSelector.String() {
+		log.Infof("node selector changed to [%s]", config.nodeSelector)
+		shiba.pruneNodeMap()
+		return true
+	}
+	return false
+}
+
+// setConfig makes the runtime config effective and returns the last one.
+func (shiba *Shiba) setConfig(config runtimeConfig) runtimeConfig {
+	log.SetLevel(config.logLevel)
+	shiba.configLock.Lock()
+	defer shiba.configLock.Unlock()
+	last := runtimeConfig{
+		mtu:                  shiba.ip6tnlMTU,
+		masqueradeExclusions: shiba.masqueradeExclusions,
+		logLevel:             shiba.logLevel,
+		syncInterval:         shiba.syncInterval,
+		nodeSelector:         shiba.nodeSelector,
+		egressPolicies:       shiba.egressPolicies,
+	}
+	shiba.ip6tnlMTU = config.mtu
+	shiba.masqueradeExclusions = config.masqueradeExclusions
+	shiba.logLevel = config.logLevel
+	shiba.syncInterval = config.syncInterval
+	shiba.nodeSelector = config.nodeSelector
+	shiba.egressPolicies = config.egressPolicies
+	return last
+}
+
+func (shiba *Shiba) rejectConfig(configMap *corev1.ConfigMap, err error) {
+	log.Errorf("rejected invalid config map [%s/%s]: %v", configMap.Namespace, configMap.Name, err)
+	if shiba.recorder != nil {
+		shiba.recorder.Eventf(configMap, corev1.EventTypeWarning, "InvalidConfig",
+			"Node %s rejected the config: %v", shiba.nodeName, err)
+	}
+}
+
+// syncMasqueradeExclusions makes the exclusion rules in the NAT chain match the runtime config.
+func (shiba *Shiba) syncMasqueradeExclusions() error {
+	shiba.configLock.Lock()
+	exclusions := shiba.masqueradeExclusions
+	shiba.configLock.Unlock()
+	return shiba.syncNATExclusions(exclusionComment, exclusions)
+}
+
+func exclusionRuleSpec(comment, cidr string) []string {
+	return []string{"--dst", cidr, "-m", "comment", "--comment", comment, "-j", "RETURN"}
+}
+
+// parseRuleDestination returns the destination of a rule listed by iptables, empty if not found.
+func parseRuleDestination(rule string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "-d" || fields[i] == "--dst" || fields[i] == "--destination" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
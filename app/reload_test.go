@@ -0,0 +1,80 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/moycat/shiba/util"
+)
+
+func TestParseRuntimeConfig(t *testing.T) {
+	selector, err := newNodeSelector("")
+	assert.NilError(t, err)
+	base := runtimeConfig{mtu: 1450, logLevel: log.InfoLevel, syncInterval: time.Minute, nodeSelector: selector}
+
+	config, err := parseRuntimeConfig(nil, base)
+	assert.NilError(t, err)
+	assert.Equal(t, config.mtu, 1450)
+
+	config, err = parseRuntimeConfig(map[string]string{
+		"mtu":                  "1400",
+		"masqueradeExclusions": "10.10.0.0/16, fd00:10::/64",
+		"logLevel":             "debug",
+		"syncInterval":         "30s",
+		"nodeSelector":         "role!=edge",
+	}, base)
+	assert.NilError(t, err)
+	assert.Equal(t, config.mtu, 1400)
+	assert.Equal(t, util.FormatIPNets(config.masqueradeExclusions), "[10.10.0.0/16 fd00:10::/64]")
+	assert.Equal(t, config.logLevel, log.DebugLevel)
+	assert.Equal(t, config.syncInterval, 30*time.Second)
+	assert.Equal(t, config.nodeSelector.String(), "role!=edge,shiba.io/exclude!=true")
+
+	_, err = parseRuntimeConfig(map[string]string{
+		"mtu":            "100",
+		"syncInterval":   "1s",
+		"nodeSelector":   "role in (",
+		"egressGateways": "- {name: a}",
+		"typo":           "",
+	}, base)
+	assert.ErrorContains(t, err, "mtu should be")
+	assert.ErrorContains(t, err, "syncInterval should be")
+	assert.ErrorContains(t, err, "nodeSelector is bad")
+	assert.ErrorContains(t, err, "egressGateways is bad")
+	assert.ErrorContains(t, err, "unknown key typo")
+}
+
+func TestShiba_reloadConfig(t *testing.T) {
+	selector, err := newNodeSelector("")
+	assert.NilError(t, err)
+	s := &Shiba{
+		fireCh:     make(chan struct{}, 1),
+		baseConfig: runtimeConfig{mtu: 1450, logLevel: log.GetLevel(), syncInterval: time.Minute, nodeSelector: selector},
+	}
+	s.initConfig()
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: configMapName, Namespace: "shiba"},
+		Data:       map[string]string{"mtu": "1400"},
+	}
+	assert.Assert(t, !s.reloadConfig(configMap))
+	assert.Equal(t, s.ip6tnlMTU, 1400)
+	assert.Equal(t, len(s.fireCh), 1)
+
+	configMap.Data = map[string]string{"mtu": "1300", "logLevel": "loud"}
+	assert.Assert(t, !s.reloadConfig(configMap))
+	assert.Equal(t, s.ip6tnlMTU, 1400) // Rejected as a whole.
+
+	assert.Assert(t, !s.reloadConfig(nil))
+	assert.Equal(t, s.ip6tnlMTU, 1450)
+}
+
+func TestParseRuleDestination(t *testing.T) {
+	assert.Equal(t, parseRuleDestination(
+		`-A SHIBA -d 10.10.0.0/16 -m comment --comment "shiba masquerade exclusion" -j RETURN`), "10.10.0.0/16")
+	assert.Equal(t, parseRuleDestination("-A SHIBA -j MASQUERADE"), "")
+}
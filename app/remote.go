@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+// remoteCluster is another cluster whose nodes are peered with the current cluster.
+type remoteCluster struct {
+	name      string
+	client    kubernetes.Interface
+	podCIDRs  []*net.IPNet  // Guarded by lock.
+	restartCh chan struct{} // Restarts the watch when the node selector is changed.
+	// nodePodCIDRs are the pod CIDRs of each node if podCIDRs are collected from the nodes, nil if by kubeadm.
+	nodePodCIDRs map[string][]*net.IPNet
+	lock         sync.Mutex
+}
+
+type remoteEvent struct {
+	source string
+	event  watch.Event
+}
+
+// initRemoteClusters gets the pod CIDRs of remote clusters, to exclude them from NAT. Pod CIDRs collected from
+// the nodes are updated by the node events.
+func (shiba *Shiba) initRemoteClusters() error {
+	for _, cluster := range shiba.remoteClusters {
+		podCIDRs, err := shiba.getKubeadmPodCIDRs(cluster.client)
+		if err != nil {
+			log.Warningf("failed to get pod cidrs of remote cluster [%s] by kubeadm, collecting from nodes: %v",
+				cluster.name, err)
+			cluster.nodePodCIDRs, err = shiba.collectNodePodCIDRs(cluster.client)
+			if err != nil {
+				return fmt.Errorf("failed to get pod cidrs of remote cluster [%s]: %w", cluster.name, err)
+			}
+			podCIDRs = mergeNodePodCIDRs(cluster.nodePodCIDRs)
+		}
+		if len(podCIDRs) == 0 {
+			return fmt.Errorf("remote cluster [%s] has no pod cidr", cluster.name)
+		}
+		cluster.podCIDRs = podCIDRs
+		log.Infof("remote cluster [%s] has pod cidrs %v", cluster.name, util.FormatIPNets(podCIDRs))
+	}
+	return nil
+}
+
+// collectNodePodCIDRs returns the pod CIDRs of each node in a cluster.
+func (shiba *Shiba) collectNodePodCIDRs(client kubernetes.Interface) (map[string][]*net.IPNet, error) {
+	ctx, cancel := shiba.getAPIContext()
+	defer cancel()
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	nodePodCIDRs := make(map[string][]*net.IPNet, len(nodes.Items))
+	for _, node := range nodes.Items {
+		podCIDRs, err := util.ParseNodePodCIDRs(&node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pod cidrs of node [%s]: %w", node.Name, err)
+		}
+		nodePodCIDRs[node.Name] = podCIDRs
+	}
+	return nodePodCIDRs, nil
+}
+
+// mergeNodePodCIDRs returns the distinct pod CIDRs of the nodes in order.
+func mergeNodePodCIDRs(nodePodCIDRs map[string][]*net.IPNet) []*net.IPNet {
+	cidrMap := make(map[string]*net.IPNet)
+	for _, podCIDRs := range nodePodCIDRs {
+		for _, cidr := range podCIDRs {
+			cidrMap[cidr.String()] = cidr
+		}
+	}
+	keys := make([]string, 0, len(cidrMap))
+	for key := range cidrMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cidrs := make([]*net.IPNet, 0, len(keys))
+	for _, key := range keys {
+		cidrs = append(cidrs, cidrMap[key])
+	}
+	return cidrs
+}
+
+func (cluster *remoteCluster) getPodCIDRs() []*net.IPNet {
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	return cluster.podCIDRs
+}
+
+// updateRemotePodCIDRs updates the pod CIDRs of the remote cluster of the source by a node event, if they are
+// collected from the nodes. Returns whether they changed.
+func (shiba *Shiba) updateRemotePodCIDRs(source string, node *corev1.Node, deleted bool) bool {
+	var cluster *remoteCluster
+	for _, c := range shiba.remoteClusters {
+		if model.RemoteSource(c.name) == source {
+			cluster = c
+		}
+	}
+	if cluster == nil || cluster.nodePodCIDRs == nil {
+		return false
+	}
+	if deleted {
+		delete(cluster.nodePodCIDRs, node.Name)
+	} else {
+		podCIDRs, err := util.ParseNodePodCIDRs(node)
+		if err != nil {
+			peerLog(model.NodeKey(source, node.Name), "update-cidrs").WithError(err).
+				Error("failed to parse pod cidrs of node")
+			return false
+		}
+		cluster.nodePodCIDRs[node.Name] = podCIDRs
+	}
+	podCIDRs := mergeNodePodCIDRs(cluster.nodePodCIDRs)
+	cluster.lock.Lock()
+	defer cluster.lock.Unlock()
+	if util.FormatIPNets(podCIDRs) == util.FormatIPNets(cluster.podCIDRs) {
+		return false
+	}
+	cluster.podCIDRs = podCIDRs
+	log.Infof("remote cluster [%s] has pod cidrs %v", cluster.name, util.FormatIPNets(podCIDRs))
+	return true
+}
+
+// watchRemote forwards node events of a remote cluster to remoteEventCh until stopCh is closed.
+func (shiba *Shiba) watchRemote(stopCh <-chan struct{}, cluster *remoteCluster) {
+	source := model.RemoteSource(cluster.name)
+	for {
+		watcher, err := cluster.client.CoreV1().Nodes().Watch(context.Background(), shiba.nodeListOptions())
+		if err != nil {
+			log.Errorf("failed to watch node list of remote cluster [%s]: %v", cluster.name, err)
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(remoteRetryInterval):
+				continue
+			}
+		}
+		log.Infof("shiba started listening to remote cluster [%s]", cluster.name)
+		if !shiba.forwardRemoteEvents(stopCh, source, watcher, cluster.restartCh) {
+			return
+		}
+		log.Infof("watch channel of remote cluster [%s] closed", cluster.name)
+	}
+}
+
+// forwardRemoteEvents returns false if stopCh is closed.
+func (shiba *Shiba) forwardRemoteEvents(stopCh <-chan struct{}, source string, watcher watch.Interface,
+	restartCh <-chan struct{}) bool {
+	defer watcher.Stop()
+	watcherCh := watcher.ResultChan()
+	for {
+		select {
+		case <-stopCh:
+			return false
+		case <-restartCh:
+			return true
+		case event, ok := <-watcherCh:
+			if !ok {
+				return true
+			}
+			select {
+			case <-stopCh:
+				return false
+			case shiba.remoteEventCh <- remoteEvent{source: source, event: event}:
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func newTestNode(name, ip, podCIDR string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{PodCIDR: podCIDR},
+		Status: corev1.NodeStatus{
+			Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func TestShiba_remoteNodes(t *testing.T) {
+	local := newTestNode("node", "2001:db8::1", "10.244.1.0/24")
+	remote := newTestNode("node", "2001:db8:1::1", "10.245.1.0/24")
+	s := &Shiba{
+		client:         fake.NewSimpleClientset(local),
+		nodeName:       "self",
+		nodeMap:        make(model.NodeMap),
+		remoteClusters: []*remoteCluster{{name: "east", client: fake.NewSimpleClientset(remote)}},
+	}
+	s.processEvent(model.SourceCluster, watch.Event{Type: watch.Added, Object: local})
+	s.processEvent(model.RemoteSource("east"), watch.Event{Type: watch.Added, Object: remote})
+	nodeMap := s.cloneNodeMap()
+	assert.Equal(t, len(nodeMap), 2)
+	assert.Equal(t, nodeMap["node"].IP.String(), "2001:db8::1")
+	assert.Equal(t, nodeMap["remote:east/node"].IP.String(), "2001:db8:1::1")
+	assert.Equal(t, nodeMap["remote:east/node"].Source, model.RemoteSource("east"))
+
+	// Nodes of a cluster no longer peered are dropped.
+	s.nodeMap["remote:west/node"] = &model.Node{Name: "node", Source: model.RemoteSource("west")}
+	s.validateNodeMap()
+	assert.Equal(t, len(s.nodeMap), 2)
+	assert.Assert(t, s.nodeMap["remote:west/node"] == nil)
+
+	s.processEvent(model.RemoteSource("east"), watch.Event{Type: watch.Deleted, Object: remote})
+	nodeMap = s.cloneNodeMap()
+	assert.Equal(t, len(nodeMap), 1)
+	assert.Assert(t, nodeMap["node"] != nil)
+}
+
+func TestShiba_updateRemotePodCIDRs(t *testing.T) {
+	cluster := &remoteCluster{name: "east", nodePodCIDRs: make(map[string][]*net.IPNet)}
+	s := &Shiba{remoteClusters: []*remoteCluster{cluster}}
+	source := model.RemoteSource("east")
+	assert.Assert(t, s.updateRemotePodCIDRs(source, newTestNode("b", "2001:db8:1::2", "10.245.2.0/24"), false))
+	assert.Assert(t, s.updateRemotePodCIDRs(source, newTestNode("a", "2001:db8:1::1", "10.245.1.0/24"), false))
+	assert.Equal(t, util.FormatIPNets(cluster.getPodCIDRs()), "[10.245.1.0/24 10.245.2.0/24]")
+	assert.Assert(t, !s.updateRemotePodCIDRs(source, newTestNode("a", "2001:db8:1::1", "10.245.1.0/24"), false),
+		"nothing changed")
+	assert.Assert(t, s.updateRemotePodCIDRs(source, newTestNode("b", "2001:db8:1::2", "10.245.2.0/24"), true))
+	assert.Equal(t, util.FormatIPNets(cluster.getPodCIDRs()), "[10.245.1.0/24]")
+
+	// Pod CIDRs by kubeadm cover the nodes added later.
+	cluster.nodePodCIDRs = nil
+	assert.Assert(t, !s.updateRemotePodCIDRs(source, newTestNode("c", "2001:db8:1::3", "10.245.3.0/24"), false))
+	assert.Assert(t, !s.updateRemotePodCIDRs(model.RemoteSource("west"), newTestNode("c", "2001:db8:1::3",
+		"10.245.3.0/24"), false))
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+// Priority of the rules to the route table, before the main table at 32766.
+const routeRulePriority = 1000
+
+// listRoutes lists the routes matching the filter in the route table of shiba.
+func (shiba *Shiba) listRoutes(family int, filter *netlink.Route, mask uint64) ([]netlink.Route, error) {
+	if shiba.routeTable > 0 {
+		filter.Table = shiba.routeTable
+		mask |= netlink.RT_FILTER_TABLE
+	}
+	return netlink.RouteListFiltered(family, filter, mask)
+}
+
+// listTunnelRoutes lists the routes via the tunnel in the route table of shiba.
+func (shiba *Shiba) listTunnelRoutes(link netlink.Link) ([]netlink.Route, error) {
+	return shiba.listRoutes(netlink.FAMILY_ALL, &netlink.Route{LinkIndex: link.Attrs().Index}, netlink.RT_FILTER_OIF)
+}
+
+// routeRuleCIDRs returns the pod CIDRs whose traffic is looked up in the route table, which are the ones of the
+// cluster and the remote clusters.
+func (shiba *Shiba) routeRuleCIDRs() []*net.IPNet {
+	cidrs := append([]*net.IPNet{}, shiba.clusterPodCIDRs...)
+	for _, cluster := range shiba.remoteClusters {
+		cidrs = append(cidrs, cluster.getPodCIDRs()...)
+	}
+	return cidrs
+}
+
+// syncRouteRules makes the rules to the route table match the pod CIDRs. Rules of shiba are marked with the route
+// protocol, so only they are removed, including those to a table configured before. Without a table configured now
+// or before, there is no marked rule to remove.
+func (shiba *Shiba) syncRouteRules() {
+	expected := make(map[string]*net.IPNet)
+	if shiba.routeTable > 0 {
+		for _, cidr := range shiba.routeRuleCIDRs() {
+			expected[cidr.String()] = cidr
+		}
+	}
+	rules, err := util.ListRouteRules(routeProtocol)
+	if err != nil {
+		log.WithError(err).Error("failed to list rules")
+		shiba.recordSyncError(stageRoutes, fmt.Errorf("failed to list rules: %w", err))
+		return
+	}
+	for _, rule := range rules {
+		if rule.Table == shiba.routeTable && rule.Priority == routeRulePriority && expected[rule.Dst.String()] != nil {
+			delete(expected, rule.Dst.String())
+			continue
+		}
+		rule := rule
+		logger := log.WithFields(log.Fields{fieldCIDR: rule.Dst.String(), fieldOperation: "delete-rule"})
+		logger.Infof("deleting stale rule to route table %d", rule.Table)
+		if err := shiba.apply(stageRoutes, model.Change{
+			Kind: "rule", Action: "delete", Target: fmt.Sprintf("table %d", rule.Table),
+			Detail: fmt.Sprintf("to %s pref %d", rule.Dst, rule.Priority),
+		}, func() error {
+			return util.DeleteRouteRule(rule)
+		}); err != nil {
+			logger.WithError(err).Error("failed to delete rule")
+		}
+	}
+	for _, cidr := range expected {
+		rule := util.RouteRule{Dst: cidr, Table: shiba.routeTable, Priority: routeRulePriority, Protocol: routeProtocol}
+		logger := log.WithFields(log.Fields{fieldCIDR: cidr.String(), fieldOperation: "add-rule"})
+		logger.Info("adding rule to route table")
+		if err := shiba.apply(stageRoutes, model.Change{
+			Kind: "rule", Action: "add", Target: fmt.Sprintf("table %d", shiba.routeTable),
+			Detail: fmt.Sprintf("to %s pref %d proto %d", cidr, routeRulePriority, routeProtocol),
+		}, func() error {
+			return util.AddRouteRule(rule)
+		}); err != nil {
+			logger.WithError(err).Error("failed to add rule")
+		}
+	}
+}
+
+// removeStrayRoutes removes the routes of shiba to peers outside the route table, which are left by a previous run
+// with another table. Routes of the egress gateways have their own tables.
+func (shiba *Shiba) removeStrayRoutes() {
+	table := shiba.routeTable
+	if table <= 0 {
+		table = syscall.RT_TABLE_MAIN
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: routeProtocol},
+		netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE) // All tables.
+	if err != nil {
+		log.WithError(err).Error("failed to list routes of shiba")
+		shiba.recordSyncError(stageRoutes, fmt.Errorf("failed to list routes of shiba: %w", err))
+		return
+	}
+	for _, route := range routes {
+		if route.Table == table || isOwnedEgressTable(route.Table) {
+			continue
+		}
+		route := route
+		logger := log.WithFields(log.Fields{fieldCIDR: fmt.Sprint(route.Dst), fieldOperation: "delete-route"})
+		logger.Infof("deleting stray route in table %d", route.Table)
+		if err := shiba.apply(stageRoutes, model.Change{
+			Kind: "route", Action: "delete", Target: fmt.Sprintf("table %d", route.Table), Detail: route.String(),
+		}, func() error {
+			return netlink.RouteDel(&route)
+		}); err != nil {
+			logger.WithError(err).Error("failed to delete route")
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package app
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/moycat/shiba/util"
+)
+
+func TestShiba_routeRuleCIDRs(t *testing.T) {
+	clusterCIDRs, err := util.ParseIPNets([]string{"10.244.0.0/16", "fd00:244::/56"})
+	assert.NilError(t, err)
+	remoteCIDRs, err := util.ParseIPNets([]string{"10.245.0.0/16"})
+	assert.NilError(t, err)
+	shiba := &Shiba{
+		clusterPodCIDRs: clusterCIDRs,
+		remoteClusters:  []*remoteCluster{{name: "east", podCIDRs: remoteCIDRs}},
+	}
+	assert.Equal(t, util.FormatIPNets(shiba.routeRuleCIDRs()), "[10.244.0.0/16 fd00:244::/56 10.245.0.0/16]")
+	assert.Equal(t, len(shiba.clusterPodCIDRs), 2) // Not modified.
+}
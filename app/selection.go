@@ -0,0 +1,180 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/moycat/shiba/model"
+)
+
+// newNodeSelector returns the selector of nodes to peer with, which always excludes the nodes labeled to.
+func newNodeSelector(selector string) (labels.Selector, error) {
+	s := excludeLabel + "!=true"
+	if len(selector) > 0 {
+		s += "," + selector
+	}
+	return labels.Parse(s)
+}
+
+// nodeListOptions returns the options to list or watch nodes to peer with.
+func (shiba *Shiba) nodeListOptions() metav1.ListOptions {
+	shiba.configLock.Lock()
+	defer shiba.configLock.Unlock()
+	if shiba.nodeSelector == nil {
+		return metav1.ListOptions{}
+	}
+	return metav1.ListOptions{LabelSelector: shiba.nodeSelector.String()}
+}
+
+// isNodeSelected checks if the node should be peered with by the labels and the taints.
+func (shiba *Shiba) isNodeSelected(node *corev1.Node) bool {
+	shiba.configLock.Lock()
+	selector := shiba.nodeSelector
+	shiba.configLock.Unlock()
+	if selector != nil && !selector.Matches(labels.Set(node.Labels)) {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		for _, key := range shiba.excludeTaints {
+			if taint.Key == key {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pruneNodeMap removes the nodes no longer selected from the node map.
+// Newly selected nodes are added by the events after the watch is restarted.
+func (shiba *Shiba) pruneNodeMap() {
+	clients := map[string]kubernetes.Interface{model.SourceCluster: shiba.client}
+	for _, cluster := range shiba.remoteClusters {
+		clients[model.RemoteSource(cluster.name)] = cluster.client
+	}
+	selected := make(map[string]bool)
+	for source, client := range clients {
+		ctx, cancel := shiba.getAPIContext()
+		nodes, err := client.CoreV1().Nodes().List(ctx, shiba.nodeListOptions())
+		cancel()
+		if err != nil {
+			log.Errorf("failed to list nodes of [%s], not pruning: %v", source, err)
+			return
+		}
+		for i := range nodes.Items {
+			if shiba.isNodeSelected(&nodes.Items[i]) {
+				selected[model.NodeKey(source, nodes.Items[i].Name)] = true
+			}
+		}
+	}
+	nodeMap := shiba.cloneNodeMap()
+	var changed bool
+	for key, node := range nodeMap {
+		if node.Source != model.SourceStatic && !selected[key] {
+			log.Infof("node [%s] is no longer selected", key)
+			delete(nodeMap, key)
+			changed = true
+		}
+	}
+	if changed {
+		shiba.saveNodeMap(nodeMap)
+		shiba.dumpNodeMap()
+		shiba.fire()
+	}
+}
+
+// nodeZone returns the zone of the node and whether it's a gateway of the zone.
+// It's empty if scoping is disabled or the node is not of the current cluster.
+func (shiba *Shiba) nodeZone(source string, node *corev1.Node) (string, bool) {
+	if len(shiba.zoneLabel) == 0 || source != model.SourceCluster {
+		return "", false
+	}
+	return node.Labels[shiba.zoneLabel], node.Labels[zoneGatewayLabel] == "true"
+}
+
+// scopeNodeMap returns the peers to tunnel to, with the pod CIDRs of the nodes in other zones routed through
+// the zone gateways. A non-gateway node only peers with nodes in its zone, and sends the traffic to other zones
+// to a gateway of its zone. A gateway node also peers with the gateways of other zones, and sends the traffic to
+// non-gateway nodes there through their gateways. Nodes are peered directly if either zone has no gateway, so that
+// both ends agree on the path, which the tunnels and the anti-spoofing rules rely on.
+// Only nodes of the current cluster are scoped.
+func (shiba *Shiba) scopeNodeMap(nodeMap model.NodeMap) model.NodeMap {
+	if len(shiba.zoneLabel) == 0 {
+		return nodeMap
+	}
+	zone, zoneGateway := shiba.selfZone()
+	gateways := make(map[string]*model.Node) // Zone -> the first gateway by name.
+	for _, node := range nodeMap {
+		if node.Source != model.SourceCluster || !node.ZoneGateway {
+			continue
+		}
+		if gateway, ok := gateways[node.Zone]; !ok || node.Name < gateway.Name {
+			gateways[node.Zone] = node
+		}
+	}
+	peerMap := make(model.NodeMap, len(nodeMap))
+	viaCIDRs := make(map[string][]*net.IPNet) // Key of the gateway -> pod CIDRs routed through it.
+	for key, node := range nodeMap {
+		var gateway *model.Node
+		if node.Source == model.SourceCluster && node.Zone != zone {
+			if !zoneGateway {
+				if gateways[node.Zone] != nil {
+					gateway = gateways[zone]
+				}
+			} else if !node.ZoneGateway {
+				gateway = gateways[node.Zone]
+			}
+		}
+		if gateway == nil {
+			peerMap[key] = node
+			continue
+		}
+		log.Debugf("routing node [%s] in zone [%s] through gateway [%s]", key, node.Zone, gateway.Name)
+		viaCIDRs[gateway.Key()] = append(viaCIDRs[gateway.Key()], node.PodCIDRs...)
+	}
+	for key, cidrs := range viaCIDRs {
+		gateway := *peerMap[key]
+		gateway.PodCIDRs = append(append([]*net.IPNet(nil), gateway.PodCIDRs...), cidrs...)
+		sort.Slice(gateway.PodCIDRs, func(i, j int) bool {
+			return gateway.PodCIDRs[i].String() < gateway.PodCIDRs[j].String()
+		})
+		peerMap[key] = &gateway
+	}
+	return peerMap
+}
+
+// selfZone returns the zone of the current node and whether it's a gateway of the zone.
+func (shiba *Shiba) selfZone() (string, bool) {
+	shiba.nodeMapLock.Lock()
+	defer shiba.nodeMapLock.Unlock()
+	return shiba.zone, shiba.zoneGateway
+}
+
+// updateSelfZone updates the zone of the current node by its labels, returning whether it changed.
+func (shiba *Shiba) updateSelfZone(node *corev1.Node) bool {
+	zone, zoneGateway := shiba.nodeZone(model.SourceCluster, node)
+	shiba.nodeMapLock.Lock()
+	defer shiba.nodeMapLock.Unlock()
+	if zone == shiba.zone && zoneGateway == shiba.zoneGateway {
+		return false
+	}
+	log.Infof("node [%s] moved to zone [%s], gateway: %v", shiba.nodeName, zone, zoneGateway)
+	shiba.zone, shiba.zoneGateway = zone, zoneGateway
+	return true
+}
+
+// describeScope returns the human-readable node selection config.
+func (shiba *Shiba) describeScope() string {
+	s := fmt.Sprintf("selector [%v], excluded taints %v", shiba.nodeSelector, shiba.excludeTaints)
+	if len(shiba.zoneLabel) > 0 {
+		zone, zoneGateway := shiba.selfZone()
+		s += fmt.Sprintf(", zone [%s] by label [%s], gateway: %v", zone, shiba.zoneLabel, zoneGateway)
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func TestShiba_isNodeSelected(t *testing.T) {
+	selector, err := newNodeSelector("role!=edge")
+	assert.NilError(t, err)
+	s := &Shiba{nodeSelector: selector, excludeTaints: []string{"example.com/no-overlay"}}
+	node := newTestNode("node", "2001:db8::1", "10.244.1.0/24")
+	assert.Assert(t, s.isNodeSelected(node))
+	node.Labels = map[string]string{excludeLabel: "true"}
+	assert.Assert(t, !s.isNodeSelected(node))
+	node.Labels = map[string]string{"role": "edge"}
+	assert.Assert(t, !s.isNodeSelected(node))
+	node.Labels = nil
+	node.Spec.Taints = []corev1.Taint{{Key: "example.com/no-overlay", Effect: corev1.TaintEffectNoSchedule}}
+	assert.Assert(t, !s.isNodeSelected(node))
+}
+
+func TestShiba_processEvent_unselected(t *testing.T) {
+	selector, err := newNodeSelector("")
+	assert.NilError(t, err)
+	s := &Shiba{
+		nodeName:     "self",
+		nodeMap:      make(model.NodeMap),
+		fireCh:       make(chan struct{}, 1),
+		nodeSelector: selector,
+	}
+	node := newTestNode("node", "2001:db8::1", "10.244.1.0/24")
+	s.processEvent(model.SourceCluster, watch.Event{Type: watch.Added, Object: node})
+	assert.Equal(t, len(s.cloneNodeMap()), 1)
+	node = node.DeepCopy()
+	node.Labels = map[string]string{excludeLabel: "true"}
+	s.processEvent(model.SourceCluster, watch.Event{Type: watch.Modified, Object: node})
+	assert.Equal(t, len(s.cloneNodeMap()), 0)
+	s.processEvent(model.SourceCluster, watch.Event{Type: watch.Added, Object: node})
+	assert.Equal(t, len(s.cloneNodeMap()), 0)
+}
+
+func TestShiba_processEvent_selfZone(t *testing.T) {
+	s := &Shiba{
+		nodeName:  "self",
+		nodeMap:   make(model.NodeMap),
+		fireCh:    make(chan struct{}, 1),
+		zoneLabel: "zone",
+		zone:      "a",
+	}
+	self := newTestNode("self", "2001:db8::1", "10.244.1.0/24")
+	self.Labels = map[string]string{"zone": "a"}
+	s.processEvent(model.SourceCluster, watch.Event{Type: watch.Modified, Object: self})
+	assert.Equal(t, len(s.fireCh), 0, "nothing changed")
+
+	self = self.DeepCopy()
+	self.Labels = map[string]string{"zone": "b", zoneGatewayLabel: "true"}
+	s.processEvent(model.SourceCluster, watch.Event{Type: watch.Modified, Object: self})
+	assert.Equal(t, len(s.fireCh), 1)
+	zone, zoneGateway := s.selfZone()
+	assert.Equal(t, zone, "b")
+	assert.Assert(t, zoneGateway)
+	assert.Equal(t, len(s.cloneNodeMap()), 0, "self is never a peer")
+}
+
+func TestShiba_scopeNodeMap(t *testing.T) {
+	newNode := func(name, zone string, gateway bool, cidr string) *model.Node {
+		cidrs, err := util.ParseIPNets([]string{cidr})
+		assert.NilError(t, err)
+		return &model.Node{Name: name, IP: net.ParseIP("2001:db8::1"), PodCIDRs: cidrs, Zone: zone, ZoneGateway: gateway}
+	}
+	nodeMap := model.NodeMap{
+		"a-1":  newNode("a-1", "a", false, "10.0.1.0/24"),
+		"a-gw": newNode("a-gw", "a", true, "10.0.2.0/24"),
+		"b-1":  newNode("b-1", "b", false, "10.0.3.0/24"),
+		"b-gw": newNode("b-gw", "b", true, "10.0.4.0/24"),
+		"c-1":  newNode("c-1", "c", false, "10.0.5.0/24"), // Zone without a gateway.
+	}
+	s := &Shiba{zoneLabel: "zone", zone: "a"}
+	peerMap := s.scopeNodeMap(nodeMap)
+	assert.Equal(t, len(peerMap), 3)
+	assert.Equal(t, util.FormatIPNets(peerMap["a-gw"].PodCIDRs), "[10.0.2.0/24 10.0.3.0/24 10.0.4.0/24]")
+	assert.Assert(t, peerMap["c-1"] != nil, "peered directly as zone c has no gateway")
+	assert.Equal(t, util.FormatIPNets(nodeMap["a-gw"].PodCIDRs), "[10.0.2.0/24]") // Not modified.
+
+	s.zoneGateway = true
+	peerMap = s.scopeNodeMap(nodeMap)
+	assert.Equal(t, len(peerMap), 4)
+	assert.Equal(t, util.FormatIPNets(peerMap["b-gw"].PodCIDRs), "[10.0.3.0/24 10.0.4.0/24]")
+	assert.Assert(t, peerMap["c-1"] != nil)
+
+	// Peers in a zone without a gateway are peered directly both ways.
+	s = &Shiba{zoneLabel: "zone", zone: "c"}
+	delete(nodeMap, "c-1")
+	peerMap = s.scopeNodeMap(nodeMap)
+	assert.Equal(t, len(peerMap), 4)
+	assert.Equal(t, util.FormatIPNets(peerMap["a-1"].PodCIDRs), "[10.0.1.0/24]")
+}
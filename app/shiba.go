@@ -4,41 +4,140 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
 )
 
 const (
-	cniConfigName      = "10-shiba.conflist"
-	cniNetName         = "shiba-net"
-	executeGracePeriod = time.Second
-	fireInterval       = time.Minute
-	iptablesChain      = "SHIBA"
-	nodeMapFilename    = "shiba-node-map"
-	tunnelPrefix       = "shiba."
+	cniConfigName              = "10-shiba.conflist"
+	cniNetName                 = "shiba-net"
+	configMapName              = "shiba-config"
+	excludeLabel               = "shiba.io/exclude"
+	executeGracePeriod         = time.Second
+	fireInterval               = time.Minute
+	iptablesChain              = "SHIBA"
+	ipPoolAnnotation           = "shiba.io/ip-pool"
+	ipsecNonceAnnotation       = "shiba.io/ipsec-nonce"
+	linkAliasPrefix            = "shiba:" // Marks the links owned by shiba, followed by the peer.
+	nodeMapFilename            = "shiba-node-map"
+	poolIPsAnnotation          = "shiba.io/pool-ips"
+	publishedIPAnnotation      = "shiba.io/published-underlay-ip" // Underlay addresses found by the node itself.
+	probeFailureThreshold      = 3
+	probeTimeout               = time.Second
+	remoteRetryInterval        = 10 * time.Second
+	routeProtocol              = 91 // Marks the routes owned by shiba.
+	staticIPAnnotation         = "shiba.io/ip"
+	tunnelPrefix               = "shiba."
+	underlayIPAnnotation       = "shiba.io/underlay-ip" // Set by operators to override the underlay addresses.
+	unreachablePeersAnnotation = "shiba.io/unreachable-peers"
+	zoneGatewayLabel           = "shiba.io/zone-gateway"
 )
 
 // Shiba is the main app.
 type Shiba struct {
-	client          kubernetes.Interface
-	cniConfigPath   string
-	clusterPodCIDRs []*net.IPNet
-	nodeName        string
-	nodeIP          net.IP // IPv6 only.
-	nodePodCIDRs    []*net.IPNet
-	nodeGateways    []net.IP
-	nodeGatewayMap  map[string]bool
-	nodeMap         model.NodeMap // When a map reaches here, it's immutable.
-	nodeMapLock     sync.Mutex
-	fireCh          chan struct{}
-	apiTimeout      time.Duration
-	ip6tnlMTU       int // the mtu config for ip6tnl interface
+	client            kubernetes.Interface
+	informers         informers.SharedInformerFactory // Started by Run, shared by the components watching objects.
+	cniConfigPath     string
+	clusterPodCIDRs   []*net.IPNet
+	nodeName          string
+	nodeIP            net.IP   // IPv6 only.
+	nodeIPs           []net.IP // All underlay addresses in multi-path mode, the first one is nodeIP.
+	nodePodCIDRs      []*net.IPNet
+	nodeGateways      []net.IP
+	nodeGatewayMap    map[string]bool
+	nodeMap           model.NodeMap // When a map reaches here, it's immutable.
+	nodeMapLock       sync.Mutex
+	nodeMapPath       string // The cache of the node map across restarts, empty to disable.
+	fireCh            chan struct{}
+	apiTimeout        time.Duration
+	ip6tnlMTU         int // the mtu config for ip6tnl interface, guarded by configLock.
+	dryRun            bool
+	plan              model.Plan // Changes recorded in dry-run mode.
+	planLock          sync.Mutex
+	syncErrors        map[string]error // Stage -> the last error of the stage, guarded by planLock.
+	recorder          record.EventRecorder
+	probeInterval     time.Duration
+	peerHealth        map[string]*model.PeerHealth // Gateway IP -> health.
+	peerHealthLock    sync.Mutex
+	unreachablePeers  map[string]bool
+	proxy             *serviceProxy // Nil if the service proxy is disabled.
+	staticPeersPath   string
+	remoteClusters    []*remoteCluster
+	remoteEventCh     chan remoteEvent
+	nodeIPPolicy      util.NodeIPPolicy
+	underlayInterface string
+	multipath         bool
+	nodeSelector      labels.Selector // Guarded by configLock.
+	excludeTaints     []string
+	zoneLabel         string
+	zone              string // Zone of the current node, guarded by nodeMapLock.
+	zoneGateway       bool   // Whether the current node is a gateway of its zone, guarded by nodeMapLock.
+	// Runtime config, changed by the config map.
+	configNamespace      string // Empty to disable the config map.
+	configCh             chan *corev1.ConfigMap
+	configLock           sync.Mutex
+	baseConfig           runtimeConfig // Config by options, overridden by the config map.
+	masqueradeExclusions []*net.IPNet
+	logLevel             log.Level
+	syncInterval         time.Duration
+	syncTicker           *time.Ticker
+	dynamicClient        dynamic.Interface // Nil to not publish the ShibaNode.
+	nodeUID              string
+	antiSpoofing         bool
+	filterApplied        map[*ipFamily]string // The last successfully applied filter script of each family.
+	ipsecSecretNamespace string
+	ipsecSecretName      string // Empty to disable IPsec.
+	ipsecKeySet          *ipsecKeySet
+	ipsecNonce           string          // Published on the node, rotated before an outgoing state is reinstalled.
+	ipsecInstalled       map[string]bool // Outgoing states installed with the current nonce, guarded by ipsecLock.
+	ipsecLock            sync.Mutex
+	routeTable           int // Zero for the main table.
+	cniVersion           string
+	cniBinPath           string // Empty to not check the plugin binaries.
+	cniPlugins           []string
+	cniSysctls           map[string]string
+	cniExtraPlugins      []map[string]interface{}
+	cniConfig            []byte
+	cniConfigOnSync      bool // Write the CNI config after the first successful sync, and remove it on exit.
+	cniReady             bool // Whether the CNI config is written after a sync, guarded by cniLock.
+	cniStopped           bool // Guarded by cniLock.
+	cniLock              sync.Mutex
+	ipamGCInterval       time.Duration // Non-positive to disable IPAM garbage collection.
+	ipamGCGracePeriod    time.Duration
+	ipamDataPath         string
+	sandboxStatePath     string // Empty to not check the pod sandboxes.
+	ipamStats            ipamStats
+	ipamLock             sync.Mutex
+	ipPools              []IPPool
+	poolCIDRs            map[string]*net.IPNet // Pool name -> CIDR on the node.
+	poolRangeEnds        map[string]net.IP     // Node pod CIDR -> the last address left to host-local.
+	clusterPoolCIDRs     []*net.IPNet
+	publishedPoolIPs     string // Guarded by poolLock.
+	poolLock             sync.Mutex
+	ipamSocketPath       string
+	egressPolicies       []*egressPolicy // Guarded by configLock.
+	egressPods           map[string]*egressPod
+	egressPodInformer    cache.SharedIndexInformer // Nil until there are egress policies, guarded by egressLock.
+	egressLock           sync.Mutex
+	egressCh             chan struct{} // Notified when the egress policies change.
+	loadBalancer         *loadBalancer // Nil if disabled.
+	bgpSpeaker           *bgpSpeaker   // Nil if disabled.
+	flowLogger           *flowLogger   // Nil if disabled.
 }
 
 // ShibaOptions specifies the non-essential options for Shiba.
@@ -46,20 +145,176 @@ type ShibaOptions struct {
 	APITimeout      time.Duration
 	ClusterPodCIDRs []*net.IPNet
 	IP6tnlMTU       int
+	DryRun          bool
+	ProbeInterval   time.Duration // Non-positive to disable probing.
+	ServiceProxy    bool
+	StaticPeersPath string                          // The file defining static peers, empty to disable.
+	RemoteClusters  map[string]kubernetes.Interface // Cluster name -> client.
+	// UnderlayAddressTypes are the node address types to find underlay addresses from in order.
+	UnderlayAddressTypes []corev1.NodeAddressType
+	// UnderlayCIDRs are the preferred subnets of underlay addresses in order.
+	UnderlayCIDRs []*net.IPNet
+	// UnderlayInterface is the interface to find the underlay address of the current node from.
+	UnderlayInterface string
+	// Multipath creates a tunnel through each pair of local and remote underlay addresses, and spreads
+	// the traffic to a peer across them.
+	Multipath bool
+	// NodeSelector is the label selector of nodes to peer with. Nodes labeled shiba.io/exclude=true are always excluded.
+	NodeSelector string
+	// ExcludeTaints are the taint keys of nodes not to peer with.
+	ExcludeTaints []string
+	// ZoneLabel is the node label of zones. If set, nodes only peer with nodes in the same zone, and reach other
+	// zones through the gateway nodes labeled shiba.io/zone-gateway=true.
+	ZoneLabel string
+	// ConfigNamespace is the namespace of the shiba-config config map to reload the runtime config from,
+	// empty to disable.
+	ConfigNamespace string
+	// DynamicClient is used to publish the overlay state to the ShibaNode of the node, nil to disable.
+	DynamicClient dynamic.Interface
+	// AntiSpoofing drops traffic from tunnels and local pods with unexpected source addresses, and tunneled
+	// packets from unknown underlay addresses, using nftables.
+	AntiSpoofing bool
+	// IPsecSecret is the secret of pre-shared keys in the form of namespace/name, which enables IPsec encryption
+	// of the traffic between nodes. Empty to disable.
+	IPsecSecret string
+	// RouteTable is the routing table of the routes to peers, which is looked up for the traffic to the cluster
+	// pod CIDRs by rules. Zero to use the main table.
+	RouteTable int
+	// CNIVersion is the version of the CNI spec of the config, one of CNIVersions, 0.3.1 by default.
+	CNIVersion string
+	// CNIBinPath is the path to CNI plugin binaries to check that all plugins in the chain exist, empty to skip.
+	CNIBinPath string
+	// CNIPlugins are the optional plugins to chain, see CNIPlugin*.
+	CNIPlugins []string
+	// CNISysctls are the sysctls of pods set by the tuning plugin.
+	CNISysctls map[string]string
+	// CNIExtraPlugins are the plugin stanzas appended to the chain as they are.
+	CNIExtraPlugins []map[string]interface{}
+	// CNIConfigOnSync writes the CNI config only after the first successful sync and removes it on exit,
+	// so pods are only scheduled to the node while its overlay is maintained.
+	CNIConfigOnSync bool
+	// IPAMGCInterval is the interval to release the host-local allocations leaked by pods on the node, non-positive
+	// to disable.
+	IPAMGCInterval time.Duration
+	// IPAMGCGracePeriod is how long an allocation must be unused before it's released.
+	IPAMGCGracePeriod time.Duration
+	// IPAMDataPath is the data directory of host-local.
+	IPAMDataPath string
+	// SandboxStatePath is the state directory of the container runtime with a directory for each running pod
+	// sandbox, whose allocations are never released. Empty to only check the pods.
+	SandboxStatePath string
+	// IPPools are the pools of pod addresses requested by the shiba.io/ip-pool and shiba.io/ip annotations of pods,
+	// which are served by the shiba-ipam plugin. Empty to use host-local directly.
+	IPPools []IPPool
+	// IPAMSocketPath is the unix socket serving the shiba-ipam plugin.
+	IPAMSocketPath string
+	// LoadBalancerCIDRs are the pools to allocate the IPs of LoadBalancer services from, which are announced by
+	// ARP/NDP from a node elected for each service. Empty to disable. ConfigNamespace holds the allocator lease.
+	LoadBalancerCIDRs []*net.IPNet
+	// LoadBalancerInterface is the interface to announce the load balancer IPs on.
+	LoadBalancerInterface string
+	// LoadBalancerClassless serves the LoadBalancer services without a class as well as those of LoadBalancerClass.
+	LoadBalancerClassless bool
+	// BGPPeers are the upstream routers to announce the pod CIDRs of the node to, empty to disable.
+	BGPPeers []BGPPeer
+	// BGPLocalASN is the ASN of the nodes.
+	BGPLocalASN uint32
+	// BGPRouterID is the BGP router ID of the node, nil to use the local IPv4 address of each session, or one
+	// derived from the node name.
+	BGPRouterID net.IP
+	// FlowLogPath is the file to write the flows of pods on the node to as JSON lines, FlowLogStdout for stdout,
+	// empty to disable.
+	FlowLogPath string
+	// FlowMetrics counts the flows of pods by namespaces in metrics.
+	FlowMetrics bool
 }
 
 // NewShiba returns a new instance of Shiba.
 func NewShiba(client kubernetes.Interface, nodeName, cniConfigPath string, options ShibaOptions) (*Shiba, error) {
 	shiba := &Shiba{
 		client:          client,
+		informers:       informers.NewSharedInformerFactory(client, 0),
 		cniConfigPath:   cniConfigPath,
 		nodeName:        nodeName,
 		nodeMap:         make(model.NodeMap),
+		nodeMapPath:     filepath.Join(os.TempDir(), nodeMapFilename),
 		nodeGatewayMap:  make(map[string]bool),
 		fireCh:          make(chan struct{}, 1),
 		apiTimeout:      options.APITimeout,
 		clusterPodCIDRs: options.ClusterPodCIDRs,
-		ip6tnlMTU:       options.IP6tnlMTU,
+		dryRun:          options.DryRun,
+		plan:            make(model.Plan),
+		recorder:        newEventRecorder(client, nodeName),
+		probeInterval:   options.ProbeInterval,
+		peerHealth:      make(map[string]*model.PeerHealth),
+		staticPeersPath: options.StaticPeersPath,
+		remoteEventCh:   make(chan remoteEvent),
+		nodeIPPolicy: util.NodeIPPolicy{
+			Annotation:          underlayIPAnnotation,
+			PublishedAnnotation: publishedIPAnnotation,
+			AddressTypes:        options.UnderlayAddressTypes,
+			PreferredCIDRs:      options.UnderlayCIDRs,
+		},
+		underlayInterface: options.UnderlayInterface,
+		multipath:         options.Multipath,
+		excludeTaints:     options.ExcludeTaints,
+		zoneLabel:         options.ZoneLabel,
+		configNamespace:   options.ConfigNamespace,
+		configCh:          make(chan *corev1.ConfigMap),
+		dynamicClient:     options.DynamicClient,
+		antiSpoofing:      options.AntiSpoofing,
+		filterApplied:     make(map[*ipFamily]string),
+		routeTable:        options.RouteTable,
+		cniVersion:        options.CNIVersion,
+		cniBinPath:        options.CNIBinPath,
+		cniPlugins:        options.CNIPlugins,
+		cniSysctls:        options.CNISysctls,
+		cniExtraPlugins:   options.CNIExtraPlugins,
+		cniConfigOnSync:   options.CNIConfigOnSync,
+		ipamGCInterval:    options.IPAMGCInterval,
+		ipamGCGracePeriod: options.IPAMGCGracePeriod,
+		ipamDataPath:      options.IPAMDataPath,
+		sandboxStatePath:  options.SandboxStatePath,
+		ipPools:           options.IPPools,
+		ipamSocketPath:    options.IPAMSocketPath,
+		egressPods:        make(map[string]*egressPod),
+		egressCh:          make(chan struct{}, 1),
+	}
+	if len(options.IPsecSecret) > 0 {
+		parts := strings.Split(options.IPsecSecret, "/")
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("bad ipsec secret [%s], should be namespace/name", options.IPsecSecret)
+		}
+		shiba.ipsecSecretNamespace, shiba.ipsecSecretName = parts[0], parts[1]
+	}
+	nodeSelector, err := newNodeSelector(options.NodeSelector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse node selector: %w", err)
+	}
+	shiba.baseConfig = runtimeConfig{
+		mtu:          options.IP6tnlMTU,
+		logLevel:     log.GetLevel(),
+		syncInterval: fireInterval,
+		nodeSelector: nodeSelector,
+	}
+	for name, client := range options.RemoteClusters {
+		shiba.remoteClusters = append(shiba.remoteClusters, &remoteCluster{
+			name:      name,
+			client:    client,
+			restartCh: make(chan struct{}, 1),
+		})
+	}
+	shiba.initConfig()
+	if options.ServiceProxy {
+		shiba.proxy = newServiceProxy(shiba)
+	} else {
+		shiba.removeProxyRules()
+	}
+	if !shiba.antiSpoofing {
+		shiba.removeFilterRules()
+	}
+	if len(shiba.ipsecSecretName) == 0 {
+		shiba.removeIPsec()
 	}
 	if err := shiba.initSelf(); err != nil {
 		return nil, fmt.Errorf("failed to get info about self: %w", err)
@@ -67,25 +322,102 @@ func NewShiba(client kubernetes.Interface, nodeName, cniConfigPath string, optio
 	if err := shiba.initCluster(); err != nil {
 		return nil, fmt.Errorf("failed to get info about the cluster: %w", err)
 	}
+	if err := shiba.initRemoteClusters(); err != nil {
+		return nil, fmt.Errorf("failed to get info about remote clusters: %w", err)
+	}
+	if err := shiba.initIPsec(); err != nil {
+		return nil, fmt.Errorf("failed to init ipsec: %w", err)
+	}
+	if err := shiba.initPools(); err != nil {
+		return nil, fmt.Errorf("failed to init ip pools: %w", err)
+	}
 	if err := shiba.initCNI(); err != nil {
 		return nil, fmt.Errorf("failed to init cni: %w", err)
 	}
+	if err := shiba.initBGP(options.BGPLocalASN, options.BGPRouterID, options.BGPPeers); err != nil {
+		return nil, fmt.Errorf("failed to init bgp: %w", err)
+	}
+	if err := shiba.initFlowLog(options.FlowLogPath, options.FlowMetrics); err != nil {
+		return nil, fmt.Errorf("failed to init flow log: %w", err)
+	}
+	if err := shiba.initLoadBalancer(options.LoadBalancerCIDRs, options.LoadBalancerInterface,
+		options.LoadBalancerClassless); err != nil {
+		return nil, fmt.Errorf("failed to init load balancer: %w", err)
+	}
 	if err := shiba.initNAT(); err != nil {
 		return nil, fmt.Errorf("failed to init nat: %w", err)
 	}
+	if err := shiba.syncMasqueradeExclusions(); err != nil {
+		return nil, fmt.Errorf("failed to sync masquerade exclusions: %w", err)
+	}
 	shiba.loadNodeMap()
+	if len(shiba.staticPeersPath) > 0 {
+		shiba.syncStaticPeers()
+	}
 	shiba.fireCh <- struct{}{} // Trigger a sync for the loaded configuration.
+	if shiba.dryRun {
+		log.Warning("shiba is running in dry-run mode, no changes will be applied")
+	}
 	log.Info("shiba initialized")
 	return shiba, nil
 }
 
 // Run starts the main routine until stopCh is closed.
 func (shiba *Shiba) Run(stopCh <-chan struct{}) error {
+	shiba.syncTicker = time.NewTicker(shiba.syncInterval)
+	defer shiba.syncTicker.Stop()
+	defer shiba.cleanupCNI()
 	go shiba.execute(stopCh)
-	go shiba.periodicFire(stopCh)
+	go shiba.periodicFire(stopCh, shiba.syncTicker.C)
+	if shiba.probeInterval > 0 {
+		go shiba.probe(stopCh)
+	}
+	if shiba.proxy != nil {
+		go shiba.proxy.run(stopCh)
+	}
+	if shiba.flowLogger != nil {
+		go shiba.flowLogger.run(stopCh)
+	}
+	if shiba.bgpSpeaker != nil {
+		defer shiba.bgpSpeaker.wait() // For the withdrawal.
+		shiba.bgpSpeaker.run(stopCh)
+	}
+	if shiba.loadBalancer != nil {
+		defer shiba.loadBalancer.cleanup()
+		go shiba.loadBalancer.run(stopCh)
+	}
+	for _, cluster := range shiba.remoteClusters {
+		go shiba.watchRemote(stopCh, cluster)
+	}
+	if shiba.multipath {
+		go shiba.watchUplinks(stopCh)
+	}
+	if len(shiba.configNamespace) > 0 {
+		go shiba.watchConfig(stopCh)
+		go shiba.watchEgressPods(stopCh)
+	}
+	if shiba.antiSpoofing {
+		go shiba.watchPodRoutes(stopCh)
+	}
+	if len(shiba.ipsecSecretName) > 0 {
+		go shiba.watchIPsecSecret(stopCh)
+	}
+	if shiba.ipamGCInterval > 0 {
+		go shiba.runIPAMGC(stopCh)
+	}
+	if len(shiba.ipPools) > 0 {
+		go shiba.serveIPAM(stopCh)
+	}
+	shiba.informers.Start(stopCh)
+	var staticPeersCh <-chan time.Time // Reload static peers in the same routine as node events.
+	if len(shiba.staticPeersPath) > 0 {
+		ticker := time.NewTicker(fireInterval)
+		defer ticker.Stop()
+		staticPeersCh = ticker.C
+	}
 watchLoop:
 	for {
-		watcher, err := shiba.client.CoreV1().Nodes().Watch(context.Background(), metav1.ListOptions{})
+		watcher, err := shiba.client.CoreV1().Nodes().Watch(context.Background(), shiba.nodeListOptions())
 		if err != nil {
 			return fmt.Errorf("failed to watch node list: %w", err)
 		}
@@ -101,25 +433,46 @@ watchLoop:
 					log.Info("watch channel closed")
 					continue watchLoop
 				}
-				shiba.processEvent(event)
+				shiba.processEvent(model.SourceCluster, event)
+			case e := <-shiba.remoteEventCh:
+				shiba.processEvent(e.source, e.event)
+			case <-staticPeersCh:
+				if shiba.syncStaticPeers() {
+					shiba.fire()
+				}
+			case configMap := <-shiba.configCh:
+				if shiba.reloadConfig(configMap) {
+					log.Info("restarting node watches for the new node selector")
+					watcher.Stop()
+					for _, cluster := range shiba.remoteClusters {
+						select {
+						case cluster.restartCh <- struct{}{}:
+						default:
+						}
+					}
+					continue watchLoop
+				}
 			}
 		}
 	}
 }
 
-// periodicFire triggers a sync every fireInterval, in case of external corruption.
-func (shiba *Shiba) periodicFire(stopCh <-chan struct{}) {
-	ticker := time.NewTicker(fireInterval)
-	defer ticker.Stop()
+// periodicFire triggers a sync every tick of the sync interval, in case of external corruption.
+func (shiba *Shiba) periodicFire(stopCh <-chan struct{}, tickCh <-chan time.Time) {
 	for {
 		select {
 		case <-stopCh:
 			return
-		case <-ticker.C:
-			select {
-			case shiba.fireCh <- struct{}{}:
-			default:
-			}
+		case <-tickCh:
+			shiba.fire()
 		}
 	}
 }
+
+// fire triggers a sync without blocking.
+func (shiba *Shiba) fire() {
+	select {
+	case shiba.fireCh <- struct{}{}:
+	default:
+	}
+}
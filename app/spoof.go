@@ -0,0 +1,243 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+const (
+	filterTable = "shiba-filter"
+	stageFilter = "filter"
+)
+
+// podInterface is the host side of the veth pair of a local pod.
+type podInterface struct {
+	name string
+	ips  []net.IP // Assigned addresses of the pod, found by the host routes via the veth.
+}
+
+// syncFilter installs the anti-spoofing rules, so that traffic from a peer tunnel must come from the pod CIDRs of
+// the peer, traffic from a local pod must come from its assigned addresses, and tunneled packets to the node must
+// come from known peers.
+func (shiba *Shiba) syncFilter(nodeMap model.NodeMap) {
+	if !shiba.antiSpoofing {
+		return
+	}
+	log.Debug("syncing anti-spoofing rules")
+	shiba.resetPlan(stageFilter)
+	pods, err := listPodInterfaces()
+	if err != nil {
+		log.WithError(err).Error("failed to list pod interfaces, anti-spoofing rules are not updated")
+		shiba.recordSyncError(stageFilter, err)
+		return
+	}
+	tunnels := make(map[string][]*net.IPNet)
+	var peerIPs []net.IP
+	for _, node := range nodeMap {
+		for _, path := range shiba.nodePaths(node) {
+			tunnels[path.Tunnel] = node.PodCIDRs
+			peerIPs = append(peerIPs, path.Remote)
+		}
+	}
+	underlayIPs := shiba.nodeIPs
+	if len(underlayIPs) == 0 && shiba.nodeIP != nil {
+		underlayIPs = []net.IP{shiba.nodeIP}
+	}
+	for _, family := range ipFamilies {
+		script := renderFilterRules(family, tunnels, pods, underlayIPs, peerIPs)
+		if shiba.filterApplied[family] == script {
+			continue
+		}
+		if err := shiba.apply(stageFilter, model.Change{
+			Kind: "nft", Action: "write", Target: family.nftFamily + " " + filterTable, Detail: script,
+		}, func() error {
+			return util.ApplyNft(script)
+		}); err != nil {
+			log.WithError(err).Errorf("failed to apply %s anti-spoofing rules", family.name)
+			delete(shiba.filterApplied, family) // Retry next time.
+			continue
+		}
+		if shiba.dryRun {
+			continue // Plan the change again next time.
+		}
+		shiba.filterApplied[family] = script
+		log.Infof("%s anti-spoofing rules are applied", family.name)
+	}
+}
+
+// removeFilterRules removes the filter tables left by a previous run with anti-spoofing enabled.
+func (shiba *Shiba) removeFilterRules() {
+	shiba.resetPlan(stageFilter)
+	for _, family := range ipFamilies {
+		if !util.NftTableExists(family.nftFamily, filterTable) {
+			continue
+		}
+		if err := shiba.apply(stageFilter, model.Change{
+			Kind: "nft", Action: "delete", Target: family.nftFamily + " " + filterTable,
+		}, func() error {
+			return util.DeleteNftTable(family.nftFamily, filterTable)
+		}); err != nil {
+			log.WithError(err).Errorf("failed to remove %s anti-spoofing rules", family.name)
+			continue
+		}
+		log.Infof("%s anti-spoofing rules are removed", family.name)
+	}
+}
+
+// renderFilterRules renders the nft script that replaces the whole filter table of the family.
+// tunnels maps the tunnels to the pod CIDRs of their peers.
+func renderFilterRules(family *ipFamily, tunnels map[string][]*net.IPNet, pods []podInterface,
+	underlayIPs, peerIPs []net.IP) string {
+	match := family.nftFamily
+	var rules strings.Builder
+	names := make([]string, 0, len(tunnels))
+	for name := range tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var sources []string
+		for _, cidr := range tunnels[name] {
+			if family.match(cidr.IP) {
+				sources = append(sources, cidr.String())
+			}
+		}
+		renderSourceRule(&rules, match, name, sources)
+	}
+	for _, pod := range pods {
+		var sources []string
+		if family == familyV6 {
+			// Neighbor discovery and DAD of the pod.
+			sources = append(sources, "fe80::/10", "::")
+		}
+		for _, ip := range pod.ips {
+			if family.match(ip) {
+				sources = append(sources, ip.String())
+			}
+		}
+		renderSourceRule(&rules, match, pod.name, sources)
+	}
+	if family == familyV6 && len(underlayIPs) > 0 {
+		// IPv6 (41) and IPv4 (4) packets tunneled to the node.
+		fmt.Fprintf(&rules, "\t\tip6 daddr %s meta l4proto { 4, 41 }", formatNftSet(formatIPs(underlayIPs)))
+		if peers := formatIPs(peerIPs); len(peers) > 0 {
+			fmt.Fprintf(&rules, " ip6 saddr != %s", formatNftSet(peers))
+		}
+		rules.WriteString(" drop\n")
+	}
+
+	var b strings.Builder
+	table := family.nftFamily + " " + filterTable
+	fmt.Fprintf(&b, "add table %s\ndelete table %s\ntable %s {\n", table, table, table)
+	fmt.Fprintf(&b, "\tchain prerouting {\n\t\ttype filter hook prerouting priority raw; policy accept;\n%s\t}\n",
+		rules.String())
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// renderSourceRule drops the traffic from the interface unless it comes from the sources.
+func renderSourceRule(b *strings.Builder, match, iifname string, sources []string) {
+	if len(sources) == 0 {
+		fmt.Fprintf(b, "\t\tiifname %q drop\n", iifname)
+		return
+	}
+	fmt.Fprintf(b, "\t\tiifname %q %s saddr != %s drop\n", iifname, match, formatNftSet(sources))
+}
+
+// formatIPs returns the distinct addresses in order.
+func formatIPs(ips []net.IP) []string {
+	seen := make(map[string]bool, len(ips))
+	var formatted []string
+	for _, ip := range ips {
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		formatted = append(formatted, ip.String())
+	}
+	sort.Strings(formatted)
+	return formatted
+}
+
+func formatNftSet(elements []string) string {
+	return "{ " + strings.Join(elements, ", ") + " }"
+}
+
+// listPodInterfaces returns the veths of local pods, which are the veths with host routes to the pods.
+func listPodInterfaces() ([]podInterface, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	var pods []podInterface
+	for _, link := range links {
+		if link.Type() != "veth" {
+			continue
+		}
+		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes of link [%s]: %w", link.Attrs().Name, err)
+		}
+		pod := podInterface{name: link.Attrs().Name}
+		for _, route := range routes {
+			if isHostRoute(route) {
+				pod.ips = append(pod.ips, route.Dst.IP)
+			}
+		}
+		if len(pod.ips) > 0 {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].name < pods[j].name
+	})
+	return pods, nil
+}
+
+func isHostRoute(route netlink.Route) bool {
+	if route.Dst == nil {
+		return false
+	}
+	ones, bits := route.Dst.Mask.Size()
+	return ones == bits
+}
+
+// watchPodRoutes triggers a sync when a host route to a pod is added or deleted, so the anti-spoofing rules
+// follow the pods.
+func (shiba *Shiba) watchPodRoutes(stopCh <-chan struct{}) {
+	updateCh := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := netlink.RouteSubscribe(updateCh, done); err != nil {
+		log.WithError(err).Error("failed to subscribe route updates, anti-spoofing rules of new pods are delayed")
+		return
+	}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case update, ok := <-updateCh:
+			if !ok {
+				log.Warning("route update channel closed")
+				return
+			}
+			if !isHostRoute(update.Route) || update.LinkIndex <= 0 {
+				continue
+			}
+			// The veth is gone if the pod is deleted.
+			if link, err := netlink.LinkByIndex(update.LinkIndex); err == nil && link.Type() != "veth" {
+				continue
+			}
+			log.WithField(fieldCIDR, update.Dst.String()).Debug("pod route changed")
+			shiba.fire()
+		}
+	}
+}
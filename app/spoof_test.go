@@ -0,0 +1,52 @@
+package app
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/moycat/shiba/util"
+)
+
+func TestRenderFilterRules(t *testing.T) {
+	dualStack, err := util.ParseIPNets([]string{"10.244.1.0/24", "fd00:1::/64"})
+	assert.NilError(t, err)
+	v6Only, err := util.ParseIPNets([]string{"fd00:2::/64"})
+	assert.NilError(t, err)
+	tunnels := map[string][]*net.IPNet{
+		"shiba.a": dualStack,
+		"shiba.b": v6Only,
+	}
+	pods := []podInterface{{name: "veth1", ips: []net.IP{net.ParseIP("10.244.0.5"), net.ParseIP("fd00::5")}}}
+	underlayIPs := []net.IP{net.ParseIP("2001:db8::1")}
+	peerIPs := []net.IP{net.ParseIP("2001:db8::3"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+
+	script := renderFilterRules(familyV4, tunnels, pods, underlayIPs, peerIPs)
+	for _, line := range []string{
+		"add table ip shiba-filter",
+		"type filter hook prerouting priority raw; policy accept;",
+		`iifname "shiba.a" ip saddr != { 10.244.1.0/24 } drop`,
+		`iifname "shiba.b" drop`,
+		`iifname "veth1" ip saddr != { 10.244.0.5 } drop`,
+	} {
+		assert.Assert(t, strings.Contains(script, line), "missing [%s] in:\n%s", line, script)
+	}
+	assert.Assert(t, !strings.Contains(script, "l4proto"), "underlay rule in ipv4:\n%s", script)
+
+	script = renderFilterRules(familyV6, tunnels, pods, underlayIPs, peerIPs)
+	for _, line := range []string{
+		"add table ip6 shiba-filter",
+		`iifname "shiba.a" ip6 saddr != { fd00:1::/64 } drop`,
+		`iifname "shiba.b" ip6 saddr != { fd00:2::/64 } drop`,
+		`iifname "veth1" ip6 saddr != { fe80::/10, ::, fd00::5 } drop`,
+		"ip6 daddr { 2001:db8::1 } meta l4proto { 4, 41 } ip6 saddr != { 2001:db8::2, 2001:db8::3 } drop",
+	} {
+		assert.Assert(t, strings.Contains(script, line), "missing [%s] in:\n%s", line, script)
+	}
+
+	// Tunneled packets are all dropped without peers.
+	script = renderFilterRules(familyV6, nil, nil, underlayIPs, nil)
+	assert.Assert(t, strings.Contains(script, "ip6 daddr { 2001:db8::1 } meta l4proto { 4, 41 } drop"), script)
+}
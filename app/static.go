@@ -0,0 +1,89 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+// syncStaticPeers merges the static peers defined in the file into the node map.
+// It returns whether the node map is changed.
+func (shiba *Shiba) syncStaticPeers() bool {
+	peers, err := loadStaticPeers(shiba.staticPeersPath)
+	if err != nil {
+		log.Errorf("failed to load static peers from [%s]: %v", shiba.staticPeersPath, err)
+		return false
+	}
+	nodeMap := shiba.cloneNodeMap()
+	var changed bool
+	peerMap := make(model.NodeMap, len(peers))
+	for _, peer := range peers {
+		key := peer.Key()
+		peerMap[key] = peer
+		if oldPeer, ok := nodeMap[key]; ok && !oldPeer.DiffersFrom(peer) {
+			continue
+		}
+		log.Infof("static peer [%s] (%v) is added or updated with cidrs %s",
+			peer.Name, peer.IP, util.FormatIPNets(peer.PodCIDRs))
+		peer.Tunnel = tunnelPrefix + util.NewUID()
+		nodeMap[key] = peer
+		changed = true
+	}
+	for key, node := range nodeMap {
+		if node.Source == model.SourceStatic && peerMap[key] == nil {
+			log.Infof("static peer [%s] is removed", node.Name)
+			delete(nodeMap, key)
+			changed = true
+		}
+	}
+	if changed {
+		shiba.saveNodeMap(nodeMap)
+		shiba.dumpNodeMap()
+	}
+	return changed
+}
+
+func loadStaticPeers(path string) ([]*model.Node, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &model.StaticPeerConfig{}
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	peers := make([]*model.Node, 0, len(config.Peers))
+	names := make(map[string]bool, len(config.Peers))
+	for _, peer := range config.Peers {
+		if len(peer.Name) == 0 || strings.Contains(peer.Name, "/") {
+			return nil, fmt.Errorf("bad peer name [%s]", peer.Name)
+		}
+		if names[peer.Name] {
+			return nil, fmt.Errorf("duplicated peer [%s]", peer.Name)
+		}
+		names[peer.Name] = true
+		ip := net.ParseIP(peer.IP)
+		if !util.IsV6(ip) {
+			return nil, fmt.Errorf("peer [%s] has a non-ipv6 address [%s]", peer.Name, peer.IP)
+		}
+		cidrs, err := util.ParseIPNets(peer.CIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cidrs of peer [%s]: %w", peer.Name, err)
+		}
+		peers = append(peers, &model.Node{
+			Name:       peer.Name,
+			IP:         ip,
+			PodCIDRs:   cidrs,
+			Source:     model.SourceStatic,
+			IPsecNonce: peer.IPsecNonce,
+		})
+	}
+	return peers, nil
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/moycat/shiba/model"
+)
+
+func TestShiba_syncStaticPeers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "static-peers.yaml")
+	assert.NilError(t, os.WriteFile(path, []byte(`
+peers:
+  - name: vm
+    ip: "2001:db8::10"
+    cidrs: [ "192.168.100.0/24" ]
+`), 0o644))
+	s := &Shiba{
+		staticPeersPath: path,
+		nodeMap:         model.NodeMap{"node": {Name: "node"}},
+	}
+	s.nodeMapPath = filepath.Join(t.TempDir(), nodeMapFilename)
+	assert.Assert(t, s.syncStaticPeers())
+	_, err := os.Stat(s.nodeMapPath)
+	assert.NilError(t, err, "node map is dumped")
+	nodeMap := s.cloneNodeMap()
+	assert.Equal(t, len(nodeMap), 2)
+	peer := nodeMap["static/vm"]
+	assert.Equal(t, peer.Source, model.SourceStatic)
+	assert.Equal(t, peer.IP.String(), "2001:db8::10")
+	assert.Equal(t, peer.PodCIDRs[0].String(), "192.168.100.0/24")
+	assert.Assert(t, len(peer.Tunnel) > 0)
+	assert.Assert(t, !s.syncStaticPeers(), "nothing changed")
+
+	assert.NilError(t, os.WriteFile(path, []byte("peers: []"), 0o644))
+	assert.Assert(t, s.syncStaticPeers())
+	nodeMap = s.cloneNodeMap()
+	assert.Equal(t, len(nodeMap), 1)
+	assert.Assert(t, nodeMap["node"] != nil)
+
+	assert.NilError(t, os.WriteFile(path, []byte(`peers: [ { name: vm, ip: "10.0.0.1" } ]`), 0o644))
+	_, err = loadStaticPeers(path)
+	assert.ErrorContains(t, err, "non-ipv6")
+}
+
+func TestShiba_validateNodeMap_listFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("unavailable")
+	})
+	s := &Shiba{
+		client: client,
+		nodeMap: model.NodeMap{
+			"node":      {Name: "node", Source: model.SourceCluster},
+			"static/vm": {Name: "vm", Source: model.SourceStatic},
+		},
+	}
+	s.validateNodeMap()
+	assert.Equal(t, len(s.nodeMap), 1)
+	assert.Assert(t, s.nodeMap["static/vm"] != nil, "static peers are kept")
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/moycat/shiba/model"
+)
+
+const (
+	backendIP6tnl = "ip6tnl"
+	syncResultOK  = "Synced"
+	syncResultBad = "Degraded"
+	tunnelUp      = "Up"
+	tunnelDown    = "Down"
+	tunnelMissing = "Missing"
+)
+
+var shibaNodeResource = schema.GroupVersionResource{Group: "shiba.io", Version: "v1alpha1", Resource: "shibanodes"}
+
+// syncStages are the stages of a sync pass, whose errors fail the last sync.
+var syncStages = []string{stageTunnels, stageIPsec, stageRoutes, stageEgress, stageFilter}
+
+// publishStatus updates the ShibaNode of the current node with the state after a sync pass.
+func (shiba *Shiba) publishStatus(nodeMap model.NodeMap) {
+	if shiba.dynamicClient == nil || shiba.dryRun {
+		return
+	}
+	status := shiba.buildStatus(nodeMap, tunnelState)
+	object, err := newShibaNode(shiba.nodeName, shiba.nodeUID, status)
+	if err != nil {
+		log.Errorf("failed to build shiba node: %v", err)
+		return
+	}
+	ctx, cancel := shiba.getAPIContext()
+	defer cancel()
+	client := shiba.dynamicClient.Resource(shibaNodeResource)
+	existing, err := client.Get(ctx, shiba.nodeName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = client.Create(ctx, object, metav1.CreateOptions{})
+	case err == nil:
+		object.SetResourceVersion(existing.GetResourceVersion())
+		_, err = client.Update(ctx, object, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		log.Errorf("failed to publish shiba node [%s]: %v", shiba.nodeName, err)
+		return
+	}
+	log.Debugf("published shiba node [%s]", shiba.nodeName)
+}
+
+// buildStatus returns the status of the current node, with the state of tunnels checked by stateFunc.
+func (shiba *Shiba) buildStatus(nodeMap model.NodeMap, stateFunc func(name string) string) *model.ShibaNodeStatus {
+	shiba.configLock.Lock()
+	mtu := shiba.ip6tnlMTU
+	shiba.configLock.Unlock()
+	shiba.peerHealthLock.Lock()
+	probed := make(map[string]bool) // Node key -> reachable.
+	for _, health := range shiba.peerHealth {
+		probed[health.Node] = probed[health.Node] || health.Reachable(probeFailureThreshold)
+	}
+	shiba.peerHealthLock.Unlock()
+
+	status := &model.ShibaNodeStatus{
+		UnderlayIP: shiba.nodeIP.String(),
+		PodCIDRs:   formatIPNets(shiba.nodePodCIDRs),
+		Backend:    backendIP6tnl,
+		MTU:        mtu,
+		PeerCount:  len(nodeMap),
+	}
+	for _, gateway := range shiba.nodeGateways {
+		status.GatewayIPs = append(status.GatewayIPs, gateway.String())
+	}
+	notReady := countTunnelsNotUp(shiba.nodePaths, nodeMap, stateFunc)
+	for _, node := range nodeMap {
+		peer := model.PeerStatus{Name: node.Name, Source: node.Source, PodCIDRs: formatIPNets(node.PodCIDRs)}
+		for _, path := range shiba.nodePaths(node) {
+			state := stateFunc(path.Tunnel)
+			peer.Tunnels = append(peer.Tunnels, model.TunnelStatus{
+				Name: path.Tunnel, Local: path.Local.String(), Remote: path.Remote.String(), State: state,
+			})
+		}
+		if reachable, ok := probed[node.Key()]; ok {
+			peer.Reachable = &reachable
+		}
+		status.Peers = append(status.Peers, peer)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool {
+		if status.Peers[i].Source != status.Peers[j].Source {
+			return status.Peers[i].Source < status.Peers[j].Source
+		}
+		return status.Peers[i].Name < status.Peers[j].Name
+	})
+	status.LastSync = model.SyncResult{Time: time.Now().UTC().Format(time.RFC3339), Result: syncResultOK}
+	problems := shiba.syncErrorMessages(syncStages...)
+	if notReady > 0 {
+		problems = append(problems, fmt.Sprintf("%d tunnels are not up", notReady))
+	}
+	if len(problems) > 0 {
+		status.LastSync.Result = syncResultBad
+		status.LastSync.Message = strings.Join(problems, "; ")
+	}
+	return status
+}
+
+// countTunnelsNotUp returns the number of tunnels to the nodes that are not up.
+func countTunnelsNotUp(pathsFunc func(node *model.Node) []model.Path, nodeMap model.NodeMap,
+	stateFunc func(name string) string) int {
+	var notUp int
+	for _, node := range nodeMap {
+		for _, path := range pathsFunc(node) {
+			if stateFunc(path.Tunnel) != tunnelUp {
+				notUp++
+			}
+		}
+	}
+	return notUp
+}
+
+// newShibaNode returns the ShibaNode object owned by the node.
+func newShibaNode(nodeName, nodeUID string, status *model.ShibaNodeStatus) (*unstructured.Unstructured, error) {
+	statusMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return nil, err
+	}
+	object := &unstructured.Unstructured{Object: map[string]interface{}{"status": statusMap}}
+	object.SetAPIVersion(shibaNodeResource.GroupVersion().String())
+	object.SetKind("ShibaNode")
+	object.SetName(nodeName)
+	object.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       nodeName,
+		UID:        types.UID(nodeUID),
+	}})
+	return object, nil
+}
+
+// tunnelState returns the state of the tunnel interface.
+func tunnelState(name string) string {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return tunnelMissing
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return tunnelDown
+	}
+	return tunnelUp
+}
+
+func formatIPNets(ipNets []*net.IPNet) []string {
+	cidrs := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs
+}
@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/moycat/shiba/model"
+	"github.com/moycat/shiba/util"
+)
+
+func newTestStatusShiba(t *testing.T) (*Shiba, model.NodeMap) {
+	podCIDRs, err := util.ParseIPNets([]string{"10.244.0.0/24"})
+	assert.NilError(t, err)
+	peerCIDRs, err := util.ParseIPNets([]string{"10.244.1.0/24"})
+	assert.NilError(t, err)
+	s := &Shiba{
+		nodeName:     "self",
+		nodeUID:      "uid",
+		nodeIP:       net.ParseIP("2001:db8::1"),
+		nodePodCIDRs: podCIDRs,
+		nodeGateways: []net.IP{util.GatewayIP(podCIDRs[0])},
+		ip6tnlMTU:    1400,
+		peerHealth: map[string]*model.PeerHealth{
+			"10.244.1.1": {Node: "peer", Gateway: net.ParseIP("10.244.1.1")},
+		},
+	}
+	nodeMap := model.NodeMap{
+		"peer": {Name: "peer", IP: net.ParseIP("2001:db8::2"), PodCIDRs: peerCIDRs, Tunnel: "shiba.a"},
+		"static/peer": {
+			Name: "peer", IP: net.ParseIP("2001:db8::3"), PodCIDRs: peerCIDRs, Tunnel: "shiba.b",
+			Source: model.SourceStatic,
+		},
+	}
+	return s, nodeMap
+}
+
+func TestShiba_buildStatus(t *testing.T) {
+	s, nodeMap := newTestStatusShiba(t)
+	status := s.buildStatus(nodeMap, func(name string) string {
+		if name == "shiba.b" {
+			return tunnelMissing
+		}
+		return tunnelUp
+	})
+	assert.Equal(t, status.UnderlayIP, "2001:db8::1")
+	assert.DeepEqual(t, status.GatewayIPs, []string{"10.244.0.1"})
+	assert.Equal(t, status.MTU, 1400)
+	assert.Equal(t, status.PeerCount, 2)
+	assert.Equal(t, status.LastSync.Result, syncResultBad)
+	assert.Equal(t, status.LastSync.Message, "1 tunnels are not up")
+	assert.Equal(t, len(status.Peers), 2)
+	assert.Equal(t, status.Peers[0].Name, "peer")
+	assert.Equal(t, *status.Peers[0].Reachable, true)
+	assert.Equal(t, status.Peers[0].Tunnels[0].Remote, "2001:db8::2")
+	assert.Equal(t, status.Peers[1].Name, "peer")
+	assert.Assert(t, status.Peers[1].Reachable == nil, "not the health of the cluster node of the same name")
+	assert.Equal(t, status.Peers[1].Tunnels[0].State, tunnelMissing)
+}
+
+func TestShiba_buildStatus_syncErrors(t *testing.T) {
+	s, nodeMap := newTestStatusShiba(t)
+	up := func(string) string { return tunnelUp }
+	assert.Equal(t, s.buildStatus(nodeMap, up).LastSync.Result, syncResultOK)
+
+	s.recordSyncError(stageRoutes, errors.New("failed to list rules"))
+	s.recordSyncError(stageTunnels, errors.New("failed to list links"))
+	status := s.buildStatus(nodeMap, up)
+	assert.Equal(t, status.LastSync.Result, syncResultBad)
+	assert.Equal(t, status.LastSync.Message, "tunnels: failed to list links; routes: failed to list rules")
+
+	s.resetPlan(stageTunnels)
+	s.resetPlan(stageRoutes)
+	assert.Equal(t, s.buildStatus(nodeMap, up).LastSync.Result, syncResultOK)
+}
+
+func TestShiba_publishStatus(t *testing.T) {
+	s, nodeMap := newTestStatusShiba(t)
+	s.dynamicClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{shibaNodeResource: "ShibaNodeList"})
+	s.publishStatus(nodeMap) // Created.
+	s.publishStatus(nodeMap) // Updated.
+	object, err := s.dynamicClient.Resource(shibaNodeResource).Get(context.Background(), "self", metav1.GetOptions{})
+	assert.NilError(t, err)
+	assert.Equal(t, object.GetOwnerReferences()[0].Kind, "Node")
+	peerCount, _, err := unstructured.NestedInt64(object.Object, "status", "peerCount")
+	assert.NilError(t, err)
+	assert.Equal(t, peerCount, int64(2))
+}
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"os"
+	"strings"
 
 	"github.com/jinzhu/configor"
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"github.com/moycat/shiba/app"
 )
 
 const (
@@ -17,6 +27,13 @@ const (
 const (
 	defaultCNIConfigPath = "/etc/cni/net.d"
 	defaultAPITimeout    = 30
+	defaultIPAMDataPath  = "/var/lib/cni/networks"
+	defaultIPAMGCGrace   = 600
+	defaultIPAMSocket    = "/run/shiba/ipam.sock"
+	configVersion        = "v1"
+	logFormatText        = "text"
+	logFormatJSON        = "json"
+	reservedRouteTables  = 253 // Tables default (253), main (254) and local (255) are reserved.
 )
 
 var debugMode bool
@@ -28,25 +45,139 @@ func init() {
 	}
 }
 
+// Config is the startup config of shiba, loaded from the config file, env and flags in the ascending order of
+// precedence. The config file is in YAML or JSON of the same keys, see config.example.yaml.
 type Config struct {
+	// Version is the schema version of the config file, which must be v1.
+	Version string `json:"version" yaml:"version"`
+	// ConfigFile is the path to the config file, empty to use env and flags only.
+	ConfigFile string `json:"-" yaml:"-"`
 	// NodeName must be set to the name of the current node.
-	NodeName string
+	NodeName string `json:"nodeName" yaml:"nodeName"`
 	// CNIConfigPath is the path to CNI configuration files, usually /etc/cni/net.d.
-	CNIConfigPath string
+	CNIConfigPath string `json:"cniConfigPath" yaml:"cniConfigPath"`
 	// KubeConfigPath is the path to the kubeconfig file, using in-cluster config if empty.
-	KubeConfigPath string
+	KubeConfigPath string `json:"kubeConfigPath" yaml:"kubeConfigPath"`
 	// APITimeout is the timeout in seconds for non-watch API calls.
-	APITimeout int
+	APITimeout int `json:"apiTimeout" yaml:"apiTimeout"`
 	// ClusterPodCIDRs is the pod CIDR subnets of the cluster.
-	ClusterPodCIDRs string
+	ClusterPodCIDRs string `json:"clusterPodCIDRs" yaml:"clusterPodCIDRs"`
 	// PprofPort specifies the port of pprof debug server, non-positive to disable.
-	PprofPort int
+	PprofPort int `json:"pprofPort" yaml:"pprofPort"`
 
 	// IP6tnlMTU is the MTU for ip6tnl interface. when not config, default is 1450.
-	IP6tnlMTU int
+	IP6tnlMTU int `json:"ip6tnlMTU" yaml:"ip6tnlMTU"`
+	// DryRun makes shiba only log the changes it would make, without applying them.
+	// The planned changes are also served at /debug/shiba/plan on the pprof port.
+	DryRun bool `json:"dryRun" yaml:"dryRun"`
+	// ProbeInterval is the interval in seconds to probe peers through the overlay, non-positive to disable.
+	ProbeInterval int `json:"probeInterval" yaml:"probeInterval"`
+	// MetricsPort specifies the port of the Prometheus metrics server, non-positive to disable.
+	MetricsPort int `json:"metricsPort" yaml:"metricsPort"`
+	// ServiceProxy enables the built-in service proxy based on nftables, so kube-proxy is no longer needed.
+	ServiceProxy bool `json:"serviceProxy" yaml:"serviceProxy"`
+	// StaticPeersPath is the path to the YAML file defining static peers outside Kubernetes, empty to disable.
+	// It's reloaded every minute, so a mounted ConfigMap can be used.
+	StaticPeersPath string `json:"staticPeersPath" yaml:"staticPeersPath"`
+	// RemoteClusters is the comma-separated remote clusters to peer with, in the form of name=kubeconfig-path.
+	RemoteClusters string `json:"remoteClusters" yaml:"remoteClusters"`
+	// UnderlayAddressTypes is the comma-separated node address types to find underlay addresses from in order,
+	// InternalIP by default. The shiba.io/underlay-ip annotation of a node always takes precedence.
+	UnderlayAddressTypes string `json:"underlayAddressTypes" yaml:"underlayAddressTypes"`
+	// UnderlayCIDRs is the comma-separated subnets preferred for underlay addresses in order.
+	UnderlayCIDRs string `json:"underlayCIDRs" yaml:"underlayCIDRs"`
+	// UnderlayInterface is the interface to find the underlay address of the current node from.
+	// The address is published to the annotation of the node for peers.
+	UnderlayInterface string `json:"underlayInterface" yaml:"underlayInterface"`
+	// Multipath creates a tunnel through each pair of local and remote underlay addresses, and installs
+	// multi-path routes to peers across them. Addresses in the same underlay CIDR are paired if set.
+	Multipath bool `json:"multipath" yaml:"multipath"`
+	// NodeSelector is the label selector of nodes to peer with.
+	// Nodes labeled shiba.io/exclude=true are always excluded.
+	NodeSelector string `json:"nodeSelector" yaml:"nodeSelector"`
+	// ExcludeTaints is the comma-separated taint keys of nodes not to peer with.
+	ExcludeTaints string `json:"excludeTaints" yaml:"excludeTaints"`
+	// ZoneLabel is the node label of zones. If set, nodes only peer with nodes in the same zone,
+	// and reach other zones through the gateway nodes labeled shiba.io/zone-gateway=true.
+	ZoneLabel string `json:"zoneLabel" yaml:"zoneLabel"`
+	// ConfigNamespace is the namespace of the shiba-config config map, empty to disable.
+	// Settings in the config map are reloaded at runtime, see README for details.
+	ConfigNamespace string `json:"configNamespace" yaml:"configNamespace"`
+	// NodeStatus publishes the overlay state of the node to its ShibaNode after each sync.
+	// The ShibaNode CRD in installation.yaml must be installed.
+	NodeStatus bool `json:"nodeStatus" yaml:"nodeStatus"`
+	// AntiSpoofing drops traffic from peer tunnels and local pods with unexpected source addresses, and
+	// tunneled packets from underlay addresses of unknown nodes. It requires nftables.
+	AntiSpoofing bool `json:"antiSpoofing" yaml:"antiSpoofing"`
+	// CNIVersion is the version of the CNI spec of the generated config, 0.3.1, 0.4.0 or 1.0.0.
+	CNIVersion string `json:"cniVersion" yaml:"cniVersion"`
+	// CNIBinPath is the path to CNI plugin binaries, usually /opt/cni/bin. If set, the binaries of all plugins
+	// in the chain are checked on startup.
+	CNIBinPath string `json:"cniBinPath" yaml:"cniBinPath"`
+	// CNIPlugins is the comma-separated optional plugins to chain after ptp: bandwidth, tuning and firewall.
+	CNIPlugins string `json:"cniPlugins" yaml:"cniPlugins"`
+	// CNISysctls is the comma-separated sysctls of pods set by the tuning plugin, like net.core.somaxconn=1024.
+	CNISysctls string `json:"cniSysctls" yaml:"cniSysctls"`
+	// CNIExtraPlugins is a JSON array of plugin stanzas appended to the chain as they are.
+	CNIExtraPlugins string `json:"cniExtraPlugins" yaml:"cniExtraPlugins"`
+	// CNIConfigOnSync writes the CNI config only after the first successful sync and removes it on exit,
+	// so kubelet only schedules pods to the node while its overlay is maintained.
+	CNIConfigOnSync bool `json:"cniConfigOnSync" yaml:"cniConfigOnSync"`
+	// RouteTable is the routing table of the routes to peers, zero to use the main table. If set, rules are
+	// added to look up the table for traffic to the cluster pod CIDRs, so host routing daemons can own the main
+	// table.
+	RouteTable int `json:"routeTable" yaml:"routeTable"`
+	// IPsecSecret is the secret of pre-shared keys in the form of namespace/name, which enables IPsec encryption
+	// of the traffic between nodes. All nodes must use the same keys, see README for details.
+	IPsecSecret string `json:"ipsecSecret" yaml:"ipsecSecret"`
+	// IPAMGCInterval is the interval in seconds to release the host-local allocations leaked by pods on the node,
+	// non-positive to disable.
+	IPAMGCInterval int `json:"ipamGCInterval" yaml:"ipamGCInterval"`
+	// IPAMGCGracePeriod is how long in seconds an allocation must be unused before it's released, 600 by default.
+	IPAMGCGracePeriod int `json:"ipamGCGracePeriod" yaml:"ipamGCGracePeriod"`
+	// IPAMDataPath is the data directory of host-local, /var/lib/cni/networks by default.
+	IPAMDataPath string `json:"ipamDataPath" yaml:"ipamDataPath"`
+	// SandboxStatePath is the state directory of the container runtime with a directory for each running pod
+	// sandbox, like /run/containerd/io.containerd.runtime.v2.task/k8s.io. Allocations of running sandboxes are
+	// never released. Empty to only check the pods on the node.
+	SandboxStatePath string `json:"sandboxStatePath" yaml:"sandboxStatePath"`
+	// IPPools is the comma-separated pools of pod addresses, which pods request by the shiba.io/ip-pool annotation,
+	// or by the shiba.io/ip annotation with addresses in them. A pool is either name=cidr, cluster-wide and routed to
+	// the nodes of its pods, or name=/prefix-length, carved from the end of the pod CIDR of each node.
+	IPPools string `json:"ipPools" yaml:"ipPools"`
+	// IPAMSocketPath is the unix socket serving the shiba-ipam plugin if IP pools are set, /run/shiba/ipam.sock by
+	// default. It must be reachable from the host.
+	IPAMSocketPath string `json:"ipamSocketPath" yaml:"ipamSocketPath"`
+	// LoadBalancerCIDRs is the comma-separated pools of LoadBalancer service IPs, which are announced by ARP/NDP on
+	// LoadBalancerInterface of a node elected for each service. Empty to disable. It requires ConfigNamespace.
+	LoadBalancerCIDRs string `json:"loadBalancerCIDRs" yaml:"loadBalancerCIDRs"`
+	// LoadBalancerInterface is the interface to announce the load balancer IPs on.
+	LoadBalancerInterface string `json:"loadBalancerInterface" yaml:"loadBalancerInterface"`
+	// LoadBalancerClassless serves LoadBalancer services without spec.loadBalancerClass as well as those of the
+	// class shiba.io/l2. Only enable it if no other load balancer implementation serves them.
+	LoadBalancerClassless bool `json:"loadBalancerClassless" yaml:"loadBalancerClassless"`
+	// BGPPeers is the comma-separated upstream routers to announce the pod CIDRs of the node to, like
+	// 192.0.2.1=65000 or [2001:db8::1]:1179=65000. Empty to disable.
+	BGPPeers string `json:"bgpPeers" yaml:"bgpPeers"`
+	// BGPLocalASN is the ASN of the nodes, required with BGP peers.
+	BGPLocalASN int `json:"bgpLocalASN" yaml:"bgpLocalASN"`
+	// BGPRouterID is the IPv4 router ID of the node, the local IPv4 address of each session or one derived from
+	// the node name by default.
+	BGPRouterID string `json:"bgpRouterID" yaml:"bgpRouterID"`
+	// FlowLogPath is the file to write the conntrack flows of pods on the node to as JSON lines, - for stdout,
+	// empty to disable.
+	FlowLogPath string `json:"flowLogPath" yaml:"flowLogPath"`
+	// FlowMetrics counts the flows of pods by namespaces in metrics.
+	FlowMetrics bool `json:"flowMetrics" yaml:"flowMetrics"`
+	// LogFormat is the format of logs, text or json. JSON logs carry the structured fields as keys.
+	LogFormat string `json:"logFormat" yaml:"logFormat"`
+	// LogLevel is the level of logs, info by default or debug if SHIBA_DEBUG is set.
+	// It can be changed at runtime by the config map.
+	LogLevel string `json:"logLevel" yaml:"logLevel"`
 }
 
 func (c *Config) InitFlags(set *flag.FlagSet) {
+	set.StringVar(&c.ConfigFile, "config", c.ConfigFile, "config file path")
 	set.StringVar(&c.NodeName, "node-name", c.NodeName, "current node name")
 	set.StringVar(&c.CNIConfigPath, "cni-config-path", c.CNIConfigPath, "CNI config path")
 	set.StringVar(&c.KubeConfigPath, "kube-config-path", c.KubeConfigPath, "K8s config file path")
@@ -54,30 +185,371 @@ func (c *Config) InitFlags(set *flag.FlagSet) {
 	set.StringVar(&c.ClusterPodCIDRs, "cluster-pod-cidrs", c.ClusterPodCIDRs, "cluster pod CIDRs")
 	set.IntVar(&c.PprofPort, "pprof-port", c.PprofPort, "pprof debug server port")
 	set.IntVar(&c.IP6tnlMTU, "ip6tnl-mtu", c.IP6tnlMTU, "the MTU for ip6tnl interface")
+	set.BoolVar(&c.DryRun, "dry-run", c.DryRun, "only plan the changes without applying them")
+	set.IntVar(&c.ProbeInterval, "probe-interval", c.ProbeInterval, "peer probing interval in seconds")
+	set.IntVar(&c.MetricsPort, "metrics-port", c.MetricsPort, "metrics server port")
+	set.BoolVar(&c.ServiceProxy, "service-proxy", c.ServiceProxy, "enable the built-in service proxy")
+	set.StringVar(&c.StaticPeersPath, "static-peers-path", c.StaticPeersPath, "static peers file path")
+	set.StringVar(&c.RemoteClusters, "remote-clusters", c.RemoteClusters, "remote clusters to peer with")
+	set.StringVar(&c.UnderlayAddressTypes, "underlay-address-types", c.UnderlayAddressTypes,
+		"node address types for underlay addresses")
+	set.StringVar(&c.UnderlayCIDRs, "underlay-cidrs", c.UnderlayCIDRs, "preferred CIDRs for underlay addresses")
+	set.StringVar(&c.UnderlayInterface, "underlay-interface", c.UnderlayInterface,
+		"interface to find the underlay address from")
+	set.BoolVar(&c.Multipath, "multipath", c.Multipath, "spread traffic across all underlay addresses")
+	set.StringVar(&c.NodeSelector, "node-selector", c.NodeSelector, "label selector of nodes to peer with")
+	set.StringVar(&c.ExcludeTaints, "exclude-taints", c.ExcludeTaints, "taint keys of nodes not to peer with")
+	set.StringVar(&c.ZoneLabel, "zone-label", c.ZoneLabel, "node label to scope peering by zone")
+	set.StringVar(&c.ConfigNamespace, "config-namespace", c.ConfigNamespace, "namespace of the runtime config map")
+	set.BoolVar(&c.NodeStatus, "node-status", c.NodeStatus, "publish the node state to ShibaNode")
+	set.BoolVar(&c.AntiSpoofing, "anti-spoofing", c.AntiSpoofing, "drop traffic with spoofed source addresses")
+	set.StringVar(&c.CNIVersion, "cni-version", c.CNIVersion, "CNI spec version of the config")
+	set.StringVar(&c.CNIBinPath, "cni-bin-path", c.CNIBinPath, "CNI plugin binary path to check the chain")
+	set.StringVar(&c.CNIPlugins, "cni-plugins", c.CNIPlugins, "optional CNI plugins: bandwidth, tuning, firewall")
+	set.StringVar(&c.CNISysctls, "cni-sysctls", c.CNISysctls, "sysctls of pods, like key=value,key=value")
+	set.StringVar(&c.CNIExtraPlugins, "cni-extra-plugins", c.CNIExtraPlugins, "JSON array of extra CNI plugins")
+	set.BoolVar(&c.CNIConfigOnSync, "cni-config-on-sync", c.CNIConfigOnSync,
+		"write the CNI config after the first sync and remove it on exit")
+	set.IntVar(&c.RouteTable, "route-table", c.RouteTable, "routing table of routes to peers, 0 for main")
+	set.StringVar(&c.IPsecSecret, "ipsec-secret", c.IPsecSecret, "namespace/name of the secret of ipsec keys")
+	set.IntVar(&c.IPAMGCInterval, "ipam-gc-interval", c.IPAMGCInterval, "ipam garbage collection interval in seconds")
+	set.IntVar(&c.IPAMGCGracePeriod, "ipam-gc-grace-period", c.IPAMGCGracePeriod,
+		"seconds an allocation must be unused before it's released")
+	set.StringVar(&c.IPAMDataPath, "ipam-data-path", c.IPAMDataPath, "host-local data path")
+	set.StringVar(&c.SandboxStatePath, "sandbox-state-path", c.SandboxStatePath,
+		"container runtime state path with a directory for each pod sandbox")
+	set.StringVar(&c.IPPools, "ip-pools", c.IPPools, "pools of pod addresses, like name=cidr or name=/prefix-length")
+	set.StringVar(&c.IPAMSocketPath, "ipam-socket-path", c.IPAMSocketPath, "unix socket serving the ipam plugin")
+	set.StringVar(&c.LoadBalancerCIDRs, "load-balancer-cidrs", c.LoadBalancerCIDRs, "pools of load balancer IPs")
+	set.StringVar(&c.LoadBalancerInterface, "load-balancer-interface", c.LoadBalancerInterface,
+		"interface to announce load balancer IPs on")
+	set.BoolVar(&c.LoadBalancerClassless, "load-balancer-classless", c.LoadBalancerClassless,
+		"serve load balancer services without a class")
+	set.StringVar(&c.BGPPeers, "bgp-peers", c.BGPPeers, "upstream routers to announce pod CIDRs to, like address=asn")
+	set.IntVar(&c.BGPLocalASN, "bgp-local-asn", c.BGPLocalASN, "ASN of the nodes")
+	set.StringVar(&c.BGPRouterID, "bgp-router-id", c.BGPRouterID, "BGP router ID of the node")
+	set.StringVar(&c.FlowLogPath, "flow-log-path", c.FlowLogPath, "file to write flows of pods to, - for stdout")
+	set.BoolVar(&c.FlowMetrics, "flow-metrics", c.FlowMetrics, "count flows of pods in metrics")
+	set.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format, text or json")
+	set.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level")
 }
 
-func (c *Config) Validate() error {
-	if len(c.NodeName) == 0 {
-		return errors.New("node name is empty")
+// CheckHost checks the config against the host, like the paths that must exist.
+func (c *Config) CheckHost() error {
+	if info, err := os.Stat(c.CNIConfigPath); err != nil {
+		return fmt.Errorf("bad cni config path: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("cni config path [%s] is not a directory", c.CNIConfigPath)
 	}
+	if len(c.SandboxStatePath) > 0 && c.IPAMGCInterval > 0 {
+		if info, err := os.Stat(c.SandboxStatePath); err != nil {
+			return fmt.Errorf("bad sandbox state path: %w", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("sandbox state path [%s] is not a directory", c.SandboxStatePath)
+		}
+	}
+	return nil
+}
+
+// Validate sets the defaults and checks the config, reporting all problems at once.
+func (c *Config) Validate() error {
 	if len(c.CNIConfigPath) == 0 {
 		c.CNIConfigPath = defaultCNIConfigPath
 	}
 	if c.APITimeout <= 0 {
 		c.APITimeout = defaultAPITimeout
 	}
+	if len(c.IPAMDataPath) == 0 {
+		c.IPAMDataPath = defaultIPAMDataPath
+	}
+	if c.IPAMGCGracePeriod == 0 {
+		c.IPAMGCGracePeriod = defaultIPAMGCGrace
+	}
+	if len(c.IPAMSocketPath) == 0 {
+		c.IPAMSocketPath = defaultIPAMSocket
+	}
+	var problems []string
+	if len(c.NodeName) == 0 {
+		problems = append(problems, "node name is empty")
+	}
+	if c.IP6tnlMTU != 0 && (c.IP6tnlMTU < app.MinMTU || c.IP6tnlMTU > app.MaxMTU) {
+		problems = append(problems, fmt.Sprintf("ip6tnl mtu should be in [%d, %d]", app.MinMTU, app.MaxMTU))
+	}
+	for name, port := range map[string]int{"pprof": c.PprofPort, "metrics": c.MetricsPort} {
+		if port > 65535 {
+			problems = append(problems, fmt.Sprintf("%s port %d is out of range", name, port))
+		}
+	}
+	if c.PprofPort > 0 && c.PprofPort == c.MetricsPort {
+		problems = append(problems, fmt.Sprintf("pprof and metrics servers can't share port %d", c.PprofPort))
+	}
+	problems = append(problems, validateCIDRs("cluster pod cidrs", c.ClusterPodCIDRs)...)
+	problems = append(problems, validateCIDRs("underlay cidrs", c.UnderlayCIDRs)...)
+	if len(c.UnderlayAddressTypes) > 0 {
+		for _, addressType := range strings.Split(c.UnderlayAddressTypes, ",") {
+			if addressType != "InternalIP" && addressType != "ExternalIP" {
+				problems = append(problems, fmt.Sprintf("bad underlay address type [%s]", addressType))
+			}
+		}
+	}
+	if len(c.RemoteClusters) > 0 {
+		names := make(map[string]bool)
+		for _, remoteCluster := range strings.Split(c.RemoteClusters, ",") {
+			name, kubeConfigPath, ok := strings.Cut(remoteCluster, "=")
+			if !ok || len(name) == 0 || strings.Contains(name, "/") || len(kubeConfigPath) == 0 {
+				problems = append(problems, fmt.Sprintf("bad remote cluster [%s], should be name=kubeconfig-path", remoteCluster))
+			} else if names[name] {
+				problems = append(problems, fmt.Sprintf("duplicated remote cluster [%s]", name))
+			}
+			names[name] = true
+		}
+	}
+	problems = append(problems, c.validateCNI()...)
+	if c.RouteTable < 0 || c.RouteTable >= reservedRouteTables {
+		problems = append(problems, fmt.Sprintf("route table %d should be in [1, %d), or 0 for main",
+			c.RouteTable, reservedRouteTables))
+	}
+	if len(c.IPsecSecret) > 0 {
+		if parts := strings.Split(c.IPsecSecret, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			problems = append(problems, fmt.Sprintf("bad ipsec secret [%s], should be namespace/name", c.IPsecSecret))
+		}
+	}
+	if c.IPAMGCGracePeriod < 0 {
+		problems = append(problems, fmt.Sprintf("ipam gc grace period %d should not be negative", c.IPAMGCGracePeriod))
+	}
+	if _, err := parseIPPools(c.IPPools); err != nil {
+		problems = append(problems, err.Error())
+	}
+	problems = append(problems, validateCIDRs("load balancer cidrs", c.LoadBalancerCIDRs)...)
+	if len(c.LoadBalancerCIDRs) > 0 {
+		if len(c.LoadBalancerInterface) == 0 {
+			problems = append(problems, "load balancer interface is not set")
+		}
+		if len(c.ConfigNamespace) == 0 {
+			problems = append(problems, "load balancer requires the config namespace for its lease")
+		}
+	}
+	if _, err := parseBGPPeers(c.BGPPeers); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(c.BGPPeers) > 0 && (c.BGPLocalASN <= 0 || int64(c.BGPLocalASN) > math.MaxUint32) {
+		problems = append(problems, fmt.Sprintf("bgp local asn %d should be in [1, 4294967295]", c.BGPLocalASN))
+	}
+	if len(c.BGPRouterID) > 0 {
+		if ip := net.ParseIP(c.BGPRouterID); ip == nil || ip.To4() == nil {
+			problems = append(problems, fmt.Sprintf("bad bgp router id [%s], should be an ipv4 address", c.BGPRouterID))
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		problems = append(problems, fmt.Sprintf("bad log format [%s], should be text or json", c.LogFormat))
+	}
+	if len(c.LogLevel) > 0 {
+		if _, err := log.ParseLevel(c.LogLevel); err != nil {
+			problems = append(problems, fmt.Sprintf("bad log level: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
 	return nil
 }
 
+func (c *Config) validateCNI() []string {
+	var problems []string
+	if len(c.CNIVersion) > 0 {
+		supported := false
+		for _, version := range app.CNIVersions {
+			supported = supported || c.CNIVersion == version
+		}
+		if !supported {
+			problems = append(problems, fmt.Sprintf("unsupported cni version [%s], should be one of %v",
+				c.CNIVersion, app.CNIVersions))
+		}
+	}
+	if len(c.CNIPlugins) > 0 {
+		for _, plugin := range strings.Split(c.CNIPlugins, ",") {
+			switch plugin {
+			case app.CNIPluginBandwidth, app.CNIPluginTuning, app.CNIPluginFirewall:
+			default:
+				problems = append(problems, fmt.Sprintf("bad cni plugin [%s], should be bandwidth, tuning or firewall", plugin))
+			}
+		}
+	}
+	if _, err := parseSysctls(c.CNISysctls); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseCNIPlugins(c.CNIExtraPlugins); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// parseSysctls parses the comma-separated key=value pairs.
+func parseSysctls(sysctls string) (map[string]string, error) {
+	if len(sysctls) == 0 {
+		return nil, nil
+	}
+	parsed := make(map[string]string)
+	for _, sysctl := range strings.Split(sysctls, ",") {
+		key, value, ok := strings.Cut(sysctl, "=")
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("bad cni sysctl [%s], should be key=value", sysctl)
+		}
+		parsed[key] = value
+	}
+	return parsed, nil
+}
+
+// parseCNIPlugins parses the JSON array of plugin stanzas, each of which must have a type.
+func parseCNIPlugins(plugins string) ([]map[string]interface{}, error) {
+	if len(plugins) == 0 {
+		return nil, nil
+	}
+	var parsed []map[string]interface{}
+	if err := json.Unmarshal([]byte(plugins), &parsed); err != nil {
+		return nil, fmt.Errorf("bad cni extra plugins: %w", err)
+	}
+	for i, plugin := range parsed {
+		if pluginType, _ := plugin["type"].(string); len(pluginType) == 0 {
+			return nil, fmt.Errorf("cni extra plugin #%d has no type", i)
+		}
+	}
+	return parsed, nil
+}
+
+// validateCIDRs checks the comma-separated CIDRs can be parsed and don't overlap.
+func validateCIDRs(name, cidrs string) []string {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	var (
+		problems []string
+		ipNets   []*net.IPNet
+	)
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("bad %s: %v", name, err))
+			continue
+		}
+		for _, other := range ipNets {
+			if ipNet.Contains(other.IP) || other.Contains(ipNet.IP) {
+				problems = append(problems, fmt.Sprintf("%s [%s] and [%s] overlap", name, other, ipNet))
+			}
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return problems
+}
+
+// loadConfig returns the config from the config file, env and flags in args.
+func loadConfig(set *flag.FlagSet, args []string) (*Config, error) {
+	config := newConfig()
+	config.InitFlags(set)
+	if err := set.Parse(args); err != nil {
+		return nil, err
+	}
+	if len(config.ConfigFile) == 0 {
+		return config, nil
+	}
+	// Load again on top of the config file, so env and flags take precedence.
+	fileConfig, err := newConfigFromFile(config.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config file [%s]: %w", config.ConfigFile, err)
+	}
+	fileSet := flag.NewFlagSet(set.Name(), flag.ContinueOnError)
+	fileConfig.InitFlags(fileSet)
+	if err := fileSet.Parse(args); err != nil {
+		return nil, err
+	}
+	return fileConfig, nil
+}
+
+// newConfigFromFile returns the config from the config file overridden by env.
+// Unknown keys in the config file are rejected.
+func newConfigFromFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if strings.HasSuffix(path, ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&config)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode: %w", err)
+	}
+	if config.Version != configVersion {
+		return nil, fmt.Errorf("unsupported version [%s], should be %s", config.Version, configVersion)
+	}
+	if err := loadEnv(&config); err != nil {
+		return nil, err
+	}
+	config.ConfigFile = path
+	return &config, nil
+}
+
 func newConfig() *Config {
 	var config Config
+	if err := loadEnv(&config); err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	return &config
+}
+
+func loadEnv(config *Config) error {
 	loader := configor.New(&configor.Config{
 		ENVPrefix: envPrefix,
 		Debug:     debugMode,
 		Verbose:   debugMode,
 	})
-	if err := loader.Load(&config); err != nil {
-		log.Fatalf("failed to load config: %v", err)
+	return loader.Load(config)
+}
+
+// parseBGPPeers parses the comma-separated BGP peers.
+func parseBGPPeers(s string) ([]app.BGPPeer, error) {
+	if len(s) == 0 {
+		return nil, nil
 	}
-	return &config
+	var peers []app.BGPPeer
+	addresses := make(map[string]bool)
+	for _, spec := range strings.Split(s, ",") {
+		peer, err := app.ParseBGPPeer(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		if addresses[peer.String()] {
+			return nil, fmt.Errorf("duplicated bgp peer [%s]", peer)
+		}
+		addresses[peer.String()] = true
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// parseIPPools parses the comma-separated IP pools.
+func parseIPPools(s string) ([]app.IPPool, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	var pools []app.IPPool
+	names := make(map[string]bool)
+	for _, spec := range strings.Split(s, ",") {
+		pool, err := app.ParseIPPool(strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		if names[pool.Name] {
+			return nil, fmt.Errorf("duplicated ip pool [%s]", pool.Name)
+		}
+		names[pool.Name] = true
+		pools = append(pools, pool)
+	}
+	return pools, nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"gotest.tools/v3/assert"
@@ -34,3 +35,109 @@ func Test_parseConfig_from_env(t *testing.T) {
 	assert.Equal(t, cfg.NodeName, "hello")
 	assert.Equal(t, cfg.CNIConfigPath, defaultCNIConfigPath)
 }
+
+func TestConfig_defaults(t *testing.T) {
+	cfg := &Config{NodeName: "hello"}
+	assert.NilError(t, cfg.Validate())
+	assert.Equal(t, cfg.APITimeout, defaultAPITimeout)
+	assert.Equal(t, cfg.IPAMDataPath, defaultIPAMDataPath)
+	assert.Equal(t, cfg.IPAMSocketPath, defaultIPAMSocket)
+}
+
+func TestConfig_CheckHost(t *testing.T) {
+	cfg := &Config{CNIConfigPath: t.TempDir()}
+	assert.NilError(t, cfg.CheckHost())
+	cfg.CNIConfigPath = filepath.Join(cfg.CNIConfigPath, "missing")
+	assert.ErrorContains(t, cfg.CheckHost(), "bad cni config path")
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NilError(t, os.WriteFile(path, nil, 0600))
+	cfg.CNIConfigPath = path
+	assert.ErrorContains(t, cfg.CheckHost(), "is not a directory")
+
+	cfg = &Config{CNIConfigPath: t.TempDir(), SandboxStatePath: path}
+	assert.NilError(t, cfg.CheckHost(), "not checked without gc")
+	cfg.IPAMGCInterval = 300
+	assert.ErrorContains(t, cfg.CheckHost(), "sandbox state path")
+}
+
+func TestConfig_Validate(t *testing.T) {
+	cfg := &Config{}
+	err := cfg.Validate()
+	assert.Equal(t, cfg.CNIConfigPath, defaultCNIConfigPath)
+	assert.ErrorContains(t, err, "node name is empty")
+
+	cfg = &Config{
+		NodeName:             "hello",
+		IP6tnlMTU:            100,
+		PprofPort:            7442,
+		MetricsPort:          7442,
+		ClusterPodCIDRs:      "10.244.0.0/16,10.244.1.0/24,fd00::/48",
+		UnderlayCIDRs:        "2001:db8::/64,bad",
+		UnderlayAddressTypes: "InternalIP,Hostname",
+		RemoteClusters:       "east=/east,east=/east2,west",
+		IPsecSecret:          "shiba-ipsec",
+		RouteTable:           254,
+		CNIVersion:           "0.2.0",
+		CNIPlugins:           "bandwidth,flannel",
+		CNISysctls:           "net.core.somaxconn",
+		CNIExtraPlugins:      `[{"name": "x"}]`,
+		LoadBalancerCIDRs:    "192.0.2.0/28",
+		BGPPeers:             "192.0.2.1=65000",
+		BGPRouterID:          "2001:db8::1",
+		LogFormat:            "xml",
+		LogLevel:             "loud",
+	}
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, "ip6tnl mtu should be in")
+	assert.ErrorContains(t, err, "can't share port 7442")
+	assert.ErrorContains(t, err, "cluster pod cidrs [10.244.0.0/16] and [10.244.1.0/24] overlap")
+	assert.ErrorContains(t, err, "bad underlay cidrs")
+	assert.ErrorContains(t, err, "bad underlay address type [Hostname]")
+	assert.ErrorContains(t, err, "duplicated remote cluster [east]")
+	assert.ErrorContains(t, err, "bad remote cluster [west]")
+	assert.ErrorContains(t, err, "bad ipsec secret [shiba-ipsec]")
+	assert.ErrorContains(t, err, "unsupported cni version [0.2.0]")
+	assert.ErrorContains(t, err, "bad cni plugin [flannel]")
+	assert.ErrorContains(t, err, "bad cni sysctl [net.core.somaxconn]")
+	assert.ErrorContains(t, err, "cni extra plugin #0 has no type")
+	assert.ErrorContains(t, err, "route table 254 should be in [1, 253)")
+	assert.ErrorContains(t, err, "load balancer interface is not set")
+	assert.ErrorContains(t, err, "load balancer requires the config namespace")
+	assert.ErrorContains(t, err, "bgp local asn 0 should be in")
+	assert.ErrorContains(t, err, "bad bgp router id [2001:db8::1]")
+	assert.ErrorContains(t, err, "bad log format [xml]")
+	assert.ErrorContains(t, err, "bad log level")
+}
+
+func TestLoadConfig_file(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shiba.yaml")
+	assert.NilError(t, os.WriteFile(path, []byte("version: v1\nkubeConfigPath: /file\nip6tnlMTU: 1400\nprobeInterval: 10\n"), 0600))
+	t.Setenv("SHIBA_PROBEINTERVAL", "20")
+	cfg, err := loadConfig(flag.NewFlagSet("", flag.ContinueOnError), []string{"--config", path, "--ip6tnl-mtu=1300"})
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.KubeConfigPath, "/file")
+	assert.Equal(t, cfg.ProbeInterval, 20) // Env overrides the file.
+	assert.Equal(t, cfg.IP6tnlMTU, 1300)   // Flags override the file.
+
+	path = filepath.Join(dir, "shiba.json")
+	assert.NilError(t, os.WriteFile(path, []byte(`{"version": "v1", "kubeConfigPath": "/json"}`), 0600))
+	cfg, err = newConfigFromFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.KubeConfigPath, "/json")
+
+	assert.NilError(t, os.WriteFile(path, []byte(`{"version": "v1", "nodeNmae": "json"}`), 0600))
+	_, err = newConfigFromFile(path)
+	assert.ErrorContains(t, err, "unknown field")
+
+	path = filepath.Join(dir, "shiba.yaml")
+	assert.NilError(t, os.WriteFile(path, []byte("nodeName: file\n"), 0600))
+	_, err = newConfigFromFile(path)
+	assert.ErrorContains(t, err, "unsupported version")
+}
+
+func TestConfigExample(t *testing.T) {
+	cfg, err := newConfigFromFile("../config.example.yaml")
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.Version, configVersion)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	installCNICommand     = "install-cni"
+	defaultCNIBundlePath  = "/opt/shiba/cni/bin"
+	defaultCNIInstallPath = "/host/opt/cni/bin"
+	cniChecksumFile       = "SHA256SUMS" // Checksums of the bundled plugins, in the format of sha256sum.
+	cniVersionFile        = "VERSION"    // Version of the bundled plugins.
+	cniProbeTimeout       = 5 * time.Second
+)
+
+var (
+	versionPattern       = regexp.MustCompile(`v?(\d+)\.(\d+)\.(\d+)`)
+	pluginVersionPattern = regexp.MustCompile(`plugin (v?\d+\.\d+\.\d+)`) // Not the protocol versions after it.
+)
+
+// installCNI runs the install mode, which installs the bundled CNI plugins to the host.
+func installCNI(args []string) error {
+	set := flag.NewFlagSet(installCNICommand, flag.ExitOnError)
+	src := set.String("src", defaultCNIBundlePath, "path to the bundled CNI plugins")
+	dst := set.String("dst", defaultCNIInstallPath, "path to install the CNI plugins to")
+	force := set.Bool("force", false, "overwrite the installed plugins even if they are newer")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	return installCNIPlugins(*src, *dst, *force, probePluginVersion)
+}
+
+// installCNIPlugins installs the plugins listed in the checksum file of src to dst. Each plugin is verified
+// against its checksum and replaced atomically. An installed plugin newer than the bundle is kept unless forced.
+// probe returns the version of an installed plugin, nil if unknown.
+func installCNIPlugins(src, dst string, force bool, probe func(path string) []int) error {
+	b, err := os.ReadFile(filepath.Join(src, cniVersionFile))
+	if err != nil {
+		return fmt.Errorf("failed to read the version of bundled plugins: %w", err)
+	}
+	bundleVersion := parseVersion(string(b))
+	if bundleVersion == nil {
+		return fmt.Errorf("bad version of bundled plugins [%s]", strings.TrimSpace(string(b)))
+	}
+	checksums, err := readChecksums(filepath.Join(src, cniChecksumFile))
+	if err != nil {
+		return fmt.Errorf("failed to read checksums of bundled plugins: %w", err)
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create [%s]: %w", dst, err)
+	}
+	names := make([]string, 0, len(checksums))
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checksum := checksums[name]
+		logger := log.WithFields(log.Fields{"plugin": name, "version": formatVersion(bundleVersion)})
+		if sum, err := fileChecksum(filepath.Join(src, name)); err != nil || sum != checksum {
+			return fmt.Errorf("bundled plugin [%s] doesn't match its checksum", name)
+		}
+		target := filepath.Join(dst, name)
+		if sum, err := fileChecksum(target); err == nil {
+			if sum == checksum {
+				logger.Debug("plugin is up to date")
+				continue
+			}
+			if installed := probe(target); !force && compareVersions(installed, bundleVersion) > 0 {
+				logger.Warningf("installed plugin is newer (%s), skipping", formatVersion(installed))
+				continue
+			}
+		}
+		if err := installFile(filepath.Join(src, name), target, checksum); err != nil {
+			return fmt.Errorf("failed to install plugin [%s]: %w", name, err)
+		}
+		logger.Info("plugin is installed")
+	}
+	return nil
+}
+
+// installFile copies the file to a temporary file next to the target, verifies it and renames it over the target,
+// so the container runtime never sees a partial binary.
+func installFile(src, target, checksum string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed.
+	if _, err := io.Copy(tmp, in); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if sum, err := fileChecksum(tmp.Name()); err != nil || sum != checksum {
+		return errors.New("copied file doesn't match the checksum")
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// readChecksums reads the checksum file in the format of sha256sum, returning file name -> checksum.
+func readChecksums(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad line [%s]", scanner.Text())
+		}
+		name := strings.TrimPrefix(fields[1], "*") // Binary mode.
+		if name != filepath.Base(name) {
+			return nil, fmt.Errorf("bad file name [%s]", name)
+		}
+		checksums[name] = strings.ToLower(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(checksums) == 0 {
+		return nil, errors.New("no plugin is listed")
+	}
+	return checksums, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// probePluginVersion runs the plugin without CNI_COMMAND, which prints its version like
+// "CNI ptp plugin v1.3.0". It returns nil if the version is unknown.
+func probePluginVersion(path string) []int {
+	ctx, cancel := context.WithTimeout(context.Background(), cniProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = []string{}
+	output, _ := cmd.CombinedOutput() // The plugin exits with an error without CNI_COMMAND.
+	match := pluginVersionPattern.FindSubmatch(output)
+	if match == nil {
+		return nil
+	}
+	return parseVersion(string(match[1]))
+}
+
+// parseVersion returns the major, minor and patch numbers of the first version in s, nil if not found.
+func parseVersion(s string) []int {
+	match := versionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return nil
+	}
+	version := make([]int, 3)
+	for i := range version {
+		version[i], _ = strconv.Atoi(match[i+1])
+	}
+	return version
+}
+
+// compareVersions compares two versions, where an unknown (nil) version is the oldest.
+func compareVersions(a, b []int) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func formatVersion(version []int) string {
+	if version == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("v%d.%d.%d", version[0], version[1], version[2])
+}
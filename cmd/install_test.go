@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestInstallCNIPlugins(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	writeBundle := func(plugins map[string]string) {
+		var sums strings.Builder
+		for name, content := range plugins {
+			path := filepath.Join(src, name)
+			assert.NilError(t, os.WriteFile(path, []byte(content), 0o755))
+			sum, err := fileChecksum(path)
+			assert.NilError(t, err)
+			fmt.Fprintf(&sums, "%s  %s\n", sum, name)
+		}
+		assert.NilError(t, os.WriteFile(filepath.Join(src, cniChecksumFile), []byte(sums.String()), 0o644))
+	}
+	assert.NilError(t, os.WriteFile(filepath.Join(src, cniVersionFile), []byte("v1.3.0\n"), 0o644))
+	writeBundle(map[string]string{"ptp": "ptp v1.3.0", "portmap": "portmap v1.3.0"})
+	installed := map[string][]int{}
+	probe := func(path string) []int {
+		return installed[filepath.Base(path)]
+	}
+
+	// Fresh install.
+	assert.NilError(t, installCNIPlugins(src, dst, false, probe))
+	b, err := os.ReadFile(filepath.Join(dst, "ptp"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "ptp v1.3.0")
+	info, err := os.Stat(filepath.Join(dst, "portmap"))
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0o755))
+
+	// Newer plugins are kept unless forced, while older and unknown ones are replaced.
+	assert.NilError(t, os.WriteFile(filepath.Join(dst, "ptp"), []byte("ptp v1.4.0"), 0o755))
+	assert.NilError(t, os.WriteFile(filepath.Join(dst, "portmap"), []byte("portmap"), 0o755))
+	installed["ptp"] = []int{1, 4, 0}
+	assert.NilError(t, installCNIPlugins(src, dst, false, probe))
+	b, _ = os.ReadFile(filepath.Join(dst, "ptp"))
+	assert.Equal(t, string(b), "ptp v1.4.0")
+	b, _ = os.ReadFile(filepath.Join(dst, "portmap"))
+	assert.Equal(t, string(b), "portmap v1.3.0")
+	assert.NilError(t, installCNIPlugins(src, dst, true, probe))
+	b, _ = os.ReadFile(filepath.Join(dst, "ptp"))
+	assert.Equal(t, string(b), "ptp v1.3.0")
+
+	// No temporary files are left.
+	entries, err := os.ReadDir(dst)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 2)
+
+	// A corrupted bundle is refused.
+	assert.NilError(t, os.WriteFile(filepath.Join(src, "ptp"), []byte("corrupted"), 0o755))
+	err = installCNIPlugins(src, dst, true, probe)
+	assert.ErrorContains(t, err, "bundled plugin [ptp] doesn't match its checksum")
+}
+
+func TestParseVersion(t *testing.T) {
+	assert.DeepEqual(t, parseVersion("v1.3.0\n"), []int{1, 3, 0})
+	assert.DeepEqual(t, parseVersion("1.10.2"), []int{1, 10, 2})
+	assert.Assert(t, parseVersion("unknown") == nil)
+	assert.Equal(t, compareVersions([]int{1, 10, 0}, []int{1, 9, 9}), 1)
+	assert.Equal(t, compareVersions(nil, []int{0, 0, 1}), -1)
+	assert.Equal(t, compareVersions([]int{1, 3, 0}, []int{1, 3, 0}), 0)
+}
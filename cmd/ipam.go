@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moycat/shiba/app"
+	"github.com/moycat/shiba/model"
+)
+
+const (
+	ipamTimeout = 30 * time.Second
+	// Error codes of the CNI spec.
+	cniErrorTryAgainLater = 11
+	cniErrorInternal      = 999
+)
+
+// cniError is the error result of a CNI plugin.
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+// runIPAMPlugin runs as the shiba-ipam plugin, which asks the shiba daemon for the addresses of pods requesting
+// static IPs or pools, and delegates the other pods to host-local. It returns the exit code.
+func runIPAMPlugin(stdin io.Reader, stdout io.Writer) int {
+	command := os.Getenv("CNI_COMMAND")
+	if command == "VERSION" {
+		_ = json.NewEncoder(stdout).Encode(map[string]interface{}{
+			"cniVersion":        app.CNIVersions[len(app.CNIVersions)-1],
+			"supportedVersions": app.CNIVersions,
+		})
+		return 0
+	}
+	if len(command) == 0 {
+		_, _ = fmt.Fprintf(stdout, "CNI %s plugin\n", app.IPAMPluginType)
+		return 1
+	}
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return writeCNIError(stdout, "", cniErrorInternal, fmt.Errorf("failed to read config: %w", err))
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return writeCNIError(stdout, "", cniErrorInternal, fmt.Errorf("failed to parse config: %w", err))
+	}
+	cniVersion, _ := config["cniVersion"].(string)
+	ipam, _ := config["ipam"].(map[string]interface{})
+	socket, _ := ipam["socket"].(string)
+	delegate, _ := ipam["delegate"].(map[string]interface{})
+	if len(socket) == 0 || delegate == nil {
+		return writeCNIError(stdout, cniVersion, cniErrorInternal, errors.New("socket and delegate must be set"))
+	}
+	args := parseCNIArgs(os.Getenv("CNI_ARGS"))
+	response, err := requestIPAM(socket, model.IPAMRequest{
+		Command:     command,
+		ContainerID: os.Getenv("CNI_CONTAINERID"),
+		IfName:      os.Getenv("CNI_IFNAME"),
+		Namespace:   args["K8S_POD_NAMESPACE"],
+		Name:        args["K8S_POD_NAME"],
+	})
+	if err != nil && command == "DEL" {
+		// Don't block the pod from being deleted, the pool addresses are released by the garbage collection.
+		config["ipam"] = delegate
+		return delegateIPAM(config, stdout)
+	} else if err != nil {
+		return writeCNIError(stdout, cniVersion, cniErrorTryAgainLater, fmt.Errorf("failed to ask shiba: %w", err))
+	}
+	if len(response.Error) > 0 {
+		code := cniErrorInternal
+		if response.Retry {
+			code = cniErrorTryAgainLater
+		}
+		return writeCNIError(stdout, cniVersion, code, errors.New(response.Error))
+	}
+	if response.Delegate {
+		config["ipam"] = delegate
+		return delegateIPAM(config, stdout)
+	}
+	if command != "ADD" {
+		return 0
+	}
+	routes, _ := delegate["routes"].([]interface{})
+	result, err := buildIPAMResult(cniVersion, response.IPs, routes)
+	if err != nil {
+		return writeCNIError(stdout, cniVersion, cniErrorInternal, err)
+	}
+	_ = json.NewEncoder(stdout).Encode(result)
+	return 0
+}
+
+// requestIPAM sends the request to the shiba daemon on the unix socket.
+func requestIPAM(socket string, request model.IPAMRequest) (*model.IPAMResponse, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: ipamTimeout,
+	}
+	b, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post("http://shiba/ipam", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var response model.IPAMResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// delegateIPAM runs the delegated IPAM plugin found in CNI_PATH with the config, passing its result through.
+func delegateIPAM(config map[string]interface{}, stdout io.Writer) int {
+	cniVersion, _ := config["cniVersion"].(string)
+	delegate := config["ipam"].(map[string]interface{})
+	pluginType, _ := delegate["type"].(string)
+	var path string
+	for _, dir := range filepath.SplitList(os.Getenv("CNI_PATH")) {
+		if info, err := os.Stat(filepath.Join(dir, pluginType)); err == nil && !info.IsDir() {
+			path = filepath.Join(dir, pluginType)
+			break
+		}
+	}
+	if len(path) == 0 || pluginType != filepath.Base(pluginType) {
+		return writeCNIError(stdout, cniVersion, cniErrorInternal, fmt.Errorf("plugin [%s] is not found", pluginType))
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return writeCNIError(stdout, cniVersion, cniErrorInternal, err)
+	}
+	cmd := exec.Command(path)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode() // The error result is written by the plugin.
+		}
+		return writeCNIError(stdout, cniVersion, cniErrorInternal, err)
+	}
+	return 0
+}
+
+// buildIPAMResult returns the result of the addresses in the CNI version, with the routes of their families.
+func buildIPAMResult(cniVersion string, addresses []model.IPAMAddress,
+	routes []interface{}) (map[string]interface{}, error) {
+	var ips []map[string]interface{}
+	families := make(map[bool]bool) // Whether IPv4.
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address.Address)
+		if err != nil {
+			return nil, fmt.Errorf("bad address [%s]: %w", address.Address, err)
+		}
+		entry := map[string]interface{}{"address": address.Address}
+		if len(address.Gateway) > 0 {
+			entry["gateway"] = address.Gateway
+		}
+		if strings.HasPrefix(cniVersion, "0.") {
+			// The version field is removed since 1.0.0.
+			entry["version"] = "6"
+			if ip.To4() != nil {
+				entry["version"] = "4"
+			}
+		}
+		families[ip.To4() != nil] = true
+		ips = append(ips, entry)
+	}
+	var familyRoutes []interface{}
+	for _, route := range routes {
+		route, _ := route.(map[string]interface{})
+		dst, _ := route["dst"].(string)
+		if ip, _, err := net.ParseCIDR(dst); err == nil && families[ip.To4() != nil] {
+			familyRoutes = append(familyRoutes, route)
+		}
+	}
+	return map[string]interface{}{
+		"cniVersion": cniVersion,
+		"ips":        ips,
+		"routes":     familyRoutes,
+	}, nil
+}
+
+// parseCNIArgs parses CNI_ARGS like "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web".
+func parseCNIArgs(s string) map[string]string {
+	args := make(map[string]string)
+	for _, pair := range strings.Split(s, ";") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			args[key] = value
+		}
+	}
+	return args
+}
+
+func writeCNIError(stdout io.Writer, cniVersion string, code int, err error) int {
+	_ = json.NewEncoder(stdout).Encode(cniError{CNIVersion: cniVersion, Code: code, Msg: err.Error()})
+	return 1
+}
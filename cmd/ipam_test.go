@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/moycat/shiba/model"
+)
+
+func TestBuildIPAMResult(t *testing.T) {
+	addresses := []model.IPAMAddress{{Address: "10.250.0.10/32", Gateway: "10.244.1.1"}}
+	routes := []interface{}{
+		map[string]interface{}{"dst": "0.0.0.0/0"},
+		map[string]interface{}{"dst": "::/0"},
+	}
+	result, err := buildIPAMResult("0.3.1", addresses, routes)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, result, map[string]interface{}{
+		"cniVersion": "0.3.1",
+		"ips": []map[string]interface{}{
+			{"address": "10.250.0.10/32", "gateway": "10.244.1.1", "version": "4"},
+		},
+		// Only the routes of the families of the addresses.
+		"routes": []interface{}{map[string]interface{}{"dst": "0.0.0.0/0"}},
+	})
+
+	result, err = buildIPAMResult("1.0.0", addresses, routes)
+	assert.NilError(t, err)
+	_, ok := result["ips"].([]map[string]interface{})[0]["version"]
+	assert.Assert(t, !ok)
+
+	_, err = buildIPAMResult("1.0.0", []model.IPAMAddress{{Address: "10.250.0.10"}}, nil)
+	assert.ErrorContains(t, err, "bad address")
+}
+
+func TestParseCNIArgs(t *testing.T) {
+	args := parseCNIArgs("IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web;K8S_POD_INFRA_CONTAINER_ID=abc")
+	assert.Equal(t, args["K8S_POD_NAMESPACE"], "default")
+	assert.Equal(t, args["K8S_POD_NAME"], "web")
+}
+
+func TestParseIPPools(t *testing.T) {
+	pools, err := parseIPPools("stable=/28, shared=10.250.0.0/24")
+	assert.NilError(t, err)
+	assert.Equal(t, len(pools), 2)
+	assert.Equal(t, pools[1].Name, "shared")
+	_, err = parseIPPools("stable=/28,stable=/27")
+	assert.ErrorContains(t, err, "duplicated ip pool [stable]")
+}
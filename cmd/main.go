@@ -3,15 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -21,15 +25,28 @@ import (
 )
 
 func main() {
+	if filepath.Base(os.Args[0]) == app.IPAMPluginType {
+		os.Exit(runIPAMPlugin(os.Stdin, os.Stdout))
+	}
 	if os.Geteuid() != 0 {
 		log.Fatal("shiba must be run as root")
 	}
-	config := newConfig()
-	config.InitFlags(flag.CommandLine)
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == installCNICommand {
+		if err := installCNI(os.Args[2:]); err != nil {
+			log.Fatalf("failed to install cni plugins: %v", err)
+		}
+		return
+	}
+	config, err := loadConfig(flag.CommandLine, os.Args[1:])
+	exitOnError(err)
 	exitOnError(config.Validate())
+	exitOnError(config.CheckHost())
+	setupLogging(config)
 	client := getKubernetesClient(config.KubeConfigPath)
 	options := getShibaOptions(config)
+	if config.NodeStatus {
+		options.DynamicClient = getDynamicClient(config.KubeConfigPath)
+	}
 	shiba, err := app.NewShiba(client, config.NodeName, config.CNIConfigPath, options)
 	if err != nil {
 		log.Fatalf("failed to create shiba: %v", err)
@@ -38,12 +55,42 @@ func main() {
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
 	go waitForSignals(signalCh, stopCh)
+	shiba.RegisterDebugHandlers(http.DefaultServeMux)
 	go servePprof(config.PprofPort)
+	go serveMetrics(config.MetricsPort, shiba.MetricsHandler())
 	if err := shiba.Run(stopCh); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// setupLogging applies the log format and level, and adds the current node to all logs.
+func setupLogging(config *Config) {
+	if config.LogFormat == logFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	if len(config.LogLevel) > 0 {
+		level, _ := log.ParseLevel(config.LogLevel) // Validated.
+		log.SetLevel(level)
+	}
+	log.AddHook(fieldsHook{"node": config.NodeName})
+}
+
+// fieldsHook adds the fields to all log entries.
+type fieldsHook log.Fields
+
+func (h fieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h fieldsHook) Fire(entry *log.Entry) error {
+	for key, value := range h {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
+
 func exitOnError(err error) {
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "%v\n\n", err)
@@ -54,8 +101,42 @@ func exitOnError(err error) {
 
 func getShibaOptions(config *Config) app.ShibaOptions {
 	options := app.ShibaOptions{
-		APITimeout: time.Duration(config.APITimeout) * time.Second,
-		IP6tnlMTU:  config.IP6tnlMTU,
+		APITimeout:        time.Duration(config.APITimeout) * time.Second,
+		IP6tnlMTU:         config.IP6tnlMTU,
+		DryRun:            config.DryRun,
+		ProbeInterval:     time.Duration(config.ProbeInterval) * time.Second,
+		ServiceProxy:      config.ServiceProxy,
+		StaticPeersPath:   config.StaticPeersPath,
+		Multipath:         config.Multipath,
+		NodeSelector:      config.NodeSelector,
+		ZoneLabel:         config.ZoneLabel,
+		ConfigNamespace:   config.ConfigNamespace,
+		AntiSpoofing:      config.AntiSpoofing,
+		IPsecSecret:       config.IPsecSecret,
+		RouteTable:        config.RouteTable,
+		CNIVersion:        config.CNIVersion,
+		CNIBinPath:        config.CNIBinPath,
+		CNIConfigOnSync:   config.CNIConfigOnSync,
+		IPAMGCInterval:    time.Duration(config.IPAMGCInterval) * time.Second,
+		IPAMGCGracePeriod: time.Duration(config.IPAMGCGracePeriod) * time.Second,
+		IPAMDataPath:      config.IPAMDataPath,
+		SandboxStatePath:  config.SandboxStatePath,
+		IPAMSocketPath:    config.IPAMSocketPath,
+	}
+	if len(config.CNIPlugins) > 0 {
+		options.CNIPlugins = strings.Split(config.CNIPlugins, ",")
+	}
+	// Validated.
+	options.CNISysctls, _ = parseSysctls(config.CNISysctls)
+	options.CNIExtraPlugins, _ = parseCNIPlugins(config.CNIExtraPlugins)
+	options.IPPools, _ = parseIPPools(config.IPPools)
+	options.BGPPeers, _ = parseBGPPeers(config.BGPPeers)
+	options.BGPLocalASN = uint32(config.BGPLocalASN)
+	options.BGPRouterID = net.ParseIP(config.BGPRouterID)
+	options.FlowLogPath = config.FlowLogPath
+	options.FlowMetrics = config.FlowMetrics
+	if len(config.ExcludeTaints) > 0 {
+		options.ExcludeTaints = strings.Split(config.ExcludeTaints, ",")
 	}
 	if len(config.ClusterPodCIDRs) > 0 {
 		cidrs, err := util.ParseIPNets(strings.Split(config.ClusterPodCIDRs, ","))
@@ -64,10 +145,69 @@ func getShibaOptions(config *Config) app.ShibaOptions {
 		}
 		options.ClusterPodCIDRs = cidrs
 	}
+	if len(config.LoadBalancerCIDRs) > 0 {
+		cidrs, err := util.ParseIPNets(strings.Split(config.LoadBalancerCIDRs, ","))
+		if err != nil {
+			log.Fatalf("failed to parse load balancer cidrs: %v", err)
+		}
+		options.LoadBalancerCIDRs = cidrs
+		options.LoadBalancerInterface = config.LoadBalancerInterface
+		options.LoadBalancerClassless = config.LoadBalancerClassless
+	}
+	if len(config.UnderlayAddressTypes) > 0 {
+		for _, addressType := range strings.Split(config.UnderlayAddressTypes, ",") {
+			switch addressType := corev1.NodeAddressType(addressType); addressType {
+			case corev1.NodeInternalIP, corev1.NodeExternalIP:
+				options.UnderlayAddressTypes = append(options.UnderlayAddressTypes, addressType)
+			default:
+				log.Fatalf("bad underlay address type [%s]", addressType)
+			}
+		}
+	}
+	options.UnderlayInterface = config.UnderlayInterface
+	if len(config.UnderlayCIDRs) > 0 {
+		// Keep the order, which is the preference.
+		for _, cidr := range strings.Split(config.UnderlayCIDRs, ",") {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Fatalf("failed to parse underlay cidrs: %v", err)
+			}
+			options.UnderlayCIDRs = append(options.UnderlayCIDRs, ipNet)
+		}
+	}
+	if len(config.RemoteClusters) > 0 {
+		options.RemoteClusters = make(map[string]kubernetes.Interface)
+		for _, remoteCluster := range strings.Split(config.RemoteClusters, ",") {
+			name, kubeConfigPath, ok := strings.Cut(remoteCluster, "=")
+			if !ok || len(name) == 0 || strings.Contains(name, "/") || len(kubeConfigPath) == 0 {
+				log.Fatalf("bad remote cluster [%s], should be name=kubeconfig-path", remoteCluster)
+			}
+			if _, ok := options.RemoteClusters[name]; ok {
+				log.Fatalf("duplicated remote cluster [%s]", name)
+			}
+			options.RemoteClusters[name] = getKubernetesClient(kubeConfigPath)
+		}
+	}
 	return options
 }
 
 func getKubernetesClient(kubeConfigPath string) kubernetes.Interface {
+	client, err := kubernetes.NewForConfig(getRESTConfig(kubeConfigPath))
+	if err != nil {
+		log.Fatalf("failed to create rest client: %v", err)
+	}
+	return client
+}
+
+func getDynamicClient(kubeConfigPath string) dynamic.Interface {
+	client, err := dynamic.NewForConfig(getRESTConfig(kubeConfigPath))
+	if err != nil {
+		log.Fatalf("failed to create dynamic client: %v", err)
+	}
+	return client
+}
+
+func getRESTConfig(kubeConfigPath string) *rest.Config {
 	var (
 		restConfig *rest.Config
 		err        error
@@ -95,11 +235,7 @@ func getKubernetesClient(kubeConfigPath string) kubernetes.Interface {
 			log.Fatalf("failed to get in-cluster config: %v", err)
 		}
 	}
-	client, err := kubernetes.NewForConfig(restConfig)
-	if err != nil {
-		log.Fatalf("failed to create rest client: %v", err)
-	}
-	return client
+	return restConfig
 }
 
 func waitForSignals(signalCh <-chan os.Signal, stopCh chan<- struct{}) {
@@ -119,3 +255,15 @@ func servePprof(port int) {
 		log.Errorf("pprof exited: %v", err)
 	}
 }
+
+func serveMetrics(port int, handler http.Handler) {
+	if port <= 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	if err != nil {
+		log.Errorf("metrics server exited: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/moycat/shiba/util"
+)
+
+func Test_getShibaOptions(t *testing.T) {
+	cfg := &Config{
+		NodeName:             "hello",
+		UnderlayAddressTypes: "ExternalIP,InternalIP",
+		UnderlayCIDRs:        "2001:db8::/32,192.0.2.0/24",
+		UnderlayInterface:    "eth1",
+	}
+	assert.NilError(t, cfg.Validate())
+	options := getShibaOptions(cfg)
+	assert.DeepEqual(t, options.UnderlayAddressTypes,
+		[]corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP})
+	assert.Equal(t, util.FormatIPNets(options.UnderlayCIDRs), "[2001:db8::/32 192.0.2.0/24]")
+	assert.Equal(t, options.UnderlayInterface, "eth1")
+}
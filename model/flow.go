@@ -0,0 +1,28 @@
+package model
+
+import "time"
+
+// Flow is a connection of pods written by the flow logger as a JSON line.
+type Flow struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"` // start or end.
+	Protocol string    `json:"protocol"`
+	Src      Endpoint  `json:"src"`
+	Dst      Endpoint  `json:"dst"`
+	// Service is the original destination if the flow is DNATed, like to a service.
+	Service *Endpoint `json:"service,omitempty"`
+	// The counters are only set when the flow ends, if conntrack accounting is enabled.
+	Packets      uint64 `json:"packets,omitempty"`
+	Bytes        uint64 `json:"bytes,omitempty"`
+	ReplyPackets uint64 `json:"replyPackets,omitempty"`
+	ReplyBytes   uint64 `json:"replyBytes,omitempty"`
+}
+
+// Endpoint is an end of a flow, with the pod of the address if known.
+type Endpoint struct {
+	IP        string `json:"ip"`
+	Port      uint16 `json:"port,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Node      string `json:"node,omitempty"`
+}
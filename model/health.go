@@ -0,0 +1,22 @@
+package model
+
+import (
+	"net"
+	"time"
+)
+
+// PeerHealth is the connectivity status of a peer gateway, measured by probing through the overlay.
+type PeerHealth struct {
+	Node     string // Key of the node.
+	Gateway  net.IP
+	Sent     uint64
+	Received uint64
+	Failures int           // Consecutive failed probes.
+	RTT      time.Duration // RTT of the last successful probe.
+	LastSeen time.Time
+}
+
+// Reachable tells if the peer gateway replied recently enough.
+func (h *PeerHealth) Reachable(failureThreshold int) bool {
+	return h.Failures < failureThreshold
+}
@@ -0,0 +1,24 @@
+package model
+
+// IPAMRequest is sent by the shiba-ipam plugin to the daemon for each CNI command.
+type IPAMRequest struct {
+	Command     string // ADD, DEL or CHECK.
+	ContainerID string
+	IfName      string
+	Namespace   string // Namespace of the pod.
+	Name        string // Name of the pod.
+}
+
+// IPAMResponse tells the shiba-ipam plugin the addresses of the pod, or to delegate to host-local.
+type IPAMResponse struct {
+	Delegate bool          `json:",omitempty"` // The pod doesn't request a static IP or a pool.
+	IPs      []IPAMAddress `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+	Retry    bool          `json:",omitempty"` // The error is temporary, like an address still in use.
+}
+
+// IPAMAddress is an address assigned to a pod.
+type IPAMAddress struct {
+	Address string // In the CIDR notation.
+	Gateway string
+}
@@ -4,18 +4,59 @@ import (
 	"net"
 )
 
-// NodeMap is the map of Node.
+// Sources of nodes.
+const (
+	SourceCluster      = ""        // Nodes of the current cluster.
+	SourceStatic       = "static"  // Static peers defined outside Kubernetes.
+	SourceRemotePrefix = "remote:" // Nodes of a remote cluster, followed by the cluster name.
+)
+
+// RemoteSource returns the source of nodes in a remote cluster.
+func RemoteSource(cluster string) string {
+	return SourceRemotePrefix + cluster
+}
+
+// NodeKey returns the key of a node in a NodeMap, which is namespaced by the source.
+func NodeKey(source, name string) string {
+	if source == SourceCluster {
+		return name
+	}
+	return source + "/" + name
+}
+
+// NodeMap is the map of Node, keyed by Node.Key().
 type NodeMap map[string]*Node
 
-// Node is a parsed K8s node.
+// Node is a parsed K8s node, or a peer treated as one.
 type Node struct {
 	Name     string
 	IP       net.IP // IPv6 only.
 	PodCIDRs []*net.IPNet
 	Tunnel   string
+	Source   string `json:",omitempty"`
+	// Paths are the tunnels through each pair of underlay addresses in multi-path mode, empty otherwise.
+	// The first path is also described by IP and Tunnel.
+	Paths []Path `json:",omitempty"`
+	// Zone is the zone of the node if zone scoping is enabled.
+	Zone        string `json:",omitempty"`
+	ZoneGateway bool   `json:",omitempty"`
+	// IPsecNonce is published by the node to derive the keys of its outgoing IPsec traffic.
+	IPsecNonce string `json:",omitempty"`
+}
+
+// Path is a tunnel between a local and a remote underlay address.
+type Path struct {
+	Local  net.IP
+	Remote net.IP
+	Tunnel string
+}
+
+// Key returns the key of the node in a NodeMap.
+func (n *Node) Key() string {
+	return NodeKey(n.Source, n.Name)
 }
 
-// DiffersFrom checks if the node is different from another node, except for the tunnel name.
+// DiffersFrom checks if the node is different from another node, except for the tunnel names.
 // The order of the pod CIDRs may be altered.
 func (n *Node) DiffersFrom(nn *Node) bool {
 	if n == nil && nn == nil {
@@ -24,7 +65,8 @@ func (n *Node) DiffersFrom(nn *Node) bool {
 	if (n == nil) != (nn == nil) {
 		return true
 	}
-	if n.Name != nn.Name {
+	if n.Name != nn.Name || n.Source != nn.Source || n.Zone != nn.Zone || n.ZoneGateway != nn.ZoneGateway ||
+		n.IPsecNonce != nn.IPsecNonce {
 		return true
 	}
 	if !n.IP.Equal(nn.IP) {
@@ -38,5 +80,13 @@ func (n *Node) DiffersFrom(nn *Node) bool {
 			return true
 		}
 	}
+	if len(n.Paths) != len(nn.Paths) {
+		return true
+	}
+	for i := range n.Paths {
+		if !n.Paths[i].Local.Equal(nn.Paths[i].Local) || !n.Paths[i].Remote.Equal(nn.Paths[i].Remote) {
+			return true
+		}
+	}
 	return false
 }
@@ -0,0 +1,12 @@
+package model
+
+// Change is a single modification to the host state planned by the reconciler.
+type Change struct {
+	Kind   string `json:"kind"`   // link, addr, route, chain, rule or file.
+	Action string `json:"action"` // add, delete, set-up, write, etc.
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan is the set of planned changes, grouped by the reconciling stage.
+type Plan map[string][]Change
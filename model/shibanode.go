@@ -0,0 +1,37 @@
+package model
+
+// ShibaNodeStatus is the overlay state of a node published to its ShibaNode.
+type ShibaNodeStatus struct {
+	UnderlayIP string       `json:"underlayIP"`
+	PodCIDRs   []string     `json:"podCIDRs"`
+	GatewayIPs []string     `json:"gatewayIPs"`
+	Backend    string       `json:"backend"`
+	MTU        int          `json:"mtu,omitempty"`
+	PeerCount  int          `json:"peerCount"`
+	LastSync   SyncResult   `json:"lastSync"`
+	Peers      []PeerStatus `json:"peers,omitempty"`
+}
+
+// SyncResult is the result of a sync pass.
+type SyncResult struct {
+	Time    string `json:"time"` // In RFC 3339.
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// PeerStatus is the status of the tunnels to a peer.
+type PeerStatus struct {
+	Name      string         `json:"name"`
+	Source    string         `json:"source,omitempty"`
+	PodCIDRs  []string       `json:"podCIDRs"`
+	Tunnels   []TunnelStatus `json:"tunnels"`
+	Reachable *bool          `json:"reachable,omitempty"` // Nil if not probed.
+}
+
+// TunnelStatus is the status of a tunnel interface.
+type TunnelStatus struct {
+	Name   string `json:"name"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	State  string `json:"state"` // Up, Down or Missing.
+}
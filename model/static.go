@@ -0,0 +1,15 @@
+package model
+
+// StaticPeerConfig is the file defining static peers outside Kubernetes.
+type StaticPeerConfig struct {
+	Peers []StaticPeer `yaml:"peers"`
+}
+
+// StaticPeer is a host outside Kubernetes, reached by a tunnel like a node.
+type StaticPeer struct {
+	Name  string   `yaml:"name"`
+	IP    string   `yaml:"ip"`    // The underlay IPv6 address.
+	CIDRs []string `yaml:"cidrs"` // The subnets routed to the peer.
+	// IPsecNonce is the nonce of the peer to derive the keys of its outgoing IPsec traffic.
+	IPsecNonce string `yaml:"ipsecNonce,omitempty"`
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+)
+
+var (
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	allNodesMAC  = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+	allNodesIP   = net.ParseIP("ff02::1")
+)
+
+// AnnounceIP sends a gratuitous ARP for an IPv4 address, or an unsolicited neighbor advertisement for an IPv6
+// address, from the interface, so the neighbors update their caches to the MAC address of the interface.
+func AnnounceIP(ifName string, ip net.IP) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return fmt.Errorf("interface [%s] has no ethernet address", ifName)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return sendFrame(iface, broadcastMAC, etherTypeARP, BuildGratuitousARP(iface.HardwareAddr, ip4))
+	}
+	return sendFrame(iface, allNodesMAC, etherTypeIPv6, BuildUnsolicitedNA(iface.HardwareAddr, ip))
+}
+
+func sendFrame(iface *net.Interface, dst net.HardwareAddr, etherType uint16, payload []byte) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(etherType),
+		Ifindex:  iface.Index,
+		Halen:    uint8(len(dst)),
+	}
+	copy(addr.Addr[:], dst)
+	return syscall.Sendto(fd, payload, 0, addr)
+}
+
+// BuildGratuitousARP returns the ARP request announcing the IPv4 address at the MAC address.
+func BuildGratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[0:], 1) // Ethernet.
+	binary.BigEndian.PutUint16(b[2:], syscall.ETH_P_IP)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:], 1) // Request.
+	copy(b[8:], mac)
+	copy(b[14:], ip.To4())
+	// The target hardware address is left zero.
+	copy(b[24:], ip.To4())
+	return b
+}
+
+// BuildUnsolicitedNA returns the IPv6 packet of an unsolicited neighbor advertisement of the address at the MAC
+// address to all nodes, with the override flag set.
+func BuildUnsolicitedNA(mac net.HardwareAddr, ip net.IP) []byte {
+	icmp := make([]byte, 32)
+	icmp[0] = 136                               // Neighbor advertisement.
+	binary.BigEndian.PutUint32(icmp[4:], 1<<29) // Override.
+	copy(icmp[8:], ip.To16())
+	icmp[24], icmp[25] = 2, 1 // Target link-layer address option of 8 bytes.
+	copy(icmp[26:], mac)
+	binary.BigEndian.PutUint16(icmp[2:], icmpv6Checksum(ip.To16(), allNodesIP, icmp))
+
+	b := make([]byte, 40, 40+len(icmp))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(len(icmp)))
+	b[6] = syscall.IPPROTO_ICMPV6
+	b[7] = 255 // Required by NDP.
+	copy(b[8:], ip.To16())
+	copy(b[24:], allNodesIP)
+	return append(b, icmp...)
+}
+
+// icmpv6Checksum computes the checksum of the ICMPv6 message with the pseudo header.
+func icmpv6Checksum(src, dst net.IP, message []byte) uint16 {
+	pseudo := make([]byte, 40, 40+len(message))
+	copy(pseudo[0:], src)
+	copy(pseudo[16:], dst)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(message)))
+	pseudo[39] = syscall.IPPROTO_ICMPV6
+	b := append(pseudo, message...)
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestBuildGratuitousARP(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	b := BuildGratuitousARP(mac, net.ParseIP("192.0.2.10"))
+	assert.DeepEqual(t, b, []byte{
+		0, 1, 8, 0, 6, 4, 0, 1,
+		2, 0, 0, 0, 0, 1, 192, 0, 2, 10,
+		0, 0, 0, 0, 0, 0, 192, 0, 2, 10,
+	})
+}
+
+func TestBuildUnsolicitedNA(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	ip := net.ParseIP("2001:db8::10")
+	b := BuildUnsolicitedNA(mac, ip)
+	assert.Equal(t, len(b), 72)
+	assert.Equal(t, b[7], byte(255))
+	assert.Assert(t, net.IP(b[8:24]).Equal(ip))
+	assert.Assert(t, net.IP(b[24:40]).Equal(allNodesIP))
+	icmp := b[40:]
+	assert.Equal(t, icmp[0], byte(136))
+	assert.Assert(t, net.IP(icmp[8:24]).Equal(ip))
+	assert.DeepEqual(t, net.HardwareAddr(icmp[26:32]), mac)
+	// A valid checksum sums up to zero.
+	assert.Equal(t, icmpv6Checksum(ip, allNodesIP, icmp), uint16(0))
+}
@@ -0,0 +1,268 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Types of BGP messages.
+const (
+	BGPOpen         = 1
+	BGPUpdate       = 2
+	BGPNotification = 3
+	BGPKeepalive    = 4
+)
+
+// BGP notification codes used by the speaker.
+const (
+	BGPErrOpen            = 2
+	BGPErrOpenBadPeerAS   = 2
+	BGPErrOpenBadHoldTime = 6
+	BGPErrHoldTimer       = 4
+	BGPErrCease           = 6
+	BGPErrCeaseShutdown   = 2
+)
+
+const (
+	bgpHeaderLen   = 19
+	bgpMaxLen      = 4096
+	bgpASTrans     = 23456
+	bgpAFIIPv4     = 1
+	bgpAFIIPv6     = 2
+	bgpSAFIUnicast = 1
+
+	bgpCapMultiprotocol = 1
+	bgpCapFourOctetAS   = 65
+
+	bgpAttrOrigin      = 1
+	bgpAttrASPath      = 2
+	bgpAttrNextHop     = 3
+	bgpAttrLocalPref   = 5
+	bgpAttrMPReach     = 14
+	bgpAttrMPUnreach   = 15
+	bgpAttrAS4Path     = 17
+	bgpFlagOptional    = 0x80
+	bgpFlagTransitive  = 0x40
+	bgpFlagExtendedLen = 0x10
+	bgpASSequence      = 2
+)
+
+// BGPOpenMessage is the part of a BGP OPEN message the speaker cares about.
+type BGPOpenMessage struct {
+	ASN         uint32 // The 4-octet ASN if FourOctetAS is set.
+	HoldTime    uint16
+	RouterID    net.IP
+	FourOctetAS bool
+	// IPv4Unicast and IPv6Unicast are the address families the peer supports by the multiprotocol capability, or
+	// only IPv4 unicast if the peer advertises none.
+	IPv4Unicast bool
+	IPv6Unicast bool
+}
+
+// WriteBGPMessage writes a BGP message of the type with the body.
+func WriteBGPMessage(w io.Writer, msgType uint8, body []byte) error {
+	if bgpHeaderLen+len(body) > bgpMaxLen {
+		return fmt.Errorf("bgp message of %d bytes is too long", bgpHeaderLen+len(body))
+	}
+	b := make([]byte, bgpHeaderLen, bgpHeaderLen+len(body))
+	for i := 0; i < 16; i++ {
+		b[i] = 0xff // Marker.
+	}
+	binary.BigEndian.PutUint16(b[16:], uint16(bgpHeaderLen+len(body)))
+	b[18] = msgType
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+// ReadBGPMessage reads a BGP message, returning its type and body.
+func ReadBGPMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, bgpHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[16:]))
+	if length < bgpHeaderLen || length > bgpMaxLen {
+		return 0, nil, fmt.Errorf("bad bgp message length %d", length)
+	}
+	body := make([]byte, length-bgpHeaderLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+// BuildBGPOpen returns the body of an OPEN message, advertising the 4-octet ASN and IPv4 and IPv6 unicast.
+func BuildBGPOpen(asn uint32, holdTime uint16, routerID net.IP) []byte {
+	var caps []byte
+	for _, afi := range []uint16{bgpAFIIPv4, bgpAFIIPv6} {
+		caps = append(caps, bgpCapMultiprotocol, 4, byte(afi>>8), byte(afi), 0, bgpSAFIUnicast)
+	}
+	caps = append(caps, bgpCapFourOctetAS, 4)
+	caps = appendUint32(caps, asn)
+
+	b := make([]byte, 10, 12+len(caps))
+	b[0] = 4 // Version.
+	myAS := uint16(bgpASTrans)
+	if asn <= 0xffff {
+		myAS = uint16(asn)
+	}
+	binary.BigEndian.PutUint16(b[1:], myAS)
+	binary.BigEndian.PutUint16(b[3:], holdTime)
+	copy(b[5:9], routerID.To4())
+	b[9] = byte(2 + len(caps))
+	b = append(b, 2, byte(len(caps))) // The capabilities parameter.
+	return append(b, caps...)
+}
+
+// ParseBGPOpen parses the body of an OPEN message.
+func ParseBGPOpen(b []byte) (*BGPOpenMessage, error) {
+	if len(b) < 10 || len(b) < 10+int(b[9]) {
+		return nil, errors.New("truncated bgp open message")
+	}
+	if b[0] != 4 {
+		return nil, fmt.Errorf("unsupported bgp version %d", b[0])
+	}
+	open := &BGPOpenMessage{
+		ASN:      uint32(binary.BigEndian.Uint16(b[1:])),
+		HoldTime: binary.BigEndian.Uint16(b[3:]),
+		RouterID: net.IP(append([]byte(nil), b[5:9]...)),
+	}
+	params := b[10 : 10+int(b[9])]
+	var multiprotocol bool
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, errors.New("truncated bgp open parameter")
+		}
+		caps := params[2 : 2+paramLen]
+		params = params[2+paramLen:]
+		if paramType != 2 {
+			continue
+		}
+		for len(caps) >= 2 {
+			code, capLen := caps[0], int(caps[1])
+			if len(caps) < 2+capLen {
+				return nil, errors.New("truncated bgp capability")
+			}
+			switch {
+			case code == bgpCapFourOctetAS && capLen == 4:
+				open.FourOctetAS = true
+				open.ASN = binary.BigEndian.Uint32(caps[2:])
+			case code == bgpCapMultiprotocol && capLen == 4:
+				multiprotocol = true
+				afi, safi := binary.BigEndian.Uint16(caps[2:]), caps[5]
+				if afi == bgpAFIIPv4 && safi == bgpSAFIUnicast {
+					open.IPv4Unicast = true
+				} else if afi == bgpAFIIPv6 && safi == bgpSAFIUnicast {
+					open.IPv6Unicast = true
+				}
+			}
+			caps = caps[2+capLen:]
+		}
+	}
+	if !multiprotocol {
+		open.IPv4Unicast = true // Implied without the capability, see RFC 4760.
+	}
+	return open, nil
+}
+
+// BuildBGPAnnouncement returns the body of an UPDATE message announcing the prefixes of the family of nextHop
+// with the origin IGP. An empty asPath is for iBGP, which carries the default local preference instead.
+// For a peer without 4-octet AS support, 4-octet ASNs are AS_TRANS in AS_PATH and kept in AS4_PATH (RFC 6793).
+func BuildBGPAnnouncement(prefixes []*net.IPNet, nextHop net.IP, asPath []uint32, fourOctetAS bool) []byte {
+	attrs := bgpAttr(bgpFlagTransitive, bgpAttrOrigin, []byte{0})
+	var path, as4Path []byte
+	if len(asPath) > 0 {
+		path = append(path, bgpASSequence, byte(len(asPath)))
+		as4Path = append(as4Path, bgpASSequence, byte(len(asPath)))
+		var trans bool
+		for _, asn := range asPath {
+			as4Path = appendUint32(as4Path, asn)
+			if fourOctetAS {
+				path = appendUint32(path, asn)
+			} else if asn > 0xffff {
+				path = appendUint16(path, bgpASTrans)
+				trans = true
+			} else {
+				path = appendUint16(path, uint16(asn))
+			}
+		}
+		if !trans {
+			as4Path = nil
+		}
+	}
+	attrs = append(attrs, bgpAttr(bgpFlagTransitive, bgpAttrASPath, path)...)
+	if len(as4Path) > 0 {
+		attrs = append(attrs, bgpAttr(bgpFlagOptional|bgpFlagTransitive, bgpAttrAS4Path, as4Path)...)
+	}
+	if len(asPath) == 0 {
+		attrs = append(attrs, bgpAttr(bgpFlagTransitive, bgpAttrLocalPref, []byte{0, 0, 0, 100})...)
+	}
+	if nh4 := nextHop.To4(); nh4 != nil {
+		attrs = append(attrs, bgpAttr(bgpFlagTransitive, bgpAttrNextHop, nh4)...)
+		return bgpUpdate(nil, attrs, bgpPrefixes(prefixes))
+	}
+	reach := []byte{0, bgpAFIIPv6, bgpSAFIUnicast, 16}
+	reach = append(reach, nextHop.To16()...)
+	reach = append(reach, 0) // Reserved.
+	reach = append(reach, bgpPrefixes(prefixes)...)
+	attrs = append(attrs, bgpAttr(bgpFlagOptional, bgpAttrMPReach, reach)...)
+	return bgpUpdate(nil, attrs, nil)
+}
+
+// BuildBGPWithdrawal returns the body of an UPDATE message withdrawing the prefixes, all of the family of the
+// first one.
+func BuildBGPWithdrawal(prefixes []*net.IPNet) []byte {
+	if len(prefixes) == 0 || prefixes[0].IP.To4() != nil {
+		return bgpUpdate(bgpPrefixes(prefixes), nil, nil)
+	}
+	unreach := append([]byte{0, bgpAFIIPv6, bgpSAFIUnicast}, bgpPrefixes(prefixes)...)
+	return bgpUpdate(nil, bgpAttr(bgpFlagOptional, bgpAttrMPUnreach, unreach), nil)
+}
+
+// BuildBGPNotification returns the body of a NOTIFICATION message.
+func BuildBGPNotification(code, subcode uint8) []byte {
+	return []byte{code, subcode}
+}
+
+func bgpUpdate(withdrawn, attrs, nlri []byte) []byte {
+	b := appendUint16(nil, uint16(len(withdrawn)))
+	b = append(b, withdrawn...)
+	b = appendUint16(b, uint16(len(attrs)))
+	b = append(b, attrs...)
+	return append(b, nlri...)
+}
+
+func bgpAttr(flags, code uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		b := []byte{flags | bgpFlagExtendedLen, code}
+		b = appendUint16(b, uint16(len(value)))
+		return append(b, value...)
+	}
+	return append([]byte{flags, code, byte(len(value))}, value...)
+}
+
+func bgpPrefixes(prefixes []*net.IPNet) []byte {
+	var b []byte
+	for _, prefix := range prefixes {
+		ones, _ := prefix.Mask.Size()
+		ip := prefix.IP.To4()
+		if ip == nil {
+			ip = prefix.IP.To16()
+		}
+		b = append(b, byte(ones))
+		b = append(b, ip[:(ones+7)/8]...)
+	}
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,75 @@
+package util
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestBGPMessage(t *testing.T) {
+	var b bytes.Buffer
+	assert.NilError(t, WriteBGPMessage(&b, BGPOpen, BuildBGPOpen(4200000000, 90, net.ParseIP("192.0.2.1"))))
+	msgType, body, err := ReadBGPMessage(&b)
+	assert.NilError(t, err)
+	assert.Equal(t, msgType, uint8(BGPOpen))
+	open, err := ParseBGPOpen(body)
+	assert.NilError(t, err)
+	// The 2-octet field carries AS_TRANS.
+	assert.DeepEqual(t, body[1:3], []byte{0x5b, 0xa0})
+	assert.DeepEqual(t, open, &BGPOpenMessage{
+		ASN: 4200000000, HoldTime: 90, RouterID: net.ParseIP("192.0.2.1").To4(), FourOctetAS: true,
+		IPv4Unicast: true, IPv6Unicast: true,
+	})
+
+	// An old speaker without capabilities only supports IPv4 unicast with 2-octet ASNs.
+	open, err = ParseBGPOpen([]byte{4, 0xfd, 0xe9, 0, 90, 192, 0, 2, 2, 0})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, open, &BGPOpenMessage{
+		ASN: 65001, HoldTime: 90, RouterID: net.ParseIP("192.0.2.2").To4(), IPv4Unicast: true,
+	})
+
+	assert.NilError(t, WriteBGPMessage(&b, BGPKeepalive, nil))
+	assert.Equal(t, b.Len(), 19)
+	_, _, err = ReadBGPMessage(&b)
+	assert.NilError(t, err)
+	assert.ErrorContains(t, WriteBGPMessage(&b, BGPUpdate, make([]byte, 4096)), "too long")
+}
+
+func TestBuildBGPAnnouncement(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("10.244.1.0/24")
+	update := BuildBGPAnnouncement([]*net.IPNet{v4}, net.ParseIP("192.0.2.1"), []uint32{65000}, true)
+	assert.DeepEqual(t, update, []byte{
+		0, 0, // No withdrawn routes.
+		0, 20, // Attributes.
+		0x40, 1, 1, 0, // ORIGIN IGP.
+		0x40, 2, 6, 2, 1, 0, 0, 0xfd, 0xe8, // AS_PATH 65000.
+		0x40, 3, 4, 192, 0, 2, 1, // NEXT_HOP.
+		24, 10, 244, 1,
+	})
+	assert.DeepEqual(t, BuildBGPWithdrawal([]*net.IPNet{v4}), []byte{0, 4, 24, 10, 244, 1, 0, 0})
+
+	// A 4-octet ASN is AS_TRANS to a 2-octet peer, and kept in AS4_PATH.
+	update = BuildBGPAnnouncement([]*net.IPNet{v4}, net.ParseIP("192.0.2.1"), []uint32{4200000000}, false)
+	assert.DeepEqual(t, update[4:26], []byte{
+		0x40, 1, 1, 0, // ORIGIN IGP.
+		0x40, 2, 4, 2, 1, 0x5b, 0xa0, // AS_PATH AS_TRANS.
+		0xc0, 17, 6, 2, 1, 0xfa, 0x56, 0xea, 0x00, // AS4_PATH 4200000000.
+		0x40, 3, // NEXT_HOP.
+	})
+	update = BuildBGPAnnouncement([]*net.IPNet{v4}, net.ParseIP("192.0.2.1"), []uint32{65000}, false)
+	// No AS4_PATH without 4-octet ASNs.
+	assert.DeepEqual(t, update[4:17], []byte{0x40, 1, 1, 0, 0x40, 2, 4, 2, 1, 0xfd, 0xe8, 0x40, 3})
+
+	_, v6, _ := net.ParseCIDR("fd00:1::/64")
+	update = BuildBGPAnnouncement([]*net.IPNet{v6}, net.ParseIP("2001:db8::1"), nil, true)
+	// ORIGIN, an empty AS_PATH and LOCAL_PREF for iBGP, then MP_REACH_NLRI.
+	assert.DeepEqual(t, update[4:18], []byte{0x40, 1, 1, 0, 0x40, 2, 0, 0x40, 5, 4, 0, 0, 0, 100})
+	reach := update[18:]
+	assert.DeepEqual(t, reach[:7], []byte{0x80, 14, 30, 0, 2, 1, 16})
+	assert.Assert(t, net.IP(reach[7:23]).Equal(net.ParseIP("2001:db8::1")))
+	assert.DeepEqual(t, reach[23:], []byte{0, 64, 0xfd, 0, 0, 1, 0, 0, 0, 0})
+	assert.DeepEqual(t, BuildBGPWithdrawal([]*net.IPNet{v6}),
+		[]byte{0, 0, 0, 15, 0x80, 15, 12, 0, 2, 1, 64, 0xfd, 0, 0, 1, 0, 0, 0, 0})
+}
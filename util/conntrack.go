@@ -0,0 +1,194 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	nfnlSubsysCTNetlink  = 1
+	nfnlGroupCTNew       = 1
+	nfnlGroupCTDestroy   = 3
+	ctMsgNew             = 0
+	ctMsgDelete          = 2
+	nlaTypeMask          = 0x3fff // Without the nested and byte order flags.
+	conntrackSocketBytes = 4 << 20
+)
+
+// ConntrackEvent is a conntrack flow that is new or destroyed.
+type ConntrackEvent struct {
+	New      bool // Whether the flow is new, or destroyed.
+	Protocol uint8
+	Original ConntrackTuple
+	Reply    ConntrackTuple
+}
+
+// ConntrackTuple is a direction of a flow. The counters are only set for destroyed flows with accounting enabled.
+type ConntrackTuple struct {
+	Src     net.IP
+	Dst     net.IP
+	SrcPort uint16
+	DstPort uint16
+	Packets uint64
+	Bytes   uint64
+}
+
+// ErrConntrackOverrun is sent when events are dropped because they came faster than being received.
+var ErrConntrackOverrun = errors.New("conntrack events are dropped by the kernel")
+
+// SubscribeConntrack sends the new and destroyed conntrack flows to eventCh until done is closed. Receiving errors
+// are sent to errCh, after which eventCh is closed unless it's ErrConntrackOverrun.
+func SubscribeConntrack(eventCh chan<- ConntrackEvent, errCh chan<- error, done <-chan struct{}) error {
+	s, err := nl.Subscribe(syscall.NETLINK_NETFILTER, nfnlGroupCTNew, nfnlGroupCTDestroy)
+	if err != nil {
+		return err
+	}
+	// A larger buffer for bursts, which may fail without privileges to exceed the limit.
+	_ = syscall.SetsockoptInt(s.GetFd(), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, conntrackSocketBytes)
+	go func() {
+		<-done
+		s.Close()
+	}()
+	go func() {
+		defer close(eventCh)
+		for {
+			msgs, _, err := s.Receive()
+			if errors.Is(err, syscall.ENOBUFS) {
+				err = ErrConntrackOverrun
+			}
+			if err != nil {
+				select {
+				case errCh <- err:
+				case <-done:
+					return
+				}
+				if err == ErrConntrackOverrun {
+					continue
+				}
+				return
+			}
+			for _, msg := range msgs {
+				event, err := ParseConntrackMessage(msg.Header.Type, msg.Data)
+				if err != nil || event == nil {
+					continue
+				}
+				select {
+				case eventCh <- *event:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// ParseConntrackMessage parses a ctnetlink message, returning nil if it's not of a new or destroyed flow.
+func ParseConntrackMessage(msgType uint16, data []byte) (*ConntrackEvent, error) {
+	if msgType>>8 != nfnlSubsysCTNetlink || (msgType&0xff != ctMsgNew && msgType&0xff != ctMsgDelete) {
+		return nil, nil
+	}
+	if len(data) < nl.SizeofNfgenmsg {
+		return nil, errors.New("truncated conntrack message")
+	}
+	attrs, err := nl.ParseRouteAttr(data[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return nil, fmt.Errorf("bad conntrack message: %w", err)
+	}
+	event := &ConntrackEvent{New: msgType&0xff == ctMsgNew}
+	for _, attr := range attrs {
+		switch attr.Attr.Type & nlaTypeMask {
+		case nl.CTA_TUPLE_ORIG:
+			if event.Protocol, err = parseConntrackTuple(attr.Value, &event.Original); err != nil {
+				return nil, err
+			}
+		case nl.CTA_TUPLE_REPLY:
+			if _, err = parseConntrackTuple(attr.Value, &event.Reply); err != nil {
+				return nil, err
+			}
+		case nl.CTA_COUNTERS_ORIG:
+			if err = parseConntrackCounters(attr.Value, &event.Original); err != nil {
+				return nil, err
+			}
+		case nl.CTA_COUNTERS_REPLY:
+			if err = parseConntrackCounters(attr.Value, &event.Reply); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if event.Original.Src == nil || event.Original.Dst == nil {
+		return nil, errors.New("conntrack message has no original tuple")
+	}
+	return event, nil
+}
+
+func parseConntrackTuple(b []byte, tuple *ConntrackTuple) (uint8, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return 0, fmt.Errorf("bad conntrack tuple: %w", err)
+	}
+	var protocol uint8
+	for _, attr := range attrs {
+		attrType := attr.Attr.Type & nlaTypeMask
+		if attrType != nl.CTA_TUPLE_IP && attrType != nl.CTA_TUPLE_PROTO {
+			continue
+		}
+		nested, err := nl.ParseRouteAttr(attr.Value)
+		if err != nil {
+			return 0, fmt.Errorf("bad conntrack tuple: %w", err)
+		}
+		switch attrType {
+		case nl.CTA_TUPLE_IP:
+			for _, a := range nested {
+				switch a.Attr.Type & nlaTypeMask {
+				case nl.CTA_IP_V4_SRC, nl.CTA_IP_V6_SRC:
+					tuple.Src = net.IP(a.Value)
+				case nl.CTA_IP_V4_DST, nl.CTA_IP_V6_DST:
+					tuple.Dst = net.IP(a.Value)
+				}
+			}
+		case nl.CTA_TUPLE_PROTO:
+			for _, a := range nested {
+				switch a.Attr.Type & nlaTypeMask {
+				case nl.CTA_PROTO_NUM:
+					if len(a.Value) > 0 {
+						protocol = a.Value[0]
+					}
+				case nl.CTA_PROTO_SRC_PORT:
+					if len(a.Value) >= 2 {
+						tuple.SrcPort = binary.BigEndian.Uint16(a.Value)
+					}
+				case nl.CTA_PROTO_DST_PORT:
+					if len(a.Value) >= 2 {
+						tuple.DstPort = binary.BigEndian.Uint16(a.Value)
+					}
+				}
+			}
+		}
+	}
+	return protocol, nil
+}
+
+func parseConntrackCounters(b []byte, tuple *ConntrackTuple) error {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return fmt.Errorf("bad conntrack counters: %w", err)
+	}
+	for _, attr := range attrs {
+		if len(attr.Value) < 8 {
+			continue
+		}
+		switch attr.Attr.Type & nlaTypeMask {
+		case nl.CTA_COUNTERS_PACKETS:
+			tuple.Packets = binary.BigEndian.Uint64(attr.Value)
+		case nl.CTA_COUNTERS_BYTES:
+			tuple.Bytes = binary.BigEndian.Uint64(attr.Value)
+		}
+	}
+	return nil
+}
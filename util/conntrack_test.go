@@ -0,0 +1,66 @@
+package util
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseConntrackMessage(t *testing.T) {
+	be16 := func(v uint16) []byte {
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, v)
+		return b
+	}
+	be64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		return b
+	}
+	tuple := func(attrType int, src, dst string, srcPort, dstPort uint16) []byte {
+		attr := nl.NewRtAttr(attrType|syscall.NLA_F_NESTED, nil)
+		ip := attr.AddRtAttr(nl.CTA_TUPLE_IP|syscall.NLA_F_NESTED, nil)
+		ip.AddRtAttr(nl.CTA_IP_V4_SRC, net.ParseIP(src).To4())
+		ip.AddRtAttr(nl.CTA_IP_V4_DST, net.ParseIP(dst).To4())
+		proto := attr.AddRtAttr(nl.CTA_TUPLE_PROTO|syscall.NLA_F_NESTED, nil)
+		proto.AddRtAttr(nl.CTA_PROTO_NUM, []byte{syscall.IPPROTO_TCP})
+		proto.AddRtAttr(nl.CTA_PROTO_SRC_PORT, be16(srcPort))
+		proto.AddRtAttr(nl.CTA_PROTO_DST_PORT, be16(dstPort))
+		return attr.Serialize()
+	}
+	counters := nl.NewRtAttr(nl.CTA_COUNTERS_ORIG|syscall.NLA_F_NESTED, nil)
+	counters.AddRtAttr(nl.CTA_COUNTERS_PACKETS, be64(3))
+	counters.AddRtAttr(nl.CTA_COUNTERS_BYTES, be64(180))
+	data := []byte{syscall.AF_INET, 0, 0, 0}
+	// A connection to a service, DNATed to the pod.
+	data = append(data, tuple(nl.CTA_TUPLE_ORIG, "10.244.1.5", "10.96.0.10", 40000, 80)...)
+	data = append(data, tuple(nl.CTA_TUPLE_REPLY, "10.244.2.7", "10.244.1.5", 8080, 40000)...)
+	data = append(data, counters.Serialize()...)
+
+	event, err := ParseConntrackMessage(nfnlSubsysCTNetlink<<8|ctMsgDelete, data)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, event, &ConntrackEvent{
+		Protocol: syscall.IPPROTO_TCP,
+		Original: ConntrackTuple{
+			Src: net.ParseIP("10.244.1.5").To4(), Dst: net.ParseIP("10.96.0.10").To4(),
+			SrcPort: 40000, DstPort: 80, Packets: 3, Bytes: 180,
+		},
+		Reply: ConntrackTuple{
+			Src: net.ParseIP("10.244.2.7").To4(), Dst: net.ParseIP("10.244.1.5").To4(), SrcPort: 8080, DstPort: 40000,
+		},
+	})
+
+	event, err = ParseConntrackMessage(nfnlSubsysCTNetlink<<8|ctMsgNew, data)
+	assert.NilError(t, err)
+	assert.Assert(t, event.New)
+	// Not of a flow.
+	event, err = ParseConntrackMessage(nfnlSubsysCTNetlink<<8|1, data)
+	assert.NilError(t, err)
+	assert.Assert(t, event == nil)
+	_, err = ParseConntrackMessage(nfnlSubsysCTNetlink<<8|ctMsgNew, data[:4])
+	assert.ErrorContains(t, err, "no original tuple")
+}
@@ -46,3 +46,11 @@ func (t *Tables) InsertUnique(table, chain string, pos int, rulespec ...string)
 	}
 	return nil
 }
+
+// Name returns the name of the command behind the tables, iptables or ip6tables.
+func (t *Tables) Name() string {
+	if t.Proto() == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
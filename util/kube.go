@@ -4,21 +4,92 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
-// FindNodeIPv6 returns the first IPv6 address of the node's InternalIPs, nil if not found.
-func FindNodeIPv6(node *corev1.Node) net.IP {
-	for _, address := range node.Status.Addresses {
-		if address.Type == corev1.NodeInternalIP {
-			ip := net.ParseIP(address.Address)
-			if IsV6(ip) {
-				return ip
+// NodeIPPolicy selects the underlay IPv6 address of nodes.
+type NodeIPPolicy struct {
+	// Annotation is the node annotation overriding the address, empty to disable.
+	Annotation string
+	// PublishedAnnotation is the node annotation of the addresses published by the node itself, which is used
+	// unless overridden by Annotation. Empty to disable.
+	PublishedAnnotation string
+	// AddressTypes are the node address types to select from in order, InternalIP if empty.
+	AddressTypes []corev1.NodeAddressType
+	// PreferredCIDRs are the subnets preferred in order. Other addresses are only used if none matches.
+	PreferredCIDRs []*net.IPNet
+}
+
+// FindNodeIPv6 returns the IPv6 address of the node selected by the policy, nil if not found.
+func (p *NodeIPPolicy) FindNodeIPv6(node *corev1.Node) net.IP {
+	if ips := p.FindNodeIPv6s(node); len(ips) > 0 {
+		return ips[0]
+	}
+	return nil
+}
+
+// FindNodeIPv6s returns all eligible IPv6 addresses of the node by the policy, the most preferred first.
+// The annotations may contain multiple addresses separated by commas.
+func (p *NodeIPPolicy) FindNodeIPv6s(node *corev1.Node) []net.IP {
+	if ips := AnnotationIPv6s(node, p.Annotation); len(ips) > 0 {
+		return ips
+	}
+	if ips := AnnotationIPv6s(node, p.PublishedAnnotation); len(ips) > 0 {
+		return ips
+	}
+	addressTypes := p.AddressTypes
+	if len(addressTypes) == 0 {
+		addressTypes = []corev1.NodeAddressType{corev1.NodeInternalIP}
+	}
+	var candidates []net.IP
+	for _, addressType := range addressTypes {
+		for _, address := range node.Status.Addresses {
+			if address.Type == addressType {
+				ip := net.ParseIP(address.Address)
+				if IsV6(ip) {
+					candidates = append(candidates, ip)
+				}
 			}
 		}
 	}
-	return nil
+	return p.SortIPs(candidates)
+}
+
+// AnnotationIPv6s returns the IPv6 addresses in the node annotation separated by commas.
+func AnnotationIPv6s(node *corev1.Node, annotation string) []net.IP {
+	value, ok := node.Annotations[annotation]
+	if len(annotation) == 0 || !ok {
+		return nil
+	}
+	var ips []net.IP
+	for _, ipString := range strings.Split(value, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(ipString)); IsV6(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// SortIPs returns the candidates in the preferred CIDRs in order, followed by other ones.
+func (p *NodeIPPolicy) SortIPs(candidates []net.IP) []net.IP {
+	ips := make([]net.IP, 0, len(candidates))
+	picked := make([]bool, len(candidates))
+	for _, cidr := range p.PreferredCIDRs {
+		for i, ip := range candidates {
+			if !picked[i] && cidr.Contains(ip) {
+				ips = append(ips, ip)
+				picked[i] = true
+			}
+		}
+	}
+	for i, ip := range candidates {
+		if !picked[i] {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
 }
 
 // ParseNodePodCIDRs returns the pod CIDRs of the node.
@@ -45,3 +116,13 @@ func ParseNodePodCIDRs(node *corev1.Node) ([]*net.IPNet, error) {
 	})
 	return podCIDRs, nil
 }
+
+// IsNodeReady returns whether the Ready condition of the node is true.
+func IsNodeReady(node *corev1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
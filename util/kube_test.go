@@ -0,0 +1,58 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNodeIPPolicy_FindNodeIPv6(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"shiba.io/underlay-ip": "2001:db8:ff::1"}},
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+			{Type: corev1.NodeInternalIP, Address: "2001:db8:1::1"},
+			{Type: corev1.NodeInternalIP, Address: "2001:db8:2::1"},
+			{Type: corev1.NodeExternalIP, Address: "2001:db8:3::1"},
+		}},
+	}
+	policy := &NodeIPPolicy{}
+	assert.Equal(t, policy.FindNodeIPv6(node).String(), "2001:db8:1::1")
+	policy.Annotation = "shiba.io/underlay-ip"
+	assert.Equal(t, policy.FindNodeIPv6(node).String(), "2001:db8:ff::1")
+	policy.Annotation = ""
+	policy.PreferredCIDRs, _ = ParseIPNets([]string{"2001:db8:2::/48"})
+	assert.Equal(t, policy.FindNodeIPv6(node).String(), "2001:db8:2::1")
+	policy.AddressTypes = []corev1.NodeAddressType{corev1.NodeExternalIP, corev1.NodeInternalIP}
+	policy.PreferredCIDRs = nil
+	assert.Equal(t, policy.FindNodeIPv6(node).String(), "2001:db8:3::1")
+	policy.AddressTypes = []corev1.NodeAddressType{corev1.NodeHostName}
+	assert.Assert(t, policy.FindNodeIPv6(node) == nil)
+}
+
+func TestNodeIPPolicy_FindNodeIPv6s(t *testing.T) {
+	node := &corev1.Node{
+		Status: corev1.NodeStatus{Addresses: []corev1.NodeAddress{
+			{Type: corev1.NodeInternalIP, Address: "2001:db8:1::1"},
+			{Type: corev1.NodeInternalIP, Address: "2001:db8:2::1"},
+			{Type: corev1.NodeInternalIP, Address: "2001:db8:3::1"},
+		}},
+	}
+	policy := &NodeIPPolicy{Annotation: "shiba.io/underlay-ip"}
+	policy.PreferredCIDRs, _ = ParseIPNets([]string{"2001:db8:3::/48"})
+	assert.DeepEqual(t, policy.FindNodeIPv6s(node), []net.IP{
+		net.ParseIP("2001:db8:3::1"), net.ParseIP("2001:db8:1::1"), net.ParseIP("2001:db8:2::1"),
+	})
+	node.Annotations = map[string]string{"shiba.io/underlay-ip": "2001:db8:ff::1, 2001:db8:ff::2"}
+	assert.DeepEqual(t, policy.FindNodeIPv6s(node), []net.IP{net.ParseIP("2001:db8:ff::1"), net.ParseIP("2001:db8:ff::2")})
+
+	// The addresses published by the node are used unless overridden.
+	policy.PublishedAnnotation = "shiba.io/published-underlay-ip"
+	node.Annotations["shiba.io/published-underlay-ip"] = "2001:db8:ee::1"
+	assert.DeepEqual(t, policy.FindNodeIPv6s(node), []net.IP{net.ParseIP("2001:db8:ff::1"), net.ParseIP("2001:db8:ff::2")})
+	delete(node.Annotations, "shiba.io/underlay-ip")
+	assert.DeepEqual(t, policy.FindNodeIPv6s(node), []net.IP{net.ParseIP("2001:db8:ee::1")})
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// MetricWriter writes metrics in the Prometheus text exposition format.
+type MetricWriter struct {
+	w io.Writer
+}
+
+// NewMetricWriter returns a MetricWriter writing to w.
+func NewMetricWriter(w io.Writer) *MetricWriter {
+	return &MetricWriter{w: w}
+}
+
+// Header writes the HELP and TYPE lines of a metric.
+func (m *MetricWriter) Header(name, kind, help string) {
+	_, _ = fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Sample writes a sample of a metric. Labels are given in key-value pairs.
+func (m *MetricWriter) Sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 1 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('\n')
+	_, _ = io.WriteString(m.w, b.String())
+}
@@ -0,0 +1,21 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestMetricWriter(t *testing.T) {
+	var b bytes.Buffer
+	m := NewMetricWriter(&b)
+	m.Header("shiba_test", "gauge", "A test metric.")
+	m.Sample("shiba_test", 1)
+	m.Sample("shiba_test", 0.5, "node", "a", "peer", `b"c`)
+	assert.Equal(t, b.String(), `# HELP shiba_test A test metric.
+# TYPE shiba_test gauge
+shiba_test 1
+shiba_test{node="a",peer="b\"c"} 0.5
+`)
+}
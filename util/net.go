@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"math/big"
 	"net"
 	"sort"
 )
@@ -41,3 +42,8 @@ func FormatIPNets(ipNets []*net.IPNet) string {
 	}
 	return fmt.Sprintf("%v", netStrings)
 }
+
+// GatewayIP returns the gateway IP of a pod CIDR, which is the first address after the network address.
+func GatewayIP(cidr *net.IPNet) net.IP {
+	return big.NewInt(0).Add(big.NewInt(0).SetBytes(cidr.IP), big.NewInt(1)).Bytes()
+}
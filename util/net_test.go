@@ -59,3 +59,10 @@ func TestParseIPNets(t *testing.T) {
 	assert.Equal(t, nets[1].String(), "172.16.0.0/12")
 	assert.Equal(t, nets[2].String(), "192.168.0.0/16")
 }
+
+func TestGatewayIP(t *testing.T) {
+	nets, err := ParseIPNets([]string{"10.244.1.0/24", "fdef:1234:0:1::/64"})
+	assert.NilError(t, err)
+	assert.Equal(t, GatewayIP(nets[0]).String(), "10.244.1.1")
+	assert.Equal(t, GatewayIP(nets[1]).String(), "fdef:1234:0:1::1")
+}
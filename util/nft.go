@@ -0,0 +1,28 @@
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ApplyNft runs an nft script, whose commands are applied in a single transaction.
+func ApplyNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// NftTableExists returns whether the nft table exists.
+func NftTableExists(family, table string) bool {
+	return exec.Command("nft", "list", "table", family, table).Run() == nil
+}
+
+// DeleteNftTable deletes the nft table if it exists.
+func DeleteNftTable(family, table string) error {
+	return ApplyNft(fmt.Sprintf("add table %s %s\ndelete table %s %s\n", family, table, family, table))
+}
@@ -0,0 +1,135 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// The protocol attribute of rules, which is supported since Linux 4.17.
+const fraProtocol = 21
+
+// RouteRule is a rule to look up a route table for a destination, marked with a protocol like routes.
+type RouteRule struct {
+	Dst      *net.IPNet
+	Table    int
+	Priority int
+	Protocol uint8
+}
+
+// AddRouteRule adds the rule.
+func AddRouteRule(rule RouteRule) error {
+	return executeRouteRule(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL|syscall.NLM_F_ACK, rule)
+}
+
+// DeleteRouteRule deletes the rule.
+func DeleteRouteRule(rule RouteRule) error {
+	return executeRouteRule(syscall.RTM_DELRULE, syscall.NLM_F_ACK, rule)
+}
+
+// ListRouteRules lists the rules of both families marked with the protocol. Rules without a destination are skipped.
+func ListRouteRules(protocol uint8) ([]RouteRule, error) {
+	var rules []RouteRule
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		req := nl.NewNetlinkRequest(syscall.RTM_GETRULE, syscall.NLM_F_DUMP)
+		req.AddData(nl.NewIfInfomsg(family))
+		msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWRULE)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			rule, err := ParseRouteRuleMessage(msg)
+			if err != nil {
+				return nil, err
+			}
+			if rule.Dst != nil && rule.Protocol == protocol {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func executeRouteRule(msgType, flags int, rule RouteRule) error {
+	req := nl.NewNetlinkRequest(msgType, flags)
+	msg, attrs, err := routeRuleMessage(rule, msgType == syscall.RTM_NEWRULE)
+	if err != nil {
+		return err
+	}
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err = req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+// routeRuleMessage returns the header and the attributes of the rule, like netlink.RuleAdd does.
+func routeRuleMessage(rule RouteRule, create bool) (*nl.RtMsg, []*nl.RtAttr, error) {
+	if rule.Dst == nil {
+		return nil, nil, errors.New("rule without a destination")
+	}
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(nl.GetIPFamily(rule.Dst.IP))
+	msg.Table = syscall.RT_TABLE_UNSPEC
+	msg.Type = syscall.RTN_UNSPEC
+	if create {
+		msg.Type = syscall.RTN_UNICAST
+	}
+	if rule.Table < 256 {
+		msg.Table = uint8(rule.Table)
+	}
+	dstLen, _ := rule.Dst.Mask.Size()
+	msg.Dst_len = uint8(dstLen)
+	dst := rule.Dst.IP.To4()
+	if msg.Family == syscall.AF_INET6 {
+		dst = rule.Dst.IP.To16()
+	}
+	native := nl.NativeEndian()
+	priority := make([]byte, 4)
+	native.PutUint32(priority, uint32(rule.Priority))
+	table := make([]byte, 4)
+	native.PutUint32(table, uint32(rule.Table))
+	return msg, []*nl.RtAttr{
+		nl.NewRtAttr(nl.FRA_DST, dst),
+		nl.NewRtAttr(nl.FRA_PRIORITY, priority),
+		nl.NewRtAttr(nl.FRA_TABLE, table),
+		nl.NewRtAttr(fraProtocol, []byte{rule.Protocol}),
+	}, nil
+}
+
+// ParseRouteRuleMessage parses a rule message from the kernel.
+func ParseRouteRuleMessage(b []byte) (RouteRule, error) {
+	var rule RouteRule
+	if len(b) < syscall.SizeofRtMsg {
+		return rule, errors.New("rule message too short")
+	}
+	msg := nl.DeserializeRtMsg(b)
+	attrs, err := nl.ParseRouteAttr(b[msg.Len():])
+	if err != nil {
+		return rule, err
+	}
+	rule.Table = int(msg.Table)
+	native := nl.NativeEndian()
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.FRA_DST:
+			rule.Dst = &net.IPNet{IP: attr.Value, Mask: net.CIDRMask(int(msg.Dst_len), 8*len(attr.Value))}
+		case nl.FRA_PRIORITY:
+			if len(attr.Value) >= 4 {
+				rule.Priority = int(native.Uint32(attr.Value))
+			}
+		case nl.FRA_TABLE:
+			if len(attr.Value) >= 4 {
+				rule.Table = int(native.Uint32(attr.Value))
+			}
+		case fraProtocol:
+			if len(attr.Value) >= 1 {
+				rule.Protocol = attr.Value[0]
+			}
+		}
+	}
+	return rule, nil
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseRouteRuleMessage(t *testing.T) {
+	for _, cidr := range []string{"10.244.0.0/16", "fd00:244::/56"} {
+		_, dst, err := net.ParseCIDR(cidr)
+		assert.NilError(t, err)
+		rule := RouteRule{Dst: dst, Table: 100, Priority: 1000, Protocol: 91}
+		msg, attrs, err := routeRuleMessage(rule, true)
+		assert.NilError(t, err)
+		b := msg.Serialize()
+		for _, attr := range attrs {
+			b = append(b, attr.Serialize()...)
+		}
+		parsed, err := ParseRouteRuleMessage(b)
+		assert.NilError(t, err)
+		assert.Equal(t, parsed.Dst.String(), cidr)
+		parsed.Dst = dst
+		assert.DeepEqual(t, parsed, rule)
+	}
+	_, err := ParseRouteRuleMessage([]byte{2, 0})
+	assert.ErrorContains(t, err, "too short")
+}